@@ -0,0 +1,73 @@
+package carrybasket
+
+import (
+	"context"
+	"crypto/subtle"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+/// Name of the gRPC metadata key that carries the auth token.
+const authTokenMetadataKey = "carrybasket-token"
+
+/// Attach the auth token to outgoing calls. Token is sent as is, so it
+/// should only be used over TLS on untrusted networks.
+func withAuthToken(ctx context.Context, token string) context.Context {
+	if token == "" {
+		return ctx
+	}
+	return metadata.AppendToOutgoingContext(ctx, authTokenMetadataKey, token)
+}
+
+// Check that the call carries the expected token. Empty token allows
+// every call.
+func checkAuthToken(ctx context.Context, token string) error {
+	if token == "" {
+		return nil
+	}
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		values := md.Get(authTokenMetadataKey)
+		if len(values) > 0 && subtle.ConstantTimeCompare([]byte(values[0]), []byte(token)) == 1 {
+			return nil
+		}
+	}
+	return status.Error(codes.Unauthenticated, "invalid auth token")
+}
+
+// Every call goes through authentication and metrics before the handler.
+func (s *syncServiceServer) unaryInterceptor(
+	ctx context.Context,
+	request interface{},
+	info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler,
+) (interface{}, error) {
+	return s.metrics.unaryInterceptor(ctx, request, info,
+		func(ctx context.Context, request interface{}) (interface{}, error) {
+			if err := checkAuthToken(ctx, s.authToken); err != nil {
+				s.callLogger(ctx).Warn("auth error", Field("method", info.FullMethod))
+				return nil, err
+			}
+			return handler(ctx, request)
+		},
+	)
+}
+
+func (s *syncServiceServer) streamInterceptor(
+	server interface{},
+	stream grpc.ServerStream,
+	info *grpc.StreamServerInfo,
+	handler grpc.StreamHandler,
+) error {
+	return s.metrics.streamInterceptor(server, stream, info,
+		func(server interface{}, stream grpc.ServerStream) error {
+			if err := checkAuthToken(stream.Context(), s.authToken); err != nil {
+				s.callLogger(stream.Context()).Warn("auth error", Field("method", info.FullMethod))
+				return err
+			}
+			return handler(server, stream)
+		},
+	)
+}
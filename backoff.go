@@ -0,0 +1,52 @@
+package carrybasket
+
+import (
+	"math/rand"
+	"time"
+)
+
+/// Delays between retries of a failed sync. Every delay is Multiplier
+/// times longer than the previous one, up to Max. A random part of
+/// every delay (Jitter, from 0 to 1) keeps the clients of a restarted
+/// server from coming back all at once.
+type Backoff struct {
+	Initial    time.Duration
+	Max        time.Duration
+	Multiplier float64
+	Jitter     float64
+}
+
+/// Backoff used when none is set.
+var DefaultBackoff = Backoff{
+	Initial:    time.Second,
+	Max:        time.Minute,
+	Multiplier: 2,
+	Jitter:     0.2,
+}
+
+/// Shortest delay between retries. Shorter or zero Initial delays are
+/// raised to it, so that a failing cycle is never retried in a loop.
+const MinBackoffDelay = 10 * time.Millisecond
+
+/// Delay before the retry, counting from 0. Initial is at least
+/// MinBackoffDelay, Multiplier is at least 1 and Max is at least Initial.
+func (b Backoff) Delay(retry int) time.Duration {
+	if b.Initial < MinBackoffDelay {
+		b.Initial = MinBackoffDelay
+	}
+	if b.Multiplier < 1 {
+		b.Multiplier = 1
+	}
+	if b.Max < b.Initial {
+		b.Max = b.Initial
+	}
+	delay := float64(b.Initial)
+	for i := 0; i < retry && delay < float64(b.Max); i++ {
+		delay *= b.Multiplier
+	}
+	if delay > float64(b.Max) {
+		delay = float64(b.Max)
+	}
+	delay -= delay * b.Jitter * rand.Float64()
+	return time.Duration(delay)
+}
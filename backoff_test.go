@@ -0,0 +1,40 @@
+package carrybasket
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestBackoff_Delay(t *testing.T) {
+	backoff := Backoff{Initial: time.Second, Max: 10 * time.Second, Multiplier: 2}
+	assert.Equal(t, time.Second, backoff.Delay(0))
+	assert.Equal(t, 2*time.Second, backoff.Delay(1))
+	assert.Equal(t, 8*time.Second, backoff.Delay(3))
+	assert.Equal(t, 10*time.Second, backoff.Delay(4))
+	assert.Equal(t, 10*time.Second, backoff.Delay(1000))
+
+	backoff.Jitter = 0.5
+	for retry := 0; retry < 100; retry++ {
+		delay := backoff.Delay(retry % 5)
+		assert.True(t, delay > 500*time.Millisecond && delay <= 10*time.Second, delay)
+	}
+	assert.True(t, backoff.Delay(4) >= 5*time.Second)
+}
+
+func TestBackoff_DelayClamped(t *testing.T) {
+	assert.Equal(t, MinBackoffDelay, Backoff{}.Delay(0))
+	assert.Equal(t, MinBackoffDelay, Backoff{}.Delay(10))
+
+	backoff := Backoff{Initial: -time.Second, Max: time.Second, Multiplier: 2}
+	assert.Equal(t, MinBackoffDelay, backoff.Delay(0))
+	assert.Equal(t, 2*MinBackoffDelay, backoff.Delay(1))
+
+	backoff = Backoff{Initial: time.Second, Max: time.Minute}
+	assert.Equal(t, time.Second, backoff.Delay(5))
+	backoff.Multiplier = 0.5
+	assert.Equal(t, time.Second, backoff.Delay(5))
+
+	backoff = Backoff{Initial: time.Second, Multiplier: 2}
+	assert.Equal(t, time.Second, backoff.Delay(5))
+}
@@ -0,0 +1,298 @@
+package carrybasket
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/pkg/errors"
+	"io"
+	"io/ioutil"
+
+	pb "github.com/balta2ar/carrybasket/rpc"
+	"github.com/golang/protobuf/proto"
+)
+
+var (
+	ErrBatchFormat         = errors.New("malformed batch or signature file")
+	ErrBatchTargetMismatch = errors.New("target dir is not in the state the batch was written for")
+)
+
+// Files start with a line that tells what they are, and end with
+// a digest of the rest, see NewFileDigest.
+const (
+	batchSignatureMagic = "carrybasket signature 1\n"
+	batchMagic          = "carrybasket batch 1\n"
+)
+
+/// How the files of a batch are hashed. The signature, the batch and the
+/// target dir of a batch must be hashed the same way, so the settings
+/// travel with the files.
+type BatchHashing struct {
+	BlockSize  int
+	FastHash   string /// see NewHashFactoryFor
+	StrongHash string
+}
+
+func (bh BatchHashing) hashFactory() (HashFactory, error) {
+	return NewHashFactoryFor(bh.BlockSize, bh.FastHash, bh.StrongHash)
+}
+
+/// Hashed files of a target dir, same as the server sends to the client
+/// before a sync. A batch is computed from the signature alone.
+type BatchSignature struct {
+	Hashing BatchHashing
+	Files   []HashedFile
+}
+
+/// Commands that make a target dir a copy of the client dir. They are
+/// applied only to a target dir in the Target state, which is the state
+/// of the signature the batch was written from.
+type Batch struct {
+	Hashing  BatchHashing
+	Target   SyncState
+	Commands []AdjustmentCommand
+}
+
+func listTargetFiles(fs VirtualFilesystem, hashing BatchHashing) ([]HashedFile, BlockCache, error) {
+	hashFactory, err := hashing.hashFactory()
+	if err != nil {
+		return nil, nil, err
+	}
+	generator := NewHashGenerator(
+		hashing.BlockSize, hashFactory.MakeFastHash(), hashFactory.MakeStrongHash(),
+	)
+	contentCache := NewBlockCache()
+	files, err := ListServerFiles(fs, generator, contentCache)
+	if err != nil {
+		return nil, nil, err
+	}
+	return files, contentCache, nil
+}
+
+/// Hash the files of the target dir into a signature.
+func NewBatchSignature(fs VirtualFilesystem, hashing BatchHashing) (*BatchSignature, error) {
+	files, _, err := listTargetFiles(fs, hashing)
+	if err != nil {
+		return nil, err
+	}
+	return &BatchSignature{Hashing: hashing, Files: files}, nil
+}
+
+/// Compare client files with the signature of the target dir and
+/// return the commands that bring the target dir up to date. Only
+/// contents that the target dir lacks are put into the batch. Scanning
+/// is stopped when ctx is done.
+func NewBatch(ctx context.Context, clientFs VirtualFilesystem, signature *BatchSignature) (*Batch, error) {
+	hashFactory, err := signature.Hashing.hashFactory()
+	if err != nil {
+		return nil, err
+	}
+	clientFiles, err := ListClientFiles(clientFs)
+	if err != nil {
+		return nil, err
+	}
+	defer CloseClientFiles(clientFiles)
+
+	comparator := NewFilesComparator(NewProducerFactory(signature.Hashing.BlockSize, hashFactory))
+	commands, err := comparator.CompareContext(ctx, clientFiles, signature.Files)
+	if err != nil {
+		return nil, err
+	}
+	return &Batch{
+		Hashing:  signature.Hashing,
+		Target:   NewSyncStateFromHashedFiles(signature.Files),
+		Commands: commands,
+	}, nil
+}
+
+/// Apply the batch to the target dir once its files have been checked
+/// against the Target state of the batch. Nothing is changed when they
+/// differ, ErrBatchTargetMismatch is returned then. Otherwise the outcome
+/// of every command is returned like AdjustmentCommandApplier does.
+func ApplyBatch(fs VirtualFilesystem, batch *Batch) ([]AdjustmentResult, error) {
+	// batch files come from elsewhere, just like pushed commands
+	if err := validateAdjustmentCommands(batch.Commands); err != nil {
+		return nil, err
+	}
+	hashFactory, err := batch.Hashing.hashFactory()
+	if err != nil {
+		return nil, err
+	}
+	files, contentCache, err := listTargetFiles(fs, batch.Hashing)
+	if err != nil {
+		return nil, err
+	}
+	if difference := syncStateDifference(batch.Target, NewSyncStateFromHashedFiles(files)); difference != "" {
+		return nil, errors.Wrap(ErrBatchTargetMismatch, difference)
+	}
+
+	reconstructor := NewContentReconstructor(hashFactory.MakeStrongHash(), contentCache)
+	return NewAdjustmentCommandApplier().Apply(batch.Commands, fs, reconstructor), nil
+}
+
+// First file that differs between the expected and the actual state,
+// empty when they are equal.
+func syncStateDifference(expected SyncState, actual SyncState) string {
+	for _, filename := range expected.Filenames() {
+		digest, ok := actual[filename]
+		if !ok {
+			return fmt.Sprintf("%v is missing", filename)
+		}
+		if digest != expected[filename] {
+			return fmt.Sprintf("%v has changed", filename)
+		}
+	}
+	for _, filename := range actual.Filenames() {
+		if _, ok := expected[filename]; !ok {
+			return fmt.Sprintf("%v is new", filename)
+		}
+	}
+	return ""
+}
+
+/// Write the signature in the format ReadBatchSignature reads.
+func WriteBatchSignature(w io.Writer, signature *BatchSignature) error {
+	buffer := newBatchBuffer(signature.Hashing)
+	if err := buffer.EncodeVarint(uint64(len(signature.Files))); err != nil {
+		return err
+	}
+	for _, file := range signature.Files {
+		protoHashedFile := file.asProtoHashedFile()
+		if err := buffer.EncodeMessage(&protoHashedFile); err != nil {
+			return errors.Wrapf(err, "cannot encode %v", file.Filename)
+		}
+	}
+	return writeBatchFile(w, batchSignatureMagic, buffer)
+}
+
+/// Read a signature written by WriteBatchSignature.
+func ReadBatchSignature(r io.Reader) (*BatchSignature, error) {
+	buffer, hashing, err := readBatchFile(r, batchSignatureMagic)
+	if err != nil {
+		return nil, err
+	}
+	count, err := buffer.DecodeVarint()
+	if err != nil {
+		return nil, errors.Wrap(ErrBatchFormat, "no file count")
+	}
+	signature := &BatchSignature{Hashing: hashing, Files: make([]HashedFile, 0)}
+	for i := uint64(0); i < count; i++ {
+		protoHashedFile := &pb.ProtoHashedFile{}
+		if err := buffer.DecodeMessage(protoHashedFile); err != nil {
+			return nil, errors.Wrapf(ErrBatchFormat, "file %v: %v", i, err)
+		}
+		signature.Files = append(signature.Files, protoHashedFileAsHashedFile(protoHashedFile))
+	}
+	return signature, nil
+}
+
+/// Write the batch in the format ReadBatch reads. The file has all
+/// that ApplyBatch needs besides the target dir.
+func WriteBatch(w io.Writer, batch *Batch) error {
+	buffer := newBatchBuffer(batch.Hashing)
+	if err := buffer.EncodeMessage(syncStateAsProtoSyncState("", batch.Target)); err != nil {
+		return errors.Wrap(err, "cannot encode target state")
+	}
+	if err := buffer.EncodeVarint(uint64(len(batch.Commands))); err != nil {
+		return err
+	}
+	for _, command := range batch.Commands {
+		protoCommand := adjustmentCommandAsProtoAdjustmentCommand(command)
+		if err := buffer.EncodeMessage(&protoCommand); err != nil {
+			return errors.Wrapf(err, "cannot encode %v", protoCommand.Filename)
+		}
+	}
+	return writeBatchFile(w, batchMagic, buffer)
+}
+
+/// Read a batch written by WriteBatch.
+func ReadBatch(r io.Reader) (*Batch, error) {
+	buffer, hashing, err := readBatchFile(r, batchMagic)
+	if err != nil {
+		return nil, err
+	}
+	protoState := &pb.ProtoSyncState{}
+	if err := buffer.DecodeMessage(protoState); err != nil {
+		return nil, errors.Wrapf(ErrBatchFormat, "target state: %v", err)
+	}
+	count, err := buffer.DecodeVarint()
+	if err != nil {
+		return nil, errors.Wrap(ErrBatchFormat, "no command count")
+	}
+	batch := &Batch{
+		Hashing:  hashing,
+		Target:   protoSyncStateAsSyncState(protoState),
+		Commands: make([]AdjustmentCommand, 0),
+	}
+	for i := uint64(0); i < count; i++ {
+		protoCommand := &pb.ProtoAdjustmentCommand{}
+		if err := buffer.DecodeMessage(protoCommand); err != nil {
+			return nil, errors.Wrapf(ErrBatchFormat, "command %v: %v", i, err)
+		}
+		command := protoAdjustmentCommandAsAdjustmentCommand(protoCommand)
+		if command == nil {
+			return nil, errors.Wrapf(ErrBatchFormat, "command %v: unknown type", i)
+		}
+		if err := validateFilename(adjustmentCommandFilename(command)); err != nil {
+			return nil, errors.Wrapf(ErrBatchFormat, "command %v: %v", i, err)
+		}
+		batch.Commands = append(batch.Commands, command)
+	}
+	return batch, nil
+}
+
+func newBatchBuffer(hashing BatchHashing) *proto.Buffer {
+	buffer := proto.NewBuffer(nil)
+	_ = buffer.EncodeVarint(uint64(hashing.BlockSize))
+	_ = buffer.EncodeStringBytes(hashing.FastHash)
+	_ = buffer.EncodeStringBytes(hashing.StrongHash)
+	return buffer
+}
+
+func writeBatchFile(w io.Writer, magic string, buffer *proto.Buffer) error {
+	digest := NewFileDigest()
+	digest.Write(buffer.Bytes())
+	for _, data := range [][]byte{[]byte(magic), buffer.Bytes(), digest.Sum(nil)} {
+		if _, err := w.Write(data); err != nil {
+			return errors.Wrap(err, "cannot write batch file")
+		}
+	}
+	return nil
+}
+
+// Check the magic and the digest, and decode hashing settings. The
+// returned buffer is positioned at the rest of the file.
+func readBatchFile(r io.Reader, magic string) (*proto.Buffer, BatchHashing, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, BatchHashing{}, errors.Wrap(err, "cannot read batch file")
+	}
+	if !bytes.HasPrefix(data, []byte(magic)) {
+		return nil, BatchHashing{}, errors.Wrapf(ErrBatchFormat, "expected %q", magic[:len(magic)-1])
+	}
+	digest := NewFileDigest()
+	data = data[len(magic):]
+	if len(data) < digest.Size() {
+		return nil, BatchHashing{}, errors.Wrap(ErrBatchFormat, "file is truncated")
+	}
+	body, expected := data[:len(data)-digest.Size()], data[len(data)-digest.Size():]
+	digest.Write(body)
+	if !bytes.Equal(expected, digest.Sum(nil)) {
+		return nil, BatchHashing{}, errors.Wrap(ErrBatchFormat, "file is truncated or corrupt")
+	}
+
+	buffer := proto.NewBuffer(body)
+	blockSize, err := buffer.DecodeVarint()
+	if err != nil {
+		return nil, BatchHashing{}, errors.Wrap(ErrBatchFormat, "no block size")
+	}
+	fastHash, err := buffer.DecodeStringBytes()
+	if err != nil {
+		return nil, BatchHashing{}, errors.Wrap(ErrBatchFormat, "no fast hash")
+	}
+	strongHash, err := buffer.DecodeStringBytes()
+	if err != nil {
+		return nil, BatchHashing{}, errors.Wrap(ErrBatchFormat, "no strong hash")
+	}
+	return buffer, BatchHashing{int(blockSize), fastHash, strongHash}, nil
+}
@@ -0,0 +1,149 @@
+package carrybasket
+
+import (
+	"bytes"
+	"context"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var testBatchHashing = BatchHashing{
+	BlockSize:  4,
+	FastHash:   FastHashMackerras,
+	StrongHash: StrongHashMD5,
+}
+
+// Write the signature of targetFs and the batch from clientFs through
+// their file formats.
+func writeAndReadBatch(t *testing.T, clientFs VirtualFilesystem, targetFs VirtualFilesystem) *Batch {
+	signature, err := NewBatchSignature(targetFs, testBatchHashing)
+	assert.Nil(t, err)
+	var signatureFile bytes.Buffer
+	assert.Nil(t, WriteBatchSignature(&signatureFile, signature))
+	signature, err = ReadBatchSignature(&signatureFile)
+	assert.Nil(t, err)
+
+	batch, err := NewBatch(context.Background(), clientFs, signature)
+	assert.Nil(t, err)
+	var batchFile bytes.Buffer
+	assert.Nil(t, WriteBatch(&batchFile, batch))
+	batch, err = ReadBatch(&batchFile)
+	assert.Nil(t, err)
+	return batch
+}
+
+func TestBatch_Apply(t *testing.T) {
+	clientFs := NewLoggingFilesystem()
+	createFiles(clientFs, []File{
+		{"a", false, "abc1234def"},
+		{"dir", true, ""},
+		{"dir/b", false, "new"},
+	})
+	targetFs := NewLoggingFilesystem()
+	createFiles(targetFs, []File{
+		{"a", false, "1234"},
+		{"c", false, "removed"},
+	})
+
+	batch := writeAndReadBatch(t, clientFs, targetFs)
+	assert.Equal(t, testBatchHashing, batch.Hashing)
+	assert.Equal(t, 2, len(batch.Target))
+
+	results, err := ApplyBatch(targetFs, batch)
+	assert.Nil(t, err)
+	assertAllApplied(t, results)
+	assertFilesystemsEqual(t, clientFs, targetFs)
+
+	// the target has moved on, the batch no longer applies
+	results, err = ApplyBatch(targetFs, batch)
+	assert.Nil(t, results)
+	assert.Equal(t, ErrBatchTargetMismatch, errors.Cause(err))
+}
+
+func TestBatch_TargetMismatch(t *testing.T) {
+	clientFs := NewLoggingFilesystem()
+	createFiles(clientFs, []File{{"a", false, "client"}})
+	targetFs := NewLoggingFilesystem()
+	createFiles(targetFs, []File{{"a", false, "target"}})
+	batch := writeAndReadBatch(t, clientFs, targetFs)
+
+	for _, files := range [][]File{
+		{{"a", false, "changed"}},
+		{{"b", false, "new"}},
+	} {
+		otherFs := NewLoggingFilesystem()
+		createFiles(otherFs, files)
+		results, err := ApplyBatch(otherFs, batch)
+		assert.Nil(t, results)
+		assert.Equal(t, ErrBatchTargetMismatch, errors.Cause(err))
+	}
+
+	// nothing has been changed by refused batches
+	batch.Commands = nil
+	results, err := ApplyBatch(targetFs, batch)
+	assert.Nil(t, err)
+	assert.Empty(t, results)
+}
+
+func TestBatch_InvalidFile(t *testing.T) {
+	batch := &Batch{Hashing: testBatchHashing, Target: SyncState{"a": DirDigest}}
+	var batchFile bytes.Buffer
+	assert.Nil(t, WriteBatch(&batchFile, batch))
+	data := batchFile.Bytes()
+
+	corrupt := append([]byte{}, data...)
+	corrupt[len(batchMagic)+1] ^= 0xff
+	for _, invalid := range [][]byte{
+		data[:len(data)-1],
+		corrupt,
+		[]byte("something else"),
+	} {
+		_, err := ReadBatch(bytes.NewReader(invalid))
+		assert.Equal(t, ErrBatchFormat, errors.Cause(err))
+	}
+
+	// a batch is not a signature
+	_, err := ReadBatchSignature(bytes.NewReader(data))
+	assert.Equal(t, ErrBatchFormat, errors.Cause(err))
+}
+
+func TestBatch_InvalidFilenames(t *testing.T) {
+	root, err := ioutil.TempDir("", "carrybasket-batch")
+	assert.Nil(t, err)
+	defer os.RemoveAll(root)
+	assert.Nil(t, os.Mkdir(filepath.Join(root, "target"), 0755))
+	victim := filepath.Join(root, "victim")
+	assert.Nil(t, ioutil.WriteFile(victim, []byte("keep me"), 0644))
+	targetFs := NewActualFilesystem(filepath.Join(root, "target"))
+
+	for _, command := range []AdjustmentCommand{
+		AdjustmentCommandRemoveFile{"../victim"},
+		AdjustmentCommandRemoveFile{victim},
+		AdjustmentCommandApplyBlocksToFile{"../victim", nil, nil},
+		AdjustmentCommandMkDir{"dir/../../victim"},
+		AdjustmentCommandRemoveFile{MetadataDir},
+	} {
+		batch := &Batch{
+			Hashing:  testBatchHashing,
+			Target:   SyncState{},
+			Commands: []AdjustmentCommand{command},
+		}
+		var batchFile bytes.Buffer
+		assert.Nil(t, WriteBatch(&batchFile, batch))
+		_, err := ReadBatch(&batchFile)
+		assert.Equal(t, ErrBatchFormat, errors.Cause(err), command)
+
+		// batches made in memory are checked as well
+		results, err := ApplyBatch(targetFs, batch)
+		assert.NotNil(t, err, command)
+		assert.Nil(t, results)
+	}
+
+	content, err := ioutil.ReadFile(victim)
+	assert.Nil(t, err)
+	assert.Equal(t, "keep me", string(content))
+}
@@ -1,7 +1,11 @@
 package carrybasket
 
+import "sync"
+
 /// Cache for blocks. Maps hash ([]byte) to a block.
+/// Implementations are safe for concurrent use.
 type BlockCache interface {
+	Len() int
 	Get(hash []byte) (block Block, ok bool)
 	Set(hash []byte, block Block)
 
@@ -9,31 +13,48 @@ type BlockCache interface {
 	AddContents(hashedBlocks []Block, contentBlocks []Block)
 }
 
-type blockCache map[string]Block
+type blockCache struct {
+	lock   sync.RWMutex
+	blocks map[string]Block
+}
 
 func NewBlockCache() *blockCache {
-	return &blockCache{}
+	return &blockCache{
+		blocks: make(map[string]Block),
+	}
 }
 
-func (bc *blockCache) Len() int { return len(*bc) }
+func (bc *blockCache) Len() int {
+	bc.lock.RLock()
+	defer bc.lock.RUnlock()
+	return len(bc.blocks)
+}
 
 func (bc *blockCache) Get(hash []byte) (Block, bool) {
-	val, ok := (*bc)[string(hash)]
+	bc.lock.RLock()
+	defer bc.lock.RUnlock()
+	val, ok := bc.blocks[string(hash)]
 	return val, ok
 }
 
 func (bc *blockCache) Set(hash []byte, block Block) {
-	(*bc)[string(hash)] = block
+	bc.lock.Lock()
+	defer bc.lock.Unlock()
+	bc.blocks[string(hash)] = block
 }
 
 func (bc *blockCache) AddHashes(blocks []Block) {
+	bc.lock.Lock()
+	defer bc.lock.Unlock()
 	for _, block := range blocks {
-		bc.Set(block.(HashedBlock).HashSum(), block)
+		bc.blocks[string(block.(HashedBlock).HashSum())] = block
 	}
 }
 
 func (bc *blockCache) AddContents(hashedBlocks []Block, contentBlocks []Block) {
+	bc.lock.Lock()
+	defer bc.lock.Unlock()
 	for i, hashedBlock := range hashedBlocks {
-		bc.Set(hashedBlock.(HashedBlock).HashSum(), contentBlocks[i])
+		bc.blocks[string(hashedBlock.(HashedBlock).HashSum())] = contentBlocks[i]
 	}
 }
@@ -1,7 +1,9 @@
 package carrybasket
 
 import (
+	"fmt"
 	"github.com/stretchr/testify/assert"
+	"sync"
 	"testing"
 )
 
@@ -65,3 +67,28 @@ func TestBlockCache_AddContents(t *testing.T) {
 	assert.Equal(t, cacheBlock2, contentBlock)
 	assert.True(t, ok)
 }
+
+func TestBlockCache_Concurrent(t *testing.T) {
+	cache := NewBlockCache()
+	var wg sync.WaitGroup
+
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			hash := []byte(fmt.Sprintf("hash%v", i))
+			hashedBlock := NewHashedBlock(0, 4, hash)
+			contentBlock := NewContentBlock(0, 4, []byte("data"))
+			for j := 0; j < 100; j++ {
+				cache.AddHashes([]Block{hashedBlock})
+				cache.AddContents([]Block{hashedBlock}, []Block{contentBlock})
+				_, ok := cache.Get(hash)
+				assert.True(t, ok)
+				cache.Len()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	assert.Equal(t, 8, cache.Len())
+}
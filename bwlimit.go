@@ -0,0 +1,409 @@
+package carrybasket
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/// Limits the rate of sent bytes with a token bucket. The bucket holds
+/// up to one second worth of bytes, so short bursts are smoothed out
+/// while the average rate stays within the limit. Limit can be changed
+/// at any time from another goroutine, it applies to the following sends.
+type BandwidthLimiter interface {
+	Wait(ctx context.Context, n int) error
+	SetLimit(bytesPerSecond int)
+	SetSchedule(schedule BandwidthSchedule)
+	Limit() int
+}
+
+type bandwidthLimiter struct {
+	lock     sync.Mutex
+	limit    int               /// bytes per second, 0 means no limit
+	schedule BandwidthSchedule /// overrides limit when not empty
+	tokens   float64           /// bytes that can be sent right away, negative is a debt
+	last     time.Time         /// when tokens were last updated
+
+	now   func() time.Time
+	sleep func(ctx context.Context, d time.Duration) error
+}
+
+func NewBandwidthLimiter(bytesPerSecond int) *bandwidthLimiter {
+	return &bandwidthLimiter{
+		limit: bytesPerSecond,
+		now:   time.Now,
+		sleep: sleepContext,
+	}
+}
+
+// Sleep for d unless ctx is done earlier.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (bl *bandwidthLimiter) SetLimit(bytesPerSecond int) {
+	bl.lock.Lock()
+	defer bl.lock.Unlock()
+	bl.limit = bytesPerSecond
+	bl.schedule = nil
+}
+
+/// Follow the schedule instead of a fixed limit.
+func (bl *bandwidthLimiter) SetSchedule(schedule BandwidthSchedule) {
+	bl.lock.Lock()
+	defer bl.lock.Unlock()
+	bl.schedule = schedule
+}
+
+/// Current limit in bytes per second, 0 means no limit.
+func (bl *bandwidthLimiter) Limit() int {
+	bl.lock.Lock()
+	defer bl.lock.Unlock()
+	return bl.currentLimit(bl.now())
+}
+
+func (bl *bandwidthLimiter) currentLimit(now time.Time) int {
+	if len(bl.schedule) > 0 {
+		return bl.schedule.LimitAt(now)
+	}
+	return bl.limit
+}
+
+/// Block until n more bytes can be sent. Sending more than the bucket
+/// holds is allowed, the caller then waits for the whole amount. When
+/// ctx is done first, the bytes are given back and ctx error is returned.
+func (bl *bandwidthLimiter) Wait(ctx context.Context, n int) error {
+	bl.lock.Lock()
+	now := bl.now()
+	limit := bl.currentLimit(now)
+	if limit <= 0 {
+		bl.tokens = 0
+		bl.last = now
+		bl.lock.Unlock()
+		return nil
+	}
+
+	if !bl.last.IsZero() {
+		bl.tokens += now.Sub(bl.last).Seconds() * float64(limit)
+	}
+	if bl.tokens > float64(limit) {
+		bl.tokens = float64(limit)
+	}
+	bl.last = now
+	bl.tokens -= float64(n)
+	debt := -bl.tokens
+	bl.lock.Unlock()
+
+	if debt <= 0 {
+		return nil
+	}
+	err := bl.sleep(ctx, time.Duration(debt/float64(limit)*float64(time.Second)))
+	if err != nil {
+		bl.lock.Lock()
+		bl.tokens += float64(n)
+		bl.lock.Unlock()
+	}
+	return err
+}
+
+// When the limiter was last used.
+func (bl *bandwidthLimiter) lastUsed() time.Time {
+	bl.lock.Lock()
+	defer bl.lock.Unlock()
+	return bl.last
+}
+
+/// Limits that change with the time of day.
+type BandwidthSchedule []BandwidthScheduleEntry
+
+/// Limit that starts at the given time of day and lasts until
+/// the start of the next entry.
+type BandwidthScheduleEntry struct {
+	Start time.Duration /// since midnight
+	Limit int           /// bytes per second, 0 means no limit
+}
+
+/// Parse bandwidth limit, either fixed or a schedule. Format is similar
+/// to the one of rclone:
+///
+///     512k                              fixed limit
+///     08:00,512k 18:00,4M 23:00,off     schedule
+///
+/// Limits are in bytes per second with optional suffix (b, k, M, G),
+/// number without suffix means kilobytes like in rsync. "off" and 0
+/// mean no limit. The last entry of a schedule lasts until the first
+/// one on the next day. Fixed limit is returned as a schedule with a
+/// single entry.
+func ParseBandwidthSchedule(value string) (BandwidthSchedule, error) {
+	fields := strings.Fields(value)
+	if len(fields) == 1 && !strings.Contains(fields[0], ",") {
+		limit, err := ParseBandwidth(fields[0])
+		if err != nil {
+			return nil, err
+		}
+		return BandwidthSchedule{{0, limit}}, nil
+	}
+
+	schedule := make(BandwidthSchedule, 0, len(fields))
+	for _, field := range fields {
+		parts := strings.SplitN(field, ",", 2)
+		if len(parts) != 2 {
+			return nil, errors.Errorf("invalid schedule entry: %q", field)
+		}
+		t, err := time.Parse("15:04", parts[0])
+		if err != nil {
+			return nil, errors.Errorf("invalid schedule time: %q", parts[0])
+		}
+		limit, err := ParseBandwidth(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		start := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+		schedule = append(schedule, BandwidthScheduleEntry{start, limit})
+	}
+	if len(schedule) == 0 {
+		return nil, errors.New("empty bandwidth limit")
+	}
+
+	sort.Slice(schedule, func(i, j int) bool {
+		return schedule[i].Start < schedule[j].Start
+	})
+	for i := 1; i < len(schedule); i++ {
+		if schedule[i].Start == schedule[i-1].Start {
+			return nil, errors.Errorf("time %v is scheduled twice", schedule[i].Start)
+		}
+	}
+	return schedule, nil
+}
+
+var bandwidthSuffixes = map[byte]float64{
+	'b': 1, 'B': 1,
+	'k': 1 << 10, 'K': 1 << 10,
+	'm': 1 << 20, 'M': 1 << 20,
+	'g': 1 << 30, 'G': 1 << 30,
+}
+
+/// Parse a single limit, see ParseBandwidthSchedule.
+func ParseBandwidth(value string) (int, error) {
+	if strings.ToLower(value) == "off" {
+		return 0, nil
+	}
+
+	multiplier := float64(1024)
+	number := value
+	if n := len(value); n > 0 {
+		if suffixMultiplier, ok := bandwidthSuffixes[value[n-1]]; ok {
+			multiplier = suffixMultiplier
+			number = value[:n-1]
+		}
+	}
+
+	rate, err := strconv.ParseFloat(number, 64)
+	if err != nil || rate < 0 {
+		return 0, errors.Errorf("invalid bandwidth limit: %q", value)
+	}
+	return int(rate * multiplier), nil
+}
+
+/// Limit at the given local time.
+func (bs BandwidthSchedule) LimitAt(t time.Time) int {
+	if len(bs) == 0 {
+		return 0
+	}
+	sinceMidnight := time.Duration(t.Hour())*time.Hour +
+		time.Duration(t.Minute())*time.Minute +
+		time.Duration(t.Second())*time.Second
+
+	// before the first entry the last one of the previous day applies
+	limit := bs[len(bs)-1].Limit
+	for _, entry := range bs {
+		if entry.Start > sinceMidnight {
+			break
+		}
+		limit = entry.Limit
+	}
+	return limit
+}
+
+/// Clients that have not pushed for this long lose their limiters,
+/// so that the server does not keep one for every host it has ever seen.
+const clientLimiterIdleTime = 10 * time.Minute
+
+/// Limiter for each client of the server, so that one client
+/// can not take the bandwidth of all the others.
+type clientBandwidthLimiters struct {
+	lock     sync.Mutex
+	schedule BandwidthSchedule
+	limiters map[string]*bandwidthLimiter /// by client host
+	now      func() time.Time
+}
+
+func newClientBandwidthLimiters() *clientBandwidthLimiters {
+	return &clientBandwidthLimiters{
+		limiters: make(map[string]*bandwidthLimiter),
+		now:      time.Now,
+	}
+}
+
+func (cbl *clientBandwidthLimiters) SetSchedule(schedule BandwidthSchedule) {
+	cbl.lock.Lock()
+	defer cbl.lock.Unlock()
+	cbl.schedule = schedule
+	for _, limiter := range cbl.limiters {
+		limiter.SetSchedule(schedule)
+	}
+}
+
+/// Limiter of the client, nil when clients are not limited. Limiters
+/// of idle clients are evicted along the way.
+func (cbl *clientBandwidthLimiters) get(host string) *bandwidthLimiter {
+	cbl.lock.Lock()
+	defer cbl.lock.Unlock()
+	if len(cbl.schedule) == 0 {
+		cbl.limiters = make(map[string]*bandwidthLimiter)
+		return nil
+	}
+
+	now := cbl.now()
+	for other, limiter := range cbl.limiters {
+		if now.Sub(limiter.lastUsed()) > clientLimiterIdleTime {
+			delete(cbl.limiters, other)
+		}
+	}
+	limiter, ok := cbl.limiters[host]
+	if !ok {
+		limiter = NewBandwidthLimiter(0)
+		limiter.SetSchedule(cbl.schedule)
+		limiter.now = cbl.now
+		limiter.last = now
+		cbl.limiters[host] = limiter
+	}
+	return limiter
+}
+
+/// Most bytes a limited connection sends or receives between waits, so
+/// that a large message goes out at the limited rate instead of in a
+/// single burst after a long wait.
+const bandwidthChunkSize = 4 * 1024
+
+// Connection that sends and receives at the rate of its limiters. They
+// are looked up for every chunk, so that a new limit applies to open
+// connections too. Nil functions, or nil limiters, do not limit.
+type limitedConn struct {
+	net.Conn
+	readLimiter  func() BandwidthLimiter
+	writeLimiter func() BandwidthLimiter
+	ctx          context.Context /// cancelled on Close, so that waits stop
+	cancel       context.CancelFunc
+}
+
+func newLimitedConn(
+	conn net.Conn,
+	readLimiter func() BandwidthLimiter,
+	writeLimiter func() BandwidthLimiter,
+) *limitedConn {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &limitedConn{
+		Conn:         conn,
+		readLimiter:  readLimiter,
+		writeLimiter: writeLimiter,
+		ctx:          ctx,
+		cancel:       cancel,
+	}
+}
+
+// Chunks are never larger than the bucket of the limiter.
+func bandwidthChunk(limiter BandwidthLimiter) int {
+	if limit := limiter.Limit(); limit > 0 && limit < bandwidthChunkSize {
+		return limit
+	}
+	return bandwidthChunkSize
+}
+
+func (lc *limitedConn) Read(p []byte) (int, error) {
+	var limiter BandwidthLimiter
+	if lc.readLimiter != nil {
+		limiter = lc.readLimiter()
+	}
+	if limiter == nil {
+		return lc.Conn.Read(p)
+	}
+
+	if chunk := bandwidthChunk(limiter); len(p) > chunk {
+		p = p[:chunk]
+	}
+	n, err := lc.Conn.Read(p)
+	if n > 0 {
+		// the bytes are here already, the wait holds back the next
+		// ones, a wait stopped by Close leaves the error to them
+		_ = limiter.Wait(lc.ctx, n)
+	}
+	return n, err
+}
+
+func (lc *limitedConn) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		var limiter BandwidthLimiter
+		if lc.writeLimiter != nil {
+			limiter = lc.writeLimiter()
+		}
+		if limiter == nil {
+			n, err := lc.Conn.Write(p[written:])
+			return written + n, err
+		}
+
+		chunk := p[written:]
+		if size := bandwidthChunk(limiter); len(chunk) > size {
+			chunk = chunk[:size]
+		}
+		if err := limiter.Wait(lc.ctx, len(chunk)); err != nil {
+			return written, err
+		}
+		n, err := lc.Conn.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+func (lc *limitedConn) Close() error {
+	lc.cancel()
+	return lc.Conn.Close()
+}
+
+// Listener whose connections receive at the rate of the limiter of the
+// client host, see clientBandwidthLimiters.
+type limitedListener struct {
+	net.Listener
+	limiters *clientBandwidthLimiters
+}
+
+func (ll limitedListener) Accept() (net.Conn, error) {
+	conn, err := ll.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	host := addrHost(conn.RemoteAddr())
+	readLimiter := func() BandwidthLimiter {
+		if limiter := ll.limiters.get(host); limiter != nil {
+			return limiter
+		}
+		return nil
+	}
+	return newLimitedConn(conn, readLimiter, nil), nil
+}
@@ -0,0 +1,204 @@
+package carrybasket
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParseBandwidth(t *testing.T) {
+	for value, expected := range map[string]int{
+		"off":  0,
+		"0":    0,
+		"100":  100 * 1024,
+		"100b": 100,
+		"512k": 512 * 1024,
+		"1.5M": 1536 * 1024,
+		"2G":   2 * 1024 * 1024 * 1024,
+	} {
+		limit, err := ParseBandwidth(value)
+		assert.Nil(t, err, value)
+		assert.Equal(t, expected, limit, value)
+	}
+
+	for _, value := range []string{"", "k", "fast", "-1k", "10x"} {
+		_, err := ParseBandwidth(value)
+		assert.NotNil(t, err, value)
+	}
+}
+
+func TestParseBandwidthSchedule(t *testing.T) {
+	schedule, err := ParseBandwidthSchedule("512k")
+	assert.Nil(t, err)
+	assert.Equal(t, BandwidthSchedule{{0, 512 * 1024}}, schedule)
+
+	schedule, err = ParseBandwidthSchedule("18:00,4M 08:30,512k 23:00,off")
+	assert.Nil(t, err)
+	assert.Equal(t, BandwidthSchedule{
+		{8*time.Hour + 30*time.Minute, 512 * 1024},
+		{18 * time.Hour, 4 * 1024 * 1024},
+		{23 * time.Hour, 0},
+	}, schedule)
+
+	for _, value := range []string{"", "08:00", "8,512k", "25:00,1k", "08:00,1k 08:00,2k", "08:00,x"} {
+		_, err := ParseBandwidthSchedule(value)
+		assert.NotNil(t, err, value)
+	}
+}
+
+func TestBandwidthSchedule_LimitAt(t *testing.T) {
+	at := func(hour int, minute int) time.Time {
+		return time.Date(2019, 1, 2, hour, minute, 0, 0, time.Local)
+	}
+	schedule, err := ParseBandwidthSchedule("08:00,1k 18:00,2k")
+	assert.Nil(t, err)
+
+	assert.Equal(t, 2*1024, schedule.LimitAt(at(7, 59)))
+	assert.Equal(t, 1*1024, schedule.LimitAt(at(8, 0)))
+	assert.Equal(t, 1*1024, schedule.LimitAt(at(17, 59)))
+	assert.Equal(t, 2*1024, schedule.LimitAt(at(18, 0)))
+	assert.Equal(t, 0, BandwidthSchedule{}.LimitAt(at(12, 0)))
+}
+
+func TestBandwidthLimiter_Wait(t *testing.T) {
+	now := time.Date(2019, 1, 2, 12, 0, 0, 0, time.Local)
+	var slept time.Duration
+	limiter := NewBandwidthLimiter(1000)
+	limiter.now = func() time.Time { return now }
+	limiter.sleep = func(ctx context.Context, d time.Duration) error {
+		slept += d
+		now = now.Add(d)
+		return nil
+	}
+	ctx := context.Background()
+
+	// no tokens at first, 500 bytes take half a second
+	assert.Nil(t, limiter.Wait(ctx, 500))
+	assert.Equal(t, 500*time.Millisecond, slept)
+
+	// bucket refills up to one second worth of bytes
+	now = now.Add(10 * time.Second)
+	slept = 0
+	assert.Nil(t, limiter.Wait(ctx, 1000))
+	assert.Equal(t, time.Duration(0), slept)
+	assert.Nil(t, limiter.Wait(ctx, 2000))
+	assert.Equal(t, 2*time.Second, slept)
+
+	// limit can be changed or removed
+	limiter.SetLimit(4000)
+	slept = 0
+	assert.Nil(t, limiter.Wait(ctx, 6000))
+	assert.Equal(t, 500*time.Millisecond, slept)
+	limiter.SetLimit(0)
+	slept = 0
+	assert.Nil(t, limiter.Wait(ctx, 1000000))
+	assert.Equal(t, time.Duration(0), slept)
+	assert.Equal(t, 0, limiter.Limit())
+
+	schedule, err := ParseBandwidthSchedule("08:00,1k 18:00,off")
+	assert.Nil(t, err)
+	limiter.SetSchedule(schedule)
+	assert.Equal(t, 1024, limiter.Limit())
+	now = now.Add(8 * time.Hour)
+	assert.Equal(t, 0, limiter.Limit())
+}
+
+func TestBandwidthLimiter_WaitCancelled(t *testing.T) {
+	limiter := NewBandwidthLimiter(1000)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// a minute worth of bytes does not block a cancelled caller
+	start := time.Now()
+	assert.Equal(t, context.Canceled, limiter.Wait(ctx, 60000))
+	assert.True(t, time.Since(start) < time.Second)
+	// and the bytes that were not sent are given back
+	assert.True(t, limiter.tokens >= 0, limiter.tokens)
+}
+
+func TestClientBandwidthLimiters_Evict(t *testing.T) {
+	now := time.Date(2019, 1, 2, 12, 0, 0, 0, time.Local)
+	limiters := newClientBandwidthLimiters()
+	limiters.now = func() time.Time { return now }
+	assert.Nil(t, limiters.get("a"))
+
+	schedule, err := ParseBandwidthSchedule("1k")
+	assert.Nil(t, err)
+	limiters.SetSchedule(schedule)
+	a := limiters.get("a")
+	assert.NotNil(t, a)
+	assert.Equal(t, a, limiters.get("a"))
+
+	// a has been pushing all along, b has gone idle
+	limiters.get("b")
+	now = now.Add(clientLimiterIdleTime / 2)
+	assert.Nil(t, a.Wait(context.Background(), 0))
+	now = now.Add(clientLimiterIdleTime)
+	assert.Equal(t, a, limiters.get("a"))
+	assert.Len(t, limiters.limiters, 1)
+}
+
+// Records when, by the clock of the test, data has been written.
+type recordingConn struct {
+	net.Conn
+	now    func() time.Time
+	writes []recordedWrite
+}
+
+type recordedWrite struct {
+	at time.Time
+	n  int
+}
+
+func (rc *recordingConn) Write(p []byte) (int, error) {
+	rc.writes = append(rc.writes, recordedWrite{rc.now(), len(p)})
+	return len(p), nil
+}
+
+func (rc *recordingConn) Close() error {
+	return nil
+}
+
+func TestLimitedConn_Write(t *testing.T) {
+	start := time.Date(2019, 1, 2, 12, 0, 0, 0, time.Local)
+	now := start
+	limiter := NewBandwidthLimiter(1000)
+	limiter.now = func() time.Time { return now }
+	limiter.sleep = func(ctx context.Context, d time.Duration) error {
+		now = now.Add(d)
+		return nil
+	}
+	recorder := &recordingConn{now: func() time.Time { return now }}
+	conn := newLimitedConn(recorder, nil, func() BandwidthLimiter { return limiter })
+
+	// a single message ten times larger than the bucket goes out at
+	// the limited rate, not in a burst after a wait
+	n, err := conn.Write(make([]byte, 10000))
+	assert.Nil(t, err)
+	assert.Equal(t, 10000, n)
+	assert.Equal(t, 10*time.Second, now.Sub(start))
+	written := 0
+	for _, write := range recorder.writes {
+		written += write.n
+		assert.True(t, write.n <= 1000, write.n)
+		assert.True(t, float64(written) <= 1000*write.at.Sub(start).Seconds(), written)
+	}
+	assert.Equal(t, 10000, written)
+
+	// a new limit applies to the open connection
+	limiter.SetLimit(0)
+	start = now
+	n, err = conn.Write(make([]byte, 10000))
+	assert.Nil(t, err)
+	assert.Equal(t, 10000, n)
+	assert.Equal(t, start, now)
+
+	// close stops a wait
+	limiter.SetLimit(1)
+	limiter.sleep = sleepContext
+	go conn.Close()
+	_, err = conn.Write(make([]byte, 10))
+	assert.Equal(t, context.Canceled, err)
+}
@@ -2,6 +2,9 @@ package carrybasket
 
 import (
 	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"github.com/pkg/errors"
 	"hash"
 )
 
@@ -88,20 +91,62 @@ type HashFactory interface {
 	MakeStrongHash() hash.Hash
 }
 
+/// Names of the hash algorithms, see NewHashFactoryFor.
+const (
+	FastHashMackerras = "mackerras"
+	StrongHashMD5     = "md5"
+	StrongHashSHA1    = "sha1"
+	StrongHashSHA256  = "sha256"
+)
+
+var strongHashes = map[string]func() hash.Hash{
+	StrongHashMD5:    md5.New,
+	StrongHashSHA1:   sha1.New,
+	StrongHashSHA256: sha256.New,
+}
+
 type hashFactory struct {
-	blockSize int
+	blockSize      int
+	makeStrongHash func() hash.Hash
 }
 
 func NewHashFactory(blockSize int) *hashFactory {
 	return &hashFactory{
-		blockSize: blockSize,
+		blockSize:      blockSize,
+		makeStrongHash: md5.New,
 	}
 }
 
+/// Hash factory with the named algorithms. Client and server must use
+/// the same ones, otherwise no block matches and everything is sent
+/// as content. Only FastHashMackerras can be used as the fast hash,
+/// because it has to be a rolling one.
+func NewHashFactoryFor(blockSize int, fastHash string, strongHash string) (*hashFactory, error) {
+	if fastHash != FastHashMackerras {
+		return nil, errors.Errorf("unknown fast hash: %q", fastHash)
+	}
+	makeStrongHash, ok := strongHashes[strongHash]
+	if !ok {
+		return nil, errors.Errorf("unknown strong hash: %q", strongHash)
+	}
+	return &hashFactory{
+		blockSize:      blockSize,
+		makeStrongHash: makeStrongHash,
+	}, nil
+}
+
 func (hf *hashFactory) MakeFastHash() hash.Hash32 {
 	return NewMackerras(hf.blockSize)
 }
 
 func (hf *hashFactory) MakeStrongHash() hash.Hash {
-	return md5.New()
+	return hf.makeStrongHash()
+}
+
+/// Digest of a whole file. It is computed by the client over the original
+/// file and by the server over the reconstructed one to make sure they
+/// match. It is deliberately different from the strong block hash so that
+/// a block hash collision can't go unnoticed.
+func NewFileDigest() hash.Hash {
+	return sha256.New()
 }
@@ -85,3 +85,15 @@ func TestMackerras_RollMatchesUpdateBothOneCall(t *testing.T) {
 	assert.Equal(t, rolling1.Sum32(), rolling2.Sum32())
 	assert.Equal(t, rolling1.Sum(nil), rolling2.Sum(nil))
 }
+
+func TestNewHashFactoryFor(t *testing.T) {
+	hashFactory, err := NewHashFactoryFor(4, FastHashMackerras, StrongHashSHA256)
+	assert.Nil(t, err)
+	assert.Equal(t, 32, hashFactory.MakeStrongHash().Size())
+	assert.Equal(t, NewHashFactory(4).MakeStrongHash().Size(), 16)
+
+	_, err = NewHashFactoryFor(4, "adler32", StrongHashMD5)
+	assert.NotNil(t, err)
+	_, err = NewHashFactoryFor(4, FastHashMackerras, "crc32")
+	assert.NotNil(t, err)
+}
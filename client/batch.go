@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"github.com/balta2ar/carrybasket"
+	"github.com/urfave/cli"
+	"log"
+	"os"
+)
+
+// Hashing of new signatures comes from the flags, batches take it from
+// their signature.
+func batchHashing(c *cli.Context) carrybasket.BatchHashing {
+	return carrybasket.BatchHashing{
+		BlockSize:  c.GlobalInt("block-size"),
+		FastHash:   c.GlobalString("fast-hash"),
+		StrongHash: c.GlobalString("strong-hash"),
+	}
+}
+
+func existingDirArg(c *cli.Context) string {
+	dir := c.Args().Get(0)
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		log.Fatalln("Please specify an existing dir")
+	}
+	return dir
+}
+
+func batchSignatureAction(c *cli.Context) error {
+	fs := carrybasket.NewActualFilesystem(existingDirArg(c))
+	signature, err := carrybasket.NewBatchSignature(fs, batchHashing(c))
+	if err != nil {
+		log.Fatalf("signature error: %v\n", err)
+	}
+	output := createOutputFile(c.Args().Get(1))
+	if err := carrybasket.WriteBatchSignature(output, signature); err != nil {
+		log.Fatalf("cannot write signature: %v\n", err)
+	}
+	closeOutputFile(output)
+	return nil
+}
+
+func batchWriteAction(c *cli.Context) error {
+	fs := carrybasket.NewActualFilesystem(existingDirArg(c))
+	if c.Args().Get(1) == "" {
+		log.Fatalln("Please specify a signature file, see batch signature command")
+	}
+	signatureFile := openInputFile(c.Args().Get(1))
+	signature, err := carrybasket.ReadBatchSignature(signatureFile)
+	signatureFile.Close()
+	if err != nil {
+		log.Fatalf("cannot read signature: %v\n", err)
+	}
+
+	ctx, cancel := cycleContext(c)
+	defer cancel()
+	batch, err := carrybasket.NewBatch(ctx, fs, signature)
+	if err != nil {
+		log.Fatalf("batch error: %v\n", err)
+	}
+	output := createOutputFile(c.Args().Get(2))
+	if err := carrybasket.WriteBatch(output, batch); err != nil {
+		log.Fatalf("cannot write batch: %v\n", err)
+	}
+	closeOutputFile(output)
+	return nil
+}
+
+func batchApplyAction(c *cli.Context) error {
+	fs := carrybasket.NewActualFilesystem(existingDirArg(c))
+	batchFile := openInputFile(c.Args().Get(1))
+	batch, err := carrybasket.ReadBatch(batchFile)
+	batchFile.Close()
+	if err != nil {
+		log.Fatalf("cannot read batch: %v\n", err)
+	}
+
+	results, err := carrybasket.ApplyBatch(fs, batch)
+	if err != nil {
+		log.Fatalf("batch apply error: %v\n", err)
+	}
+	failed := 0
+	for _, result := range results {
+		if result.Status != carrybasket.AdjustmentResultApplied {
+			log.Printf("cannot apply %v: %v\n", result.Filename, result.Reason)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return cli.NewExitError(fmt.Sprintf("%v of %v commands failed", failed, len(results)), exitSyncError)
+	}
+	return nil
+}
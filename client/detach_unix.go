@@ -0,0 +1,13 @@
+// +build !windows
+
+package main
+
+import (
+	"syscall"
+)
+
+// Start the daemon in a session of its own, so that it outlives the
+// terminal.
+func detachedProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Setsid: true}
+}
@@ -0,0 +1,10 @@
+package main
+
+import (
+	"syscall"
+)
+
+// There are no sessions to detach from, the daemon is a plain process.
+func detachedProcAttr() *syscall.SysProcAttr {
+	return nil
+}
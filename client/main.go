@@ -1,46 +1,355 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
 	"github.com/balta2ar/carrybasket"
+	"github.com/pkg/errors"
 	"github.com/urfave/cli"
 	"log"
 	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"syscall"
 	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
 )
 
-func action(c *cli.Context) error {
-	targetDir := c.Args().Get(0)
-	log.Printf("targetDir %v\n", targetDir)
+const (
+	snapshotTimeFormat = "2006-01-02 15:04"
+	jsonProgressPeriod = time.Second
+)
+
+// Redraws a single status line on stderr.
+type lineProgressReporter struct{}
+
+func (lineProgressReporter) ReportProgress(p carrybasket.Progress) {
+	fmt.Fprintf(os.Stderr, "\r\033[K%-4v files %v/%v, scanned %v, matched %v, literal %v, sent %v/%v, eta %v",
+		p.Phase, p.FilesScanned, p.FilesTotal,
+		formatBytes(p.BytesScanned), formatBytes(p.BytesMatched), formatBytes(p.BytesLiteral),
+		formatBytes(p.BytesSent), formatBytes(p.BytesTotal), p.ETA.Round(time.Second),
+	)
+	if p.Phase == carrybasket.ProgressPhaseDone {
+		fmt.Fprintln(os.Stderr)
+	}
+}
+
+// Prints progress as JSON lines on stdout, at most once per period
+// except for phase changes, so that it can be read by other programs.
+type jsonProgressReporter struct {
+	phase string
+	last  time.Time
+}
+
+func (r *jsonProgressReporter) ReportProgress(p carrybasket.Progress) {
+	now := time.Now()
+	if p.Phase == r.phase && now.Sub(r.last) < jsonProgressPeriod {
+		return
+	}
+	r.phase, r.last = p.Phase, now
+	line, _ := json.Marshal(p)
+	fmt.Println(string(line))
+}
+
+func formatBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%vB", n)
+	}
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// Logger set up by the flags. Messages of the standard log package,
+// e.g. fatal errors, go through it as well.
+func newLogger(c *cli.Context) carrybasket.Logger {
+	level, err := carrybasket.ParseLogLevel(c.GlobalString("log-level"))
+	if err != nil {
+		log.Fatalf("log-level error: %v\n", err)
+	}
+	json := false
+	switch c.GlobalString("log-format") {
+	case "text":
+	case "json":
+		json = true
+	default:
+		log.Fatalf("unknown log format %q, use text or json\n", c.GlobalString("log-format"))
+	}
+
+	logger := carrybasket.NewLogger(os.Stderr, level, json)
+	log.SetFlags(0)
+	log.SetOutput(carrybasket.NewLogWriter(logger, carrybasket.LogError))
+	return logger
+}
+
+// Serve metrics when asked to, nil otherwise.
+func serveMetrics(c *cli.Context, logger carrybasket.Logger) *carrybasket.Metrics {
+	address := c.GlobalString("metrics-address")
+	if address == "" {
+		return nil
+	}
+	metrics := carrybasket.NewMetrics()
+	go func() {
+		logger.Info("serving metrics", carrybasket.Field("address", address+carrybasket.MetricsPath))
+		if err := carrybasket.ServeMetrics(address, metrics); err != nil {
+			log.Fatalf("metrics error: %v\n", err)
+		}
+	}()
+	return metrics
+}
+
+func progressReporter(c *cli.Context) carrybasket.ProgressReporter {
+	switch c.GlobalString("progress") {
+	case "":
+		return nil
+	case "line":
+		return lineProgressReporter{}
+	case "json":
+		return &jsonProgressReporter{}
+	}
+	log.Fatalf("unknown progress format %q, use line or json\n", c.GlobalString("progress"))
+	return nil
+}
+
+// Exit codes of the sync command, so that scripts can tell failures apart.
+const (
+	exitSyncError   = 1 // any other error
+	exitUnreachable = 2 // server cannot be reached
+	exitRefused     = 3 // too many deletions, see --max-delete
+	exitDenied      = 4 // auth token or module access is rejected
+	exitInterrupted = 5 // cycle has not finished in time after a signal
+	exitNotApplied  = 6 // some files have not been synced, see the log
+)
+
+func syncExitCode(err error) int {
+	cause := errors.Cause(err)
+	switch cause {
+	case carrybasket.ErrTooManyDeletions:
+		return exitRefused
+	case carrybasket.ErrFilesNotApplied:
+		return exitNotApplied
+	}
+	switch status.Code(cause) {
+	case codes.Unavailable, codes.DeadlineExceeded:
+		return exitUnreachable
+	case codes.FailedPrecondition:
+		return exitRefused
+	case codes.Unauthenticated, codes.PermissionDenied:
+		return exitDenied
+	}
+	return exitSyncError
+}
+
+// Client calls used by the sync and watch commands.
+type syncClient interface {
+	carrybasket.SyncServiceClient
+	Close() error
+	DryRunCycleContext(ctx context.Context) ([]carrybasket.AdjustmentCommand, error)
+}
+
+// Context of a single cycle of the sync command, it has a deadline
+// when --sync-timeout is set.
+func cycleContext(c *cli.Context) (context.Context, context.CancelFunc) {
+	if timeout := c.GlobalDuration("sync-timeout"); timeout > 0 {
+		return context.WithTimeout(context.Background(), timeout)
+	}
+	return context.WithCancel(context.Background())
+}
+
+// Missing or "-" filename stands for stdin.
+func openInputFile(filename string) *os.File {
+	if filename == "" || filename == "-" {
+		return os.Stdin
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		log.Fatalf("cannot open input file: %v\n", err)
+	}
+	return f
+}
+
+// Missing or "-" filename stands for stdout.
+func createOutputFile(filename string) *os.File {
+	if filename == "" || filename == "-" {
+		return os.Stdout
+	}
+	f, err := os.Create(filename)
+	if err != nil {
+		log.Fatalf("cannot create output file: %v\n", err)
+	}
+	return f
+}
+
+func closeOutputFile(f *os.File) {
+	if err := f.Close(); err != nil {
+		log.Fatalf("cannot write output file: %v\n", err)
+	}
+}
+
+// Connect a client that syncs the target dir, set up by the flags.
+func openSyncClient(c *cli.Context, logger carrybasket.Logger, metrics *carrybasket.Metrics) syncClient {
+	targetDir := targetDirArg(c)
 	if _, err := os.Stat(targetDir); os.IsNotExist(err) {
 		log.Fatalln("Please specify an existing target dir")
 	}
-	log.Printf("command %v\n", targetDir)
-	log.Println("starting")
 
-	blockSize := 64 * 1024
 	fs := carrybasket.NewActualFilesystem(".")
-	address := "0.0.0.0:20000"
 
-	log.Printf(
-		"starting client: blockSize %v, targetDir %v, address %v (pid %v)\n",
-		blockSize, targetDir, address, os.Getpid(),
-	)
+	logStart(c, logger, targetDir)
 	os.Chdir(targetDir)
-	hashFactory := carrybasket.NewHashFactory(blockSize)
-	client := carrybasket.NewSyncServiceClient(blockSize, targetDir, fs, address, hashFactory)
+	// leftovers of pulls into the dir that have been interrupted
+	if err := carrybasket.RemoveTempFiles(fs); err != nil {
+		logger.Warn("error removing temporary files", carrybasket.Field("error", err))
+	}
+	blockSize := c.GlobalInt("block-size")
+	client := carrybasket.NewSyncServiceClient(
+		blockSize, targetDir, fs, c.GlobalString("address"), newHashFactory(c, blockSize), logger,
+	)
+	configureClient(c, client)
+	// dial does not wait for the server, it only fails on bad settings
 	err := client.Dial()
 	if err != nil {
 		log.Fatalf("dial error: %v\n", err)
 	}
+	client.SetTwoWay(c.GlobalBool("two-way"))
+	client.SetDeletionGuard(carrybasket.DeletionGuard{
+		MaxFiles:   c.GlobalInt("max-delete"),
+		MaxPercent: c.GlobalFloat64("max-delete-percent"),
+		MinFiles:   c.GlobalInt("max-delete-min-files"),
+	})
+	client.SetForce(c.GlobalBool("force"))
+	if c.GlobalString("bwlimit") != "" {
+		schedule, err := carrybasket.ParseBandwidthSchedule(c.GlobalString("bwlimit"))
+		if err != nil {
+			log.Fatalf("bwlimit error: %v\n", err)
+		}
+		limiter := carrybasket.NewBandwidthLimiter(0)
+		limiter.SetSchedule(schedule)
+		client.SetBandwidthLimiter(limiter)
+	}
+	client.SetProgressReporter(progressReporter(c))
+	client.SetMetrics(metrics)
+	return client
+}
+
+// Target dir is the argument of the command, or the flag when it is
+// set in the settings or environment.
+func targetDirArg(c *cli.Context) string {
+	if targetDir := c.Args().Get(0); targetDir != "" {
+		return targetDir
+	}
+	return c.GlobalString("target-dir")
+}
+
+func dryRun(c *cli.Context, client syncClient) {
+	if c.GlobalBool("two-way") {
+		log.Fatalln("client dry run error: only one-way sync can be planned, drop --two-way")
+	}
+	ctx, cancel := cycleContext(c)
+	defer cancel()
+	commands, err := client.DryRunCycleContext(ctx)
+	if err != nil {
+		log.Fatalf("client dry run error: %v\n", err)
+	}
+	for _, command := range commands {
+		fmt.Println(command)
+	}
+}
+
+// Sync once and exit with a code that tells what went wrong.
+func syncAction(c *cli.Context) error {
+	logger := newLogger(c)
+	client := openSyncClient(c, logger, serveMetrics(c, logger))
 	defer client.Close()
 
-	// one-time sync in the beginning
-	if err := client.SyncCycle(); err != nil {
-		log.Fatalf("client sync error: %v\n", err)
+	if c.GlobalBool("dry-run") {
+		dryRun(c, client)
+		return nil
 	}
 
-	changeHandler := carrybasket.NewChangeHandler(client)
-	fileWatcher := carrybasket.NewActualFileEventWatcher(".")
+	ctx, cancel := cycleContext(c)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		_, err := client.SyncCycleContext(ctx)
+		done <- err
+	}()
+	var err error
+	select {
+	case err = <-done:
+	case sig := <-notifySignals():
+		logger.Info("finishing sync cycle", carrybasket.Field("signal", sig))
+		select {
+		case err = <-done:
+		case <-time.After(c.GlobalDuration("shutdown-timeout")):
+			// server stops applying an unfinished push after the
+			// file it writes, the next sync does the rest
+			logger.Warn("sync cycle did not finish in time, dropping it")
+			return cli.NewExitError("", exitInterrupted)
+		}
+	}
+	if err != nil {
+		logger.Error("client sync error", carrybasket.Field("error", err))
+		return cli.NewExitError("", syncExitCode(err))
+	}
+	return nil
+}
+
+// Sync once, then on every change until SIGINT or SIGTERM.
+func watchAction(c *cli.Context) error {
+	logger := newLogger(c)
+	if pidFile := c.String("pid-file"); pidFile != "" {
+		if err := carrybasket.WritePidFile(pidFile); err != nil {
+			log.Fatalf("pid file error: %v\n", err)
+		}
+		defer carrybasket.RemovePidFile(pidFile)
+	}
+	metrics := serveMetrics(c, logger)
+	client := openSyncClient(c, logger, metrics)
+	defer client.Close()
+
+	if c.GlobalBool("dry-run") {
+		dryRun(c, client)
+		return nil
+	}
+
+	// left behind when the previous client has not stopped gracefully
+	runningFile := filepath.Join(carrybasket.MetadataDir, carrybasket.ClientRunningFile)
+	crashed, err := carrybasket.MarkRunning(runningFile)
+	if err != nil {
+		logger.Warn("running file error", carrybasket.Field("error", err))
+	}
+	defer carrybasket.MarkStopped(runningFile)
+
+	changeHandler := carrybasket.NewChangeHandler(client, logger)
+	changeHandler.SetMetrics(metrics)
+	backoff := carrybasket.DefaultBackoff
+	backoff.Initial = c.GlobalDuration("retry-delay")
+	backoff.Max = c.GlobalDuration("retry-max-delay")
+	if backoff.Initial <= 0 || backoff.Max < backoff.Initial {
+		log.Fatalln("Please specify a positive --retry-delay, not longer than --retry-max-delay")
+	}
+	changeHandler.SetBackoff(backoff)
+	changeHandler.SetCycleTimeout(c.GlobalDuration("sync-timeout"))
+	changeHandler.SetRescanInterval(c.GlobalDuration("rescan-interval"))
+	changeHandler.SetDebounce(carrybasket.Debounce{
+		Quiet:    c.GlobalDuration("debounce"),
+		MaxDelay: c.GlobalDuration("debounce-max-delay"),
+	})
+	fileWatcher, err := carrybasket.NewFileEventWatcherFor(c.GlobalString("watcher"), ".", logger)
+	if err != nil {
+		log.Fatalf("watcher error: %v\n", err)
+	}
 	events := make(chan carrybasket.ChangeEvent, 0)
 	syncCycleDone := make(chan struct{}, 0)
 
@@ -48,14 +357,400 @@ func action(c *cli.Context) error {
 		for {
 			select {
 			case <-syncCycleDone:
-				log.Println("main routine: sync cycle done")
+				logger.Debug("main routine: sync cycle done")
 			}
 		}
 	}()
 
+	// server changes do not produce local events, poll for them
+	if c.GlobalBool("two-way") {
+		go func() {
+			for range time.Tick(c.GlobalDuration("server-poll-interval")) {
+				events <- carrybasket.ChangeEvent{}
+			}
+		}()
+	}
+
+	signals := notifySignals()
 	changeHandler.Watch(events, syncCycleDone)
-	fileWatcher.Watch(events, time.Second*1)
+	// one-time sync in the beginning, retried as any other when the
+	// server is not reachable yet
+	if crashed {
+		logger.Warn("previous client has not stopped gracefully, changes may have been missed")
+		changeHandler.Rescan()
+	} else {
+		events <- carrybasket.ChangeEvent{}
+	}
+	go fileWatcher.Watch(events, c.GlobalDuration("poll-interval"))
+
+	sig := <-signals
+	logger.Info("shutting down", carrybasket.Field("signal", sig))
+	go fileWatcher.Close()
+	if !changeHandler.Stop(c.GlobalDuration("shutdown-timeout")) {
+		// server stops applying an unfinished push after the file it
+		// writes, files pulled in two-way mode are left as temporary
+		// files
+		logger.Warn("sync cycle did not finish in time, dropping it")
+		return nil
+	}
+	if err := carrybasket.RemoveTempFiles(carrybasket.NewActualFilesystem(".")); err != nil {
+		logger.Warn("error removing temporary files", carrybasket.Field("error", err))
+	}
+	return nil
+}
+
+// Channel that receives SIGINT and SIGTERM. The second signal exits
+// at once, without waiting for a graceful shutdown.
+func notifySignals() <-chan os.Signal {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	first := make(chan os.Signal, 1)
+	go func() {
+		first <- <-signals
+		<-signals
+		log.Fatalln("interrupted")
+	}()
+	return first
+}
+
+// Run the watch command in the background, detached from the terminal.
+// It writes its PID file itself, and logs into the log file.
+func daemonAction(c *cli.Context) error {
+	targetDir, err := filepath.Abs(targetDirArg(c))
+	if err != nil || targetDir == "" {
+		log.Fatalln("Please specify an existing target dir")
+	}
+	if _, err := os.Stat(targetDir); os.IsNotExist(err) {
+		log.Fatalln("Please specify an existing target dir")
+	}
+	pidFile := c.String("pid-file")
+	if pidFile == "" {
+		pidFile = filepath.Join(targetDir, carrybasket.MetadataDir, carrybasket.ClientPidFile)
+	}
+	logFile := c.String("log-file")
+	if logFile == "" {
+		logFile = filepath.Join(targetDir, carrybasket.MetadataDir, "client.log")
+	}
+	if pid, err := carrybasket.ReadPidFile(pidFile); err != nil || pid != 0 {
+		log.Fatalf("client is already running with pid %v, see %v\n", pid, pidFile)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(logFile), os.ModeDir|0755); err != nil {
+		log.Fatalf("cannot create log dir: %v\n", err)
+	}
+	output, err := os.OpenFile(logFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		log.Fatalf("cannot open log file: %v\n", err)
+	}
+	defer output.Close()
+
+	executable, err := os.Executable()
+	if err != nil {
+		log.Fatalf("cannot find executable: %v\n", err)
+	}
+	// global flags are passed as they are, the command is replaced
+	args := globalArgs(os.Args[1:], c.Command.Name)
+	args = append(args, "watch", "--pid-file", pidFile, targetDir)
+	cmd := exec.Command(executable, args...)
+	cmd.Stdout, cmd.Stderr = output, output
+	cmd.SysProcAttr = detachedProcAttr()
+	if err := cmd.Start(); err != nil {
+		log.Fatalf("cannot start daemon: %v\n", err)
+	}
+	if err := waitDaemon(cmd, pidFile); err != nil {
+		log.Fatalf("client daemon error: %v, see %v\n", err, logFile)
+	}
+	fmt.Printf("started client daemon with pid %v, logs in %v\n", cmd.Process.Pid, logFile)
+	return nil
+}
+
+// How long the daemon may take to write its PID file.
+const daemonStartTimeout = 5 * time.Second
+
+// Wait until the started daemon has written its PID into the file, so
+// that it has not lost the file to another client. Fails when the daemon
+// exits first or does not start in time, then it is killed.
+func waitDaemon(cmd *exec.Cmd, pidFile string) error {
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	timeout := time.After(daemonStartTimeout)
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		// an error means the file is being written
+		if pid, err := carrybasket.ReadPidFile(pidFile); err == nil && pid == cmd.Process.Pid {
+			return nil
+		}
+		select {
+		case err := <-exited:
+			if err == nil {
+				return errors.New("exited on start")
+			}
+			return errors.Wrap(err, "exited on start")
+		case <-timeout:
+			cmd.Process.Kill()
+			return errors.Errorf("has not started in %v", daemonStartTimeout)
+		case <-ticker.C:
+		}
+	}
+}
+
+// Arguments that come before the command.
+func globalArgs(args []string, command string) []string {
+	for i, arg := range args {
+		if arg == command {
+			return append([]string{}, args[:i]...)
+		}
+	}
+	return append([]string{}, args...)
+}
+
+func restoreAction(c *cli.Context) error {
+	targetDir := c.Args().Get(0)
+	if targetDir == "" {
+		log.Fatalln("Please specify a target dir to restore into")
+	}
+	if err := os.MkdirAll(targetDir, os.ModeDir|0755); err != nil {
+		log.Fatalf("cannot create target dir: %v\n", err)
+	}
+
+	client := dialClient(c, targetDir)
+	defer client.Close()
+
+	if err := client.RestoreCycle(); err != nil {
+		log.Fatalf("client restore error: %v\n", err)
+	}
+	return nil
+}
+
+func versionsAction(c *cli.Context) error {
+	targetDir := c.Args().Get(0)
+	if _, err := os.Stat(targetDir); os.IsNotExist(err) {
+		log.Fatalln("Please specify an existing target dir")
+	}
+
+	client := dialClient(c, targetDir)
+	defer client.Close()
+
+	versions, err := client.ListVersions(c.Args().Get(1))
+	if err != nil {
+		log.Fatalf("list versions error: %v\n", err)
+	}
+	for _, version := range versions {
+		fmt.Printf("%v %v\n", version.Version, version.Filename)
+	}
+	return nil
+}
+
+func restoreVersionAction(c *cli.Context) error {
+	targetDir := c.Args().Get(0)
+	if _, err := os.Stat(targetDir); os.IsNotExist(err) {
+		log.Fatalln("Please specify an existing target dir")
+	}
+	filename, version := c.Args().Get(1), c.Args().Get(2)
+	if filename == "" || version == "" {
+		log.Fatalln("Please specify a file and its version, see versions command")
+	}
+
+	client := dialClient(c, targetDir)
+	defer client.Close()
+
+	if err := client.RestoreVersion(filename, version); err != nil {
+		log.Fatalf("restore version error: %v\n", err)
+	}
+	return nil
+}
+
+func snapshotsAction(c *cli.Context) error {
+	targetDir := c.Args().Get(0)
+	if _, err := os.Stat(targetDir); os.IsNotExist(err) {
+		log.Fatalln("Please specify an existing target dir")
+	}
+
+	client := dialClient(c, targetDir)
+	defer client.Close()
+
+	snapshots, err := client.ListSnapshots()
+	if err != nil {
+		log.Fatalf("list snapshots error: %v\n", err)
+	}
+	for _, snapshot := range snapshots {
+		fmt.Printf("%v %v\n", snapshot.Id, snapshot.Time.Local().Format(snapshotTimeFormat))
+	}
+	return nil
+}
+
+func restoreSnapshotAction(c *cli.Context) error {
+	targetDir := c.Args().Get(0)
+	if _, err := os.Stat(targetDir); os.IsNotExist(err) {
+		log.Fatalln("Please specify an existing target dir")
+	}
+
+	client := dialClient(c, targetDir)
+	defer client.Close()
+
+	id := resolveSnapshot(client, c.Args().Get(1))
+	if err := client.RestoreSnapshot(id); err != nil {
+		log.Fatalf("restore snapshot error: %v\n", err)
+	}
+	return nil
+}
+
+func exportSnapshotAction(c *cli.Context) error {
+	targetDir := c.Args().Get(0)
+	if targetDir == "" {
+		log.Fatalln("Please specify a target dir to export into")
+	}
+	if err := os.MkdirAll(targetDir, os.ModeDir|0755); err != nil {
+		log.Fatalf("cannot create target dir: %v\n", err)
+	}
+
+	client := dialClient(c, targetDir)
+	defer client.Close()
 
+	id := resolveSnapshot(client, c.Args().Get(1))
+	if err := client.ExportSnapshot(id); err != nil {
+		log.Fatalf("export snapshot error: %v\n", err)
+	}
+	return nil
+}
+
+// Snapshot is given either by its id, or by local time. In the latter
+// case the latest snapshot taken by that time is used.
+func resolveSnapshot(client subcommandClient, snapshot string) string {
+	if _, err := time.Parse(carrybasket.VersionTimeFormat, snapshot); err == nil {
+		return snapshot
+	}
+	t, err := time.ParseInLocation(snapshotTimeFormat, snapshot, time.Local)
+	if err != nil {
+		log.Fatalf("Please specify a snapshot id or time as %q\n", snapshotTimeFormat)
+	}
+
+	snapshots, err := client.ListSnapshots()
+	if err != nil {
+		log.Fatalf("list snapshots error: %v\n", err)
+	}
+	found, ok := carrybasket.FindSnapshot(snapshots, t)
+	if !ok {
+		log.Fatalf("no snapshot taken by %v\n", snapshot)
+	}
+	fmt.Fprintf(os.Stderr, "using snapshot %v\n", found.Id)
+	return found.Id
+}
+
+// Client calls used by the subcommands.
+type subcommandClient interface {
+	Close() error
+	RestoreCycle() error
+	ListVersions(filename string) ([]carrybasket.FileVersion, error)
+	RestoreVersion(filename string, version string) error
+	ListSnapshots() ([]carrybasket.Snapshot, error)
+	RestoreSnapshot(id string) error
+	ExportSnapshot(id string) error
+}
+
+func logStart(c *cli.Context, logger carrybasket.Logger, targetDir string) {
+	logger.Info(
+		"starting client",
+		carrybasket.Field("block_size", c.GlobalInt("block-size")),
+		carrybasket.Field("target_dir", targetDir),
+		carrybasket.Field("address", c.GlobalString("address")),
+		carrybasket.Field("pid", os.Getpid()),
+	)
+}
+
+// Connect a client working in the target dir, for the subcommands.
+func dialClient(c *cli.Context, targetDir string) subcommandClient {
+	logger := newLogger(c)
+	fs := carrybasket.NewActualFilesystem(".")
+
+	logStart(c, logger, targetDir)
+	os.Chdir(targetDir)
+	// leftovers of pulls into the dir that have been interrupted
+	if err := carrybasket.RemoveTempFiles(fs); err != nil {
+		logger.Warn("error removing temporary files", carrybasket.Field("error", err))
+	}
+	blockSize := c.GlobalInt("block-size")
+	client := carrybasket.NewSyncServiceClient(
+		blockSize, targetDir, fs, c.GlobalString("address"), newHashFactory(c, blockSize), logger,
+	)
+	configureClient(c, client)
+	err := client.Dial()
+	if err != nil {
+		log.Fatalf("dial error: %v\n", err)
+	}
+	return client
+}
+
+// Client calls that set it up from the flags before dialing.
+type configurableClient interface {
+	SetModule(module string)
+	SetIgnoreRules(rules carrybasket.IgnoreRules)
+	SetAuthToken(token string)
+	SetCredentials(creds credentials.TransportCredentials)
+}
+
+func configureClient(c *cli.Context, client configurableClient) {
+	client.SetModule(c.GlobalString("module"))
+	rules, err := carrybasket.NewIgnoreRules(c.GlobalStringSlice("ignore"))
+	if err != nil {
+		log.Fatalf("ignore error: %v\n", err)
+	}
+	client.SetIgnoreRules(rules)
+	client.SetAuthToken(c.GlobalString("auth-token"))
+	if creds := clientCredentials(c); creds != nil {
+		client.SetCredentials(creds)
+	}
+}
+
+// TLS credentials when asked for, nil otherwise. Without a CA file the
+// server certificate is checked against the system roots.
+func clientCredentials(c *cli.Context) credentials.TransportCredentials {
+	ca, serverName := c.GlobalString("tls-ca"), c.GlobalString("tls-server-name")
+	if !c.GlobalBool("tls") && ca == "" {
+		return nil
+	}
+	if ca == "" {
+		return credentials.NewTLS(&tls.Config{ServerName: serverName})
+	}
+	creds, err := credentials.NewClientTLSFromFile(ca, serverName)
+	if err != nil {
+		log.Fatalf("tls error: %v\n", err)
+	}
+	return creds
+}
+
+func newHashFactory(c *cli.Context, blockSize int) carrybasket.HashFactory {
+	hashFactory, err := carrybasket.NewHashFactoryFor(
+		blockSize, c.GlobalString("fast-hash"), c.GlobalString("strong-hash"),
+	)
+	if err != nil {
+		log.Fatalf("hash error: %v\n", err)
+	}
+	return hashFactory
+}
+
+// Fill the flags given neither on the command line nor in the
+// environment from the settings file.
+func applySettings(c *cli.Context) error {
+	filename := c.String("settings")
+	if filename == "" {
+		return nil
+	}
+	settings, err := carrybasket.LoadSettings(filename)
+	if err != nil {
+		return err
+	}
+	for _, name := range settings.Keys() {
+		if name == "settings" || c.IsSet(name) {
+			continue
+		}
+		for _, value := range settings[name] {
+			if err := c.Set(name, value); err != nil {
+				return fmt.Errorf("setting %v: %v", name, err)
+			}
+		}
+	}
 	return nil
 }
 
@@ -63,7 +758,308 @@ func main() {
 	app := cli.NewApp()
 	app.Name = "carrybasket_client"
 	app.Usage = "Run carrybasket client"
-	app.Action = action
+	app.ArgsUsage = "[target dir]"
+	app.Action = watchAction
+	app.Commands = []cli.Command{
+		{
+			Name:      "sync",
+			Usage:     "sync target dir once and exit, with a non-zero code on errors",
+			ArgsUsage: "[target dir]",
+			Action:    syncAction,
+		},
+		{
+			Name:      "watch",
+			Usage:     "sync target dir once, then on every change (default)",
+			ArgsUsage: "[target dir]",
+			Action:    watchAction,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "pid-file",
+					Usage: "write PID into this file, refuse to start if it names a running client",
+				},
+			},
+		},
+		{
+			Name:      "daemon",
+			Usage:     "run watch in the background",
+			ArgsUsage: "[target dir]",
+			Action:    daemonAction,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "pid-file",
+					Usage: "PID file of the daemon (default: \"<target dir>/.carrybasket/client.pid\")",
+				},
+				cli.StringFlag{
+					Name:  "log-file",
+					Usage: "append log messages to this file (default: \"<target dir>/.carrybasket/client.log\")",
+				},
+			},
+		},
+		{
+			Name:      "restore",
+			Usage:     "make target dir a copy of the server dir",
+			ArgsUsage: "<target dir>",
+			Action:    restoreAction,
+		},
+		{
+			Name:      "versions",
+			Usage:     "list previous versions of files kept by the server",
+			ArgsUsage: "<target dir> [file]",
+			Action:    versionsAction,
+		},
+		{
+			Name:      "restore-version",
+			Usage:     "bring back a previous version of a file",
+			ArgsUsage: "<target dir> <file> <version>",
+			Action:    restoreVersionAction,
+		},
+		{
+			Name:      "snapshots",
+			Usage:     "list snapshots of the server dir",
+			ArgsUsage: "<target dir>",
+			Action:    snapshotsAction,
+		},
+		{
+			Name:      "restore-snapshot",
+			Usage:     "roll server and target dir back to a snapshot",
+			ArgsUsage: "<target dir> <snapshot id or \"YYYY-MM-DD HH:MM\">",
+			Action:    restoreSnapshotAction,
+		},
+		{
+			Name:      "export-snapshot",
+			Usage:     "make target dir a copy of a snapshot, server is not changed",
+			ArgsUsage: "<target dir> <snapshot id or \"YYYY-MM-DD HH:MM\">",
+			Action:    exportSnapshotAction,
+		},
+		{
+			Name:      "signature",
+			Usage:     "write rdiff signature of basis file, \"-\" is stdin or stdout",
+			ArgsUsage: "[basis file [signature file]]",
+			Action:    signatureAction,
+			Flags:     rdiffSignatureFlags,
+		},
+		{
+			Name:      "delta",
+			Usage:     "write rdiff delta from the basis file of signature to new file",
+			ArgsUsage: "<signature file> [new file [delta file]]",
+			Action:    deltaAction,
+		},
+		{
+			Name:      "patch",
+			Usage:     "apply rdiff delta to basis file and write the new file",
+			ArgsUsage: "<basis file> [delta file [new file]]",
+			Action:    patchAction,
+		},
+		{
+			Name:  "batch",
+			Usage: "sync a dir that can not be reached over the network, by files",
+			Subcommands: []cli.Command{
+				{
+					Name:      "signature",
+					Usage:     "write hashes of target dir files, \"-\" is stdout",
+					ArgsUsage: "<target dir> [signature file]",
+					Action:    batchSignatureAction,
+				},
+				{
+					Name:      "write",
+					Usage:     "write a batch that makes the target dir of signature a copy of client dir",
+					ArgsUsage: "<client dir> <signature file> [batch file]",
+					Action:    batchWriteAction,
+				},
+				{
+					Name:      "apply",
+					Usage:     "apply a batch to the target dir it was written for, \"-\" is stdin",
+					ArgsUsage: "<target dir> [batch file]",
+					Action:    batchApplyAction,
+				},
+			},
+		},
+	}
+	app.Before = applySettings
+	app.Flags = []cli.Flag{
+		cli.StringFlag{
+			Name:   "address",
+			Value:  "0.0.0.0:20000",
+			Usage:  "address of the server",
+			EnvVar: "CARRYBASKET_ADDRESS",
+		},
+		cli.StringFlag{
+			Name:   "auth-token",
+			Usage:  "token the server asks for",
+			EnvVar: "CARRYBASKET_AUTH_TOKEN",
+		},
+		cli.IntFlag{
+			Name:   "block-size",
+			Value:  64 * 1024,
+			Usage:  "size of blocks in bytes, must be the same on the server",
+			EnvVar: "CARRYBASKET_BLOCK_SIZE",
+		},
+		cli.StringFlag{
+			Name:   "bwlimit",
+			Usage:  "limit upload rate, e.g. \"512k\" or \"08:00,512k 18:00,off\"",
+			EnvVar: "CARRYBASKET_BWLIMIT",
+		},
+		cli.DurationFlag{
+			Name:   "debounce",
+			Value:  time.Second,
+			Usage:  "sync once changes have settled for this long, 0 syncs right away",
+			EnvVar: "CARRYBASKET_DEBOUNCE",
+		},
+		cli.DurationFlag{
+			Name:   "debounce-max-delay",
+			Value:  10 * time.Second,
+			Usage:  "sync at most this long after the first change, even if changes go on",
+			EnvVar: "CARRYBASKET_DEBOUNCE_MAX_DELAY",
+		},
+		cli.BoolFlag{
+			Name:   "dry-run",
+			Usage:  "print planned commands without changing the server, not with --two-way",
+			EnvVar: "CARRYBASKET_DRY_RUN",
+		},
+		cli.StringFlag{
+			Name:   "fast-hash",
+			Value:  carrybasket.FastHashMackerras,
+			Usage:  "rolling hash of blocks, must be the same on the server: mackerras",
+			EnvVar: "CARRYBASKET_FAST_HASH",
+		},
+		cli.BoolFlag{
+			Name:   "force",
+			Usage:  "sync even if it removes more files than allowed, on both sides",
+			EnvVar: "CARRYBASKET_FORCE",
+		},
+		cli.StringSliceFlag{
+			Name:   "ignore",
+			Usage:  "do not sync files matching the pattern, e.g. \"*.tmp\" or \"build/\", can be repeated",
+			EnvVar: "CARRYBASKET_IGNORE",
+		},
+		cli.IntFlag{
+			Name:   "max-delete",
+			Usage:  "refuse to remove more files than this in one sync, 0 means no limit",
+			EnvVar: "CARRYBASKET_MAX_DELETE",
+		},
+		cli.Float64Flag{
+			Name:   "max-delete-percent",
+			Value:  50,
+			Usage:  "refuse to remove a bigger share of files in one sync, 0 means no limit",
+			EnvVar: "CARRYBASKET_MAX_DELETE_PERCENT",
+		},
+		cli.IntFlag{
+			Name:   "max-delete-min-files",
+			Value:  10,
+			Usage:  "apply --max-delete-percent only to syncs that remove at least this many files",
+			EnvVar: "CARRYBASKET_MAX_DELETE_MIN_FILES",
+		},
+		cli.DurationFlag{
+			Name:   "poll-interval",
+			Value:  time.Second,
+			Usage:  "how often the polling watcher checks the target dir for changes",
+			EnvVar: "CARRYBASKET_POLL_INTERVAL",
+		},
+		cli.StringFlag{
+			Name:   "progress",
+			Usage:  "show progress of syncs: \"line\" on stderr or \"json\" lines on stdout",
+			EnvVar: "CARRYBASKET_PROGRESS",
+		},
+		cli.StringFlag{
+			Name:   "log-format",
+			Value:  "text",
+			Usage:  "format of log messages: text or json",
+			EnvVar: "CARRYBASKET_LOG_FORMAT",
+		},
+		cli.StringFlag{
+			Name:   "log-level",
+			Value:  "info",
+			Usage:  "log messages of this level and above: debug, info, warn or error",
+			EnvVar: "CARRYBASKET_LOG_LEVEL",
+		},
+		cli.StringFlag{
+			Name:   "metrics-address",
+			Usage:  "serve Prometheus metrics on this address, e.g. \":9100\"",
+			EnvVar: "CARRYBASKET_METRICS_ADDRESS",
+		},
+		cli.StringFlag{
+			Name:   "module",
+			Usage:  "name of the server module to sync with",
+			EnvVar: "CARRYBASKET_MODULE",
+		},
+		cli.DurationFlag{
+			Name:   "rescan-interval",
+			Value:  10 * time.Minute,
+			Usage:  "how often all files are compared with the server in case the watcher has missed changes, 0 disables it",
+			EnvVar: "CARRYBASKET_RESCAN_INTERVAL",
+		},
+		cli.DurationFlag{
+			Name:   "retry-delay",
+			Value:  carrybasket.DefaultBackoff.Initial,
+			Usage:  "first delay before a failed sync is retried, it doubles on every failure, must be positive",
+			EnvVar: "CARRYBASKET_RETRY_DELAY",
+		},
+		cli.DurationFlag{
+			Name:   "retry-max-delay",
+			Value:  carrybasket.DefaultBackoff.Max,
+			Usage:  "longest delay between retries of a failed sync",
+			EnvVar: "CARRYBASKET_RETRY_MAX_DELAY",
+		},
+		cli.DurationFlag{
+			Name:   "server-poll-interval",
+			Value:  10 * time.Second,
+			Usage:  "how often the server is checked for changes in two-way mode",
+			EnvVar: "CARRYBASKET_SERVER_POLL_INTERVAL",
+		},
+		cli.StringFlag{
+			Name:   "settings",
+			Usage:  "read flags from this TOML file, flags and environment take precedence",
+			EnvVar: "CARRYBASKET_SETTINGS",
+		},
+		cli.DurationFlag{
+			Name:   "shutdown-timeout",
+			Value:  30 * time.Second,
+			Usage:  "how long the running sync may take after SIGINT or SIGTERM",
+			EnvVar: "CARRYBASKET_SHUTDOWN_TIMEOUT",
+		},
+		cli.StringFlag{
+			Name:   "strong-hash",
+			Value:  carrybasket.StrongHashMD5,
+			Usage:  "hash of blocks and files, must be the same on the server: md5, sha1 or sha256",
+			EnvVar: "CARRYBASKET_STRONG_HASH",
+		},
+		cli.DurationFlag{
+			Name:   "sync-timeout",
+			Usage:  "give up a sync that takes longer, e.g. when the server hangs, 0 means no limit",
+			EnvVar: "CARRYBASKET_SYNC_TIMEOUT",
+		},
+		cli.StringFlag{
+			Name:   "target-dir",
+			Usage:  "dir to sync when it is not given as the argument",
+			EnvVar: "CARRYBASKET_TARGET_DIR",
+		},
+		cli.BoolFlag{
+			Name:   "tls",
+			Usage:  "connect over TLS, server certificate is checked against the system roots",
+			EnvVar: "CARRYBASKET_TLS",
+		},
+		cli.StringFlag{
+			Name:   "tls-ca",
+			Usage:  "connect over TLS, server certificate is checked against this CA file",
+			EnvVar: "CARRYBASKET_TLS_CA",
+		},
+		cli.StringFlag{
+			Name:   "tls-server-name",
+			Usage:  "name in the server certificate, when it differs from the address",
+			EnvVar: "CARRYBASKET_TLS_SERVER_NAME",
+		},
+		cli.BoolFlag{
+			Name:   "two-way",
+			Usage:  "sync changes in both directions, keep conflicting edits as copies",
+			EnvVar: "CARRYBASKET_TWO_WAY",
+		},
+		cli.StringFlag{
+			Name:   "watcher",
+			Value:  carrybasket.FileWatcherAuto,
+			Usage:  "how changes are detected: auto, native (inotify) or polling",
+			EnvVar: "CARRYBASKET_WATCHER",
+		},
+	}
 
 	err := app.Run(os.Args)
 	if err != nil {
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"github.com/balta2ar/carrybasket"
+	"github.com/urfave/cli"
+	"log"
+)
+
+// Flags of the signature command, defaults are the ones of rdiff.
+var rdiffSignatureFlags = []cli.Flag{
+	cli.IntFlag{
+		Name:  "block-len",
+		Value: carrybasket.RdiffDefaultBlockLen,
+		Usage: "length of basis file blocks",
+	},
+	cli.IntFlag{
+		Name:  "sum-len",
+		Usage: "length of strong hashes of blocks, 0 keeps them whole",
+	},
+	cli.StringFlag{
+		Name:  "hash",
+		Value: carrybasket.RdiffHashBlake2,
+		Usage: "strong hash of blocks: md4 or blake2",
+	},
+	cli.StringFlag{
+		Name:  "rollsum",
+		Value: carrybasket.RdiffRabinKarp,
+		Usage: "rolling hash of blocks: rollsum or rabinkarp",
+	},
+}
+
+func signatureAction(c *cli.Context) error {
+	magic, err := carrybasket.RdiffSigMagicFor(c.String("hash"), c.String("rollsum"))
+	if err != nil {
+		log.Fatalln(err)
+	}
+	basis := openInputFile(c.Args().Get(0))
+	defer basis.Close()
+
+	signature, err := carrybasket.NewRdiffSignature(basis, magic, c.Int("block-len"), c.Int("sum-len"))
+	if err != nil {
+		log.Fatalf("signature error: %v\n", err)
+	}
+	output := createOutputFile(c.Args().Get(1))
+	if _, err := signature.WriteTo(output); err != nil {
+		log.Fatalf("cannot write signature: %v\n", err)
+	}
+	closeOutputFile(output)
+	return nil
+}
+
+func deltaAction(c *cli.Context) error {
+	if c.Args().Get(0) == "" {
+		log.Fatalln("Please specify a signature file")
+	}
+	signatureFile := openInputFile(c.Args().Get(0))
+	signature, err := carrybasket.ReadRdiffSignature(signatureFile)
+	signatureFile.Close()
+	if err != nil {
+		log.Fatalf("cannot read signature: %v\n", err)
+	}
+	newFile := openInputFile(c.Args().Get(1))
+	defer newFile.Close()
+
+	output := createOutputFile(c.Args().Get(2))
+	if err := carrybasket.WriteRdiffDelta(signature, newFile, output); err != nil {
+		log.Fatalf("delta error: %v\n", err)
+	}
+	closeOutputFile(output)
+	return nil
+}
+
+func patchAction(c *cli.Context) error {
+	// copies read the basis at random offsets, it can not be a pipe
+	basisFilename := c.Args().Get(0)
+	if basisFilename == "" || basisFilename == "-" {
+		log.Fatalln("Please specify a basis file")
+	}
+	basis := openInputFile(basisFilename)
+	defer basis.Close()
+	delta := openInputFile(c.Args().Get(1))
+	defer delta.Close()
+
+	output := createOutputFile(c.Args().Get(2))
+	if err := carrybasket.ApplyRdiffDelta(basis, delta, output); err != nil {
+		log.Fatalf("patch error: %v\n", err)
+	}
+	closeOutputFile(output)
+	return nil
+}
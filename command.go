@@ -1,6 +1,14 @@
 package carrybasket
 
-import "log"
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/pkg/errors"
+	"io"
+)
+
+var ErrDigestMismatch = errors.New("reconstructed file digest does not match client digest")
 
 type AdjustmentCommand interface{}
 
@@ -11,12 +19,91 @@ type AdjustmentCommandRemoveFile struct {
 type AdjustmentCommandApplyBlocksToFile struct {
 	filename string
 	blocks   []Block
+	digest   []byte /// digest of the whole client file, see NewFileDigest
 }
 
 type AdjustmentCommandMkDir struct {
 	filename string
 }
 
+func (c AdjustmentCommandRemoveFile) String() string {
+	return fmt.Sprintf("remove %v", c.filename)
+}
+
+func (c AdjustmentCommandMkDir) String() string {
+	return fmt.Sprintf("mkdir %v", c.filename)
+}
+
+func (c AdjustmentCommandApplyBlocksToFile) String() string {
+	return fmt.Sprintf(
+		"apply %v: %v bytes literal, %v bytes reused",
+		c.filename, c.LiteralBytes(), c.ReusedBytes(),
+	)
+}
+
+/// Number of bytes that have to be sent to the server as content blocks.
+func (c AdjustmentCommandApplyBlocksToFile) LiteralBytes() uint64 {
+	var size uint64
+	for _, block := range c.blocks {
+		if _, ok := block.(ContentBlock); ok {
+			size += block.Size()
+		}
+	}
+	return size
+}
+
+/// Number of bytes that server already has and will reuse from
+/// hashed blocks.
+func (c AdjustmentCommandApplyBlocksToFile) ReusedBytes() uint64 {
+	var size uint64
+	for _, block := range c.blocks {
+		if _, ok := block.(HashedBlock); ok {
+			size += block.Size()
+		}
+	}
+	return size
+}
+
+// Name of the file or dir that the command changes, empty for unknown
+// commands.
+func adjustmentCommandFilename(abstractCommand AdjustmentCommand) string {
+	switch command := abstractCommand.(type) {
+	case AdjustmentCommandRemoveFile:
+		return command.filename
+	case AdjustmentCommandApplyBlocksToFile:
+		return command.filename
+	case AdjustmentCommandMkDir:
+		return command.filename
+	}
+	return ""
+}
+
+// Commands come from the clients, none of them may change files outside
+// the tree or in the metadata dir.
+func validateAdjustmentCommands(commands []AdjustmentCommand) error {
+	for _, command := range commands {
+		if err := validateFilename(adjustmentCommandFilename(command)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type AdjustmentResultStatus int
+
+const (
+	AdjustmentResultApplied AdjustmentResultStatus = iota
+	AdjustmentResultFailed
+	AdjustmentResultNeedsFullResend /// server lacks blocks, send pure content
+)
+
+/// Outcome of applying a single AdjustmentCommand on the server.
+type AdjustmentResult struct {
+	Filename string
+	Status   AdjustmentResultStatus
+	Reason   string /// empty when the command has been applied
+}
+
 /// Files can be compared and based on the comparison results various
 /// actions are possible, e.g. remove file from server or apply
 /// client blocks to server files.
@@ -25,15 +112,39 @@ type FilesComparator interface {
 		clientFiles []VirtualFile,
 		serverHashedFiles []HashedFile,
 	) []AdjustmentCommand
+	CompareContext(
+		ctx context.Context,
+		clientFiles []VirtualFile,
+		serverHashedFiles []HashedFile,
+	) ([]AdjustmentCommand, error)
 }
 
 type filesComparator struct {
-	producerFactory ProducerFactory
+	producerFactory  ProducerFactory
+	fullContentFiles map[string]struct{}
+	logger           Logger
 }
 
 func NewFilesComparator(producerFactory ProducerFactory) *filesComparator {
 	return &filesComparator{
-		producerFactory: producerFactory,
+		producerFactory:  producerFactory,
+		fullContentFiles: make(map[string]struct{}),
+		logger:           NewNopLogger(),
+	}
+}
+
+/// Log scanned files. Nothing is logged by default.
+func (fc *filesComparator) SetLogger(logger Logger) {
+	fc.logger = logger
+}
+
+/// Files with the given names will be sent as pure content, without
+/// referring to the blocks that server already has. This is used when
+/// server could not reconstruct a file from the previously sent blocks.
+func (fc *filesComparator) SetFullContentFiles(filenames []string) {
+	fc.fullContentFiles = make(map[string]struct{}, len(filenames))
+	for _, filename := range filenames {
+		fc.fullContentFiles[filename] = struct{}{}
 	}
 }
 
@@ -53,17 +164,46 @@ func (fc *filesComparator) Compare(
 	clientFiles []VirtualFile,
 	serverHashedFiles []HashedFile,
 ) []AdjustmentCommand {
+	commands, _ := fc.CompareContext(context.Background(), clientFiles, serverHashedFiles)
+	return commands
+}
+
+/// Compare like Compare, stops with the context error when ctx is
+/// cancelled or its deadline is exceeded, also in the middle of
+/// scanning a large file.
+func (fc *filesComparator) CompareContext(
+	ctx context.Context,
+	clientFiles []VirtualFile,
+	serverHashedFiles []HashedFile,
+) ([]AdjustmentCommand, error) {
 	var commands []AdjustmentCommand
+	var scanErr error
+	var postponed []int
 	var i, j int
 	fastCache, strongCache := createCacheFromServerFiles(serverHashedFiles)
 
 	addClientFile := func(i int) {
 		// both are files
+		if scanErr != nil {
+			return
+		}
 		producer := fc.producerFactory.MakeProducerWithCache(fastCache, strongCache)
-		log.Printf("scanning file %v\n", clientFiles[i].Filename)
-		blocks := producer.Scan(clientFiles[i].Rw)
+		if _, ok := fc.fullContentFiles[clientFiles[i].Filename]; ok {
+			producer = fc.producerFactory.MakeProducer(nil, nil)
+		}
+		fc.logger.Debug("scanning file", Field("filename", clientFiles[i].Filename))
+		digest := NewFileDigest()
+		blocks, err := producer.ScanContext(ctx, io.TeeReader(clientFiles[i].Rw, digest))
+		if err != nil {
+			scanErr = err
+			return
+		}
 		commands = append(commands,
-			AdjustmentCommandApplyBlocksToFile{clientFiles[i].Filename, blocks},
+			AdjustmentCommandApplyBlocksToFile{
+				clientFiles[i].Filename,
+				blocks,
+				digest.Sum(nil),
+			},
 		)
 	}
 
@@ -92,10 +232,11 @@ func (fc *filesComparator) Compare(
 		// client file, server dir
 		if !clientDir && serverDir {
 			// remove server dir, replace it with new client file
+			// once files inside the dir have been removed too
 			commands = append(commands,
 				AdjustmentCommandRemoveFile{serverHashedFiles[j].Filename},
 			)
-			addClientFile(i)
+			postponed = append(postponed, i)
 			return
 		}
 
@@ -148,7 +289,15 @@ func (fc *filesComparator) Compare(
 		j += 1
 	}
 
-	return commands
+	// add client files that replace server dirs
+	for _, i := range postponed {
+		addClientFile(i)
+	}
+
+	if scanErr != nil {
+		return nil, scanErr
+	}
+	return commands, nil
 }
 
 type AdjustmentCommandApplier interface {
@@ -156,46 +305,168 @@ type AdjustmentCommandApplier interface {
 		commands []AdjustmentCommand,
 		fs VirtualFilesystem,
 		cr ContentReconstructor,
-	) error
+	) []AdjustmentResult
+	ApplyContext(
+		ctx context.Context,
+		commands []AdjustmentCommand,
+		fs VirtualFilesystem,
+		cr ContentReconstructor,
+	) []AdjustmentResult
 }
 
-type adjustmentCommandApplier struct{}
+type adjustmentCommandApplier struct {
+	versions FileVersions /// keeps files before they are overwritten or removed
+}
 
 func NewAdjustmentCommandApplier() *adjustmentCommandApplier {
 	return &adjustmentCommandApplier{}
 }
 
+/// Keep previous versions of files that are overwritten or removed
+/// by the commands. Versions are not kept by default.
+func (aca *adjustmentCommandApplier) SetFileVersions(versions FileVersions) {
+	aca.versions = versions
+}
+
+/// Apply all commands one by one. A failure to apply one command does
+/// not stop the rest, the outcome of every command is reported in the
+/// returned slice in the same order as commands.
 func (aca *adjustmentCommandApplier) Apply(
 	commands []AdjustmentCommand,
 	fs VirtualFilesystem,
 	cr ContentReconstructor,
-) error {
-	for _, abstractCommand := range commands {
+) []AdjustmentResult {
+	return aca.ApplyContext(context.Background(), commands, fs, cr)
+}
+
+/// Apply like Apply, stops between commands when ctx is cancelled or its
+/// deadline is exceeded. Commands that have not been applied by then
+/// fail with the context error. A command is never stopped halfway,
+/// the commands applied before it stay applied.
+func (aca *adjustmentCommandApplier) ApplyContext(
+	ctx context.Context,
+	commands []AdjustmentCommand,
+	fs VirtualFilesystem,
+	cr ContentReconstructor,
+) []AdjustmentResult {
+	results := make([]AdjustmentResult, 0, len(commands))
+
+	for i, abstractCommand := range commands {
+		if err := ctx.Err(); err != nil {
+			for _, command := range commands[i:] {
+				results = append(results, makeAdjustmentResult(adjustmentCommandFilename(command), err))
+			}
+			break
+		}
+
 		switch command := abstractCommand.(type) {
 		case AdjustmentCommandRemoveFile:
-			if err := fs.Delete(command.filename); err != nil {
-				return err
-			}
+			err := aca.removeFile(command.filename, fs)
+			results = append(results, makeAdjustmentResult(command.filename, err))
 
 		case AdjustmentCommandMkDir:
-			if err := fs.Mkdir(command.filename); err != nil {
-				return err
-			}
+			err := fs.Mkdir(command.filename)
+			results = append(results, makeAdjustmentResult(command.filename, err))
 
 		case AdjustmentCommandApplyBlocksToFile:
-			tempFilename := command.filename + ".tmp"
-			w, err := fs.OpenWrite(tempFilename)
-			if err != nil {
-				return err
-			}
-			// TODO: add w.Close() here
+			err := applyBlocksToFile(command, fs, cr, aca.versions)
+			results = append(results, makeAdjustmentResult(command.filename, err))
+		}
+	}
 
-			cr.Reconstruct(command.blocks, w)
-			if err := fs.Move(tempFilename, command.filename); err != nil {
-				return err
-			}
+	return results
+}
+
+// When versions are kept, the file has already been moved away
+// by the time it is to be removed, only directories remain.
+func (aca *adjustmentCommandApplier) removeFile(filename string, fs VirtualFilesystem) error {
+	if aca.versions != nil {
+		if err := aca.versions.Keep(filename); err != nil {
+			return err
+		}
+		if !fs.IsPath(filename) {
+			return nil
 		}
 	}
+	return fs.Delete(filename)
+}
 
-	return nil
+// Reconstruct the file into a temporary file first, and only replace
+// the original when reconstruction has succeeded and the digest of the
+// result matches the one computed by the client. Commands without
+// a digest are not verified.
+func applyBlocksToFile(
+	command AdjustmentCommandApplyBlocksToFile,
+	fs VirtualFilesystem,
+	cr ContentReconstructor,
+	versions FileVersions,
+) error {
+	tempFilename := tempFileFor(command.filename)
+	w, err := fs.OpenWrite(tempFilename)
+	if err != nil {
+		return err
+	}
+
+	digest := NewFileDigest()
+	_, err = cr.Reconstruct(command.blocks, io.MultiWriter(w, digest))
+	if closeErr := w.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && len(command.digest) > 0 &&
+		!bytes.Equal(command.digest, digest.Sum(nil)) {
+		err = errors.Wrapf(ErrDigestMismatch, "file %v", command.filename)
+	}
+	if err != nil {
+		_ = fs.Delete(tempFilename)
+		return err
+	}
+
+	// unchanged files are rewritten on every sync, they must not
+	// produce new versions
+	if versions != nil && !fileHasDigest(fs, command.filename, digest.Sum(nil)) {
+		if err := versions.Keep(command.filename); err != nil {
+			_ = fs.Delete(tempFilename)
+			return err
+		}
+	}
+	return fs.Move(tempFilename, command.filename)
+}
+
+func fileHasDigest(fs VirtualFilesystem, filename string, expected []byte) bool {
+	if !fs.IsPath(filename) || fs.IsDir(filename) {
+		return false
+	}
+	r, err := fs.OpenRead(filename)
+	if err != nil {
+		return false
+	}
+	defer r.Close()
+
+	digest := NewFileDigest()
+	if _, err := io.Copy(digest, r); err != nil {
+		return false
+	}
+	return bytes.Equal(expected, digest.Sum(nil))
+}
+
+func makeAdjustmentResult(filename string, err error) AdjustmentResult {
+	if err == nil {
+		return AdjustmentResult{filename, AdjustmentResultApplied, ""}
+	}
+
+	status := AdjustmentResultFailed
+	switch errors.Cause(err) {
+	case ErrMissingHash, ErrDigestMismatch:
+		status = AdjustmentResultNeedsFullResend
+	}
+	return AdjustmentResult{filename, status, err.Error()}
+}
+
+func allApplied(results []AdjustmentResult) bool {
+	for _, result := range results {
+		if result.Status != AdjustmentResultApplied {
+			return false
+		}
+	}
+	return true
 }
@@ -1,8 +1,11 @@
 package carrybasket
 
 import (
+	"context"
 	"crypto/md5"
+	"fmt"
 	"github.com/stretchr/testify/assert"
+	"io"
 	"io/ioutil"
 	"strings"
 	"testing"
@@ -48,6 +51,7 @@ func makeServerFileAndGetContent(
 		isDir,
 		result.fastHashes,
 		result.strongHashes,
+		nil,
 	}
 }
 
@@ -70,8 +74,8 @@ func TestFilesComparator_RemoveOneOfTwoAndChange(t *testing.T) {
 		{"b", false, NopReadCloser(strings.NewReader("abc"))},
 	}
 	serverHashedFiles := []HashedFile{
-		{"a", false, nil, nil},
-		{"b", false, nil, nil},
+		{"a", false, nil, nil, nil},
+		{"b", false, nil, nil, nil},
 	}
 	commands := runComparator(blockSize, clientFiles, serverHashedFiles)
 	assert.Len(t, commands, 2)
@@ -86,7 +90,7 @@ func TestFilesComparator_RemoveOnlyOne(t *testing.T) {
 	blockSize := 4
 	clientFiles := []VirtualFile{}
 	serverHashedFiles := []HashedFile{
-		{"a", false, nil, nil},
+		{"a", false, nil, nil, nil},
 	}
 	commands := runComparator(blockSize, clientFiles, serverHashedFiles)
 	assert.Len(t, commands, 1)
@@ -238,6 +242,85 @@ func TestFilesComparator_ReplaceFileWithDir(t *testing.T) {
 	assert.Equal(t, "a", commands[1].(AdjustmentCommandMkDir).filename)
 }
 
+func TestFilesComparator_ClientFileReplacesServerDirWithFiles(t *testing.T) {
+	blockSize := 4
+	clientFiles := []VirtualFile{
+		makeClientFile("a", false, "abcd"),
+	}
+	serverHashedFiles := []HashedFile{
+		makeServerFile(blockSize, "a", true, ""),
+		makeServerFile(blockSize, "a/1", false, "1234"),
+	}
+	commands := runComparator(blockSize, clientFiles, serverHashedFiles)
+	assert.Len(t, commands, 3)
+	assert.Equal(t, "a", commands[0].(AdjustmentCommandRemoveFile).filename)
+	assert.Equal(t, "a/1", commands[1].(AdjustmentCommandRemoveFile).filename)
+	assert.Equal(t, "a", commands[2].(AdjustmentCommandApplyBlocksToFile).filename)
+}
+
+func TestFilesComparator_FullContent(t *testing.T) {
+	blockSize := 4
+	clientFiles := []VirtualFile{
+		makeClientFile("a", false, "abcd1234"),
+	}
+	serverHashedFiles := []HashedFile{
+		makeServerFile(blockSize, "a", false, "abcd1234"),
+	}
+
+	hashFactory := NewHashFactory(blockSize)
+	factory := NewProducerFactory(blockSize, hashFactory)
+	comparator := NewFilesComparator(factory)
+	comparator.SetFullContentFiles([]string{"a"})
+	commands := comparator.Compare(clientFiles, serverHashedFiles)
+	assert.Len(t, commands, 1)
+	assert.Equal(t, "a", commands[0].(AdjustmentCommandApplyBlocksToFile).filename)
+	blocks := commands[0].(AdjustmentCommandApplyBlocksToFile).blocks
+	assert.Len(t, blocks, 1)
+	assert.Equal(t, "abcd1234", string(blocks[0].(ContentBlock).Content()))
+
+	digest := NewFileDigest()
+	digest.Write([]byte("abcd1234"))
+	assert.Equal(t, digest.Sum(nil), commands[0].(AdjustmentCommandApplyBlocksToFile).digest)
+}
+
+func TestFilesComparator_CompareContextCancelled(t *testing.T) {
+	blockSize := 4
+	clientFiles := []VirtualFile{
+		makeClientFile("a", true, ""),
+		makeClientFile("a/1", false, "abcd1234"),
+	}
+
+	hashFactory := NewHashFactory(blockSize)
+	comparator := NewFilesComparator(NewProducerFactory(blockSize, hashFactory))
+	ctx, cancel := context.WithTimeout(context.Background(), 0)
+	defer cancel()
+	commands, err := comparator.CompareContext(ctx, clientFiles, nil)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.Nil(t, commands)
+}
+
+func TestAdjustmentCommand_String(t *testing.T) {
+	blockSize := 4
+	clientFiles := []VirtualFile{
+		makeClientFile("a", true, ""),
+		makeClientFile("b", false, "abc1234def"),
+	}
+	serverHashedFiles := []HashedFile{
+		makeServerFile(blockSize, "b", false, "1234"),
+		makeServerFile(blockSize, "c", false, "xyz"),
+	}
+	commands := runComparator(blockSize, clientFiles, serverHashedFiles)
+	assert.Len(t, commands, 3)
+
+	apply := commands[1].(AdjustmentCommandApplyBlocksToFile)
+	assert.Equal(t, uint64(6), apply.LiteralBytes())
+	assert.Equal(t, uint64(4), apply.ReusedBytes())
+
+	assert.Equal(t, "mkdir a", fmt.Sprint(commands[0]))
+	assert.Equal(t, "apply b: 6 bytes literal, 4 bytes reused", fmt.Sprint(commands[1]))
+	assert.Equal(t, "remove c", fmt.Sprint(commands[2]))
+}
+
 func TestAdjustmentCommandApplier_Smoke(t *testing.T) {
 	blockSize := 4
 	clientContent := "abc1234def"
@@ -269,8 +352,8 @@ func TestAdjustmentCommandApplier_Smoke(t *testing.T) {
 	assert.Equal(t, len(serverContent), n)
 
 	applier := NewAdjustmentCommandApplier()
-	err = applier.Apply(commands, fs, reconstructor)
-	assert.Nil(t, err)
+	results := applier.Apply(commands, fs, reconstructor)
+	assertAllApplied(t, results)
 
 	r, err := fs.OpenRead("a")
 	result, err := ioutil.ReadAll(r)
@@ -295,8 +378,8 @@ func TestAdjustmentCommandApplier_AddOneDir(t *testing.T) {
 
 	fs := NewLoggingFilesystem()
 	applier := NewAdjustmentCommandApplier()
-	err := applier.Apply(commands, fs, reconstructor)
-	assert.Nil(t, err)
+	results := applier.Apply(commands, fs, reconstructor)
+	assertAllApplied(t, results)
 
 	filenames, err := fs.ListAll()
 	assert.Nil(t, err)
@@ -318,10 +401,175 @@ func TestAdjustmentCommandApplier_RmOneDir(t *testing.T) {
 	fs := NewLoggingFilesystem()
 	assert.Nil(t, fs.Mkdir("b"))
 	applier := NewAdjustmentCommandApplier()
-	err := applier.Apply(commands, fs, reconstructor)
-	assert.Nil(t, err)
+	results := applier.Apply(commands, fs, reconstructor)
+	assertAllApplied(t, results)
 
 	filenames, err := fs.ListAll()
 	assert.Nil(t, err)
 	assert.Equal(t, []string{}, filenames)
 }
+
+func TestAdjustmentCommandApplier_MissingHash(t *testing.T) {
+	blockSize := 4
+	clientFiles := []VirtualFile{
+		makeClientFile("a", false, "abcd1234"),
+		makeClientFile("b", false, "xyz"),
+	}
+	serverHashedFiles := []HashedFile{
+		makeServerFile(blockSize, "a", false, "abcd"),
+	}
+	commands := runComparator(blockSize, clientFiles, serverHashedFiles)
+
+	// server has lost the content of its blocks
+	contentCache := NewBlockCache()
+	reconstructor := NewContentReconstructor(md5.New(), contentCache)
+
+	fs := NewLoggingFilesystem()
+	applier := NewAdjustmentCommandApplier()
+	results := applier.Apply(commands, fs, reconstructor)
+	assert.Len(t, results, 2)
+	assert.Equal(t, "a", results[0].Filename)
+	assert.Equal(t, AdjustmentResultNeedsFullResend, results[0].Status)
+	assert.NotEmpty(t, results[0].Reason)
+	assert.Equal(t, "b", results[1].Filename)
+	assert.Equal(t, AdjustmentResultApplied, results[1].Status)
+
+	filenames, err := fs.ListAll()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"b"}, filenames)
+}
+
+func TestAdjustmentCommandApplier_Failed(t *testing.T) {
+	commands := []AdjustmentCommand{
+		AdjustmentCommandRemoveFile{"a"},
+	}
+	reconstructor := NewContentReconstructor(md5.New(), NewBlockCache())
+
+	fs := NewLoggingFilesystem()
+	applier := NewAdjustmentCommandApplier()
+	results := applier.Apply(commands, fs, reconstructor)
+	assert.Len(t, results, 1)
+	assert.Equal(t, "a", results[0].Filename)
+	assert.Equal(t, AdjustmentResultFailed, results[0].Status)
+	assert.NotEmpty(t, results[0].Reason)
+}
+
+// Cancels the context once it has reconstructed a file.
+type cancellingReconstructor struct {
+	ContentReconstructor
+	cancel context.CancelFunc
+}
+
+func (cr cancellingReconstructor) Reconstruct(blocks []Block, w io.Writer) (uint64, error) {
+	defer cr.cancel()
+	return cr.ContentReconstructor.Reconstruct(blocks, w)
+}
+
+func TestAdjustmentCommandApplier_ApplyContextCancelled(t *testing.T) {
+	blockSize := 4
+	clientFiles := []VirtualFile{
+		makeClientFile("a", false, "abcd"),
+		makeClientFile("b", true, ""),
+		makeClientFile("c", false, "xyz"),
+	}
+	commands := runComparator(blockSize, clientFiles, []HashedFile{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	reconstructor := cancellingReconstructor{
+		NewContentReconstructor(md5.New(), NewBlockCache()),
+		cancel,
+	}
+	fs := NewLoggingFilesystem()
+	applier := NewAdjustmentCommandApplier()
+	results := applier.ApplyContext(ctx, commands, fs, reconstructor)
+	assert.Len(t, results, 3)
+	assert.Equal(t, AdjustmentResultApplied, results[0].Status)
+	for _, result := range results[1:] {
+		assert.Equal(t, AdjustmentResultFailed, result.Status)
+		assert.Equal(t, context.Canceled.Error(), result.Reason)
+	}
+	assert.Equal(t, "c", results[2].Filename)
+
+	filenames, err := fs.ListAll()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"a"}, filenames)
+}
+
+func TestAdjustmentCommandApplier_DigestMismatch(t *testing.T) {
+	blockSize := 4
+	clientFiles := []VirtualFile{
+		makeClientFile("a", false, "abcd1234"),
+	}
+	generatorResult, file := makeServerFileAndGetContent(
+		blockSize, "a", false, "abcd",
+	)
+	serverHashedFiles := []HashedFile{file}
+	commands := runComparator(blockSize, clientFiles, serverHashedFiles)
+
+	// stale cache: the hash is known, but the content is different
+	contentCache := NewBlockCache()
+	contentCache.AddContents(
+		generatorResult.strongHashes,
+		[]Block{NewContentBlock(0, 4, []byte("wxyz"))},
+	)
+	reconstructor := NewContentReconstructor(md5.New(), contentCache)
+
+	fs := NewLoggingFilesystem()
+	createFiles(fs, []File{{"a", false, "abcd"}})
+	applier := NewAdjustmentCommandApplier()
+	results := applier.Apply(commands, fs, reconstructor)
+	assert.Len(t, results, 1)
+	assert.Equal(t, AdjustmentResultNeedsFullResend, results[0].Status)
+
+	r, err := fs.OpenRead("a")
+	assert.Nil(t, err)
+	result, err := ioutil.ReadAll(r)
+	assert.Nil(t, err)
+	assert.Equal(t, "abcd", string(result))
+
+	filenames, err := fs.ListAll()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"a"}, filenames)
+}
+
+func TestAdjustmentCommandApplier_KeepsVersions(t *testing.T) {
+	blockSize := 4
+	clientFiles := []VirtualFile{
+		makeClientFile("a", false, "abcd1234"),
+	}
+	generatorResult, file := makeServerFileAndGetContent(
+		blockSize, "a", false, "abcd",
+	)
+	serverHashedFiles := []HashedFile{
+		file,
+		makeServerFile(blockSize, "dir", true, ""),
+		makeServerFile(blockSize, "dir/b", false, "efgh"),
+	}
+	commands := runComparator(blockSize, clientFiles, serverHashedFiles)
+
+	contentCache := NewBlockCache()
+	contentCache.AddContents(generatorResult.strongHashes, generatorResult.contentBlocks)
+	reconstructor := NewContentReconstructor(md5.New(), contentCache)
+
+	fs := NewLoggingFilesystem()
+	createFiles(fs, []File{
+		{"a", false, "abcd"},
+		{"dir", true, ""},
+		{"dir/b", false, "efgh"},
+	})
+	versions := NewFileVersions(fs, VersionRetention{})
+	applier := NewAdjustmentCommandApplier()
+	applier.SetFileVersions(versions)
+	results := applier.Apply(commands, fs, reconstructor)
+	assertAllApplied(t, results)
+	assert.Len(t, results, 3)
+
+	assert.Equal(t, []string{"a"}, listSyncedFiles(t, fs))
+	assertFileContent(t, fs, "a", "abcd1234")
+	listed, err := versions.List("")
+	assert.Nil(t, err)
+	assert.Len(t, listed, 2)
+	assertFileContent(t, fs, versionFilename("a", listed[0].Version), "abcd")
+	assertFileContent(t, fs, versionFilename("dir/b", listed[1].Version), "efgh")
+}
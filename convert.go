@@ -1,6 +1,8 @@
 package carrybasket
 
 import (
+	"time"
+
 	pb "github.com/balta2ar/carrybasket/rpc"
 )
 
@@ -13,6 +15,7 @@ func adjustmentCommandAsProtoAdjustmentCommand(abstractCommand AdjustmentCommand
 			Type:     pb.ProtoAdjustmentCommandType_APPLY_BLOCKS_TO_FILE,
 			Filename: command.filename,
 			Blocks:   []*pb.ProtoBlock{},
+			Digest:   command.digest,
 		}
 
 		for _, abstractBlock := range command.blocks {
@@ -67,6 +70,7 @@ func protoHashedFileAsHashedFile(protoHashedFile *pb.ProtoHashedFile) HashedFile
 		IsDir:        protoHashedFile.IsDir,
 		FastHashes:   []Block{},
 		StrongHashes: []Block{},
+		Digest:       protoHashedFile.Digest,
 	}
 	for _, fastHashedBlock := range protoHashedFile.FastHashes {
 		hashedFile.FastHashes = append(
@@ -113,6 +117,7 @@ func protoAdjustmentCommandAsAdjustmentCommand(protoCommand *pb.ProtoAdjustmentC
 		command = AdjustmentCommandApplyBlocksToFile{
 			protoCommand.Filename,
 			blocks,
+			protoCommand.Digest,
 		}
 	}
 	return command
@@ -144,6 +149,7 @@ func (hf *HashedFile) asProtoHashedFile() pb.ProtoHashedFile {
 		IsDir:        hf.IsDir,
 		FastHashes:   []*pb.ProtoBlock{},
 		StrongHashes: []*pb.ProtoBlock{},
+		Digest:       hf.Digest,
 	}
 
 	for _, abstractBlock := range hf.FastHashes {
@@ -172,3 +178,143 @@ func (hf *HashedFile) asProtoHashedFile() pb.ProtoHashedFile {
 	}
 	return protoHashedFile
 }
+
+func adjustmentResultsAsProtoAdjustmentResults(results []AdjustmentResult) *pb.ProtoAdjustmentResults {
+	protoResults := &pb.ProtoAdjustmentResults{
+		Results: make([]*pb.ProtoAdjustmentResult, 0, len(results)),
+	}
+
+	for _, result := range results {
+		var status pb.ProtoAdjustmentResultStatus
+		switch result.Status {
+		case AdjustmentResultApplied:
+			status = pb.ProtoAdjustmentResultStatus_APPLIED
+		case AdjustmentResultFailed:
+			status = pb.ProtoAdjustmentResultStatus_FAILED
+		case AdjustmentResultNeedsFullResend:
+			status = pb.ProtoAdjustmentResultStatus_NEEDS_FULL_RESEND
+		}
+
+		protoResults.Results = append(
+			protoResults.Results,
+			&pb.ProtoAdjustmentResult{
+				Status:   status,
+				Filename: result.Filename,
+				Reason:   result.Reason,
+			},
+		)
+	}
+
+	return protoResults
+}
+
+func protoAdjustmentResultsAsAdjustmentResults(protoResults *pb.ProtoAdjustmentResults) []AdjustmentResult {
+	results := make([]AdjustmentResult, 0, len(protoResults.Results))
+
+	for _, protoResult := range protoResults.Results {
+		var status AdjustmentResultStatus
+		switch protoResult.Status {
+		case pb.ProtoAdjustmentResultStatus_APPLIED:
+			status = AdjustmentResultApplied
+		case pb.ProtoAdjustmentResultStatus_FAILED:
+			status = AdjustmentResultFailed
+		case pb.ProtoAdjustmentResultStatus_NEEDS_FULL_RESEND:
+			status = AdjustmentResultNeedsFullResend
+		}
+
+		results = append(results, AdjustmentResult{
+			Filename: protoResult.Filename,
+			Status:   status,
+			Reason:   protoResult.Reason,
+		})
+	}
+
+	return results
+}
+
+func syncStateAsProtoSyncState(client string, state SyncState) *pb.ProtoSyncState {
+	protoState := &pb.ProtoSyncState{
+		Client:  client,
+		Entries: make([]*pb.ProtoSyncStateEntry, 0, len(state)),
+	}
+
+	for _, filename := range state.Filenames() {
+		protoState.Entries = append(
+			protoState.Entries,
+			&pb.ProtoSyncStateEntry{
+				Filename: filename,
+				Digest:   state[filename],
+			},
+		)
+	}
+
+	return protoState
+}
+
+func protoSyncStateAsSyncState(protoState *pb.ProtoSyncState) SyncState {
+	state := make(SyncState, len(protoState.Entries))
+	for _, entry := range protoState.Entries {
+		state[entry.Filename] = entry.Digest
+	}
+	return state
+}
+
+func fileVersionsAsProtoFileVersions(versions []FileVersion) *pb.ProtoFileVersions {
+	protoVersions := &pb.ProtoFileVersions{
+		Versions: make([]*pb.ProtoFileVersion, 0, len(versions)),
+	}
+
+	for _, version := range versions {
+		protoVersions.Versions = append(
+			protoVersions.Versions,
+			&pb.ProtoFileVersion{
+				Filename: version.Filename,
+				Version:  version.Version,
+				Time:     version.Time.UnixNano(),
+			},
+		)
+	}
+
+	return protoVersions
+}
+
+func protoFileVersionsAsFileVersions(protoVersions *pb.ProtoFileVersions) []FileVersion {
+	versions := make([]FileVersion, 0, len(protoVersions.Versions))
+	for _, protoVersion := range protoVersions.Versions {
+		versions = append(versions, FileVersion{
+			Filename: protoVersion.Filename,
+			Version:  protoVersion.Version,
+			Time:     time.Unix(0, protoVersion.Time).UTC(),
+		})
+	}
+	return versions
+}
+
+func snapshotsAsProtoSnapshots(snapshots []Snapshot) *pb.ProtoSnapshots {
+	protoSnapshots := &pb.ProtoSnapshots{
+		Snapshots: make([]*pb.ProtoSnapshot, 0, len(snapshots)),
+	}
+
+	for _, snapshot := range snapshots {
+		protoSnapshots.Snapshots = append(
+			protoSnapshots.Snapshots,
+			&pb.ProtoSnapshot{
+				Id:   snapshot.Id,
+				Time: snapshot.Time.UnixNano(),
+			},
+		)
+	}
+
+	return protoSnapshots
+}
+
+func protoSnapshotsAsSnapshots(protoSnapshots *pb.ProtoSnapshots) []Snapshot {
+	snapshots := make([]Snapshot, 0, len(protoSnapshots.Snapshots))
+	for _, protoSnapshot := range protoSnapshots.Snapshots {
+		snapshots = append(snapshots, Snapshot{
+			Id:   protoSnapshot.Id,
+			Time: time.Unix(0, protoSnapshot.Time).UTC(),
+		})
+	}
+	return snapshots
+}
@@ -1,28 +1,75 @@
 package carrybasket
 
 import (
-	"fmt"
+	"context"
+	"github.com/pkg/errors"
 	"github.com/radovskyb/watcher"
-	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type ChangeEvent struct {
 }
 
-type actualFileEventWatcher struct {
+/// Watches the files under a dir and reports their changes.
+type FileEventWatcher interface {
+	/// Send an event to eventSink on every change until Close, blocks
+	/// until then. Polling watchers check for changes every pollInterval.
+	Watch(eventSink chan<- ChangeEvent, pollInterval time.Duration)
+	/// Wait until Watch has started watching.
+	Wait()
+	/// Stop watching, Watch returns.
+	Close()
+}
+
+/// Names of the file watchers, see NewFileEventWatcherFor.
+const (
+	FileWatcherAuto    = "auto"    /// native on Linux, polling elsewhere
+	FileWatcherNative  = "native"  /// falls back to polling when it fails
+	FileWatcherPolling = "polling" /// scans the whole tree every time
+)
+
+/// Create a watcher of the files under rootDir, the best one for the
+/// platform, see FileWatcherAuto. Nil logger logs info messages to
+/// stderr.
+func NewActualFileEventWatcher(rootDir string, logger Logger) FileEventWatcher {
+	return newDefaultFileEventWatcher(rootDir, defaultLogger(logger))
+}
+
+/// Create the named watcher of the files under rootDir.
+func NewFileEventWatcherFor(kind string, rootDir string, logger Logger) (FileEventWatcher, error) {
+	switch kind {
+	case FileWatcherAuto:
+		return NewActualFileEventWatcher(rootDir, logger), nil
+	case FileWatcherNative:
+		return NewFallbackFileEventWatcher(rootDir, logger), nil
+	case FileWatcherPolling:
+		return NewPollingFileEventWatcher(rootDir, logger), nil
+	}
+	return nil, errors.Errorf("unknown file watcher: %q", kind)
+}
+
+type pollingFileEventWatcher struct {
 	rootDir string
 	watcher *watcher.Watcher
+	logger  Logger
 }
 
-func NewActualFileEventWatcher(rootDir string) *actualFileEventWatcher {
-	return &actualFileEventWatcher{
+/// Create a watcher that scans the files under rootDir for changes. It
+/// works everywhere, but a large tree takes its toll on CPU. Nil logger
+/// logs info messages to stderr.
+func NewPollingFileEventWatcher(rootDir string, logger Logger) *pollingFileEventWatcher {
+	return &pollingFileEventWatcher{
 		rootDir: rootDir,
 		watcher: watcher.New(),
+		logger:  defaultLogger(logger),
 	}
 }
 
-func (ew *actualFileEventWatcher) Watch(
+func (ew *pollingFileEventWatcher) Watch(
 	eventSink chan<- ChangeEvent,
 	duration time.Duration,
 ) {
@@ -38,28 +85,46 @@ func (ew *actualFileEventWatcher) Watch(
 		for {
 			select {
 			case event := <-ew.watcher.Event:
-				log.Printf("event: %v\n", event)
+				ew.logger.Debug(
+					"watcher event",
+					Field("filename", event.Path), Field("op", event.Op),
+				)
 				eventSink <- struct{}{}
-				log.Println("event has been sent")
 			case err := <-ew.watcher.Error:
-				log.Printf("error: %v\n", err)
+				ew.logger.Error("watcher error", Field("error", err))
 			case <-ew.watcher.Closed:
-				log.Printf("closed")
+				ew.logger.Info("watcher closed")
 				return
 			}
 		}
 	}()
 
+	// sync state is written there during sync cycles, watching it
+	// would trigger another cycle right after every cycle
+	if err := ew.watcher.Ignore(filepath.Join(ew.rootDir, MetadataDir)); err != nil {
+		ew.fatal("error ignoring metadata dir", err)
+	}
+
 	if err := ew.watcher.AddRecursive(ew.rootDir); err != nil {
-		log.Fatalf("error adding watch dir: %v\n", err)
+		ew.fatal("error adding watch dir", err)
 	}
 
 	if err := ew.watcher.Start(duration); err != nil {
-		log.Fatalf("error starting watcher: %v\n", err)
+		ew.fatal("error starting watcher", err)
 	}
 }
 
-func (ew *actualFileEventWatcher) Wait() {
+// Watcher can not work without the watched dir, give up like log.Fatal.
+func (ew *pollingFileEventWatcher) fatal(msg string, err error) {
+	ew.logger.Error(msg, Field("error", err), Field("dir", ew.rootDir))
+	os.Exit(1)
+}
+
+func (ew *pollingFileEventWatcher) Close() {
+	ew.watcher.Close()
+}
+
+func (ew *pollingFileEventWatcher) Wait() {
 	ew.watcher.Wait()
 }
 
@@ -67,30 +132,288 @@ type WatcherSyncServiceClient interface {
 	Watch(eventSource <-chan ChangeEvent)
 }
 
+/// Implemented by clients that can connect to the server again, see
+/// changeHandler.
+type Redialer interface {
+	Redial() error
+}
+
+/// Delays of the sync cycle after a change, so that a burst of changes,
+/// e.g. a checkout of another branch, is synced by a single cycle. The
+/// cycle runs once there have been no changes for Quiet, but at most
+/// MaxDelay after the first change of the burst. Zero Quiet runs the
+/// cycle right away, zero MaxDelay means no limit.
+type Debounce struct {
+	Quiet    time.Duration
+	MaxDelay time.Duration
+}
+
 type changeHandler struct {
 	syncClient SyncServiceClient
+	metrics    *Metrics      /// see SetMetrics
+	backoff    Backoff       /// see SetBackoff
+	timeout    time.Duration /// see SetCycleTimeout
+	debounce   Debounce      /// see SetDebounce
+	changed    chan struct{} /// one slot, holds changes waiting for a cycle
+	changes    int64         /// events since the last cycle, atomic
+	rescan     time.Duration /// see SetRescanInterval
+	rescanNow  chan struct{} /// one slot, see Rescan
+	logger     Logger
+	stop       chan struct{} /// closed by Stop
+	stopOnce   sync.Once
+	stopped    chan struct{}      /// closed when Watch has returned
+	ctx        context.Context    /// of every cycle, see Stop
+	cancel     context.CancelFunc /// cancels the running cycle
 }
 
-func NewChangeHandler(syncClient SyncServiceClient) *changeHandler {
+/// Create a handler that runs a sync cycle on every change. Nil logger
+/// logs info messages to stderr.
+func NewChangeHandler(syncClient SyncServiceClient, logger Logger) *changeHandler {
+	ctx, cancel := context.WithCancel(context.Background())
 	return &changeHandler{
 		syncClient: syncClient,
+		backoff:    DefaultBackoff,
+		logger:     defaultLogger(logger),
+		stop:       make(chan struct{}),
+		stopped:    make(chan struct{}),
+		changed:    make(chan struct{}, 1),
+		rescanNow:  make(chan struct{}, 1),
+		ctx:        ctx,
+		cancel:     cancel,
+	}
+}
+
+/// Record metrics of the handled events.
+func (c *changeHandler) SetMetrics(metrics *Metrics) {
+	c.metrics = metrics
+}
+
+/// Set delays between retries of failed cycles. Delays shorter than
+/// MinBackoffDelay are raised to it, see Backoff.Delay.
+func (c *changeHandler) SetBackoff(backoff Backoff) {
+	c.backoff = backoff
+}
+
+/// Give up a cycle that takes longer than timeout, e.g. when the server
+/// hangs, and retry it like any other failed cycle. Zero means no limit,
+/// which is the default.
+func (c *changeHandler) SetCycleTimeout(timeout time.Duration) {
+	c.timeout = timeout
+}
+
+/// Wait for a burst of events to settle before running a cycle. By
+/// default the cycle runs right away.
+func (c *changeHandler) SetDebounce(debounce Debounce) {
+	c.debounce = debounce
+}
+
+/// Run a full rescan every interval, as a safety net for changes that
+/// the watcher has missed. A rescan is a cycle that runs without an
+/// event, every cycle compares all files anyway. Its results are logged
+/// and recorded in metrics apart from other cycles. Zero means no
+/// rescans, which is the default.
+func (c *changeHandler) SetRescanInterval(interval time.Duration) {
+	c.rescan = interval
+}
+
+/// Run a full rescan as soon as possible, e.g. on start after a crash,
+/// when changes made while the client was down have not been seen.
+func (c *changeHandler) Rescan() {
+	select {
+	case c.rescanNow <- struct{}{}:
+	default:
 	}
 }
 
+/// Run a sync cycle on changes. Events are always received at once, so
+/// that the watcher never blocks. Events that come while a cycle runs
+/// are merged into at most one follow-up cycle, see also SetDebounce.
+/// A failed cycle, e.g. when the server is down, is retried with backoff,
+/// redialing the server when the client is a Redialer. Events that come
+/// while waiting for a retry are covered by it. syncCycleDone receives
+/// every successful cycle.
 func (c *changeHandler) Watch(
 	eventSource <-chan ChangeEvent,
 	syncCycleDone chan<- struct{},
 ) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		wg.Wait()
+		close(c.stopped)
+	}()
+
 	go func() {
+		defer wg.Done()
+		c.collect(eventSource)
+	}()
+
+	go func() {
+		defer wg.Done()
+		retries := 0
+		var retry <-chan time.Time // pending changes wait for it
+		var rescanTick <-chan time.Time
+		if c.rescan > 0 {
+			ticker := time.NewTicker(c.rescan)
+			defer ticker.Stop()
+			rescanTick = ticker.C
+		}
+		rescan := false // until a rescan cycle succeeds
 		for {
+			// events may be ready as well, stop takes precedence
 			select {
-			case <-eventSource:
-				if err := c.syncClient.SyncCycle(); err != nil {
-					close(syncCycleDone)
-					panic(fmt.Sprintf("watcher: sync cycle error: %v\n", err))
+			case <-c.stop:
+				return
+			default:
+			}
+
+			select {
+			case <-c.stop:
+				return
+			case <-c.changed:
+				if retry != nil {
+					continue
+				}
+			case <-rescanTick:
+				rescan = true
+				if retry != nil {
+					continue
 				}
-				syncCycleDone <- struct{}{}
+			case <-c.rescanNow:
+				rescan = true
+				if retry != nil {
+					continue
+				}
+			case <-retry:
+				retry = nil
+				if redialer, ok := c.syncClient.(Redialer); ok {
+					if err := redialer.Redial(); err != nil {
+						retry = c.scheduleRetry(retries, err)
+						retries++
+						continue
+					}
+				}
+			}
+
+			// the cycle covers changes marked so far
+			select {
+			case <-c.changed:
+			default:
+			}
+			events := atomic.SwapInt64(&c.changes, 0)
+			if rescan {
+				c.logger.Info("rescan: comparing all files", Field("events", events))
+			} else {
+				c.logger.Debug("syncing changes", Field("events", events))
+			}
+			stats, err := c.syncCycle()
+			if rescan {
+				c.reportRescan(stats, err)
+			}
+			if err != nil {
+				retry = c.scheduleRetry(retries, err)
+				retries++
+				continue
+			}
+			rescan = false
+			if retries > 0 {
+				c.logger.Info("caught up after failed cycles", Field("retries", retries))
+				retries = 0
+			}
+			select {
+			case syncCycleDone <- struct{}{}:
+			case <-c.stop:
+				return
 			}
 		}
 	}()
 }
+
+// Receive events until stopped and mark changes for the cycle once they
+// have settled.
+func (c *changeHandler) collect(eventSource <-chan ChangeEvent) {
+	var quiet, deadline <-chan time.Time // both are nil between bursts
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-eventSource:
+			c.metrics.watcherEvent()
+			atomic.AddInt64(&c.changes, 1)
+			if c.debounce.Quiet <= 0 {
+				c.markChanged()
+				continue
+			}
+			quiet = time.After(c.debounce.Quiet)
+			if deadline == nil && c.debounce.MaxDelay > 0 {
+				deadline = time.After(c.debounce.MaxDelay)
+			}
+		case <-quiet:
+			quiet, deadline = nil, nil
+			c.markChanged()
+		case <-deadline:
+			quiet, deadline = nil, nil
+			c.markChanged()
+		}
+	}
+}
+
+// Changes already waiting for a cycle cover the new ones.
+func (c *changeHandler) markChanged() {
+	select {
+	case c.changed <- struct{}{}:
+	default:
+	}
+}
+
+/// Stop running cycles of a watching handler. The running cycle is
+/// waited for, at most for timeout, and cancelled after that. Returns
+/// false when it has not finished in time.
+func (c *changeHandler) Stop(timeout time.Duration) bool {
+	c.stopOnce.Do(func() {
+		close(c.stop)
+	})
+	select {
+	case <-c.stopped:
+		c.cancel()
+		return true
+	case <-time.After(timeout):
+		c.cancel()
+		return false
+	}
+}
+
+func (c *changeHandler) syncCycle() (SyncStats, error) {
+	ctx := c.ctx
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+	return c.syncClient.SyncCycleContext(ctx)
+}
+
+// Files that a rescan has found out of date are the ones the watcher
+// has missed, unless they have been changed after the last event.
+func (c *changeHandler) reportRescan(stats SyncStats, err error) {
+	if err != nil {
+		c.metrics.rescanDone(0, err)
+		return
+	}
+	missed := stats.FilesAdded + stats.FilesUpdated + stats.FilesRemoved
+	c.metrics.rescanDone(missed, nil)
+	if missed > 0 {
+		c.logger.Warn("rescan: synced missed changes", stats.logFields()...)
+	} else {
+		c.logger.Info("rescan: nothing missed")
+	}
+}
+
+func (c *changeHandler) scheduleRetry(retries int, err error) <-chan time.Time {
+	delay := c.backoff.Delay(retries)
+	c.logger.Warn(
+		"sync cycle failed, changes are pending",
+		Field("error", err), Field("retry", retries+1), Field("retry_in", delay),
+	)
+	return time.After(delay)
+}
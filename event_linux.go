@@ -0,0 +1,7 @@
+package carrybasket
+
+// Polling would scan the whole tree every time, inotify is notified
+// of the changes instead.
+func newDefaultFileEventWatcher(rootDir string, logger Logger) FileEventWatcher {
+	return NewFallbackFileEventWatcher(rootDir, logger)
+}
@@ -0,0 +1,233 @@
+package carrybasket
+
+import (
+	"github.com/fsnotify/fsnotify"
+	"github.com/pkg/errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+/// Native watcher has hit a limit of the OS and may miss changes: the
+/// number of watches (fs.inotify.max_user_watches on Linux) or the size
+/// of the event queue. Polling works regardless, see
+/// NewFallbackFileEventWatcher.
+var ErrWatchLimit = errors.New("file watcher limit reached")
+
+type nativeFileEventWatcher struct {
+	rootDir   string
+	watcher   *fsnotify.Watcher
+	logger    Logger
+	started   chan struct{} /// closed once all dirs are watched
+	closed    chan struct{} /// closed by Close
+	closeOnce sync.Once
+}
+
+/// Create a watcher that is notified of changes under rootDir by the OS
+/// (inotify on Linux). Every dir takes a watch, new dirs are watched as
+/// they appear. Nil logger logs info messages to stderr.
+func NewNativeFileEventWatcher(rootDir string, logger Logger) (*nativeFileEventWatcher, error) {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot create native file watcher")
+	}
+	return &nativeFileEventWatcher{
+		rootDir: rootDir,
+		watcher: w,
+		logger:  defaultLogger(logger),
+		started: make(chan struct{}),
+		closed:  make(chan struct{}),
+	}, nil
+}
+
+/// Watch until Close. There is nothing to poll, pollInterval is not used.
+func (ew *nativeFileEventWatcher) Watch(eventSink chan<- ChangeEvent, pollInterval time.Duration) {
+	started := func() { close(ew.started) }
+	if err := ew.watch(eventSink, started); err != nil {
+		ew.logger.Error("watcher error", Field("error", err), Field("dir", ew.rootDir))
+		os.Exit(1)
+	}
+}
+
+// Watch until Close, which returns nil, or until a failure, e.g.
+// ErrWatchLimit. started is called once all dirs are watched.
+func (ew *nativeFileEventWatcher) watch(eventSink chan<- ChangeEvent, started func()) error {
+	if err := ew.addRecursive(ew.rootDir); err != nil {
+		return err
+	}
+	started()
+
+	for {
+		select {
+		case event, ok := <-ew.watcher.Events:
+			if !ok {
+				ew.logger.Info("watcher closed")
+				return nil
+			}
+			if ew.ignored(event) {
+				continue
+			}
+			ew.logger.Debug(
+				"watcher event",
+				Field("filename", event.Name), Field("op", event.Op),
+			)
+			if event.Op&fsnotify.Create == fsnotify.Create {
+				// the new dir may already have files, they are synced
+				// anyway by the cycle of this event
+				if err := ew.addRecursive(event.Name); err != nil {
+					return err
+				}
+			}
+			select {
+			case eventSink <- struct{}{}:
+			case <-ew.closed:
+				return nil
+			}
+		case err, ok := <-ew.watcher.Errors:
+			if !ok {
+				return nil
+			}
+			if err == fsnotify.ErrEventOverflow {
+				return errors.Wrap(ErrWatchLimit, err.Error())
+			}
+			ew.logger.Error("watcher error", Field("error", err))
+		}
+	}
+}
+
+// Sync state is written to the metadata dir during sync cycles, watching
+// it would trigger another cycle right after every cycle. Changes of
+// permissions are not synced.
+func (ew *nativeFileEventWatcher) ignored(event fsnotify.Event) bool {
+	if event.Op == fsnotify.Chmod {
+		return true
+	}
+	rel, err := filepath.Rel(ew.rootDir, event.Name)
+	if err != nil {
+		return false
+	}
+	return rel == MetadataDir || strings.HasPrefix(rel, MetadataDir+string(filepath.Separator))
+}
+
+// Watch dir and all dirs inside it, except for the metadata dir. Files
+// and dirs that are gone in the meantime are skipped.
+func (ew *nativeFileEventWatcher) addRecursive(dir string) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.IsDir() {
+			return nil
+		}
+		if path == filepath.Join(ew.rootDir, MetadataDir) {
+			return filepath.SkipDir
+		}
+		if err := ew.watcher.Add(path); err != nil {
+			if err == syscall.ENOSPC {
+				return errors.Wrap(ErrWatchLimit, "see fs.inotify.max_user_watches")
+			}
+			ew.logger.Warn("cannot watch dir", Field("dir", path), Field("error", err))
+		}
+		return nil
+	})
+}
+
+func (ew *nativeFileEventWatcher) Close() {
+	ew.closeOnce.Do(func() {
+		close(ew.closed)
+		ew.watcher.Close()
+	})
+}
+
+func (ew *nativeFileEventWatcher) Wait() {
+	<-ew.started
+}
+
+// Watcher that Watch of the fallback watcher starts with.
+type primaryFileEventWatcher interface {
+	watch(eventSink chan<- ChangeEvent, started func()) error
+	Close()
+}
+
+type fallbackFileEventWatcher struct {
+	rootDir     string
+	logger      Logger
+	newPrimary  func() (primaryFileEventWatcher, error)
+	lock        sync.Mutex
+	current     interface{ Close() } /// nil until Watch starts one
+	closed      bool
+	started     chan struct{} /// closed when either watcher has started
+	startedOnce sync.Once
+}
+
+/// Create a native watcher of the files under rootDir that switches to
+/// polling when the native one can not be created or fails, e.g. with
+/// ErrWatchLimit. Nil logger logs info messages to stderr.
+func NewFallbackFileEventWatcher(rootDir string, logger Logger) *fallbackFileEventWatcher {
+	logger = defaultLogger(logger)
+	return &fallbackFileEventWatcher{
+		rootDir: rootDir,
+		logger:  logger,
+		newPrimary: func() (primaryFileEventWatcher, error) {
+			return NewNativeFileEventWatcher(rootDir, logger)
+		},
+		started: make(chan struct{}),
+	}
+}
+
+func (ew *fallbackFileEventWatcher) Watch(eventSink chan<- ChangeEvent, pollInterval time.Duration) {
+	primary, err := ew.newPrimary()
+	if err == nil {
+		if !ew.use(primary) {
+			return
+		}
+		err = primary.watch(eventSink, ew.markStarted)
+		primary.Close()
+		if err == nil {
+			return
+		}
+	}
+
+	ew.logger.Warn("native file watcher failed, polling instead", Field("error", err))
+	polling := NewPollingFileEventWatcher(ew.rootDir, ew.logger)
+	if !ew.use(polling) {
+		return
+	}
+	go func() {
+		polling.Wait()
+		ew.markStarted()
+	}()
+	// changes may have been missed while the primary was failing
+	eventSink <- struct{}{}
+	polling.Watch(eventSink, pollInterval)
+}
+
+// Switch to watcher w unless the fallback watcher has been closed.
+func (ew *fallbackFileEventWatcher) use(w interface{ Close() }) bool {
+	ew.lock.Lock()
+	defer ew.lock.Unlock()
+	if ew.closed {
+		return false
+	}
+	ew.current = w
+	return true
+}
+
+func (ew *fallbackFileEventWatcher) markStarted() {
+	ew.startedOnce.Do(func() {
+		close(ew.started)
+	})
+}
+
+func (ew *fallbackFileEventWatcher) Close() {
+	ew.lock.Lock()
+	defer ew.lock.Unlock()
+	ew.closed = true
+	if ew.current != nil {
+		ew.current.Close()
+	}
+}
+
+func (ew *fallbackFileEventWatcher) Wait() {
+	<-ew.started
+}
@@ -0,0 +1,93 @@
+package carrybasket
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func expectChangeEvent(t *testing.T, events <-chan ChangeEvent, expected bool, msg string) {
+	select {
+	case <-events:
+		assert.True(t, expected, msg)
+	case <-time.After(300 * time.Millisecond):
+		assert.False(t, expected, msg)
+	}
+}
+
+// Drop events that come in bursts, e.g. create and write of a file.
+func drainChangeEvents(events <-chan ChangeEvent) {
+	for {
+		select {
+		case <-events:
+		case <-time.After(100 * time.Millisecond):
+			return
+		}
+	}
+}
+
+func TestNativeFileEventWatcher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "carrybasket-watcher")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	assert.Nil(t, os.MkdirAll(filepath.Join(dir, MetadataDir), os.ModeDir|0755))
+
+	watcher, err := NewNativeFileEventWatcher(dir, NewNopLogger())
+	assert.Nil(t, err)
+	events := make(chan ChangeEvent)
+	go watcher.Watch(events, time.Second)
+	watcher.Wait()
+	defer watcher.Close()
+
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "a"), []byte("a"), 0644))
+	expectChangeEvent(t, events, true, "new file")
+	drainChangeEvents(events)
+
+	// new dirs are watched too
+	assert.Nil(t, os.Mkdir(filepath.Join(dir, "b"), os.ModeDir|0755))
+	expectChangeEvent(t, events, true, "new dir")
+	drainChangeEvents(events)
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "b", "1"), []byte("1"), 0644))
+	expectChangeEvent(t, events, true, "new file in new dir")
+	drainChangeEvents(events)
+
+	statePath := filepath.Join(dir, MetadataDir, "state")
+	assert.Nil(t, ioutil.WriteFile(statePath, []byte("state"), 0644))
+	expectChangeEvent(t, events, false, "metadata file")
+}
+
+// Fails like a native watcher that has hit the watch limit.
+type limitedFileEventWatcher struct{}
+
+func (limitedFileEventWatcher) watch(eventSink chan<- ChangeEvent, started func()) error {
+	started()
+	return ErrWatchLimit
+}
+
+func (limitedFileEventWatcher) Close() {}
+
+func TestFallbackFileEventWatcher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "carrybasket-watcher")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	watcher := NewFallbackFileEventWatcher(dir, NewNopLogger())
+	watcher.newPrimary = func() (primaryFileEventWatcher, error) {
+		return limitedFileEventWatcher{}, nil
+	}
+	events := make(chan ChangeEvent)
+	go watcher.Watch(events, 10*time.Millisecond)
+	watcher.Wait()
+	defer watcher.Close()
+
+	// changes missed by the failed watcher are synced by a cycle
+	expectChangeEvent(t, events, true, "fallback")
+
+	// polling has taken over
+	time.Sleep(50 * time.Millisecond)
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "a"), []byte("a"), 0644))
+	expectChangeEvent(t, events, true, "new file")
+}
@@ -0,0 +1,9 @@
+// +build !linux
+
+package carrybasket
+
+// Native watchers of other platforms have not been tried enough, polling
+// works everywhere.
+func newDefaultFileEventWatcher(rootDir string, logger Logger) FileEventWatcher {
+	return NewPollingFileEventWatcher(rootDir, logger)
+}
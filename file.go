@@ -8,6 +8,7 @@ import (
 	"path/filepath"
 	"sort"
 	"strings"
+	"sync"
 )
 
 // Server-side representation of a file
@@ -16,6 +17,27 @@ type HashedFile struct {
 	IsDir        bool
 	FastHashes   []Block
 	StrongHashes []Block
+	Digest       []byte /// digest of the whole file, see NewFileDigest
+}
+
+/// Directory in the root of a synchronized tree where carrybasket keeps
+/// its own data (e.g. sync state). It is never listed and never synced.
+const MetadataDir = ".carrybasket"
+
+func isMetadataPath(filename string) bool {
+	return filename == MetadataDir ||
+		strings.HasPrefix(filename, MetadataDir+string(filepath.Separator))
+}
+
+// Filenames come from the clients, make sure they stay inside the tree.
+func validateFilename(filename string) error {
+	if filename == "" || filepath.IsAbs(filename) ||
+		filepath.Clean(filename) != filename ||
+		filename == ".." || strings.HasPrefix(filename, "../") ||
+		isMetadataPath(filename) {
+		return errors.Errorf("invalid filename: %q", filename)
+	}
+	return nil
 }
 
 /// Client-side representation of a file
@@ -36,9 +58,35 @@ type VirtualFilesystem interface {
 	ListAll() ([]string, error)
 }
 
+/// Suffix of temporary files that are written first and then moved in
+/// place of the actual ones, see RemoveTempFiles.
+const TempFileSuffix = ".carrybasket-tmp"
+
+func tempFileFor(filename string) string {
+	return filename + TempFileSuffix
+}
+
+/// Remove temporary files left behind by writes that have been
+/// interrupted, e.g. when the process was killed.
+func RemoveTempFiles(fs VirtualFilesystem) error {
+	filenames, err := fs.ListAll()
+	if err != nil {
+		return errors.Wrap(err, "cannot list filesystem")
+	}
+	for _, filename := range filenames {
+		if strings.HasSuffix(filename, TempFileSuffix) && !fs.IsDir(filename) {
+			if err := fs.Delete(filename); err != nil {
+				return errors.Wrapf(err, "cannot remove %v", filename)
+			}
+		}
+	}
+	return nil
+}
+
 type loggingFilesystem struct {
 	Actions []string                    /// actions recorded after calls to the filesystem
 	storage map[string]*strings.Builder /// internal storage for filenames and data
+	lock    sync.Mutex                  /// guards the two above
 }
 
 func NewLoggingFilesystem() *loggingFilesystem {
@@ -49,6 +97,8 @@ func NewLoggingFilesystem() *loggingFilesystem {
 }
 
 func (lf *loggingFilesystem) Move(sourceFilename string, destFilename string) error {
+	lf.lock.Lock()
+	defer lf.lock.Unlock()
 	lf.Actions = append(lf.Actions, fmt.Sprintf("move %v %v", sourceFilename, destFilename))
 	if _, ok := lf.storage[sourceFilename]; !ok {
 		return errors.New("source file does not exit")
@@ -63,6 +113,8 @@ func (lf *loggingFilesystem) Move(sourceFilename string, destFilename string) er
 }
 
 func (lf *loggingFilesystem) Delete(filename string) error {
+	lf.lock.Lock()
+	defer lf.lock.Unlock()
 	lf.Actions = append(lf.Actions, fmt.Sprintf("delete %v", filename))
 	if _, ok := lf.storage[filename]; ok {
 		delete(lf.storage, filename)
@@ -72,6 +124,8 @@ func (lf *loggingFilesystem) Delete(filename string) error {
 }
 
 func (lf *loggingFilesystem) OpenRead(filename string) (io.ReadCloser, error) {
+	lf.lock.Lock()
+	defer lf.lock.Unlock()
 	lf.Actions = append(lf.Actions, fmt.Sprintf("openread %v", filename))
 	r, ok := lf.storage[filename]
 	if !ok {
@@ -91,6 +145,8 @@ func (lf *loggingFilesystem) OpenRead(filename string) (io.ReadCloser, error) {
 }
 
 func (lf *loggingFilesystem) OpenWrite(filename string) (io.WriteCloser, error) {
+	lf.lock.Lock()
+	defer lf.lock.Unlock()
 	lf.Actions = append(lf.Actions, fmt.Sprintf("openwrite %v", filename))
 	rw, ok := lf.storage[filename]
 	if ok && (rw == nil) {
@@ -104,18 +160,24 @@ func (lf *loggingFilesystem) OpenWrite(filename string) (io.WriteCloser, error)
 }
 
 func (lf *loggingFilesystem) IsPath(filename string) bool {
+	lf.lock.Lock()
+	defer lf.lock.Unlock()
 	lf.Actions = append(lf.Actions, fmt.Sprintf("ispath %v", filename))
 	_, ok := lf.storage[filename]
 	return ok
 }
 
 func (lf *loggingFilesystem) IsDir(filename string) bool {
+	lf.lock.Lock()
+	defer lf.lock.Unlock()
 	lf.Actions = append(lf.Actions, fmt.Sprintf("isdir %v", filename))
 	rw, ok := lf.storage[filename]
 	return (rw == nil) && ok
 }
 
 func (lf *loggingFilesystem) Mkdir(filename string) error {
+	lf.lock.Lock()
+	defer lf.lock.Unlock()
 	lf.Actions = append(lf.Actions, fmt.Sprintf("mkdir %v", filename))
 	if _, ok := lf.storage[filename]; ok {
 		return errors.New("file already exists")
@@ -125,6 +187,8 @@ func (lf *loggingFilesystem) Mkdir(filename string) error {
 }
 
 func (lf *loggingFilesystem) ListAll() ([]string, error) {
+	lf.lock.Lock()
+	defer lf.lock.Unlock()
 	lf.Actions = append(lf.Actions, "listall")
 	filenames := make([]string, 0, len(lf.storage))
 
@@ -142,7 +206,7 @@ type actualFilesystem struct {
 
 func NewActualFilesystem(prefix string) *actualFilesystem {
 	return &actualFilesystem{
-		prefix: prefix,
+		prefix: filepath.Clean(prefix),
 	}
 }
 
@@ -151,8 +215,9 @@ func (lf *actualFilesystem) prefixed(filename string) string {
 }
 
 func (lf *actualFilesystem) unprefixed(filename string) string {
-	if strings.HasPrefix(filename, lf.prefix) {
-		return filename[len(lf.prefix)+1:]
+	// a plain prefix check would cut dotfiles when prefix is "."
+	if relative, err := filepath.Rel(lf.prefix, filename); err == nil {
+		return relative
 	}
 	return filename
 }
@@ -225,6 +290,9 @@ func ListClientFiles(fs VirtualFilesystem) ([]VirtualFile, error) {
 	clientFiles := make([]VirtualFile, 0, len(filenames))
 
 	for _, filename := range filenames {
+		if isMetadataPath(filename) {
+			continue
+		}
 		if fs.IsDir(filename) {
 			clientFiles = append(clientFiles, VirtualFile{
 				Filename: filename,
@@ -259,6 +327,9 @@ func ListServerFiles(
 	serverFiles := make([]HashedFile, 0, len(filenames))
 
 	for _, filename := range filenames {
+		if isMetadataPath(filename) {
+			continue
+		}
 		if fs.IsDir(filename) {
 			serverFiles = append(serverFiles, HashedFile{
 				Filename:     filename,
@@ -272,13 +343,15 @@ func ListServerFiles(
 				return nil, errors.Wrap(err, "cannot open file")
 			}
 			generator.Reset()
-			generatorResult := generator.Scan(r)
+			digest := NewFileDigest()
+			generatorResult := generator.Scan(io.TeeReader(r, digest))
 			r.Close()
 			serverFiles = append(serverFiles, HashedFile{
 				Filename:     filename,
 				IsDir:        false,
 				FastHashes:   generatorResult.fastHashes,
 				StrongHashes: generatorResult.strongHashes,
+				Digest:       digest.Sum(nil),
 			})
 			if contentCache != nil {
 				contentCache.AddContents(
@@ -290,3 +363,12 @@ func ListServerFiles(
 
 	return serverFiles, nil
 }
+
+/// Close readers of the listed client files, if any.
+func CloseClientFiles(clientFiles []VirtualFile) {
+	for _, clientFile := range clientFiles {
+		if clientFile.Rw != nil {
+			_ = clientFile.Rw.Close()
+		}
+	}
+}
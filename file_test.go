@@ -4,6 +4,8 @@ import (
 	"crypto/md5"
 	"github.com/stretchr/testify/assert"
 	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -172,6 +174,42 @@ func TestLoggingFilesystem_IsDirMkDir(t *testing.T) {
 	}, fs.Actions)
 }
 
+func TestActualFilesystem_ListAllDotfiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "carrybasket-list")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	assert.Nil(t, os.MkdirAll(filepath.Join(dir, MetadataDir), 0755))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, ".hidden"), []byte("a"), 0644))
+
+	filenames, err := NewActualFilesystem(dir).ListAll()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{".carrybasket", ".hidden"}, filenames)
+
+	cwd, err := os.Getwd()
+	assert.Nil(t, err)
+	defer os.Chdir(cwd)
+	assert.Nil(t, os.Chdir(dir))
+	filenames, err = NewActualFilesystem(".").ListAll()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{".carrybasket", ".hidden"}, filenames)
+}
+
+func TestRemoveTempFiles(t *testing.T) {
+	fs := NewLoggingFilesystem()
+	createFiles(fs, []File{
+		{"a", false, "a"},
+		{"a" + TempFileSuffix, false, "a"},
+		{"dir", true, ""},
+		{"dir/b.tmp", false, "b"},
+		{"dir/b" + TempFileSuffix, false, "b"},
+	})
+
+	assert.Nil(t, RemoveTempFiles(fs))
+	filenames, err := fs.ListAll()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"a", "dir", "dir/b.tmp"}, filenames)
+}
+
 func TestListClientFiles_Smoke(t *testing.T) {
 	fs := NewLoggingFilesystem()
 	files, err := ListClientFiles(fs)
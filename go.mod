@@ -3,12 +3,15 @@ module github.com/balta2ar/carrybasket
 go 1.12
 
 require (
-	github.com/fsnotify/fsnotify v1.4.7 // indirect
+	github.com/BurntSushi/toml v0.3.1
+	github.com/fsnotify/fsnotify v1.4.7
 	github.com/golang/protobuf v1.3.1
 	github.com/pkg/errors v0.8.1
+	github.com/prometheus/client_golang v0.9.2
 	github.com/radovskyb/watcher v1.0.6
 	github.com/stretchr/testify v1.3.0
 	github.com/urfave/cli v1.20.0
+	golang.org/x/crypto v0.0.0-20190308221718-c2843e01d9a2
 	golang.org/x/sys v0.0.0-20190410235845-0ad05ae3009d // indirect
 	google.golang.org/grpc v1.19.1
 )
@@ -0,0 +1,111 @@
+package carrybasket
+
+import (
+	"context"
+	"github.com/pkg/errors"
+
+	"google.golang.org/grpc/metadata"
+)
+
+/// Returned when a sync would remove more files than DeletionGuard allows.
+var ErrTooManyDeletions = errors.New("too many deletions, use --force to sync anyway")
+
+/// Name of the gRPC metadata key that tells server to skip the guard.
+const forceMetadataKey = "carrybasket-force"
+
+/// Protects a tree from being wiped out by accident, e.g. when client
+/// directory is an empty mount point of an unmounted volume. Zero value
+/// allows any number of deletions. Only regular files are counted,
+/// directories are not. A guard with any limit refuses to remove all
+/// files of the tree, however few there are.
+type DeletionGuard struct {
+	MaxFiles   int     /// most files a sync may remove, 0 means no limit
+	MaxPercent float64 /// largest share of the tree a sync may remove, 0 means no limit
+	MinFiles   int     /// MaxPercent applies only when at least this many files are removed
+}
+
+/// Check that removing this many files out of total files of the tree
+/// is allowed.
+func (g DeletionGuard) Check(removed int, total int) error {
+	if removed == 0 {
+		return nil
+	}
+
+	if g.MaxFiles > 0 && removed > g.MaxFiles {
+		return errors.Wrapf(
+			ErrTooManyDeletions,
+			"%d of %d files would be removed, limit is %d files",
+			removed, total, g.MaxFiles,
+		)
+	}
+	if (g.MaxFiles > 0 || g.MaxPercent > 0) && removed == total {
+		return errors.Wrapf(
+			ErrTooManyDeletions,
+			"all %d files would be removed",
+			total,
+		)
+	}
+	// removing a few files of a small tree is a large share of it
+	if g.MaxPercent > 0 && total > 0 && removed >= g.MinFiles &&
+		float64(removed)*100/float64(total) > g.MaxPercent {
+		return errors.Wrapf(
+			ErrTooManyDeletions,
+			"%d of %d files would be removed, limit is %v%%",
+			removed, total, g.MaxPercent,
+		)
+	}
+	return nil
+}
+
+// Count regular files the commands remove.
+func countRemovals(commands []AdjustmentCommand, isDir func(filename string) bool) int {
+	removed := 0
+	for _, command := range commands {
+		if command, ok := command.(AdjustmentCommandRemoveFile); ok && !isDir(command.filename) {
+			removed++
+		}
+	}
+	return removed
+}
+
+// Count regular files of the tree the same way ListClientFiles lists them.
+func countFiles(fs VirtualFilesystem) (int, error) {
+	filenames, err := fs.ListAll()
+	if err != nil {
+		return 0, errors.Wrap(err, "cannot list filesystem")
+	}
+	total := 0
+	for _, filename := range filenames {
+		if !isMetadataPath(filename) && !fs.IsDir(filename) {
+			total++
+		}
+	}
+	return total, nil
+}
+
+// Count regular files among the filenames of the state.
+func countStateFiles(state SyncState, filenames []string) int {
+	total := 0
+	for _, filename := range filenames {
+		if state[filename] != DirDigest {
+			total++
+		}
+	}
+	return total
+}
+
+// Tell the server that the client has been forced to skip the guard.
+func withForce(ctx context.Context, force bool) context.Context {
+	if !force {
+		return ctx
+	}
+	return metadata.AppendToOutgoingContext(ctx, forceMetadataKey, "true")
+}
+
+func forceFromContext(ctx context.Context) bool {
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		values := md.Get(forceMetadataKey)
+		return len(values) > 0 && values[0] == "true"
+	}
+	return false
+}
@@ -0,0 +1,62 @@
+package carrybasket
+
+import (
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestDeletionGuard_Check(t *testing.T) {
+	assert.Nil(t, DeletionGuard{}.Check(10, 10))
+	assert.Nil(t, DeletionGuard{MaxFiles: 1, MaxPercent: 1}.Check(0, 10))
+
+	guard := DeletionGuard{MaxFiles: 3}
+	assert.Nil(t, guard.Check(3, 4))
+	assert.Equal(t, ErrTooManyDeletions, errors.Cause(guard.Check(4, 100)))
+
+	guard = DeletionGuard{MaxPercent: 50}
+	assert.Nil(t, guard.Check(5, 10))
+	assert.Equal(t, ErrTooManyDeletions, errors.Cause(guard.Check(6, 10)))
+	assert.Nil(t, guard.Check(1, 0))
+
+	// small removals are allowed whatever share of the tree they are,
+	// unless they remove the whole tree
+	guard = DeletionGuard{MaxPercent: 50, MinFiles: 10}
+	assert.Nil(t, guard.Check(1, 2))
+	assert.Nil(t, guard.Check(8, 9))
+	assert.Equal(t, ErrTooManyDeletions, errors.Cause(guard.Check(1, 1)))
+	assert.Equal(t, ErrTooManyDeletions, errors.Cause(guard.Check(9, 9)))
+	assert.Equal(t, ErrTooManyDeletions, errors.Cause(guard.Check(10, 10)))
+	assert.Nil(t, guard.Check(10, 20))
+	assert.Equal(t, ErrTooManyDeletions, errors.Cause(DeletionGuard{MaxFiles: 5}.Check(3, 3)))
+}
+
+func TestDeletionGuard_CountRemovals(t *testing.T) {
+	commands := []AdjustmentCommand{
+		AdjustmentCommandRemoveFile{"a"},
+		AdjustmentCommandMkDir{"b"},
+		AdjustmentCommandRemoveFile{"c"},
+		AdjustmentCommandRemoveFile{"dir"},
+	}
+	isDir := func(filename string) bool { return filename == "dir" }
+	assert.Equal(t, 2, countRemovals(commands, isDir))
+	assert.Equal(t, 0, countRemovals(nil, isDir))
+}
+
+func TestDeletionGuard_CountFiles(t *testing.T) {
+	fs := NewLoggingFilesystem()
+	createFiles(fs, []File{
+		{"a", false, "a"},
+		{"dir", true, ""},
+		{"dir/b", false, "b"},
+		{MetadataDir, true, ""},
+		{ClientSyncStateFilename(), false, ""},
+	})
+	total, err := countFiles(fs)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, total)
+
+	state := SyncState{"a": "1", "dir": DirDigest, "dir/b": "2"}
+	assert.Equal(t, 2, countStateFiles(state, state.Filenames()))
+	assert.Equal(t, 0, countStateFiles(state, []string{"dir"}))
+}
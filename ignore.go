@@ -0,0 +1,127 @@
+package carrybasket
+
+import (
+	"github.com/pkg/errors"
+	"path/filepath"
+	"strings"
+)
+
+/// Files that are not synced, given by patterns similar to .gitignore:
+///
+///     *.tmp         file or dir with matching name at any depth
+///     build/        trailing slash matches directories only
+///     /cache        leading slash matches at the root of the tree only
+///     docs/*.pdf    pattern with a slash is matched against the whole path
+///
+/// Everything inside an ignored directory is ignored as well. Patterns
+/// use filepath.Match syntax.
+type IgnoreRules struct {
+	patterns []ignorePattern
+}
+
+type ignorePattern struct {
+	pattern  string
+	dirOnly  bool /// pattern ends with a slash
+	anchored bool /// pattern is matched against the path from the root
+}
+
+func NewIgnoreRules(patterns []string) (IgnoreRules, error) {
+	rules := IgnoreRules{}
+	for _, pattern := range patterns {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" || strings.HasPrefix(pattern, "#") {
+			continue
+		}
+
+		p := ignorePattern{}
+		if strings.HasSuffix(pattern, "/") {
+			p.dirOnly = true
+			pattern = strings.TrimRight(pattern, "/")
+		}
+		if strings.Contains(pattern, "/") {
+			p.anchored = true
+			pattern = strings.TrimLeft(pattern, "/")
+		}
+		if _, err := filepath.Match(pattern, ""); err != nil || pattern == "" {
+			return IgnoreRules{}, errors.Errorf("invalid ignore pattern: %q", pattern)
+		}
+		p.pattern = pattern
+		rules.patterns = append(rules.patterns, p)
+	}
+	return rules, nil
+}
+
+/// Tell whether the file or dir (relative to the root) is ignored.
+func (ir IgnoreRules) Match(filename string, isDir bool) bool {
+	if len(ir.patterns) == 0 {
+		return false
+	}
+	parts := strings.Split(filename, "/")
+	for _, p := range ir.patterns {
+		for i := range parts {
+			// parents of the file are directories
+			if p.dirOnly && i == len(parts)-1 && !isDir {
+				continue
+			}
+			subject := parts[i]
+			if p.anchored {
+				subject = strings.Join(parts[:i+1], "/")
+			}
+			if matched, _ := filepath.Match(p.pattern, subject); matched {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+/// Filesystem that does not list ignored files, so they are neither
+/// synced nor removed on the other side. Everything else is passed to
+/// the underlying filesystem as is.
+type ignoringFilesystem struct {
+	VirtualFilesystem
+	rules IgnoreRules
+}
+
+func NewIgnoringFilesystem(fs VirtualFilesystem, rules IgnoreRules) *ignoringFilesystem {
+	return &ignoringFilesystem{fs, rules}
+}
+
+func (ifs *ignoringFilesystem) ListAll() ([]string, error) {
+	filenames, err := ifs.VirtualFilesystem.ListAll()
+	if err != nil {
+		return nil, err
+	}
+	listed := make([]string, 0, len(filenames))
+	for _, filename := range filenames {
+		if !ifs.rules.Match(filename, ifs.IsDir(filename)) {
+			listed = append(listed, filename)
+		}
+	}
+	return listed, nil
+}
+
+// Tell whether the command changes an ignored file or dir.
+func ignoresAdjustmentCommand(rules IgnoreRules, abstractCommand AdjustmentCommand) bool {
+	switch command := abstractCommand.(type) {
+	case AdjustmentCommandRemoveFile:
+		return rules.Match(command.filename, false) || rules.Match(command.filename, true)
+	case AdjustmentCommandApplyBlocksToFile:
+		return rules.Match(command.filename, false)
+	case AdjustmentCommandMkDir:
+		return rules.Match(command.filename, true)
+	}
+	return false
+}
+
+// Drop the files that are ignored, the same way the ignoring filesystem
+// does not list them.
+func selectNotIgnoredHashedFiles(files []HashedFile, rules IgnoreRules) []HashedFile {
+	selected := make([]HashedFile, 0, len(files))
+	for _, file := range files {
+		if !rules.Match(file.Filename, file.IsDir) {
+			selected = append(selected, file)
+		}
+	}
+	return selected
+}
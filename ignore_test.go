@@ -0,0 +1,61 @@
+package carrybasket
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestIgnoreRules_Match(t *testing.T) {
+	rules, err := NewIgnoreRules([]string{"*.tmp", "build/", "/cache", "docs/*.pdf", "# comment", ""})
+	assert.Nil(t, err)
+
+	for _, ignored := range []struct {
+		filename string
+		isDir    bool
+	}{
+		{"a.tmp", false},
+		{"dir/a.tmp", false},
+		{"dir.tmp/a", false},
+		{"build", true},
+		{"build/a", false},
+		{"dir/build/a", false},
+		{"cache", false},
+		{"cache/a", false},
+		{"docs/a.pdf", false},
+	} {
+		assert.True(t, rules.Match(ignored.filename, ignored.isDir), ignored.filename)
+	}
+
+	for _, synced := range []struct {
+		filename string
+		isDir    bool
+	}{
+		{"a.txt", false},
+		{"build", false},
+		{"dir/cache", false},
+		{"dir/docs/a.pdf", false},
+		{"docs/dir/a.pdf", false},
+	} {
+		assert.False(t, rules.Match(synced.filename, synced.isDir), synced.filename)
+	}
+
+	assert.False(t, IgnoreRules{}.Match("a.tmp", false))
+	_, err = NewIgnoreRules([]string{"[a"})
+	assert.NotNil(t, err)
+}
+
+func TestIgnoringFilesystem_ListAll(t *testing.T) {
+	fs := NewLoggingFilesystem()
+	createFiles(fs, []File{
+		{"a", false, "a"},
+		{"b.tmp", false, "b"},
+		{"build", true, ""},
+		{"build/c", false, "c"},
+	})
+	rules, err := NewIgnoreRules([]string{"*.tmp", "build/"})
+	assert.Nil(t, err)
+
+	filenames, err := NewIgnoringFilesystem(fs, rules).ListAll()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"a"}, filenames)
+}
@@ -35,7 +35,8 @@ func assertGenerateProduceReconstruct(
 	contentCache.AddContents(generatorResult.strongHashes, generatorResult.contentBlocks)
 	reconstructor := NewContentReconstructor(strongHasher, contentCache)
 	serverOutputFile := bytes.NewBuffer(nil)
-	reconstructor.Reconstruct(producerResult, serverOutputFile)
+	_, err := reconstructor.Reconstruct(producerResult, serverOutputFile)
+	assert.Nil(t, err)
 
 	assert.Equal(t, clientContent, serverOutputFile.String())
 }
@@ -63,8 +64,8 @@ func assertSyncOffline(t *testing.T, blockSize int, clientFiles []File, serverFi
 
 	reconstructor := NewContentReconstructor(hashFactory.MakeStrongHash(), serverContentCache)
 	applier := NewAdjustmentCommandApplier()
-	err = applier.Apply(commands, serverFs, reconstructor)
-	assert.Nil(t, err)
+	results := applier.Apply(commands, serverFs, reconstructor)
+	assertAllApplied(t, results)
 
 	assertFilesystemsEqual(t, clientFs, serverFs)
 	return commands
@@ -133,7 +134,8 @@ func TestIntegration_Smoke(t *testing.T) {
 	contentCache.AddContents(generatorResult.strongHashes, generatorResult.contentBlocks)
 	reconstructor := NewContentReconstructor(strongHasher, contentCache)
 	serverOutputFile := bytes.NewBuffer(nil)
-	n := reconstructor.Reconstruct(producerResult, serverOutputFile)
+	n, err := reconstructor.Reconstruct(producerResult, serverOutputFile)
+	assert.Nil(t, err)
 	assert.Equal(t, uint64(0), n)
 	assert.Equal(t, clientContent, serverOutputFile.String())
 }
@@ -21,3 +21,20 @@ func (nopWriteCloser) Close() error { return nil }
 func NopWriteCloser(r io.Writer) io.WriteCloser {
 	return nopWriteCloser{r}
 }
+
+// Reader that fills the whole buffer on every read but the last one, the
+// way block scanners expect. Read errors other than EOF are kept in err.
+type fullReader struct {
+	r   io.Reader
+	err error
+}
+
+func (fr *fullReader) Read(p []byte) (int, error) {
+	n, err := io.ReadFull(fr.r, p)
+	if err == io.ErrUnexpectedEOF {
+		err = nil
+	} else if err != nil && err != io.EOF {
+		fr.err = err
+	}
+	return n, err
+}
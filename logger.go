@@ -0,0 +1,217 @@
+package carrybasket
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/// Severity of a log message. Messages below the level of the logger
+/// are dropped.
+type LogLevel int
+
+const (
+	LogDebug LogLevel = iota /// every file and block, very verbose
+	LogInfo                  /// cycles, phases and their results
+	LogWarn                  /// failures that are retried or worked around
+	LogError                 /// failures that stop a cycle or a call
+)
+
+var logLevelNames = []string{"debug", "info", "warn", "error"}
+
+func (l LogLevel) String() string {
+	if l < LogDebug || l > LogError {
+		return fmt.Sprintf("level(%d)", int(l))
+	}
+	return logLevelNames[l]
+}
+
+/// Parse level name: debug, info, warn or error.
+func ParseLogLevel(name string) (LogLevel, error) {
+	for level, levelName := range logLevelNames {
+		if strings.ToLower(name) == levelName {
+			return LogLevel(level), nil
+		}
+	}
+	return LogInfo, errors.Errorf("unknown log level: %q", name)
+}
+
+/// Named value attached to a log message, e.g. filename or byte count.
+type LogField struct {
+	Key   string
+	Value interface{}
+}
+
+func Field(key string, value interface{}) LogField {
+	return LogField{key, value}
+}
+
+/// Leveled logger with fields. Loggers made by With add their fields
+/// to every message and write to the same output.
+type Logger interface {
+	Debug(msg string, fields ...LogField)
+	Info(msg string, fields ...LogField)
+	Warn(msg string, fields ...LogField)
+	Error(msg string, fields ...LogField)
+	With(fields ...LogField) Logger
+}
+
+/// Writes one line per message, either as text:
+///
+///     2019-04-12T10:00:00.000Z INFO sync cycle done cycle=3 files_added=2
+///
+/// or as a JSON object:
+///
+///     {"time":"2019-04-12T10:00:00.000Z","level":"info","msg":"sync cycle done","cycle":3,"files_added":2}
+///
+type logger struct {
+	lock   *sync.Mutex /// shared with the loggers made by With
+	out    io.Writer
+	level  LogLevel
+	json   bool
+	fields []LogField
+	now    func() time.Time
+}
+
+const logTimeFormat = "2006-01-02T15:04:05.000Z07:00"
+
+func NewLogger(out io.Writer, level LogLevel, json bool) *logger {
+	return &logger{
+		lock:  &sync.Mutex{},
+		out:   out,
+		level: level,
+		json:  json,
+		now:   time.Now,
+	}
+}
+
+/// Logger that drops all messages.
+func NewNopLogger() *logger {
+	return NewLogger(ioutil.Discard, LogError+1, false)
+}
+
+// Logger used when none is given to a constructor.
+func defaultLogger(l Logger) Logger {
+	if l == nil {
+		return NewLogger(os.Stderr, LogInfo, false)
+	}
+	return l
+}
+
+func (l *logger) Debug(msg string, fields ...LogField) { l.log(LogDebug, msg, fields) }
+func (l *logger) Info(msg string, fields ...LogField)  { l.log(LogInfo, msg, fields) }
+func (l *logger) Warn(msg string, fields ...LogField)  { l.log(LogWarn, msg, fields) }
+func (l *logger) Error(msg string, fields ...LogField) { l.log(LogError, msg, fields) }
+
+func (l *logger) With(fields ...LogField) Logger {
+	child := *l
+	child.fields = append(append([]LogField{}, l.fields...), fields...)
+	return &child
+}
+
+func (l *logger) log(level LogLevel, msg string, fields []LogField) {
+	if level < l.level {
+		return
+	}
+	t := l.now().UTC().Format(logTimeFormat)
+	all := append(append([]LogField{}, l.fields...), fields...)
+
+	var line bytes.Buffer
+	if l.json {
+		writeJSONLogLine(&line, t, level, msg, all)
+	} else {
+		writeTextLogLine(&line, t, level, msg, all)
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	_, _ = l.out.Write(line.Bytes())
+}
+
+func writeTextLogLine(line *bytes.Buffer, t string, level LogLevel, msg string, fields []LogField) {
+	fmt.Fprintf(line, "%v %v %v", t, strings.ToUpper(level.String()), msg)
+	for _, field := range fields {
+		value := fmt.Sprint(logValue(field.Value))
+		if value == "" || strings.ContainsAny(value, " =\"\n") {
+			value = strconv.Quote(value)
+		}
+		fmt.Fprintf(line, " %v=%v", field.Key, value)
+	}
+	line.WriteByte('\n')
+}
+
+func writeJSONLogLine(line *bytes.Buffer, t string, level LogLevel, msg string, fields []LogField) {
+	line.WriteString(`{"time":`)
+	writeJSONValue(line, t)
+	line.WriteString(`,"level":`)
+	writeJSONValue(line, level.String())
+	line.WriteString(`,"msg":`)
+	writeJSONValue(line, msg)
+	for _, field := range fields {
+		line.WriteByte(',')
+		writeJSONValue(line, field.Key)
+		line.WriteByte(':')
+		writeJSONValue(line, logValue(field.Value))
+	}
+	line.WriteString("}\n")
+}
+
+func writeJSONValue(line *bytes.Buffer, value interface{}) {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		encoded, _ = json.Marshal(fmt.Sprint(value))
+	}
+	line.Write(encoded)
+}
+
+// Errors and durations are logged the way they are printed.
+func logValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case error:
+		return v.Error()
+	case time.Duration:
+		return v.String()
+	case fmt.Stringer:
+		return v.String()
+	}
+	return value
+}
+
+/// Writer that logs every line written to it at the given level, e.g. to
+/// send messages of the standard log package to the logger:
+///
+///     log.SetFlags(0)
+///     log.SetOutput(NewLogWriter(logger, LogError))
+///
+func NewLogWriter(logger Logger, level LogLevel) io.Writer {
+	return &logWriter{logger, level}
+}
+
+type logWriter struct {
+	logger Logger
+	level  LogLevel
+}
+
+func (lw *logWriter) Write(p []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		switch lw.level {
+		case LogDebug:
+			lw.logger.Debug(line)
+		case LogInfo:
+			lw.logger.Info(line)
+		case LogWarn:
+			lw.logger.Warn(line)
+		default:
+			lw.logger.Error(line)
+		}
+	}
+	return len(p), nil
+}
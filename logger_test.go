@@ -0,0 +1,86 @@
+package carrybasket
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"log"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestLogger(out *bytes.Buffer, level LogLevel, json bool) *logger {
+	logger := NewLogger(out, level, json)
+	logger.now = func() time.Time { return time.Date(2019, 4, 12, 10, 0, 0, 0, time.UTC) }
+	return logger
+}
+
+func TestLogger_Text(t *testing.T) {
+	out := &bytes.Buffer{}
+	logger := newTestLogger(out, LogInfo, false)
+
+	logger.Debug("dropped")
+	logger.With(Field("cycle", 3)).Info(
+		"sync cycle done",
+		Field("filename", "dir/some file"), Field("bytes", 42), Field("empty", ""),
+	)
+	logger.Error("push error", Field("error", errors.New("no route")))
+	assert.Equal(t,
+		"2019-04-12T10:00:00.000Z INFO sync cycle done cycle=3 filename=\"dir/some file\" bytes=42 empty=\"\"\n"+
+			"2019-04-12T10:00:00.000Z ERROR push error error=\"no route\"\n",
+		out.String(),
+	)
+}
+
+func TestLogger_JSON(t *testing.T) {
+	out := &bytes.Buffer{}
+	logger := newTestLogger(out, LogDebug, true)
+
+	logger.With(Field("cycle", 1)).Debug(
+		"pushed",
+		Field("bytes", 42), Field("push_time", 1500*time.Millisecond),
+	)
+	assert.Equal(t,
+		`{"time":"2019-04-12T10:00:00.000Z","level":"debug","msg":"pushed","cycle":1,"bytes":42,"push_time":"1.5s"}`+"\n",
+		out.String(),
+	)
+	var decoded map[string]interface{}
+	assert.Nil(t, json.Unmarshal(out.Bytes(), &decoded))
+}
+
+func TestLogger_With(t *testing.T) {
+	out := &bytes.Buffer{}
+	logger := newTestLogger(out, LogInfo, false)
+
+	// fields of one child do not leak into another
+	parent := logger.With(Field("a", 1))
+	parent.With(Field("b", 2)).Info("first")
+	parent.With(Field("c", 3)).Info("second")
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	assert.True(t, strings.HasSuffix(lines[0], "first a=1 b=2"), lines[0])
+	assert.True(t, strings.HasSuffix(lines[1], "second a=1 c=3"), lines[1])
+}
+
+func TestParseLogLevel(t *testing.T) {
+	for name, expected := range map[string]LogLevel{
+		"debug": LogDebug,
+		"info":  LogInfo,
+		"WARN":  LogWarn,
+		"error": LogError,
+	} {
+		level, err := ParseLogLevel(name)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, level)
+	}
+	_, err := ParseLogLevel("verbose")
+	assert.NotNil(t, err)
+}
+
+func TestLogWriter(t *testing.T) {
+	out := &bytes.Buffer{}
+	stdLogger := log.New(NewLogWriter(newTestLogger(out, LogInfo, false), LogWarn), "", 0)
+	stdLogger.Printf("something happened: %v", 1)
+	assert.Equal(t, "2019-04-12T10:00:00.000Z WARN something happened: 1\n", out.String())
+}
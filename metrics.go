@@ -0,0 +1,238 @@
+package carrybasket
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+/// Path at which ServeMetrics serves the metrics.
+const MetricsPath = "/metrics"
+
+/// Prometheus metrics of a client or a server. Every binary keeps its
+/// own set, filled by syncServiceServer, syncServiceClient and
+/// changeHandler (see their SetMetrics), and serves it with ServeMetrics.
+/// Nil *Metrics is valid and records nothing.
+type Metrics struct {
+	registry *prometheus.Registry
+
+	cycles          *prometheus.CounterVec   /// client sync cycles by result
+	cycleDuration   prometheus.Histogram     /// of client sync cycles
+	requests        *prometheus.CounterVec   /// server calls by method and code
+	requestDuration *prometheus.HistogramVec /// of server calls by method
+	activeStreams   *prometheus.GaugeVec     /// server streams by method
+	bytesPulled     prometheus.Counter       /// from server to client
+	bytesPushed     prometheus.Counter       /// from client to server
+	cacheBlocks     *prometheus.GaugeVec     /// server content cache size by module
+	cacheLookups    *prometheus.CounterVec   /// server content cache lookups by result
+	failedCommands  prometheus.Counter       /// commands that have not been applied
+	watcherEvents   prometheus.Counter       /// file changes seen by the change handler
+	rescans         *prometheus.CounterVec   /// full rescan cycles by result
+	rescanFiles     prometheus.Counter       /// files out of date found by rescans
+}
+
+func NewMetrics() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+
+		cycles: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "carrybasket_sync_cycles_total",
+			Help: "Sync cycles run by the client, by result.",
+		}, []string{"result"}),
+		cycleDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "carrybasket_sync_cycle_duration_seconds",
+			Help:    "Duration of sync cycles run by the client.",
+			Buckets: prometheus.ExponentialBuckets(0.01, 4, 8),
+		}),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "carrybasket_requests_total",
+			Help: "Calls handled by the server, by method and status code.",
+		}, []string{"method", "code"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "carrybasket_request_duration_seconds",
+			Help:    "Duration of calls handled by the server, by method.",
+			Buckets: prometheus.ExponentialBuckets(0.01, 4, 8),
+		}, []string{"method"}),
+		activeStreams: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "carrybasket_active_streams",
+			Help: "Streams currently open on the server, by method.",
+		}, []string{"method"}),
+		bytesPulled: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "carrybasket_pulled_bytes_total",
+			Help: "Bytes of messages sent from the server to clients.",
+		}),
+		bytesPushed: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "carrybasket_pushed_bytes_total",
+			Help: "Bytes of messages sent from clients to the server.",
+		}),
+		cacheBlocks: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "carrybasket_block_cache_blocks",
+			Help: "Blocks in the content cache of the server, by module.",
+		}, []string{"module"}),
+		cacheLookups: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "carrybasket_block_cache_lookups_total",
+			Help: "Lookups of hashed blocks in the content cache, by result (hit or miss).",
+		}, []string{"result"}),
+		failedCommands: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "carrybasket_failed_commands_total",
+			Help: "Adjustment commands that could not be applied.",
+		}),
+		watcherEvents: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "carrybasket_watcher_events_total",
+			Help: "Change events received by the change handler.",
+		}),
+		rescans: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "carrybasket_rescan_cycles_total",
+			Help: "Full rescan cycles run by the change handler, by result.",
+		}, []string{"result"}),
+		rescanFiles: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "carrybasket_rescan_missed_files_total",
+			Help: "Files found out of date by full rescans, their changes have been missed by the watcher.",
+		}),
+	}
+	m.registry.MustRegister(
+		m.cycles, m.cycleDuration,
+		m.requests, m.requestDuration, m.activeStreams,
+		m.bytesPulled, m.bytesPushed,
+		m.cacheBlocks, m.cacheLookups,
+		m.failedCommands, m.watcherEvents,
+		m.rescans, m.rescanFiles,
+	)
+	return m
+}
+
+/// Handler that serves the metrics in Prometheus text format.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+/// Serve the metrics on MetricsPath until the listener fails.
+func ServeMetrics(address string, metrics *Metrics) error {
+	mux := http.NewServeMux()
+	mux.Handle(MetricsPath, metrics.Handler())
+	return http.ListenAndServe(address, mux)
+}
+
+func (m *Metrics) cycleDone(duration time.Duration, err error) {
+	if m == nil {
+		return
+	}
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	m.cycles.WithLabelValues(result).Inc()
+	m.cycleDuration.Observe(duration.Seconds())
+}
+
+func (m *Metrics) pulled(n int) {
+	if m != nil {
+		m.bytesPulled.Add(float64(n))
+	}
+}
+
+func (m *Metrics) pushed(n int) {
+	if m != nil {
+		m.bytesPushed.Add(float64(n))
+	}
+}
+
+func (m *Metrics) setCacheBlocks(module string, n int) {
+	if m != nil {
+		m.cacheBlocks.WithLabelValues(module).Set(float64(n))
+	}
+}
+
+func (m *Metrics) cacheLookup(hit bool) {
+	if m == nil {
+		return
+	}
+	if hit {
+		m.cacheLookups.WithLabelValues("hit").Inc()
+	} else {
+		m.cacheLookups.WithLabelValues("miss").Inc()
+	}
+}
+
+func (m *Metrics) commandsFailed(results []AdjustmentResult) {
+	if m == nil {
+		return
+	}
+	for _, result := range results {
+		if result.Status != AdjustmentResultApplied {
+			m.failedCommands.Inc()
+		}
+	}
+}
+
+func (m *Metrics) watcherEvent() {
+	if m != nil {
+		m.watcherEvents.Inc()
+	}
+}
+
+func (m *Metrics) rescanDone(missed int, err error) {
+	if m == nil {
+		return
+	}
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	m.rescans.WithLabelValues(result).Inc()
+	m.rescanFiles.Add(float64(missed))
+}
+
+func (m *Metrics) requestDone(method string, start time.Time, err error) {
+	m.requests.WithLabelValues(method, status.Code(err).String()).Inc()
+	m.requestDuration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+}
+
+func (m *Metrics) unaryInterceptor(
+	ctx context.Context,
+	request interface{},
+	info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler,
+) (interface{}, error) {
+	if m == nil {
+		return handler(ctx, request)
+	}
+	start := time.Now()
+	reply, err := handler(ctx, request)
+	m.requestDone(info.FullMethod, start, err)
+	return reply, err
+}
+
+func (m *Metrics) streamInterceptor(
+	server interface{},
+	stream grpc.ServerStream,
+	info *grpc.StreamServerInfo,
+	handler grpc.StreamHandler,
+) error {
+	if m == nil {
+		return handler(server, stream)
+	}
+	start := time.Now()
+	m.activeStreams.WithLabelValues(info.FullMethod).Inc()
+	err := handler(server, stream)
+	m.activeStreams.WithLabelValues(info.FullMethod).Dec()
+	m.requestDone(info.FullMethod, start, err)
+	return err
+}
+
+// Content cache that counts lookups of hashed blocks.
+type meteredBlockCache struct {
+	BlockCache
+	metrics *Metrics
+}
+
+func (mbc meteredBlockCache) Get(hash []byte) (Block, bool) {
+	block, ok := mbc.BlockCache.Get(hash)
+	mbc.metrics.cacheLookup(ok)
+	return block, ok
+}
@@ -0,0 +1,62 @@
+package carrybasket
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func scrapeMetrics(t *testing.T, metrics *Metrics) string {
+	recorder := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(recorder, httptest.NewRequest("GET", MetricsPath, nil))
+	body, err := ioutil.ReadAll(recorder.Body)
+	assert.Nil(t, err)
+	return string(body)
+}
+
+func TestMetrics_Nil(t *testing.T) {
+	var metrics *Metrics
+	metrics.cycleDone(time.Second, nil)
+	metrics.pulled(1)
+	metrics.pushed(1)
+	metrics.setCacheBlocks("module", 1)
+	metrics.cacheLookup(true)
+	metrics.commandsFailed([]AdjustmentResult{{"a", AdjustmentResultFailed, "error"}})
+	metrics.watcherEvent()
+	metrics.rescanDone(1, nil)
+}
+
+func TestMetrics_Handler(t *testing.T) {
+	metrics := NewMetrics()
+	metrics.cycleDone(time.Second, nil)
+	metrics.cycleDone(time.Second, ErrTooManyDeletions)
+	metrics.cacheLookup(true)
+	metrics.cacheLookup(false)
+	metrics.cacheLookup(true)
+	metrics.commandsFailed([]AdjustmentResult{
+		{"a", AdjustmentResultApplied, ""},
+		{"b", AdjustmentResultFailed, "error"},
+	})
+
+	text := scrapeMetrics(t, metrics)
+	assert.Contains(t, text, `carrybasket_sync_cycles_total{result="ok"} 1`)
+	assert.Contains(t, text, `carrybasket_sync_cycles_total{result="error"} 1`)
+	assert.Contains(t, text, `carrybasket_sync_cycle_duration_seconds_count 2`)
+	assert.Contains(t, text, `carrybasket_block_cache_lookups_total{result="hit"} 2`)
+	assert.Contains(t, text, `carrybasket_block_cache_lookups_total{result="miss"} 1`)
+	assert.Contains(t, text, `carrybasket_failed_commands_total 1`)
+}
+
+func TestMetrics_Rescan(t *testing.T) {
+	metrics := NewMetrics()
+	metrics.rescanDone(2, nil)
+	metrics.rescanDone(0, nil)
+	metrics.rescanDone(0, ErrTooManyDeletions)
+
+	text := scrapeMetrics(t, metrics)
+	assert.Contains(t, text, `carrybasket_rescan_cycles_total{result="ok"} 2`)
+	assert.Contains(t, text, `carrybasket_rescan_cycles_total{result="error"} 1`)
+	assert.Contains(t, text, `carrybasket_rescan_missed_files_total 2`)
+}
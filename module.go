@@ -0,0 +1,354 @@
+package carrybasket
+
+import (
+	"bufio"
+	"context"
+	"github.com/pkg/errors"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+/// Name of the module served when client does not ask for any.
+const DefaultModule = ""
+
+/// Name of the gRPC metadata key that carries the module name.
+const moduleMetadataKey = "carrybasket-module"
+
+/// Name of the gRPC metadata key that carries the module generation,
+/// see serverModule.
+const generationMetadataKey = "carrybasket-generation"
+
+/// Who can access a module and how.
+type ModuleAccess struct {
+	ReadOnly   bool     /// clients can only pull from the module
+	HostsAllow []string /// IPs or CIDRs of allowed clients, empty allows all
+}
+
+/// Module declared in the server config file, see ParseModulesConfig.
+type ModuleConfig struct {
+	Name              string
+	Path              string
+	Access            ModuleAccess
+	Retention         VersionRetention
+	SnapshotRetention SnapshotRetention
+}
+
+/// Parse modules config. The format is similar to the one of rsyncd.conf:
+///
+///     # comment
+///     [photos]
+///     path = /srv/photos
+///     read only = yes
+///     hosts allow = 127.0.0.1 10.0.0.0/8
+///     keep versions = 10
+///     keep days = 30
+///     keep snapshots = 100
+///     keep snapshot days = 90
+///
+func ParseModulesConfig(r io.Reader) ([]ModuleConfig, error) {
+	var configs []ModuleConfig
+	var current *ModuleConfig
+	lineNumber := 0
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			name := strings.TrimSpace(line[1 : len(line)-1])
+			if name == "" {
+				return nil, errors.Errorf("line %v: empty module name", lineNumber)
+			}
+			configs = append(configs, ModuleConfig{Name: name})
+			current = &configs[len(configs)-1]
+			continue
+		}
+
+		fields := strings.SplitN(line, "=", 2)
+		if len(fields) != 2 {
+			return nil, errors.Errorf("line %v: expected key = value", lineNumber)
+		}
+		if current == nil {
+			return nil, errors.Errorf("line %v: parameter outside of a module", lineNumber)
+		}
+		key := strings.ToLower(strings.TrimSpace(fields[0]))
+		value := strings.TrimSpace(fields[1])
+
+		switch key {
+		case "path":
+			current.Path = value
+		case "read only":
+			readOnly, err := parseConfigBool(value)
+			if err != nil {
+				return nil, errors.Wrapf(err, "line %v", lineNumber)
+			}
+			current.Access.ReadOnly = readOnly
+		case "hosts allow":
+			hosts := strings.FieldsFunc(value, func(r rune) bool {
+				return r == ',' || r == ' ' || r == '\t'
+			})
+			for _, host := range hosts {
+				if _, err := parseHostPattern(host); err != nil {
+					return nil, errors.Wrapf(err, "line %v", lineNumber)
+				}
+			}
+			current.Access.HostsAllow = hosts
+		case "keep versions", "keep days":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return nil, errors.Errorf("line %v: invalid number: %q", lineNumber, value)
+			}
+			if key == "keep versions" {
+				current.Retention.KeepVersions = n
+			} else {
+				current.Retention.KeepDays = n
+			}
+		case "keep snapshots", "keep snapshot days":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return nil, errors.Errorf("line %v: invalid number: %q", lineNumber, value)
+			}
+			if key == "keep snapshots" {
+				current.SnapshotRetention.KeepSnapshots = n
+			} else {
+				current.SnapshotRetention.KeepDays = n
+			}
+		default:
+			return nil, errors.Errorf("line %v: unknown parameter %q", lineNumber, key)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "cannot read modules config")
+	}
+
+	names := make(map[string]struct{}, len(configs))
+	for _, config := range configs {
+		if config.Path == "" {
+			return nil, errors.Errorf("module %v: path is missing", config.Name)
+		}
+		if _, ok := names[config.Name]; ok {
+			return nil, errors.Errorf("module %v: declared twice", config.Name)
+		}
+		names[config.Name] = struct{}{}
+	}
+
+	return configs, nil
+}
+
+func LoadModulesConfig(filename string) ([]ModuleConfig, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot open modules config")
+	}
+	defer f.Close()
+	return ParseModulesConfig(f)
+}
+
+func parseConfigBool(value string) (bool, error) {
+	switch strings.ToLower(value) {
+	case "yes", "true", "1":
+		return true, nil
+	case "no", "false", "0":
+		return false, nil
+	}
+	return false, errors.Errorf("invalid boolean: %q", value)
+}
+
+func parseHostPattern(pattern string) (*net.IPNet, error) {
+	if strings.Contains(pattern, "/") {
+		_, ipNet, err := net.ParseCIDR(pattern)
+		return ipNet, err
+	}
+
+	ip := net.ParseIP(pattern)
+	if ip == nil {
+		return nil, errors.Errorf("invalid host: %q", pattern)
+	}
+	bits := 8 * net.IPv6len
+	if ip.To4() != nil {
+		ip = ip.To4()
+		bits = 8 * net.IPv4len
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
+
+/// Server side of a module: its own files and its own content cache.
+type serverModule struct {
+	name         string
+	fs           VirtualFilesystem
+	access       ModuleAccess
+	contentCache BlockCache
+	versions     *fileVersions /// previous versions of files
+	snapshots    *snapshots    /// snapshots of the whole tree
+	lock         *sync.RWMutex /// shared by all modules that serve the same fs
+	generation   *uint64       /// changes with the files, guarded and shared like lock
+}
+
+func newServerModule(name string, fs VirtualFilesystem, access ModuleAccess) *serverModule {
+	return &serverModule{
+		name:         name,
+		fs:           fs,
+		access:       access,
+		contentCache: NewBlockCache(),
+		versions:     NewFileVersions(fs, VersionRetention{}),
+		snapshots:    NewSnapshots(fs, SnapshotRetention{}),
+		lock:         &sync.RWMutex{},
+		generation:   newGeneration(),
+	}
+}
+
+// Generations start from the time, so that a restarted server does not
+// repeat the ones its clients have seen before.
+func newGeneration() *uint64 {
+	generation := uint64(time.Now().UnixNano())
+	return &generation
+}
+
+// Generation of the files. Clients send the one they have planned their
+// changes against, so that the changes are not applied to files that
+// have changed since. Must be called under the lock.
+func (m *serverModule) currentGeneration() string {
+	return strconv.FormatUint(*m.generation, 10)
+}
+
+// Files have been changed. Must be called under the write lock.
+func (m *serverModule) changed() {
+	*m.generation++
+}
+
+// Check that files have not changed since the client has seen them,
+// when the client tells which generation it has seen. Must be called
+// under the lock.
+func (m *serverModule) checkGeneration(ctx context.Context) error {
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		values := md.Get(generationMetadataKey)
+		if len(values) > 0 && values[0] != m.currentGeneration() {
+			return status.Error(codes.FailedPrecondition, ErrServerChanged.Error())
+		}
+	}
+	return nil
+}
+
+// Attach the generation seen by the client to outgoing calls.
+func withGeneration(ctx context.Context, generation string) context.Context {
+	if generation == "" {
+		return ctx
+	}
+	return metadata.AppendToOutgoingContext(ctx, generationMetadataKey, generation)
+}
+
+// Refusal of the server to apply changes planned against old files is
+// returned as ErrServerChanged.
+func serverChangedError(err error) error {
+	if s, ok := status.FromError(err); ok && s.Code() == codes.FailedPrecondition &&
+		s.Message() == ErrServerChanged.Error() {
+		return errors.WithStack(ErrServerChanged)
+	}
+	return err
+}
+
+// Calls that modify files exclude all other calls on the same root,
+// while calls that only read files can run concurrently.
+func (m *serverModule) lockFor(modify bool) func() {
+	if modify {
+		m.lock.Lock()
+		return m.lock.Unlock
+	}
+	m.lock.RLock()
+	return m.lock.RUnlock
+}
+
+func (m *serverModule) allowsHost(addr net.Addr) bool {
+	if len(m.access.HostsAllow) == 0 {
+		return true
+	}
+
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, pattern := range m.access.HostsAllow {
+		ipNet, err := parseHostPattern(pattern)
+		if err == nil && ipNet.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// Find the module requested by the client and check that the client is
+// allowed to access it. Modifying calls need a writable module.
+func (s *syncServiceServer) moduleFromContext(ctx context.Context, modify bool) (*serverModule, error) {
+	name := moduleNameFromContext(ctx)
+	module, ok := s.modules[name]
+	if !ok {
+		if name == DefaultModule {
+			return nil, status.Error(codes.InvalidArgument, "module name is required")
+		}
+		return nil, status.Errorf(codes.NotFound, "unknown module %q", name)
+	}
+
+	if p, ok := peer.FromContext(ctx); ok && !module.allowsHost(p.Addr) {
+		return nil, status.Errorf(codes.PermissionDenied, "host %v is not allowed in module %q", p.Addr, name)
+	}
+	if modify && module.access.ReadOnly {
+		return nil, status.Errorf(codes.PermissionDenied, "module %q is read only", name)
+	}
+
+	return module, nil
+}
+
+func moduleNameFromContext(ctx context.Context) string {
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get(moduleMetadataKey); len(values) > 0 {
+			return values[0]
+		}
+	}
+	return DefaultModule
+}
+
+// Logger of a call, with the client and the module it asks for.
+func (s *syncServiceServer) callLogger(ctx context.Context) Logger {
+	return s.logger.With(
+		Field("client", clientHost(ctx)),
+		Field("module", moduleNameFromContext(ctx)),
+	)
+}
+
+// Host of the client, used to tell clients apart.
+func clientHost(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return ""
+	}
+	return addrHost(p.Addr)
+}
+
+func addrHost(addr net.Addr) string {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr.IP.String()
+	}
+	return addr.String()
+}
+
+// Attach the selected module name to outgoing calls.
+func withModule(ctx context.Context, module string) context.Context {
+	if module == DefaultModule {
+		return ctx
+	}
+	return metadata.AppendToOutgoingContext(ctx, moduleMetadataKey, module)
+}
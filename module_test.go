@@ -0,0 +1,69 @@
+package carrybasket
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestParseModulesConfig_Smoke(t *testing.T) {
+	configs, err := ParseModulesConfig(strings.NewReader(""))
+	assert.Nil(t, err)
+	assert.Empty(t, configs)
+}
+
+func TestParseModulesConfig_Modules(t *testing.T) {
+	config := `
+# shared photos
+[photos]
+path = /srv/photos
+read only = yes
+hosts allow = 127.0.0.1, 10.0.0.0/8
+keep versions = 3
+keep snapshots = 10
+
+[alice]
+    path = /srv/alice
+`
+	configs, err := ParseModulesConfig(strings.NewReader(config))
+	assert.Nil(t, err)
+	assert.Equal(t, []ModuleConfig{
+		{"photos", "/srv/photos", ModuleAccess{true, []string{"127.0.0.1", "10.0.0.0/8"}}, VersionRetention{3, 0}, SnapshotRetention{10, 0}},
+		{"alice", "/srv/alice", ModuleAccess{false, nil}, VersionRetention{}, SnapshotRetention{}},
+	}, configs)
+}
+
+func TestParseModulesConfig_Errors(t *testing.T) {
+	for _, config := range []string{
+		"path = /srv",
+		"[a]\npath /srv",
+		"[a]\npath = /srv\nunknown = 1",
+		"[a]\npath = /srv\nread only = maybe",
+		"[a]\npath = /srv\nhosts allow = localhost",
+		"[a]\npath = /srv\nkeep days = -1",
+		"[a]\npath = /srv\nkeep snapshots = many",
+		"[a]\n",
+		"[a]\npath = /a\n[a]\npath = /b",
+		"[]\npath = /srv",
+	} {
+		_, err := ParseModulesConfig(strings.NewReader(config))
+		assert.NotNil(t, err, config)
+	}
+}
+
+func TestServerModule_AllowsHost(t *testing.T) {
+	addr := func(ip string) net.Addr {
+		return &net.TCPAddr{IP: net.ParseIP(ip), Port: 20000}
+	}
+
+	module := newServerModule("a", NewLoggingFilesystem(), ModuleAccess{})
+	assert.True(t, module.allowsHost(addr("192.168.1.1")))
+
+	module = newServerModule("a", NewLoggingFilesystem(), ModuleAccess{
+		HostsAllow: []string{"127.0.0.1", "10.0.0.0/8"},
+	})
+	assert.True(t, module.allowsHost(addr("127.0.0.1")))
+	assert.True(t, module.allowsHost(addr("10.1.2.3")))
+	assert.False(t, module.allowsHost(addr("192.168.1.1")))
+}
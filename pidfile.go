@@ -0,0 +1,139 @@
+package carrybasket
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+/// Default name of the PID file of a client daemon, inside MetadataDir
+/// of the synced dir.
+const ClientPidFile = "client.pid"
+
+/// Write PID of the current process into the file. Fails when the file
+/// names another running process, so that two daemons never sync the
+/// same dir. The file is created exclusively, so of two processes that
+/// start at once only one gets it. A file left by a process that has
+/// exited is replaced.
+func WritePidFile(filename string) error {
+	if err := os.MkdirAll(filepath.Dir(filename), os.ModeDir|0755); err != nil {
+		return errors.Wrap(err, "cannot create pid file dir")
+	}
+	// one more attempt after a stale file has been removed
+	for attempt := 0; ; attempt++ {
+		err := createPidFile(filename)
+		if !os.IsExist(err) {
+			return err
+		}
+		pid, err := ReadPidFile(filename)
+		if err != nil {
+			return err
+		}
+		switch {
+		case pid == os.Getpid():
+			return nil
+		case pid != 0:
+			return errors.Errorf("already running with pid %d, see %v", pid, filename)
+		case attempt > 0:
+			return errors.Errorf("cannot replace stale pid file %v", filename)
+		}
+		if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+			return errors.Wrap(err, "cannot remove stale pid file")
+		}
+	}
+}
+
+// Create the file with PID of the current process, fails when it exists.
+func createPidFile(filename string) error {
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if os.IsExist(err) {
+		return err
+	}
+	if err != nil {
+		return errors.Wrap(err, "cannot create pid file")
+	}
+	_, err = fmt.Fprintf(file, "%d\n", os.Getpid())
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(filename)
+		return errors.Wrap(err, "cannot write pid file")
+	}
+	return nil
+}
+
+/// PID of the running process named in the file. Returns 0 when there
+/// is no file or the process has exited.
+func ReadPidFile(filename string) (int, error) {
+	content, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, errors.Wrap(err, "cannot read pid file")
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(content)))
+	if err != nil || pid <= 0 {
+		return 0, errors.Errorf("invalid pid file: %v", filename)
+	}
+	if !processRunning(pid) {
+		return 0, nil
+	}
+	return pid, nil
+}
+
+/// Remove the file unless it has been taken over by another process.
+func RemovePidFile(filename string) error {
+	pid, err := ReadPidFile(filename)
+	if err != nil || (pid != 0 && pid != os.Getpid()) {
+		return err
+	}
+	if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "cannot remove pid file")
+	}
+	return nil
+}
+
+func processRunning(pid int) bool {
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	err = process.Signal(syscall.Signal(0))
+	// the process exists, but belongs to someone else
+	return err == nil || err == syscall.EPERM
+}
+
+/// Name of the file, inside MetadataDir of the synced dir, that exists
+/// while a client watches the dir, see MarkRunning.
+const ClientRunningFile = "client.running"
+
+/// Create the running file. Returns true when it is there already, left
+/// by a previous client that has crashed or has been killed, so that
+/// changes made meanwhile may have been missed.
+func MarkRunning(filename string) (bool, error) {
+	_, err := os.Stat(filename)
+	crashed := err == nil
+	if err := os.MkdirAll(filepath.Dir(filename), os.ModeDir|0755); err != nil {
+		return crashed, errors.Wrap(err, "cannot create running file dir")
+	}
+	content := fmt.Sprintf("%d\n", os.Getpid())
+	if err := ioutil.WriteFile(filename, []byte(content), 0644); err != nil {
+		return crashed, errors.Wrap(err, "cannot write running file")
+	}
+	return crashed, nil
+}
+
+/// Remove the running file when the client stops gracefully.
+func MarkStopped(filename string) error {
+	if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "cannot remove running file")
+	}
+	return nil
+}
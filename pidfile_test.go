@@ -0,0 +1,97 @@
+package carrybasket
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestPidFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "carrybasket-pid")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, MetadataDir, ClientPidFile)
+
+	pid, err := ReadPidFile(filename)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, pid)
+
+	assert.Nil(t, WritePidFile(filename))
+	pid, err = ReadPidFile(filename)
+	assert.Nil(t, err)
+	assert.Equal(t, os.Getpid(), pid)
+
+	// init is always running, so the file is taken
+	assert.Nil(t, ioutil.WriteFile(filename, []byte("1\n"), 0644))
+	assert.NotNil(t, WritePidFile(filename))
+	assert.Nil(t, RemovePidFile(filename))
+	assert.FileExists(t, filename)
+
+	assert.Nil(t, ioutil.WriteFile(filename, []byte("junk"), 0644))
+	_, err = ReadPidFile(filename)
+	assert.NotNil(t, err)
+
+	assert.Nil(t, os.Remove(filename))
+	assert.Nil(t, WritePidFile(filename))
+	assert.Nil(t, RemovePidFile(filename))
+
+	// left by a process that has exited
+	assert.Nil(t, ioutil.WriteFile(filename, []byte(fmt.Sprintf("%d\n", exitedPid(t))), 0644))
+	assert.Nil(t, WritePidFile(filename))
+	pid, err = ReadPidFile(filename)
+	assert.Nil(t, err)
+	assert.Equal(t, os.Getpid(), pid)
+	assert.Nil(t, RemovePidFile(filename))
+	_, err = os.Stat(filename)
+	assert.True(t, os.IsNotExist(err))
+}
+
+// PID of a process that has already exited.
+func exitedPid(t *testing.T) int {
+	cmd := exec.Command("true")
+	assert.Nil(t, cmd.Run())
+	return cmd.Process.Pid
+}
+
+func TestPidFile_Exclusive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "carrybasket-pid")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, ClientPidFile)
+
+	// as if another process has just created the file
+	assert.Nil(t, createPidFile(filename))
+	assert.NotNil(t, createPidFile(filename))
+	assert.Nil(t, ioutil.WriteFile(filename, []byte("1\n"), 0644))
+	assert.NotNil(t, WritePidFile(filename))
+	pid, err := ReadPidFile(filename)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, pid)
+}
+
+func TestMarkRunning(t *testing.T) {
+	dir, err := ioutil.TempDir("", "carrybasket-running")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, MetadataDir, ClientRunningFile)
+
+	crashed, err := MarkRunning(filename)
+	assert.Nil(t, err)
+	assert.False(t, crashed)
+	assert.Nil(t, MarkStopped(filename))
+
+	crashed, err = MarkRunning(filename)
+	assert.Nil(t, err)
+	assert.False(t, crashed)
+	// not stopped, as if killed
+	crashed, err = MarkRunning(filename)
+	assert.Nil(t, err)
+	assert.True(t, crashed)
+
+	assert.Nil(t, MarkStopped(filename))
+	assert.Nil(t, MarkStopped(filename))
+}
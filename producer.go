@@ -1,6 +1,7 @@
 package carrybasket
 
 import (
+	"context"
 	"fmt"
 	"hash"
 	"io"
@@ -13,6 +14,7 @@ import (
 /// ContentReconstructor.
 type BlockProducer interface {
 	Scan(r io.Reader) []Block
+	ScanContext(ctx context.Context, r io.Reader) ([]Block, error)
 	Reset()
 }
 
@@ -176,8 +178,24 @@ func (bp *blockProducer) findFastAndStrongHash(r io.Reader) (Block, bool) {
 /// Blocks with hashes indicate that server already has this block on
 /// its side so it can reuse it.
 func (bp *blockProducer) Scan(r io.Reader) []Block {
+	blocks, _ := bp.ScanContext(context.Background(), r)
+	return blocks
+}
+
+// Context is checked once per this many scanned bytes, checking it
+// on every byte would slow the scan down.
+const scanContextCheckInterval = 64 * 1024
+
+/// Scan like Scan, the scan stops with the context error when ctx
+/// is cancelled or its deadline is exceeded.
+func (bp *blockProducer) ScanContext(ctx context.Context, r io.Reader) ([]Block, error) {
 	blocks := make([]Block, 0)
-	for {
+	for scanned := 0; ; scanned++ {
+		if scanned%scanContextCheckInterval == 0 {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+		}
 		blocks, _ = bp.tryEmitHash(blocks, r)
 		if err := bp.advance(r); err != nil {
 			break
@@ -186,7 +204,7 @@ func (bp *blockProducer) Scan(r io.Reader) []Block {
 
 	blocks, _ = bp.tryEmitHash(blocks, r)
 	blocks = bp.tryEmitContent(blocks)
-	return blocks
+	return blocks, nil
 }
 
 // Try reading 1 byte from reader r
@@ -1,6 +1,7 @@
 package carrybasket
 
 import (
+	"context"
 	"crypto/md5"
 	"fmt"
 	"github.com/stretchr/testify/assert"
@@ -35,6 +36,16 @@ func TestBlockProducer_Smoke(t *testing.T) {
 	assert.Empty(t, result)
 }
 
+func TestBlockProducer_ScanContextCancelled(t *testing.T) {
+	producer := makeEmptyBlockProducer(4)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	result, err := producer.ScanContext(ctx, strings.NewReader("abcd1234"))
+	assert.Equal(t, context.Canceled, err)
+	assert.Nil(t, result)
+}
+
 func BenchmarkBlockProducer_Huge(b *testing.B) {
 	blockSize := 64 * 1024
 	fastHash := NewMackerras(blockSize)
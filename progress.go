@@ -0,0 +1,153 @@
+package carrybasket
+
+import (
+	"io"
+	"time"
+)
+
+/// Phases of a sync cycle reported in Progress.
+const (
+	ProgressPhaseScan = "scan" /// client files are hashed and compared
+	ProgressPhasePush = "push" /// commands are sent to the server
+	ProgressPhaseDone = "done" /// cycle has finished
+)
+
+/// How often progress is reported at most, except for phase changes.
+const progressInterval = 100 * time.Millisecond
+
+/// Progress of a sync cycle. Bytes matched and literal are known once
+/// scanning is done: matched bytes are already on the server and are
+/// sent as hashes, literal bytes are sent as content.
+type Progress struct {
+	Phase        string        `json:"phase"`
+	FilesTotal   int           `json:"files_total"`
+	FilesScanned int           `json:"files_scanned"`
+	BytesScanned uint64        `json:"bytes_scanned"`
+	BytesMatched uint64        `json:"bytes_matched"`
+	BytesLiteral uint64        `json:"bytes_literal"`
+	BytesTotal   uint64        `json:"bytes_total"` /// bytes to send in the push phase
+	BytesSent    uint64        `json:"bytes_sent"`
+	Elapsed      time.Duration `json:"elapsed"`
+	ETA          time.Duration `json:"eta"` /// of the current phase, 0 when unknown
+}
+
+/// Receives progress of sync cycles, see SetProgressReporter.
+type ProgressReporter interface {
+	ReportProgress(progress Progress)
+}
+
+/// Keeps progress of a single cycle and passes it to the reporter.
+/// Without a reporter all calls do nothing.
+type progressTracker struct {
+	reporter   ProgressReporter
+	progress   Progress
+	start      time.Time /// of the cycle
+	phaseStart time.Time
+	lastReport time.Time
+	now        func() time.Time
+}
+
+func newProgressTracker(reporter ProgressReporter, now func() time.Time) *progressTracker {
+	start := now()
+	return &progressTracker{
+		reporter:   reporter,
+		start:      start,
+		phaseStart: start,
+		now:        now,
+	}
+}
+
+func (pt *progressTracker) startPhase(phase string) {
+	pt.progress.Phase = phase
+	pt.phaseStart = pt.now()
+	pt.report(true)
+}
+
+// Count bytes read from the client files during the scan.
+func (pt *progressTracker) trackScan(files []VirtualFile) {
+	if pt.reporter == nil {
+		return
+	}
+	for i := range files {
+		if !files[i].IsDir {
+			pt.progress.FilesTotal++
+			files[i].Rw = &progressReader{files[i].Rw, pt, false}
+		}
+	}
+	pt.report(true)
+}
+
+func (pt *progressTracker) scanned(commands []AdjustmentCommand) {
+	for _, abstractCommand := range commands {
+		if command, ok := abstractCommand.(AdjustmentCommandApplyBlocksToFile); ok {
+			pt.progress.BytesMatched += command.ReusedBytes()
+			pt.progress.BytesLiteral += command.LiteralBytes()
+		}
+	}
+	pt.report(true)
+}
+
+func (pt *progressTracker) pushing(bytesTotal uint64) {
+	pt.progress.BytesTotal += bytesTotal
+	pt.report(true)
+}
+
+func (pt *progressTracker) sent(n int) {
+	pt.progress.BytesSent += uint64(n)
+	pt.report(false)
+}
+
+func (pt *progressTracker) finish() {
+	pt.startPhase(ProgressPhaseDone)
+}
+
+func (pt *progressTracker) report(force bool) {
+	if pt.reporter == nil {
+		return
+	}
+	now := pt.now()
+	if !force && now.Sub(pt.lastReport) < progressInterval {
+		return
+	}
+	pt.lastReport = now
+
+	pt.progress.Elapsed = now.Sub(pt.start)
+	pt.progress.ETA = pt.eta(now.Sub(pt.phaseStart))
+	pt.reporter.ReportProgress(pt.progress)
+}
+
+// Remaining time of the phase, assuming the rest goes at the same rate.
+// Sizes of files are not known before they are read, so the scan is
+// estimated by the number of files.
+func (pt *progressTracker) eta(phaseElapsed time.Duration) time.Duration {
+	var done, total float64
+	switch pt.progress.Phase {
+	case ProgressPhaseScan:
+		done, total = float64(pt.progress.FilesScanned), float64(pt.progress.FilesTotal)
+	case ProgressPhasePush:
+		done, total = float64(pt.progress.BytesSent), float64(pt.progress.BytesTotal)
+	}
+	if done == 0 || done >= total {
+		return 0
+	}
+	return time.Duration(float64(phaseElapsed) * (total - done) / done)
+}
+
+type progressReader struct {
+	io.ReadCloser
+	tracker *progressTracker
+	done    bool /// file has been read till the end
+}
+
+func (pr *progressReader) Read(p []byte) (int, error) {
+	n, err := pr.ReadCloser.Read(p)
+	pr.tracker.progress.BytesScanned += uint64(n)
+	if err == io.EOF && !pr.done {
+		pr.done = true
+		pr.tracker.progress.FilesScanned++
+		pr.tracker.report(true)
+	} else {
+		pr.tracker.report(false)
+	}
+	return n, err
+}
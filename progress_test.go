@@ -0,0 +1,95 @@
+package carrybasket
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+type recordingProgressReporter struct {
+	reports []Progress
+}
+
+func (rpr *recordingProgressReporter) ReportProgress(progress Progress) {
+	rpr.reports = append(rpr.reports, progress)
+}
+
+func (rpr *recordingProgressReporter) last() Progress {
+	return rpr.reports[len(rpr.reports)-1]
+}
+
+func (rpr *recordingProgressReporter) phases() []string {
+	phases := make([]string, 0)
+	for _, report := range rpr.reports {
+		if len(phases) == 0 || phases[len(phases)-1] != report.Phase {
+			phases = append(phases, report.Phase)
+		}
+	}
+	return phases
+}
+
+func TestProgressTracker_Scan(t *testing.T) {
+	now := time.Unix(0, 0)
+	reporter := &recordingProgressReporter{}
+	tracker := newProgressTracker(reporter, func() time.Time { return now })
+
+	files := []VirtualFile{
+		{"dir", true, nil},
+		{"dir/a", false, ioutil.NopCloser(bytes.NewBufferString("abcd"))},
+		{"dir/b", false, ioutil.NopCloser(bytes.NewBufferString("efgh"))},
+	}
+	tracker.startPhase(ProgressPhaseScan)
+	tracker.trackScan(files)
+	assert.Equal(t, 2, reporter.last().FilesTotal)
+
+	now = now.Add(time.Second)
+	_, _ = ioutil.ReadAll(files[1].Rw)
+	assert.Equal(t, 1, reporter.last().FilesScanned)
+	assert.Equal(t, uint64(4), reporter.last().BytesScanned)
+	assert.Equal(t, time.Second, reporter.last().ETA)
+
+	// reading past the end does not count the file again
+	_, _ = ioutil.ReadAll(files[1].Rw)
+	_, _ = ioutil.ReadAll(files[2].Rw)
+	assert.Equal(t, 2, reporter.last().FilesScanned)
+	assert.Equal(t, uint64(8), reporter.last().BytesScanned)
+	assert.Equal(t, time.Duration(0), reporter.last().ETA)
+}
+
+func TestProgressTracker_Push(t *testing.T) {
+	now := time.Unix(0, 0)
+	reporter := &recordingProgressReporter{}
+	tracker := newProgressTracker(reporter, func() time.Time { return now })
+
+	tracker.startPhase(ProgressPhasePush)
+	tracker.pushing(100)
+	now = now.Add(time.Second)
+	tracker.sent(25)
+	assert.Equal(t, uint64(25), reporter.last().BytesSent)
+	assert.Equal(t, 3*time.Second, reporter.last().ETA)
+	assert.Equal(t, time.Second, reporter.last().Elapsed)
+
+	// reports are throttled between phase changes
+	reports := len(reporter.reports)
+	tracker.sent(25)
+	assert.Equal(t, reports, len(reporter.reports))
+
+	tracker.finish()
+	assert.Equal(t, ProgressPhaseDone, reporter.last().Phase)
+	assert.Equal(t, uint64(50), reporter.last().BytesSent)
+	assert.Equal(t, []string{ProgressPhasePush, ProgressPhaseDone}, reporter.phases())
+}
+
+func TestProgressTracker_NoReporter(t *testing.T) {
+	tracker := newProgressTracker(nil, time.Now)
+	files := []VirtualFile{
+		{"a", false, ioutil.NopCloser(bytes.NewBufferString("abcd"))},
+	}
+	rw := files[0].Rw
+	tracker.trackScan(files)
+	assert.Equal(t, rw, files[0].Rw)
+	tracker.sent(10)
+	tracker.finish()
+}
@@ -0,0 +1,618 @@
+package carrybasket
+
+import (
+	"bufio"
+	"encoding/binary"
+	"github.com/pkg/errors"
+	"hash"
+	"io"
+
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/md4"
+)
+
+/// Magic numbers that start librsync signature and delta files. The
+/// signature magic names the hashes of the blocks: the rolling one is
+/// either rollsum or (RK) RabinKarp, the strong one is MD4 or BLAKE2b.
+const (
+	RdiffMD4SigMagic      uint32 = 0x72730136
+	RdiffBlake2SigMagic   uint32 = 0x72730137
+	RdiffRkMD4SigMagic    uint32 = 0x72730146
+	RdiffRkBlake2SigMagic uint32 = 0x72730147
+	RdiffDeltaMagic       uint32 = 0x72730236
+)
+
+/// Names of the hashes of rdiff signatures, see RdiffSigMagicFor.
+const (
+	RdiffHashMD4    = "md4"
+	RdiffHashBlake2 = "blake2"
+	RdiffRollsum    = "rollsum"
+	RdiffRabinKarp  = "rabinkarp"
+)
+
+/// Block length that rdiff uses by default.
+const RdiffDefaultBlockLen = 2048
+
+var (
+	ErrRdiffMagic  = errors.New("not an rdiff file or unknown format")
+	ErrRdiffFormat = errors.New("malformed rdiff file")
+)
+
+// Delta commands, see the librsync documentation of the delta format.
+const (
+	rdiffOpEnd       = 0x00
+	rdiffOpLiteral64 = 0x40 // 0x01-0x40 are literals of 1-64 bytes
+	rdiffOpLiteralN1 = 0x41 // length follows in 1, 2, 4 or 8 bytes
+	rdiffOpCopyN1N1  = 0x45 // offset and length follow in 1-8 bytes each
+	rdiffOpCopyN8N8  = 0x54
+)
+
+/// Signature magic of the named strong and rolling hashes.
+func RdiffSigMagicFor(strongHash string, rollingHash string) (uint32, error) {
+	magics := map[[2]string]uint32{
+		{RdiffHashMD4, RdiffRollsum}:      RdiffMD4SigMagic,
+		{RdiffHashBlake2, RdiffRollsum}:   RdiffBlake2SigMagic,
+		{RdiffHashMD4, RdiffRabinKarp}:    RdiffRkMD4SigMagic,
+		{RdiffHashBlake2, RdiffRabinKarp}: RdiffRkBlake2SigMagic,
+	}
+	magic, ok := magics[[2]string{strongHash, rollingHash}]
+	if !ok {
+		return 0, errors.Errorf("unknown rdiff hashes: %q and %q", strongHash, rollingHash)
+	}
+	return magic, nil
+}
+
+/// Hashes of a block of the basis file.
+type RdiffBlockSum struct {
+	Weak   uint32
+	Strong []byte /// truncated to StrongLen of the signature
+}
+
+/// Signature of a basis file in librsync format, as made by
+/// `rdiff signature`. A delta against the basis file is computed from the
+/// signature alone.
+type RdiffSignature struct {
+	Magic     uint32
+	BlockLen  int
+	StrongLen int
+	Blocks    []RdiffBlockSum
+}
+
+/// Compute the signature of the basis file. Zero strongLen keeps strong
+/// hashes whole.
+func NewRdiffSignature(basis io.Reader, magic uint32, blockLen int, strongLen int) (*RdiffSignature, error) {
+	newStrongHash, err := rdiffStrongHashFor(magic)
+	if err != nil {
+		return nil, err
+	}
+	maxStrongLen := newStrongHash().Size()
+	if strongLen == 0 {
+		strongLen = maxStrongLen
+	}
+	if strongLen < 0 || strongLen > maxStrongLen {
+		return nil, errors.Errorf("strong hash length must be from 1 to %v", maxStrongLen)
+	}
+	if blockLen <= 0 {
+		return nil, errors.Errorf("invalid block length: %v", blockLen)
+	}
+
+	signature := &RdiffSignature{
+		Magic:     magic,
+		BlockLen:  blockLen,
+		StrongLen: strongLen,
+		Blocks:    make([]RdiffBlockSum, 0),
+	}
+	hashFactory := rdiffHashFactory{magic, blockLen, strongLen}
+	generator := NewHashGenerator(blockLen, hashFactory.MakeFastHash(), hashFactory.MakeStrongHash())
+	// one block at a time, so that the basis file is not kept in memory
+	reader := &fullReader{r: basis}
+	for {
+		result := generator.Scan(io.LimitReader(reader, int64(blockLen)))
+		if reader.err != nil {
+			return nil, errors.Wrap(reader.err, "cannot read basis file")
+		}
+		if len(result.fastHashes) == 0 {
+			return signature, nil
+		}
+		signature.Blocks = append(signature.Blocks, RdiffBlockSum{
+			Weak:   binary.BigEndian.Uint32(result.fastHashes[0].(HashedBlock).HashSum()),
+			Strong: result.strongHashes[0].(HashedBlock).HashSum(),
+		})
+	}
+}
+
+/// Read a signature written by WriteTo or by `rdiff signature`.
+func ReadRdiffSignature(r io.Reader) (*RdiffSignature, error) {
+	var header [3]uint32
+	if err := binary.Read(r, binary.BigEndian, &header); err != nil {
+		return nil, errors.Wrap(ErrRdiffFormat, "signature header is too short")
+	}
+	newStrongHash, err := rdiffStrongHashFor(header[0])
+	if err != nil {
+		return nil, err
+	}
+	signature := &RdiffSignature{
+		Magic:     header[0],
+		BlockLen:  int(header[1]),
+		StrongLen: int(header[2]),
+		Blocks:    make([]RdiffBlockSum, 0),
+	}
+	if signature.BlockLen <= 0 || signature.StrongLen <= 0 ||
+		signature.StrongLen > newStrongHash().Size() {
+		return nil, errors.Wrap(ErrRdiffFormat, "invalid signature header")
+	}
+
+	br := bufio.NewReader(r)
+	sum := make([]byte, 4+signature.StrongLen)
+	for {
+		n, err := io.ReadFull(br, sum)
+		if n == 0 && err == io.EOF {
+			return signature, nil
+		}
+		if err != nil {
+			return nil, errors.Wrap(ErrRdiffFormat, "truncated block signature")
+		}
+		signature.Blocks = append(signature.Blocks, RdiffBlockSum{
+			Weak:   binary.BigEndian.Uint32(sum),
+			Strong: append([]byte(nil), sum[4:]...),
+		})
+	}
+}
+
+/// Write the signature in librsync format.
+func (s *RdiffSignature) WriteTo(w io.Writer) (int64, error) {
+	bw := bufio.NewWriter(w)
+	header := []uint32{s.Magic, uint32(s.BlockLen), uint32(s.StrongLen)}
+	if err := binary.Write(bw, binary.BigEndian, header); err != nil {
+		return 0, err
+	}
+	written := int64(12)
+	for _, block := range s.Blocks {
+		if err := binary.Write(bw, binary.BigEndian, block.Weak); err != nil {
+			return written, err
+		}
+		if _, err := bw.Write(block.Strong); err != nil {
+			return written + 4, err
+		}
+		written += int64(4 + len(block.Strong))
+	}
+	return written, bw.Flush()
+}
+
+func rdiffStrongHashFor(magic uint32) (func() hash.Hash, error) {
+	switch magic {
+	case RdiffMD4SigMagic, RdiffRkMD4SigMagic:
+		return md4.New, nil
+	case RdiffBlake2SigMagic, RdiffRkBlake2SigMagic:
+		return func() hash.Hash {
+			h, _ := blake2b.New256(nil)
+			return h
+		}, nil
+	}
+	return nil, errors.Wrapf(ErrRdiffMagic, "signature magic %#x", magic)
+}
+
+/// Write a delta that turns the basis file of the signature into
+/// newFile, in librsync format, as made by `rdiff delta`.
+func WriteRdiffDelta(signature *RdiffSignature, newFile io.Reader, w io.Writer) error {
+	if _, err := rdiffStrongHashFor(signature.Magic); err != nil {
+		return err
+	}
+	blockLen := uint64(signature.BlockLen)
+	fastCache := NewBlockCache()
+	strongCache := NewBlockCache()
+	for i, block := range signature.Blocks {
+		offset := uint64(i) * blockLen
+		weak := make([]byte, 4)
+		binary.BigEndian.PutUint32(weak, block.Weak)
+		fastCache.Set(weak, NewHashedBlock(offset, blockLen, weak))
+		strongCache.Set(block.Strong, NewHashedBlock(offset, blockLen, block.Strong))
+	}
+
+	hashFactory := rdiffHashFactory{signature.Magic, signature.BlockLen, signature.StrongLen}
+	producer := NewProducerFactory(signature.BlockLen, hashFactory).MakeProducerWithCache(
+		rdiffBasisCache{fastCache}, rdiffBasisCache{strongCache},
+	)
+	reader := &fullReader{r: bufio.NewReader(newFile)}
+	blocks := producer.Scan(reader)
+	if reader.err != nil {
+		return errors.Wrap(reader.err, "cannot read new file")
+	}
+
+	emitter := newRdiffDeltaEmitter(w)
+	if err := emitter.header(); err != nil {
+		return err
+	}
+	var position uint64
+	for _, abstractBlock := range blocks {
+		switch block := abstractBlock.(type) {
+		case ContentBlock:
+			if err := emitter.literal(block.Content()); err != nil {
+				return err
+			}
+			position += block.Size()
+		case HashedBlock:
+			basisBlock, _ := strongCache.Get(block.HashSum())
+			// the last block of the basis may be shorter than the others,
+			// only the end of the match in the new file is known for sure
+			end := block.Offset() + block.Size()
+			if err := emitter.copy(basisBlock.Offset(), end-position); err != nil {
+				return err
+			}
+			position = end
+		}
+	}
+	return emitter.end()
+}
+
+// Cache that ignores blocks the producer adds while scanning: a delta can
+// only copy from the basis file, not from the new one.
+type rdiffBasisCache struct {
+	BlockCache
+}
+
+func (rdiffBasisCache) Set(hash []byte, block Block) {}
+
+/// Apply a delta written by WriteRdiffDelta or by `rdiff delta` to the
+/// basis file and write the new file to w, as `rdiff patch` does.
+func ApplyRdiffDelta(basis io.ReaderAt, delta io.Reader, w io.Writer) error {
+	br := bufio.NewReader(delta)
+	var magic uint32
+	if err := binary.Read(br, binary.BigEndian, &magic); err != nil {
+		return errors.Wrap(ErrRdiffFormat, "delta header is too short")
+	}
+	if magic != RdiffDeltaMagic {
+		return errors.Wrapf(ErrRdiffMagic, "delta magic %#x", magic)
+	}
+
+	bw := bufio.NewWriter(w)
+	for {
+		op, err := br.ReadByte()
+		if err != nil {
+			return errors.Wrap(ErrRdiffFormat, "delta has no end")
+		}
+
+		switch {
+		case op == rdiffOpEnd:
+			return bw.Flush()
+
+		case op <= rdiffOpLiteral64:
+			if err := copyRdiffLiteral(br, bw, uint64(op)); err != nil {
+				return err
+			}
+
+		case op < rdiffOpCopyN1N1:
+			length, err := readRdiffInt(br, 1<<(op-rdiffOpLiteralN1))
+			if err != nil {
+				return err
+			}
+			if err := copyRdiffLiteral(br, bw, length); err != nil {
+				return err
+			}
+
+		case op <= rdiffOpCopyN8N8:
+			offsetLen := 1 << ((op - rdiffOpCopyN1N1) / 4)
+			lengthLen := 1 << ((op - rdiffOpCopyN1N1) % 4)
+			offset, err := readRdiffInt(br, offsetLen)
+			if err != nil {
+				return err
+			}
+			length, err := readRdiffInt(br, lengthLen)
+			if err != nil {
+				return err
+			}
+			section := io.NewSectionReader(basis, int64(offset), int64(length))
+			n, err := io.Copy(bw, section)
+			if err != nil {
+				return errors.Wrap(err, "cannot copy from basis file")
+			}
+			if uint64(n) != length {
+				return errors.Wrapf(ErrRdiffFormat, "copy past the end of basis file at %v", offset)
+			}
+
+		default:
+			return errors.Wrapf(ErrRdiffFormat, "unknown command %#x", op)
+		}
+	}
+}
+
+func copyRdiffLiteral(r io.Reader, w io.Writer, length uint64) error {
+	n, err := io.CopyN(w, r, int64(length))
+	if uint64(n) != length {
+		return errors.Wrap(ErrRdiffFormat, "truncated literal")
+	}
+	return err
+}
+
+func readRdiffInt(r io.Reader, size int) (uint64, error) {
+	buffer := make([]byte, 8)
+	if _, err := io.ReadFull(r, buffer[8-size:]); err != nil {
+		return 0, errors.Wrap(ErrRdiffFormat, "truncated command")
+	}
+	return binary.BigEndian.Uint64(buffer), nil
+}
+
+// Writes delta commands, merging adjacent literals and copies like
+// librsync does.
+type rdiffDeltaEmitter struct {
+	w          *bufio.Writer
+	pending    []byte // literal bytes not written yet
+	copyOffset uint64
+	copyLength uint64 // zero when there is no pending copy
+}
+
+// Literals are flushed once they are that long, to limit memory use.
+const rdiffMaxLiteral = 1 << 20
+
+func newRdiffDeltaEmitter(w io.Writer) *rdiffDeltaEmitter {
+	return &rdiffDeltaEmitter{w: bufio.NewWriter(w)}
+}
+
+func (e *rdiffDeltaEmitter) header() error {
+	return binary.Write(e.w, binary.BigEndian, RdiffDeltaMagic)
+}
+
+func (e *rdiffDeltaEmitter) literal(p []byte) error {
+	if err := e.flushCopy(); err != nil {
+		return err
+	}
+	for len(p) > 0 {
+		n := min(len(p), rdiffMaxLiteral-len(e.pending))
+		e.pending = append(e.pending, p[:n]...)
+		p = p[n:]
+		if len(e.pending) >= rdiffMaxLiteral {
+			if err := e.flushLiteral(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (e *rdiffDeltaEmitter) copy(offset uint64, length uint64) error {
+	if err := e.flushLiteral(); err != nil {
+		return err
+	}
+	if e.copyLength > 0 && e.copyOffset+e.copyLength == offset {
+		e.copyLength += length
+		return nil
+	}
+	if err := e.flushCopy(); err != nil {
+		return err
+	}
+	e.copyOffset, e.copyLength = offset, length
+	return nil
+}
+
+func (e *rdiffDeltaEmitter) end() error {
+	if err := e.flushLiteral(); err != nil {
+		return err
+	}
+	if err := e.flushCopy(); err != nil {
+		return err
+	}
+	if err := e.w.WriteByte(rdiffOpEnd); err != nil {
+		return err
+	}
+	return e.w.Flush()
+}
+
+func (e *rdiffDeltaEmitter) flushLiteral() error {
+	length := uint64(len(e.pending))
+	if length == 0 {
+		return nil
+	}
+	if length <= rdiffOpLiteral64 {
+		if err := e.w.WriteByte(byte(length)); err != nil {
+			return err
+		}
+	} else {
+		size := rdiffIntLen(length)
+		if err := e.w.WriteByte(rdiffOpLiteralN1 + rdiffIntLenCode(size)); err != nil {
+			return err
+		}
+		if err := writeRdiffInt(e.w, length, size); err != nil {
+			return err
+		}
+	}
+	_, err := e.w.Write(e.pending)
+	e.pending = e.pending[:0]
+	return err
+}
+
+func (e *rdiffDeltaEmitter) flushCopy() error {
+	if e.copyLength == 0 {
+		return nil
+	}
+	offsetSize, lengthSize := rdiffIntLen(e.copyOffset), rdiffIntLen(e.copyLength)
+	op := rdiffOpCopyN1N1 + 4*rdiffIntLenCode(offsetSize) + rdiffIntLenCode(lengthSize)
+	if err := e.w.WriteByte(op); err != nil {
+		return err
+	}
+	if err := writeRdiffInt(e.w, e.copyOffset, offsetSize); err != nil {
+		return err
+	}
+	if err := writeRdiffInt(e.w, e.copyLength, lengthSize); err != nil {
+		return err
+	}
+	e.copyLength = 0
+	return nil
+}
+
+// Smallest number of bytes, 1, 2, 4 or 8, that holds the value.
+func rdiffIntLen(value uint64) int {
+	switch {
+	case value <= 0xff:
+		return 1
+	case value <= 0xffff:
+		return 2
+	case value <= 0xffffffff:
+		return 4
+	}
+	return 8
+}
+
+// Commands of 1, 2, 4 and 8 byte arguments go in this order.
+func rdiffIntLenCode(size int) byte {
+	switch size {
+	case 1:
+		return 0
+	case 2:
+		return 1
+	case 4:
+		return 2
+	}
+	return 3
+}
+
+func writeRdiffInt(w io.Writer, value uint64, size int) error {
+	buffer := make([]byte, 8)
+	binary.BigEndian.PutUint64(buffer, value)
+	_, err := w.Write(buffer[8-size:])
+	return err
+}
+
+// Hashes of rdiff blocks as HashGenerator and BlockProducer take them.
+type rdiffHashFactory struct {
+	magic     uint32
+	blockLen  int
+	strongLen int
+}
+
+func (hf rdiffHashFactory) MakeFastHash() hash.Hash32 {
+	if hf.magic == RdiffRkMD4SigMagic || hf.magic == RdiffRkBlake2SigMagic {
+		return NewRdiffRabinKarp(hf.blockLen)
+	}
+	return NewRdiffRollsum(hf.blockLen)
+}
+
+func (hf rdiffHashFactory) MakeStrongHash() hash.Hash {
+	newStrongHash, _ := rdiffStrongHashFor(hf.magic)
+	return truncatedHash{newStrongHash(), hf.strongLen}
+}
+
+// Signatures keep only the first bytes of strong hashes.
+type truncatedHash struct {
+	hash.Hash
+	size int
+}
+
+func (h truncatedHash) Size() int { return h.size }
+
+func (h truncatedHash) Sum(in []byte) []byte {
+	return append(in, h.Hash.Sum(nil)[:h.size]...)
+}
+
+// Window of the last blockLen bytes written to a rolling checksum.
+type rdiffWindow struct {
+	circle []byte
+	index  int
+	count  int // bytes in the window, up to len(circle)
+}
+
+// Add the byte to the end of the window. Once the window is full, the
+// byte at its start leaves it and is returned with true.
+func (w *rdiffWindow) push(b byte) (byte, bool) {
+	out, full := w.circle[w.index], w.count == len(w.circle)
+	w.circle[w.index] = b
+	w.index = (w.index + 1) % len(w.circle)
+	if !full {
+		w.count++
+	}
+	return out, full
+}
+
+func (w *rdiffWindow) reset() {
+	w.circle = make([]byte, len(w.circle))
+	w.index = 0
+	w.count = 0
+}
+
+func (w *rdiffWindow) Size() int { return 4 }
+
+func (w *rdiffWindow) BlockSize() int { return len(w.circle) }
+
+func sum32Bytes(in []byte, s uint32) []byte {
+	return append(in, byte(s>>24), byte(s>>16), byte(s>>8), byte(s))
+}
+
+const rollsumCharOffset = 31
+
+type rdiffRollsum struct {
+	rdiffWindow
+	s1, s2 uint32
+}
+
+/// Rolling checksum of librsync signatures with rollsum: the one of rsync
+/// with an offset added to every byte, so that runs of zero bytes of
+/// different length differ. Like NewMackerras, it rolls once blockLen
+/// bytes have been written.
+func NewRdiffRollsum(blockLen int) hash.Hash32 {
+	return &rdiffRollsum{rdiffWindow: rdiffWindow{circle: make([]byte, blockLen)}}
+}
+
+func (r *rdiffRollsum) Reset() {
+	r.reset()
+	r.s1, r.s2 = 0, 0
+}
+
+func (r *rdiffRollsum) Write(p []byte) (int, error) {
+	for _, in := range p {
+		if out, full := r.push(in); full {
+			r.s1 += uint32(in) - uint32(out)
+			r.s2 += r.s1 - uint32(r.count)*(uint32(out)+rollsumCharOffset)
+		} else {
+			r.s1 += uint32(in) + rollsumCharOffset
+			r.s2 += r.s1
+		}
+	}
+	return len(p), nil
+}
+
+func (r *rdiffRollsum) Sum32() uint32 { return r.s2<<16 | r.s1&0xffff }
+
+func (r *rdiffRollsum) Sum(in []byte) []byte { return sum32Bytes(in, r.Sum32()) }
+
+const (
+	rabinKarpSeed = 1
+	rabinKarpMult = 0x08104225
+	rabinKarpAdj  = rabinKarpMult - 1 // removes the seed together with a byte
+)
+
+type rdiffRabinKarp struct {
+	rdiffWindow
+	hash uint32
+	mult uint32 // rabinKarpMult to the power of the window length
+}
+
+/// Rolling checksum of librsync signatures with RabinKarp: polynomial
+/// checksum of the window, all arithmetic is modulo 2^32. It rolls once
+/// blockLen bytes have been written.
+func NewRdiffRabinKarp(blockLen int) hash.Hash32 {
+	return &rdiffRabinKarp{
+		rdiffWindow: rdiffWindow{circle: make([]byte, blockLen)},
+		hash:        rabinKarpSeed,
+		mult:        1,
+	}
+}
+
+func (r *rdiffRabinKarp) Reset() {
+	r.reset()
+	r.hash, r.mult = rabinKarpSeed, 1
+}
+
+func (r *rdiffRabinKarp) Write(p []byte) (int, error) {
+	for _, in := range p {
+		if out, full := r.push(in); full {
+			r.hash = r.hash*rabinKarpMult + uint32(in) - r.mult*(uint32(out)+rabinKarpAdj)
+		} else {
+			r.hash = r.hash*rabinKarpMult + uint32(in)
+			r.mult *= rabinKarpMult
+		}
+	}
+	return len(p), nil
+}
+
+func (r *rdiffRabinKarp) Sum32() uint32 { return r.hash }
+
+func (r *rdiffRabinKarp) Sum(in []byte) []byte { return sum32Bytes(in, r.Sum32()) }
@@ -0,0 +1,261 @@
+package carrybasket
+
+import (
+	"bytes"
+	"encoding/hex"
+	"github.com/stretchr/testify/assert"
+	"hash"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func mustDecodeHex(t *testing.T, s string) []byte {
+	data, err := hex.DecodeString(s)
+	assert.Nil(t, err)
+	return data
+}
+
+func TestRdiffSignature_Format(t *testing.T) {
+	signature, err := NewRdiffSignature(bytes.NewReader([]byte("a")), RdiffMD4SigMagic, 2048, 8)
+	assert.Nil(t, err)
+	var buffer bytes.Buffer
+	_, err = signature.WriteTo(&buffer)
+	assert.Nil(t, err)
+	// header, then rollsum and md4 of "a"
+	expected := "72730136" + "00000800" + "00000008" + "00800080" + "bde52cb31de33e46"
+	assert.Equal(t, mustDecodeHex(t, expected), buffer.Bytes())
+
+	read, err := ReadRdiffSignature(&buffer)
+	assert.Nil(t, err)
+	assert.Equal(t, signature, read)
+}
+
+func TestRdiffSignature_Defaults(t *testing.T) {
+	magic, err := RdiffSigMagicFor(RdiffHashBlake2, RdiffRabinKarp)
+	assert.Nil(t, err)
+	assert.Equal(t, RdiffRkBlake2SigMagic, magic)
+	_, err = RdiffSigMagicFor("sha1", RdiffRabinKarp)
+	assert.NotNil(t, err)
+
+	signature, err := NewRdiffSignature(bytes.NewReader([]byte("a")), magic, RdiffDefaultBlockLen, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 32, signature.StrongLen)
+	assert.Equal(t, 1, len(signature.Blocks))
+	assert.Equal(t, uint32(0x08104286), signature.Blocks[0].Weak)
+	assert.Equal(t,
+		mustDecodeHex(t, "8928aae63c84d87ea098564d1e03ad813f107add474e56aedd286349c0c03ea4"),
+		signature.Blocks[0].Strong,
+	)
+}
+
+func TestRdiffSignature_Invalid(t *testing.T) {
+	_, err := ReadRdiffSignature(bytes.NewReader(mustDecodeHex(t, "72730236")))
+	assert.NotNil(t, err)
+	_, err = ReadRdiffSignature(bytes.NewReader(mustDecodeHex(t, "12345678"+"00000800"+"00000008")))
+	assert.NotNil(t, err)
+	_, err = ReadRdiffSignature(bytes.NewReader(mustDecodeHex(t, "72730136"+"00000800"+"00000008"+"0080")))
+	assert.NotNil(t, err)
+}
+
+func TestRdiffWeakSum_RollMatchesFresh(t *testing.T) {
+	data := []byte("the quick brown fox jumps over the lazy dog")
+	blockLen := 8
+	for _, newWeakSum := range []func(int) hash.Hash32{NewRdiffRollsum, NewRdiffRabinKarp} {
+		rolling := newWeakSum(blockLen)
+		_, _ = rolling.Write(data[:blockLen])
+		for i := 1; i+blockLen <= len(data); i++ {
+			_, _ = rolling.Write(data[i+blockLen-1 : i+blockLen])
+			fresh := newWeakSum(blockLen)
+			_, _ = fresh.Write(data[i : i+blockLen])
+			assert.Equal(t, fresh.Sum32(), rolling.Sum32())
+			assert.Equal(t, fresh.Sum(nil), rolling.Sum(nil))
+		}
+
+		rolling.Reset()
+		fresh := newWeakSum(blockLen)
+		assert.Equal(t, fresh.Sum32(), rolling.Sum32())
+	}
+}
+
+func TestRdiffDelta_Format(t *testing.T) {
+	// empty basis, everything is a literal
+	signature, err := NewRdiffSignature(bytes.NewReader(nil), RdiffMD4SigMagic, 2048, 8)
+	assert.Nil(t, err)
+	var delta bytes.Buffer
+	assert.Nil(t, WriteRdiffDelta(signature, bytes.NewReader([]byte("abc")), &delta))
+	assert.Equal(t, mustDecodeHex(t, "72730236"+"03"+"616263"+"00"), delta.Bytes())
+
+	// identical files, one copy of the whole file
+	data := bytes.Repeat([]byte("x"), 2048)
+	signature, err = NewRdiffSignature(bytes.NewReader(data), RdiffMD4SigMagic, 2048, 8)
+	assert.Nil(t, err)
+	delta.Reset()
+	assert.Nil(t, WriteRdiffDelta(signature, bytes.NewReader(data), &delta))
+	assert.Equal(t, mustDecodeHex(t, "72730236"+"46"+"00"+"0800"+"00"), delta.Bytes())
+}
+
+func TestRdiffDelta_RoundTrip(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	basis := make([]byte, 10000)
+	random.Read(basis)
+
+	inserted := append([]byte("inserted"), basis[5000:]...)
+	cases := map[string][]byte{
+		"same":     basis,
+		"empty":    {},
+		"prefix":   append([]byte("prefix"), basis...),
+		"suffix":   append(append([]byte{}, basis...), "suffix"...),
+		"inserted": append(append([]byte{}, basis[:5000]...), inserted...),
+		"cut":      append(append([]byte{}, basis[:3000]...), basis[7000:]...),
+		"long":     bytes.Repeat(basis[:100], 200),
+		// blocks repeated in the new file are not in the basis
+		"repeated": bytes.Repeat([]byte("0123456789abcdef"), 200),
+	}
+	for _, magic := range []uint32{RdiffMD4SigMagic, RdiffBlake2SigMagic, RdiffRkMD4SigMagic, RdiffRkBlake2SigMagic} {
+		signature, err := NewRdiffSignature(bytes.NewReader(basis), magic, 512, 0)
+		assert.Nil(t, err)
+		for name, newFile := range cases {
+			var delta bytes.Buffer
+			assert.Nil(t, WriteRdiffDelta(signature, bytes.NewReader(newFile), &delta), name)
+			if name != "long" && name != "repeated" {
+				// unchanged blocks are copied, not sent
+				assert.True(t, delta.Len() < 2*signature.BlockLen, name)
+			}
+			var patched bytes.Buffer
+			assert.Nil(t, ApplyRdiffDelta(bytes.NewReader(basis), &delta, &patched), name)
+			assert.Equal(t, string(newFile), patched.String(), name)
+		}
+	}
+}
+
+func TestRdiffPatch_Commands(t *testing.T) {
+	basis := []byte("0123456789")
+	// literal "ab" with a length byte, copy 3 bytes from 4, 1-byte literal
+	delta := mustDecodeHex(t, "72730236"+"41"+"02"+"6162"+"45"+"04"+"03"+"01"+"63"+"00")
+	var patched bytes.Buffer
+	assert.Nil(t, ApplyRdiffDelta(bytes.NewReader(basis), bytes.NewReader(delta), &patched))
+	assert.Equal(t, "ab456c", patched.String())
+
+	for _, invalid := range []string{
+		"72730136" + "00",                      // signature magic
+		"72730236" + "0161",                    // no end
+		"72730236" + "55" + "00",               // unknown command
+		"72730236" + "45" + "08" + "05" + "00", // past the end of basis
+		"72730236" + "05" + "61" + "00",        // truncated literal
+	} {
+		patched.Reset()
+		err := ApplyRdiffDelta(bytes.NewReader(basis), bytes.NewReader(mustDecodeHex(t, invalid)), &patched)
+		assert.NotNil(t, err, invalid)
+	}
+}
+
+// Fixtures in testdata/rdiff, see generate.sh there.
+func readRdiffFixture(t *testing.T, name string) []byte {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", "rdiff", name))
+	assert.Nil(t, err)
+	return data
+}
+
+func TestRdiff_FixtureSignatures(t *testing.T) {
+	basis := readRdiffFixture(t, "basis")
+	for name, params := range map[string][3]int{
+		"basis.md4.sig":    {int(RdiffMD4SigMagic), 2048, 8},
+		"basis.blake2.sig": {int(RdiffRkBlake2SigMagic), 2048, 32},
+	} {
+		expected := readRdiffFixture(t, name)
+		read, err := ReadRdiffSignature(bytes.NewReader(expected))
+		assert.Nil(t, err, name)
+		assert.Len(t, read.Blocks, 3, name)
+
+		signature, err := NewRdiffSignature(bytes.NewReader(basis), uint32(params[0]), params[1], params[2])
+		assert.Nil(t, err, name)
+		assert.Equal(t, read, signature, name)
+		var written bytes.Buffer
+		_, err = signature.WriteTo(&written)
+		assert.Nil(t, err, name)
+		assert.Equal(t, expected, written.Bytes(), name)
+	}
+}
+
+func TestRdiff_FixtureDelta(t *testing.T) {
+	basis := readRdiffFixture(t, "basis")
+	newFile := readRdiffFixture(t, "new")
+	expected := readRdiffFixture(t, "new.delta")
+
+	var patched bytes.Buffer
+	assert.Nil(t, ApplyRdiffDelta(bytes.NewReader(basis), bytes.NewReader(expected), &patched))
+	assert.Equal(t, newFile, patched.Bytes())
+
+	// moved blocks, a literal and the short last block
+	for _, name := range []string{"basis.md4.sig", "basis.blake2.sig"} {
+		signature, err := ReadRdiffSignature(bytes.NewReader(readRdiffFixture(t, name)))
+		assert.Nil(t, err, name)
+		var delta bytes.Buffer
+		assert.Nil(t, WriteRdiffDelta(signature, bytes.NewReader(newFile), &delta), name)
+		assert.Equal(t, expected, delta.Bytes(), name)
+	}
+}
+
+// Files written here are read by rdiff and the other way round. Runs
+// only where librsync's rdiff is installed.
+func TestRdiff_Interop(t *testing.T) {
+	rdiff, err := exec.LookPath("rdiff")
+	if err != nil {
+		t.Skip("rdiff is not installed")
+	}
+	dir, err := ioutil.TempDir("", "carrybasket-rdiff")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := func(name string) string { return filepath.Join(dir, name) }
+	run := func(args ...string) {
+		output, err := exec.Command(rdiff, args...).CombinedOutput()
+		assert.Nil(t, err, string(output))
+	}
+
+	random := rand.New(rand.NewSource(2))
+	basis := make([]byte, 100000)
+	random.Read(basis)
+	newFile := append(append(append([]byte{}, basis[:30000]...), "changed"...), basis[40000:]...)
+	assert.Nil(t, ioutil.WriteFile(path("basis"), basis, 0644))
+	assert.Nil(t, ioutil.WriteFile(path("new"), newFile, 0644))
+
+	for _, hashes := range [][2]string{
+		{RdiffHashMD4, RdiffRollsum},
+		{RdiffHashBlake2, RdiffRabinKarp},
+	} {
+		magic, err := RdiffSigMagicFor(hashes[0], hashes[1])
+		assert.Nil(t, err)
+		run("signature", "-b", "1024", "-S", "8", "-H", hashes[0], "-R", hashes[1], path("basis"), path("rdiff.sig"))
+		signature, err := NewRdiffSignature(bytes.NewReader(basis), magic, 1024, 8)
+		assert.Nil(t, err)
+		var written bytes.Buffer
+		_, err = signature.WriteTo(&written)
+		assert.Nil(t, err)
+		assert.Equal(t, readFile(t, path("rdiff.sig")), written.Bytes())
+
+		// rdiff reads our signature and delta
+		assert.Nil(t, ioutil.WriteFile(path("our.sig"), written.Bytes(), 0644))
+		run("delta", path("our.sig"), path("new"), path("rdiff.delta"))
+		var delta bytes.Buffer
+		assert.Nil(t, WriteRdiffDelta(signature, bytes.NewReader(newFile), &delta))
+		assert.Nil(t, ioutil.WriteFile(path("our.delta"), delta.Bytes(), 0644))
+		run("patch", path("basis"), path("our.delta"), path("rdiff.patched"))
+		assert.Equal(t, newFile, readFile(t, path("rdiff.patched")))
+
+		// we read rdiff's delta
+		var patched bytes.Buffer
+		rdiffDelta := bytes.NewReader(readFile(t, path("rdiff.delta")))
+		assert.Nil(t, ApplyRdiffDelta(bytes.NewReader(basis), rdiffDelta, &patched))
+		assert.Equal(t, newFile, patched.Bytes())
+	}
+}
+
+func readFile(t *testing.T, filename string) []byte {
+	data, err := ioutil.ReadFile(filename)
+	assert.Nil(t, err)
+	return data
+}
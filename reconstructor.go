@@ -1,18 +1,25 @@
 package carrybasket
 
 import (
+	"github.com/pkg/errors"
 	"hash"
 	"io"
 	"sort"
 )
 
+var (
+	ErrOffsetMismatch = errors.New("current offset does not match another block offset")
+	ErrMissingHash    = errors.New("could not find hashed block in the cache")
+	ErrSizeMismatch   = errors.New("content block size does not match actual content length")
+)
+
 /// ContentReconstructor rebuilds a file from the given list of hashed
 /// and content blocks. Content blocks are inserted into the file as is,
 /// hashed blocks are looked up in a cache where actual content is stored.
 /// This abstraction is supposed to be used by the receiving (server)
 /// side.
 type ContentReconstructor interface {
-	Reconstruct(blocks []Block, w io.Writer) uint64
+	Reconstruct(blocks []Block, w io.Writer) (uint64, error)
 }
 
 type contentReconstructor struct {
@@ -34,8 +41,10 @@ func (b byOffset) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
 func (b byOffset) Less(i, j int) bool { return b[i].Offset() < b[j].Offset() }
 
 /// Reconstruct the file from the given blocks into the given writer w.
-/// Return the final offset, which is equal to file size.
-func (cr *contentReconstructor) Reconstruct(blocks []Block, w io.Writer) uint64 {
+/// Return the final offset, which is equal to file size. If a block
+/// cannot be placed into the file, ErrOffsetMismatch, ErrMissingHash or
+/// ErrSizeMismatch is returned (wrapped, use errors.Cause to check).
+func (cr *contentReconstructor) Reconstruct(blocks []Block, w io.Writer) (uint64, error) {
 	var offset uint64
 
 	// Sort blocks in the increasing offset order
@@ -43,30 +52,40 @@ func (cr *contentReconstructor) Reconstruct(blocks []Block, w io.Writer) uint64
 
 	for _, abstractBlock := range blocks {
 		if offset != abstractBlock.Offset() {
-			panic("current offset does not match another block offset")
+			return offset, errors.Wrapf(ErrOffsetMismatch,
+				"expected %v, got %v", offset, abstractBlock.Offset())
 		}
 
 		switch block := abstractBlock.(type) {
 		case ContentBlock:
-			n, _ := w.Write(block.Content())
+			n, err := w.Write(block.Content())
 			offset += uint64(n)
+			if err != nil {
+				return offset, errors.Wrap(err, "cannot write content block")
+			}
 			cr.updateStrongCacheWithContent(block)
 
 		case HashedBlock:
-			hashedBlock, ok := cr.strongHashCache.Get(block.HashSum())
+			cachedBlock, ok := cr.strongHashCache.Get(block.HashSum())
 			if !ok {
-				panic("could not find hashed block in the cache")
+				return offset, errors.Wrapf(ErrMissingHash, "offset %v", offset)
+			}
+			contentBlock, ok := cachedBlock.(ContentBlock)
+			if !ok {
+				return offset, errors.Wrapf(ErrMissingHash, "offset %v", offset)
 			}
-			contentBlock := hashedBlock.(ContentBlock)
 			if contentBlock.Size() != uint64(len(contentBlock.Content())) {
-				panic("content block size does not match actual content length")
+				return offset, errors.Wrapf(ErrSizeMismatch, "offset %v", offset)
 			}
-			n, _ := w.Write(contentBlock.Content())
+			n, err := w.Write(contentBlock.Content())
 			offset += uint64(n)
+			if err != nil {
+				return offset, errors.Wrap(err, "cannot write hashed block")
+			}
 		}
 	}
 
-	return offset
+	return offset, nil
 }
 
 // Client will not send the same content block twice. Instead, it will reuse already
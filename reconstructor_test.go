@@ -3,6 +3,7 @@ package carrybasket
 import (
 	"bytes"
 	"crypto/md5"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 	"io/ioutil"
 	"testing"
@@ -12,7 +13,8 @@ func TestContentReconstructor_Smoke(t *testing.T) {
 	strongHashCache := NewBlockCache()
 	strongHasher := md5.New()
 	reconstructor := NewContentReconstructor(strongHasher, strongHashCache)
-	reconstructor.Reconstruct(nil, ioutil.Discard)
+	_, err := reconstructor.Reconstruct(nil, ioutil.Discard)
+	assert.Nil(t, err)
 }
 
 func TestContentReconstructor_Empty(t *testing.T) {
@@ -20,7 +22,8 @@ func TestContentReconstructor_Empty(t *testing.T) {
 	strongHasher := md5.New()
 	reconstructor := NewContentReconstructor(strongHasher, strongHashCache)
 	buffer := bytes.NewBuffer(nil)
-	n := reconstructor.Reconstruct([]Block{}, buffer)
+	n, err := reconstructor.Reconstruct([]Block{}, buffer)
+	assert.Nil(t, err)
 	assert.Equal(t, uint64(0), n)
 	assert.Equal(t, "", buffer.String())
 }
@@ -33,7 +36,8 @@ func TestContentReconstructor_OneContent(t *testing.T) {
 	blocks := []Block{
 		NewContentBlock(0, 4, []byte("1234")),
 	}
-	n := reconstructor.Reconstruct(blocks, buffer)
+	n, err := reconstructor.Reconstruct(blocks, buffer)
+	assert.Nil(t, err)
 	assert.Equal(t, uint64(4), n)
 	assert.Equal(t, "1234", buffer.String())
 }
@@ -47,7 +51,8 @@ func TestContentReconstructor_TwoContent(t *testing.T) {
 		NewContentBlock(0, 4, []byte("1234")),
 		NewContentBlock(4, 4, []byte("abcd")),
 	}
-	n := reconstructor.Reconstruct(blocks, buffer)
+	n, err := reconstructor.Reconstruct(blocks, buffer)
+	assert.Nil(t, err)
 	assert.Equal(t, uint64(8), n)
 	assert.Equal(t, "1234abcd", buffer.String())
 }
@@ -61,8 +66,9 @@ func TestContentReconstructor_TwoContentInvalidOffset(t *testing.T) {
 		NewContentBlock(0, 4, []byte("1234")),
 		NewContentBlock(100, 4, []byte("abcd")),
 	}
-	assert.PanicsWithValue(t, "current offset does not match another block offset",
-		func() { reconstructor.Reconstruct(blocks, buffer) })
+	n, err := reconstructor.Reconstruct(blocks, buffer)
+	assert.Equal(t, ErrOffsetMismatch, errors.Cause(err))
+	assert.Equal(t, uint64(4), n)
 }
 
 func TestContentReconstructor_TwoContentReorder(t *testing.T) {
@@ -74,7 +80,8 @@ func TestContentReconstructor_TwoContentReorder(t *testing.T) {
 		NewContentBlock(4, 4, []byte("1234")),
 		NewContentBlock(0, 4, []byte("abcd")),
 	}
-	n := reconstructor.Reconstruct(blocks, buffer)
+	n, err := reconstructor.Reconstruct(blocks, buffer)
+	assert.Nil(t, err)
 	assert.Equal(t, uint64(8), n)
 	assert.Equal(t, "abcd1234", buffer.String())
 }
@@ -87,8 +94,9 @@ func TestContentReconstructor_MissingHash(t *testing.T) {
 	blocks := []Block{
 		NewHashedBlock(0, 4, []byte("abcd")),
 	}
-	assert.PanicsWithValue(t, "could not find hashed block in the cache",
-		func() { reconstructor.Reconstruct(blocks, buffer) })
+	n, err := reconstructor.Reconstruct(blocks, buffer)
+	assert.Equal(t, ErrMissingHash, errors.Cause(err))
+	assert.Equal(t, uint64(0), n)
 }
 
 func TestContentReconstructor_ContentAndHash(t *testing.T) {
@@ -101,7 +109,8 @@ func TestContentReconstructor_ContentAndHash(t *testing.T) {
 		NewContentBlock(0, 4, []byte("1234")),
 		NewHashedBlock(4, 4, []byte("#abcd")),
 	}
-	n := reconstructor.Reconstruct(blocks, buffer)
+	n, err := reconstructor.Reconstruct(blocks, buffer)
+	assert.Nil(t, err)
 	assert.Equal(t, uint64(8), n)
 	assert.Equal(t, "1234wxyz", buffer.String())
 }
@@ -3,45 +3,398 @@ package main
 //go:generate protoc -I=.. --go_out=plugins=grpc:../rpc ../sync_service.proto
 
 import (
+	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
 
 	"github.com/balta2ar/carrybasket"
 	"github.com/urfave/cli"
+	"google.golang.org/grpc/credentials"
 )
 
 func action(c *cli.Context) error {
+	if c.String("config") != "" {
+		return modulesAction(c)
+	}
+
+	logger := newLogger(c)
 	targetDir := c.Args().Get(0)
-	log.Printf("targetDir %v\n", targetDir)
+	if targetDir == "" {
+		targetDir = c.String("target-dir")
+	}
 	if _, err := os.Stat(targetDir); os.IsNotExist(err) {
 		log.Fatalln("Please specify an existing target dir")
 	}
 
-	blockSize := 64 * 1024
+	blockSize := c.Int("block-size")
 	fs := carrybasket.NewActualFilesystem(".")
-	address := "0.0.0.0:20000"
+	address := c.String("listen-address")
 
-	log.Printf(
-		"starting server: blockSize %v, targetDir %v, address %v (pid %v)\n",
-		blockSize, targetDir, address, os.Getpid(),
+	logger.Info(
+		"starting server",
+		carrybasket.Field("block_size", blockSize),
+		carrybasket.Field("target_dir", targetDir),
+		carrybasket.Field("address", address),
+		carrybasket.Field("pid", os.Getpid()),
 	)
 	os.Chdir(targetDir)
-	hashFactory := carrybasket.NewHashFactory(blockSize)
-	server := carrybasket.NewSyncServiceServer(blockSize, targetDir, fs, address, hashFactory)
-	err := server.Serve()
+	hashFactory := newHashFactory(c, blockSize)
+	server := carrybasket.NewSyncServiceServer(blockSize, targetDir, fs, address, hashFactory, logger)
+	secureServer(c, server)
+	server.SetDeletionGuard(deletionGuard(c))
+	server.SetClientBandwidthLimit(clientBandwidthLimit(c))
+	server.SetMetrics(serveMetrics(c, logger))
+	retention := carrybasket.VersionRetention{
+		KeepVersions: c.Int("keep-versions"),
+		KeepDays:     c.Int("keep-days"),
+	}
+	if err := server.SetVersionRetention(carrybasket.DefaultModule, retention); err != nil {
+		log.Fatalf("server retention error: %v\n", err)
+	}
+	snapshotRetention := carrybasket.SnapshotRetention{
+		KeepSnapshots: c.Int("keep-snapshots"),
+		KeepDays:      c.Int("keep-snapshot-days"),
+	}
+	if err := server.SetSnapshotRetention(carrybasket.DefaultModule, snapshotRetention); err != nil {
+		log.Fatalf("server retention error: %v\n", err)
+	}
+	serve(c, server, logger)
+	return nil
+}
+
+// Serve named modules declared in the config file
+func modulesAction(c *cli.Context) error {
+	logger := newLogger(c)
+	configs, err := carrybasket.LoadModulesConfig(c.String("config"))
 	if err != nil {
+		log.Fatalf("config error: %v\n", err)
+	}
+
+	blockSize := c.Int("block-size")
+	address := c.String("listen-address")
+
+	logger.Info(
+		"starting server",
+		carrybasket.Field("block_size", blockSize),
+		carrybasket.Field("config", c.String("config")),
+		carrybasket.Field("address", address),
+		carrybasket.Field("pid", os.Getpid()),
+	)
+	hashFactory := newHashFactory(c, blockSize)
+	server := carrybasket.NewSyncServiceServer(blockSize, "", nil, address, hashFactory, logger)
+	secureServer(c, server)
+	server.SetDeletionGuard(deletionGuard(c))
+	server.SetClientBandwidthLimit(clientBandwidthLimit(c))
+	server.SetMetrics(serveMetrics(c, logger))
+	// modules with the same path share the filesystem, and thus the lock
+	filesystems := make(map[string]carrybasket.VirtualFilesystem)
+	for _, config := range configs {
+		if _, err := os.Stat(config.Path); os.IsNotExist(err) {
+			log.Fatalf("module %v: path %v does not exist\n", config.Name, config.Path)
+		}
+		logger.Info(
+			"serving module",
+			carrybasket.Field("module", config.Name), carrybasket.Field("path", config.Path),
+		)
+		path := filepath.Clean(config.Path)
+		fs, ok := filesystems[path]
+		if !ok {
+			fs = carrybasket.NewActualFilesystem(path)
+			filesystems[path] = fs
+		}
+		server.AddModule(config.Name, fs, config.Access)
+		if err := server.SetVersionRetention(config.Name, config.Retention); err != nil {
+			log.Fatalf("server retention error: %v\n", err)
+		}
+		if err := server.SetSnapshotRetention(config.Name, config.SnapshotRetention); err != nil {
+			log.Fatalf("server retention error: %v\n", err)
+		}
+	}
+
+	serve(c, server, logger)
+	return nil
+}
+
+// Server calls that run it.
+type runningServer interface {
+	Serve() error
+	Shutdown(timeout time.Duration)
+}
+
+// Serve until SIGINT or SIGTERM, then let running calls finish.
+func serve(c *cli.Context, server runningServer, logger carrybasket.Logger) {
+	stopped := make(chan struct{})
+	go func() {
+		sig := <-notifySignals()
+		logger.Info("shutting down", carrybasket.Field("signal", sig))
+		server.Shutdown(c.Duration("shutdown-timeout"))
+		close(stopped)
+	}()
+
+	if err := server.Serve(); err != nil {
 		log.Fatalf("server serve error: %v\n", err)
 	}
+	<-stopped
+}
 
-	log.Println("server done")
+// Channel that receives SIGINT and SIGTERM. The second signal exits
+// at once, without waiting for a graceful shutdown.
+func notifySignals() <-chan os.Signal {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	first := make(chan os.Signal, 1)
+	go func() {
+		first <- <-signals
+		<-signals
+		log.Fatalln("interrupted")
+	}()
+	return first
+}
+
+func newHashFactory(c *cli.Context, blockSize int) carrybasket.HashFactory {
+	hashFactory, err := carrybasket.NewHashFactoryFor(blockSize, c.String("fast-hash"), c.String("strong-hash"))
+	if err != nil {
+		log.Fatalf("hash error: %v\n", err)
+	}
+	return hashFactory
+}
+
+// Server calls that set up its security.
+type securedServer interface {
+	SetAuthToken(token string)
+	SetCredentials(creds credentials.TransportCredentials)
+}
+
+// Require the auth token and serve over TLS when they are given.
+func secureServer(c *cli.Context, server securedServer) {
+	server.SetAuthToken(c.String("auth-token"))
+	cert, key := c.String("tls-cert"), c.String("tls-key")
+	if cert == "" && key == "" {
+		return
+	}
+	if cert == "" || key == "" {
+		log.Fatalln("Please specify both tls-cert and tls-key")
+	}
+	creds, err := credentials.NewServerTLSFromFile(cert, key)
+	if err != nil {
+		log.Fatalf("tls error: %v\n", err)
+	}
+	server.SetCredentials(creds)
+}
+
+// Fill the flags given neither on the command line nor in the
+// environment from the settings file.
+func applySettings(c *cli.Context) error {
+	filename := c.String("settings")
+	if filename == "" {
+		return nil
+	}
+	settings, err := carrybasket.LoadSettings(filename)
+	if err != nil {
+		return err
+	}
+	for _, name := range settings.Keys() {
+		if name == "settings" || c.IsSet(name) {
+			continue
+		}
+		for _, value := range settings[name] {
+			if err := c.Set(name, value); err != nil {
+				return fmt.Errorf("setting %v: %v", name, err)
+			}
+		}
+	}
 	return nil
 }
 
+func clientBandwidthLimit(c *cli.Context) carrybasket.BandwidthSchedule {
+	if c.String("client-bwlimit") == "" {
+		return nil
+	}
+	schedule, err := carrybasket.ParseBandwidthSchedule(c.String("client-bwlimit"))
+	if err != nil {
+		log.Fatalf("client-bwlimit error: %v\n", err)
+	}
+	return schedule
+}
+
+// Logger set up by the flags. Messages of the standard log package,
+// e.g. fatal errors, go through it as well.
+func newLogger(c *cli.Context) carrybasket.Logger {
+	level, err := carrybasket.ParseLogLevel(c.GlobalString("log-level"))
+	if err != nil {
+		log.Fatalf("log-level error: %v\n", err)
+	}
+	json := false
+	switch c.GlobalString("log-format") {
+	case "text":
+	case "json":
+		json = true
+	default:
+		log.Fatalf("unknown log format %q, use text or json\n", c.GlobalString("log-format"))
+	}
+
+	logger := carrybasket.NewLogger(os.Stderr, level, json)
+	log.SetFlags(0)
+	log.SetOutput(carrybasket.NewLogWriter(logger, carrybasket.LogError))
+	return logger
+}
+
+// Serve metrics when asked to, nil otherwise.
+func serveMetrics(c *cli.Context, logger carrybasket.Logger) *carrybasket.Metrics {
+	address := c.String("metrics-address")
+	if address == "" {
+		return nil
+	}
+	metrics := carrybasket.NewMetrics()
+	go func() {
+		logger.Info("serving metrics", carrybasket.Field("address", address+carrybasket.MetricsPath))
+		if err := carrybasket.ServeMetrics(address, metrics); err != nil {
+			log.Fatalf("metrics error: %v\n", err)
+		}
+	}()
+	return metrics
+}
+
+func deletionGuard(c *cli.Context) carrybasket.DeletionGuard {
+	return carrybasket.DeletionGuard{
+		MaxFiles:   c.Int("max-delete"),
+		MaxPercent: c.Float64("max-delete-percent"),
+		MinFiles:   c.Int("max-delete-min-files"),
+	}
+}
+
 func main() {
 	app := cli.NewApp()
 	app.Name = "carrybasket_server"
 	app.Usage = "Run carrybasket server"
+	app.ArgsUsage = "[target dir]"
 	app.Action = action
+	app.Before = applySettings
+	app.Flags = []cli.Flag{
+		cli.StringFlag{
+			Name:   "auth-token",
+			Usage:  "refuse clients that do not send this token",
+			EnvVar: "CARRYBASKET_AUTH_TOKEN",
+		},
+		cli.IntFlag{
+			Name:   "block-size",
+			Value:  64 * 1024,
+			Usage:  "size of blocks in bytes, must be the same on the clients",
+			EnvVar: "CARRYBASKET_BLOCK_SIZE",
+		},
+		cli.StringFlag{
+			Name:   "client-bwlimit",
+			Usage:  "limit upload rate of every client, e.g. \"512k\" or \"08:00,512k 18:00,off\"",
+			EnvVar: "CARRYBASKET_CLIENT_BWLIMIT",
+		},
+		cli.StringFlag{
+			Name:   "config",
+			Usage:  "serve named modules declared in this file instead of a single dir",
+			EnvVar: "CARRYBASKET_CONFIG",
+		},
+		cli.StringFlag{
+			Name:   "fast-hash",
+			Value:  carrybasket.FastHashMackerras,
+			Usage:  "rolling hash of blocks, must be the same on the clients: mackerras",
+			EnvVar: "CARRYBASKET_FAST_HASH",
+		},
+		cli.StringFlag{
+			Name:   "listen-address",
+			Value:  "0.0.0.0:20000",
+			Usage:  "address to serve clients on",
+			EnvVar: "CARRYBASKET_LISTEN_ADDRESS",
+		},
+		cli.IntFlag{
+			Name:   "max-delete",
+			Usage:  "refuse pushes that remove more files than this, 0 means no limit",
+			EnvVar: "CARRYBASKET_MAX_DELETE",
+		},
+		cli.Float64Flag{
+			Name:   "max-delete-percent",
+			Value:  50,
+			Usage:  "refuse pushes that remove a bigger share of files, 0 means no limit",
+			EnvVar: "CARRYBASKET_MAX_DELETE_PERCENT",
+		},
+		cli.IntFlag{
+			Name:   "max-delete-min-files",
+			Value:  10,
+			Usage:  "apply --max-delete-percent only to pushes that remove at least this many files",
+			EnvVar: "CARRYBASKET_MAX_DELETE_MIN_FILES",
+		},
+		cli.StringFlag{
+			Name:   "log-format",
+			Value:  "text",
+			Usage:  "format of log messages: text or json",
+			EnvVar: "CARRYBASKET_LOG_FORMAT",
+		},
+		cli.StringFlag{
+			Name:   "log-level",
+			Value:  "info",
+			Usage:  "log messages of this level and above: debug, info, warn or error",
+			EnvVar: "CARRYBASKET_LOG_LEVEL",
+		},
+		cli.StringFlag{
+			Name:   "metrics-address",
+			Usage:  "serve Prometheus metrics on this address, e.g. \":9100\"",
+			EnvVar: "CARRYBASKET_METRICS_ADDRESS",
+		},
+		cli.IntFlag{
+			Name:   "keep-versions",
+			Usage:  "number of previous versions kept per file, 0 keeps all",
+			EnvVar: "CARRYBASKET_KEEP_VERSIONS",
+		},
+		cli.IntFlag{
+			Name:   "keep-days",
+			Usage:  "days to keep previous versions of files, 0 keeps them forever",
+			EnvVar: "CARRYBASKET_KEEP_DAYS",
+		},
+		cli.IntFlag{
+			Name:   "keep-snapshots",
+			Usage:  "number of the most recent snapshots kept, 0 keeps all",
+			EnvVar: "CARRYBASKET_KEEP_SNAPSHOTS",
+		},
+		cli.IntFlag{
+			Name:   "keep-snapshot-days",
+			Usage:  "days to keep snapshots, 0 keeps them forever",
+			EnvVar: "CARRYBASKET_KEEP_SNAPSHOT_DAYS",
+		},
+		cli.StringFlag{
+			Name:   "settings",
+			Usage:  "read flags from this TOML file, flags and environment take precedence",
+			EnvVar: "CARRYBASKET_SETTINGS",
+		},
+		cli.DurationFlag{
+			Name:   "shutdown-timeout",
+			Value:  30 * time.Second,
+			Usage:  "how long running calls may take after SIGINT or SIGTERM",
+			EnvVar: "CARRYBASKET_SHUTDOWN_TIMEOUT",
+		},
+		cli.StringFlag{
+			Name:   "strong-hash",
+			Value:  carrybasket.StrongHashMD5,
+			Usage:  "hash of blocks and files, must be the same on the clients: md5, sha1 or sha256",
+			EnvVar: "CARRYBASKET_STRONG_HASH",
+		},
+		cli.StringFlag{
+			Name:   "target-dir",
+			Usage:  "dir to serve when it is not given as the argument",
+			EnvVar: "CARRYBASKET_TARGET_DIR",
+		},
+		cli.StringFlag{
+			Name:   "tls-cert",
+			Usage:  "serve over TLS with this certificate file, needs tls-key",
+			EnvVar: "CARRYBASKET_TLS_CERT",
+		},
+		cli.StringFlag{
+			Name:   "tls-key",
+			Usage:  "private key file of the TLS certificate",
+			EnvVar: "CARRYBASKET_TLS_KEY",
+		},
+	}
 
 	err := app.Run(os.Args)
 	if err != nil {
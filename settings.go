@@ -0,0 +1,68 @@
+package carrybasket
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"sort"
+
+	"github.com/BurntSushi/toml"
+)
+
+/// Settings read from a TOML file. Keys are the names of command line
+/// flags, values are kept as the strings that would be given to the
+/// flags, so that the file, environment and flags are parsed alike:
+///
+///     address = "sync.example.com:20000"
+///     block-size = 65536
+///     ignore = ["*.tmp", ".git/"]
+///
+/// Lists are for flags that can be repeated.
+type Settings map[string][]string
+
+func LoadSettings(filename string) (Settings, error) {
+	values := make(map[string]interface{})
+	if _, err := toml.DecodeFile(filename, &values); err != nil {
+		return nil, errors.Wrap(err, "cannot load settings")
+	}
+	return settingsFromValues(values)
+}
+
+func ParseSettings(text string) (Settings, error) {
+	values := make(map[string]interface{})
+	if _, err := toml.Decode(text, &values); err != nil {
+		return nil, errors.Wrap(err, "cannot parse settings")
+	}
+	return settingsFromValues(values)
+}
+
+func settingsFromValues(values map[string]interface{}) (Settings, error) {
+	settings := make(Settings, len(values))
+	for key, value := range values {
+		switch v := value.(type) {
+		case string, int64, float64, bool:
+			settings[key] = []string{fmt.Sprint(v)}
+		case []interface{}:
+			for _, item := range v {
+				switch item.(type) {
+				case string, int64, float64, bool:
+					settings[key] = append(settings[key], fmt.Sprint(item))
+				default:
+					return nil, errors.Errorf("setting %v: unsupported list item %v", key, item)
+				}
+			}
+		default:
+			return nil, errors.Errorf("setting %v: unsupported value %v", key, value)
+		}
+	}
+	return settings, nil
+}
+
+/// Setting names in a stable order.
+func (s Settings) Keys() []string {
+	keys := make([]string, 0, len(s))
+	for key := range s {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,30 @@
+package carrybasket
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestParseSettings(t *testing.T) {
+	settings, err := ParseSettings(`
+address = "sync.example.com:20000"
+block-size = 4096
+two-way = true
+max-delete-percent = 12.5
+ignore = ["*.tmp", "build/"]
+`)
+	assert.Nil(t, err)
+	assert.Equal(t, Settings{
+		"address":            {"sync.example.com:20000"},
+		"block-size":         {"4096"},
+		"two-way":            {"true"},
+		"max-delete-percent": {"12.5"},
+		"ignore":             {"*.tmp", "build/"},
+	}, settings)
+	assert.Equal(t, []string{"address", "block-size", "ignore", "max-delete-percent", "two-way"}, settings.Keys())
+
+	for _, text := range []string{"address", "[client]\naddress = \"a\"", "ignore = [[\"a\"]]"} {
+		_, err := ParseSettings(text)
+		assert.NotNil(t, err, text)
+	}
+}
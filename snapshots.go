@@ -0,0 +1,405 @@
+package carrybasket
+
+import (
+	"encoding/hex"
+	"github.com/pkg/errors"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/// Consistent state of the whole tree at some point in time.
+type Snapshot struct {
+	Id   string    /// time of the snapshot in VersionTimeFormat
+	Time time.Time /// when the snapshot was taken
+}
+
+/// How long snapshots are kept. Zero means no limit. The latest snapshot
+/// is always kept.
+type SnapshotRetention struct {
+	KeepSnapshots int /// number of the most recent snapshots kept
+	KeepDays      int /// snapshots older than this are removed
+}
+
+/// Records snapshots of the tree and gives access to their files.
+/// Snapshots are kept inside MetadataDir. Every snapshot is a list of
+/// filenames and digests saved in the SyncState format:
+///
+///     .carrybasket/snapshots/20190102-150405.000000000
+///
+/// and the content of the files is stored once per digest, so files
+/// that have not changed between snapshots take no extra space:
+///
+///     .carrybasket/objects/<digest>
+///
+/// Contents that no snapshot refers to anymore are removed by Prune.
+type snapshots struct {
+	fs        VirtualFilesystem
+	retention SnapshotRetention
+	now       func() time.Time
+	taken     []Snapshot /// snapshots listed so far, nil until listed
+	lock      sync.Mutex /// guards taken, List runs along with other readers
+}
+
+func NewSnapshots(fs VirtualFilesystem, retention SnapshotRetention) *snapshots {
+	return &snapshots{
+		fs:        fs,
+		retention: retention,
+		now:       time.Now,
+	}
+}
+
+func snapshotsDir() string {
+	return filepath.Join(MetadataDir, "snapshots")
+}
+
+func snapshotFilename(id string) string {
+	return filepath.Join(snapshotsDir(), id)
+}
+
+func objectFilename(digest string) string {
+	return filepath.Join(MetadataDir, "objects", digest)
+}
+
+/// Record current state of the tree. When nothing has changed since
+/// the latest snapshot, no new one is made and the latest is returned
+/// with false.
+func (ss *snapshots) Take() (Snapshot, bool, error) {
+	filenames, err := ss.fs.ListAll()
+	if err != nil {
+		return Snapshot{}, false, errors.Wrap(err, "cannot list filesystem")
+	}
+
+	state := make(SyncState, len(filenames))
+	for _, filename := range filenames {
+		if isMetadataPath(filename) {
+			continue
+		}
+		if ss.fs.IsDir(filename) {
+			state[filename] = DirDigest
+			continue
+		}
+		digest, err := ss.storeObject(filename)
+		if err != nil {
+			return Snapshot{}, false, err
+		}
+		state[filename] = digest
+	}
+
+	return ss.record(state)
+}
+
+/// Record state of the tree after the commands have been applied to it.
+/// Only files changed by the commands are looked at, the rest is taken
+/// from the latest snapshot, and digests the commands carry are used
+/// instead of reading the files again. Without any snapshot the whole
+/// tree is recorded as in Take.
+func (ss *snapshots) TakeAfter(commands []AdjustmentCommand) (Snapshot, bool, error) {
+	latest, ok, err := ss.latest()
+	if err != nil {
+		return Snapshot{}, false, err
+	}
+	if !ok {
+		return ss.Take()
+	}
+	latestState, err := LoadSyncState(ss.fs, snapshotFilename(latest.Id))
+	if err != nil {
+		return Snapshot{}, false, err
+	}
+
+	state := make(SyncState, len(latestState))
+	for filename, digest := range latestState {
+		state[filename] = digest
+	}
+	for _, abstractCommand := range commands {
+		switch command := abstractCommand.(type) {
+		case AdjustmentCommandRemoveFile:
+			removeFromState(state, command.filename)
+		case AdjustmentCommandMkDir:
+			if state[command.filename] != DirDigest {
+				removeFromState(state, command.filename)
+			}
+			addParentsToState(state, command.filename)
+			state[command.filename] = DirDigest
+		case AdjustmentCommandApplyBlocksToFile:
+			var digest string
+			if len(command.digest) > 0 {
+				digest = hex.EncodeToString(command.digest)
+				err = ss.storeObjectAs(command.filename, digest)
+			} else {
+				digest, err = ss.storeObject(command.filename)
+			}
+			if err != nil {
+				return Snapshot{}, false, err
+			}
+			removeFromState(state, command.filename)
+			addParentsToState(state, command.filename)
+			state[command.filename] = digest
+		}
+	}
+	return ss.record(state)
+}
+
+// Remove the file, or the directory with everything inside.
+func removeFromState(state SyncState, filename string) {
+	delete(state, filename)
+	prefix := filename + "/"
+	for other := range state {
+		if strings.HasPrefix(other, prefix) {
+			delete(state, other)
+		}
+	}
+}
+
+// Writing a file creates its parent directories as well.
+func addParentsToState(state SyncState, filename string) {
+	for dir := filepath.Dir(filename); dir != "."; dir = filepath.Dir(dir) {
+		state[dir] = DirDigest
+	}
+}
+
+// Save the state as a new snapshot, unless it is the same as the latest.
+func (ss *snapshots) record(state SyncState) (Snapshot, bool, error) {
+	latest, ok, err := ss.latest()
+	if err != nil {
+		return Snapshot{}, false, err
+	}
+	if ok {
+		latestState, err := LoadSyncState(ss.fs, snapshotFilename(latest.Id))
+		if err != nil {
+			return Snapshot{}, false, err
+		}
+		if syncStatesEqual(state, latestState) {
+			return latest, false, nil
+		}
+	}
+
+	t := ss.now().UTC()
+	for ss.fs.IsPath(snapshotFilename(t.Format(VersionTimeFormat))) {
+		t = t.Add(time.Nanosecond)
+	}
+	snapshot := Snapshot{t.Format(VersionTimeFormat), t}
+	if err := mkdirParents(ss.fs, snapshotFilename(snapshot.Id)); err != nil {
+		return Snapshot{}, false, err
+	}
+	if err := SaveSyncState(ss.fs, snapshotFilename(snapshot.Id), state); err != nil {
+		return Snapshot{}, false, errors.Wrap(err, "cannot save snapshot")
+	}
+
+	ss.lock.Lock()
+	ss.taken = append(ss.taken, snapshot)
+	ss.lock.Unlock()
+	return snapshot, true, nil
+}
+
+func (ss *snapshots) latest() (Snapshot, bool, error) {
+	taken, err := ss.List()
+	if err != nil || len(taken) == 0 {
+		return Snapshot{}, false, err
+	}
+	return taken[len(taken)-1], true, nil
+}
+
+// Copy the file into objects unless its content is there already.
+func (ss *snapshots) storeObject(filename string) (string, error) {
+	r, err := ss.fs.OpenRead(filename)
+	if err != nil {
+		return "", errors.Wrapf(err, "cannot open %v", filename)
+	}
+	digest := NewFileDigest()
+	_, err = io.Copy(digest, r)
+	_ = r.Close()
+	if err != nil {
+		return "", errors.Wrapf(err, "cannot read %v", filename)
+	}
+
+	hexDigest := hex.EncodeToString(digest.Sum(nil))
+	return hexDigest, ss.storeObjectAs(filename, hexDigest)
+}
+
+// Same as storeObject when the digest of the file is already known.
+func (ss *snapshots) storeObjectAs(filename string, hexDigest string) error {
+	object := objectFilename(hexDigest)
+	if ss.fs.IsPath(object) {
+		return nil
+	}
+
+	if err := mkdirParents(ss.fs, object); err != nil {
+		return err
+	}
+	tempFilename := tempFileFor(object)
+	if err := copyFile(ss.fs, filename, tempFilename); err != nil {
+		_ = ss.fs.Delete(tempFilename)
+		return errors.Wrapf(err, "cannot store %v", filename)
+	}
+	return ss.fs.Move(tempFilename, object)
+}
+
+func syncStatesEqual(left SyncState, right SyncState) bool {
+	if len(left) != len(right) {
+		return false
+	}
+	for filename, digest := range left {
+		if rightDigest, ok := right[filename]; !ok || rightDigest != digest {
+			return false
+		}
+	}
+	return true
+}
+
+/// All snapshots, oldest first. The tree is listed only once, later
+/// snapshots are remembered as they are taken.
+func (ss *snapshots) List() ([]Snapshot, error) {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+	if ss.taken == nil {
+		taken, err := ss.listAll()
+		if err != nil {
+			return nil, err
+		}
+		ss.taken = taken
+	}
+	return append([]Snapshot(nil), ss.taken...), nil
+}
+
+func (ss *snapshots) listAll() ([]Snapshot, error) {
+	filenames, err := ss.fs.ListAll()
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot list filesystem")
+	}
+
+	prefix := snapshotsDir() + "/"
+	taken := make([]Snapshot, 0)
+	for _, filename := range filenames {
+		if !strings.HasPrefix(filename, prefix) {
+			continue
+		}
+		id := filename[len(prefix):]
+		if t, err := time.Parse(VersionTimeFormat, id); err == nil {
+			taken = append(taken, Snapshot{id, t})
+		}
+	}
+	sort.Slice(taken, func(i, j int) bool {
+		return taken[i].Time.Before(taken[j].Time)
+	})
+	return taken, nil
+}
+
+/// Open files of the snapshot the same way ListClientFiles opens files
+/// of the tree. Files have to be closed with CloseClientFiles.
+func (ss *snapshots) Open(id string) ([]VirtualFile, error) {
+	if _, err := time.Parse(VersionTimeFormat, id); err != nil {
+		return nil, errors.Errorf("invalid snapshot: %q", id)
+	}
+	if !ss.fs.IsPath(snapshotFilename(id)) {
+		return nil, errors.Errorf("no snapshot %v", id)
+	}
+	state, err := LoadSyncState(ss.fs, snapshotFilename(id))
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]VirtualFile, 0, len(state))
+	for _, filename := range state.Filenames() {
+		if state[filename] == DirDigest {
+			files = append(files, VirtualFile{
+				Filename: filename,
+				IsDir:    true,
+				Rw:       nil,
+			})
+			continue
+		}
+
+		r, err := ss.fs.OpenRead(objectFilename(state[filename]))
+		if err != nil {
+			CloseClientFiles(files)
+			return nil, errors.Wrapf(err, "cannot open %v of snapshot %v", filename, id)
+		}
+		files = append(files, VirtualFile{
+			Filename: filename,
+			IsDir:    false,
+			Rw:       r,
+		})
+	}
+	return files, nil
+}
+
+/// Remove snapshots that are not covered by the retention rules, and then
+/// contents of files that no remaining snapshot refers to.
+func (ss *snapshots) Prune() error {
+	if ss.retention.KeepSnapshots <= 0 && ss.retention.KeepDays <= 0 {
+		return nil
+	}
+
+	taken, err := ss.List()
+	if err != nil {
+		return err
+	}
+	maxAge := time.Duration(ss.retention.KeepDays) * 24 * time.Hour
+	now := ss.now()
+
+	kept := make([]Snapshot, 0, len(taken))
+	for i, snapshot := range taken {
+		tooMany := ss.retention.KeepSnapshots > 0 && len(taken)-i > ss.retention.KeepSnapshots
+		tooOld := ss.retention.KeepDays > 0 && now.Sub(snapshot.Time) > maxAge
+		if (tooMany || tooOld) && i < len(taken)-1 {
+			if err := ss.fs.Delete(snapshotFilename(snapshot.Id)); err != nil {
+				return errors.Wrapf(err, "cannot remove snapshot %v", snapshot.Id)
+			}
+			continue
+		}
+		kept = append(kept, snapshot)
+	}
+	if len(kept) == len(taken) {
+		return nil
+	}
+
+	ss.lock.Lock()
+	ss.taken = kept
+	ss.lock.Unlock()
+	return ss.removeUnreferencedObjects(kept)
+}
+
+func (ss *snapshots) removeUnreferencedObjects(kept []Snapshot) error {
+	referenced := make(map[string]struct{})
+	for _, snapshot := range kept {
+		state, err := LoadSyncState(ss.fs, snapshotFilename(snapshot.Id))
+		if err != nil {
+			return err
+		}
+		for _, digest := range state {
+			referenced[digest] = struct{}{}
+		}
+	}
+
+	filenames, err := ss.fs.ListAll()
+	if err != nil {
+		return errors.Wrap(err, "cannot list filesystem")
+	}
+	prefix := objectFilename("") + "/"
+	for _, filename := range filenames {
+		if !strings.HasPrefix(filename, prefix) {
+			continue
+		}
+		if _, ok := referenced[filename[len(prefix):]]; ok {
+			continue
+		}
+		if err := ss.fs.Delete(filename); err != nil {
+			return errors.Wrapf(err, "cannot remove object %v", filename)
+		}
+	}
+	return nil
+}
+
+/// Find the latest snapshot taken not later than t.
+func FindSnapshot(taken []Snapshot, t time.Time) (Snapshot, bool) {
+	for i := len(taken) - 1; i >= 0; i-- {
+		if !taken[i].Time.After(t) {
+			return taken[i], true
+		}
+	}
+	return Snapshot{}, false
+}
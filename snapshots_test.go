@@ -0,0 +1,209 @@
+package carrybasket
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSnapshots_Smoke(t *testing.T) {
+	fs := NewLoggingFilesystem()
+	snapshots := NewSnapshots(fs, SnapshotRetention{})
+
+	taken, err := snapshots.List()
+	assert.Nil(t, err)
+	assert.Empty(t, taken)
+
+	_, err = snapshots.Open("20190102-150405.000000000")
+	assert.NotNil(t, err)
+	_, err = snapshots.Open("../state")
+	assert.NotNil(t, err)
+}
+
+func TestSnapshots_TakeAndOpen(t *testing.T) {
+	fs := NewLoggingFilesystem()
+	now := time.Date(2019, 1, 2, 15, 4, 5, 0, time.UTC)
+	snapshots := NewSnapshots(fs, SnapshotRetention{})
+	snapshots.now = func() time.Time { return now }
+	createFiles(fs, []File{
+		{"a", false, "same"},
+		{"dir", true, ""},
+		{"dir/b", false, "same"},
+		{"dir/c", false, "c1"},
+	})
+
+	first, ok, err := snapshots.Take()
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, Snapshot{"20190102-150405.000000000", now}, first)
+
+	// nothing has changed
+	now = now.Add(time.Hour)
+	same, ok, err := snapshots.Take()
+	assert.Nil(t, err)
+	assert.False(t, ok)
+	assert.Equal(t, first, same)
+
+	assert.Nil(t, fs.Delete("dir/c"))
+	createFiles(fs, []File{{"dir/c", false, "c2"}})
+	second, ok, err := snapshots.Take()
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "20190102-160405.000000000", second.Id)
+
+	// every content is stored once
+	objects := 0
+	filenames, err := fs.ListAll()
+	assert.Nil(t, err)
+	for _, filename := range filenames {
+		if strings.HasPrefix(filename, objectFilename("")+"/") {
+			objects++
+		}
+	}
+	assert.Equal(t, 3, objects)
+
+	taken, err := snapshots.List()
+	assert.Nil(t, err)
+	assert.Equal(t, []Snapshot{first, second}, taken)
+
+	files, err := snapshots.Open(first.Id)
+	assert.Nil(t, err)
+	snapshotFs := NewLoggingFilesystem()
+	for _, file := range files {
+		if file.IsDir {
+			createFiles(snapshotFs, []File{{file.Filename, true, ""}})
+		} else {
+			w, _ := snapshotFs.OpenWrite(file.Filename)
+			_, err := io.Copy(w, file.Rw)
+			assert.Nil(t, err)
+		}
+	}
+	CloseClientFiles(files)
+	assert.Equal(t, []string{"a", "dir", "dir/b", "dir/c"}, listSyncedFiles(t, snapshotFs))
+	assertFileContent(t, snapshotFs, "dir/b", "same")
+	assertFileContent(t, snapshotFs, "dir/c", "c1")
+}
+
+func TestSnapshots_TakeAfter(t *testing.T) {
+	fs := NewLoggingFilesystem()
+	now := time.Date(2019, 1, 2, 15, 4, 5, 0, time.UTC)
+	snapshots := NewSnapshots(fs, SnapshotRetention{})
+	snapshots.now = func() time.Time { return now }
+	createFiles(fs, []File{
+		{"a", false, "a1"},
+		{"dir", true, ""},
+		{"dir/b", false, "b1"},
+		{"dir/c", false, "c1"},
+	})
+	_, _, err := snapshots.Take()
+	assert.Nil(t, err)
+
+	assert.Nil(t, fs.Delete("a"))
+	assert.Nil(t, fs.Delete("dir/b"))
+	assert.Nil(t, fs.Delete("dir/c"))
+	assert.Nil(t, fs.Delete("dir"))
+	createFiles(fs, []File{
+		{"a", false, "a2"},
+		{"new", true, ""},
+		{"new/d", false, "d1"},
+	})
+	digest := NewFileDigest()
+	_, _ = digest.Write([]byte("a2"))
+	commands := []AdjustmentCommand{
+		AdjustmentCommandApplyBlocksToFile{"a", nil, digest.Sum(nil)},
+		AdjustmentCommandRemoveFile{"dir"},
+		AdjustmentCommandApplyBlocksToFile{"new/d", nil, nil},
+	}
+
+	now = now.Add(time.Hour)
+	fs.Actions = nil
+	incremental, ok, err := snapshots.TakeAfter(commands)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	// the tree is not listed, and a file with a known digest is only copied
+	assert.NotContains(t, fs.Actions, "listall")
+	reads := 0
+	for _, action := range fs.Actions {
+		if action == "openread a" {
+			reads++
+		}
+	}
+	assert.Equal(t, 1, reads)
+
+	// a full snapshot of the tree is the same
+	now = now.Add(time.Hour)
+	full, ok, err := snapshots.Take()
+	assert.Nil(t, err)
+	assert.False(t, ok)
+	assert.Equal(t, incremental, full)
+	state, err := LoadSyncState(fs, snapshotFilename(incremental.Id))
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"a", "new", "new/d"}, state.Filenames())
+}
+
+func TestSnapshots_Prune(t *testing.T) {
+	fs := NewLoggingFilesystem()
+	now := time.Date(2019, 1, 2, 15, 4, 5, 0, time.UTC)
+	snapshots := NewSnapshots(fs, SnapshotRetention{KeepSnapshots: 2})
+	snapshots.now = func() time.Time { return now }
+
+	var taken []Snapshot
+	for _, content := range []string{"1", "2", "3"} {
+		createFiles(fs, []File{{"a", false, content}})
+		snapshot, ok, err := snapshots.TakeAfter(
+			[]AdjustmentCommand{AdjustmentCommandApplyBlocksToFile{"a", nil, nil}},
+		)
+		assert.Nil(t, err)
+		assert.True(t, ok)
+		taken = append(taken, snapshot)
+		now = now.Add(time.Hour)
+	}
+
+	assert.Nil(t, snapshots.Prune())
+	listed, err := snapshots.List()
+	assert.Nil(t, err)
+	assert.Equal(t, taken[1:], listed)
+
+	// content of the removed snapshot is gone
+	objects := 0
+	filenames, err := fs.ListAll()
+	assert.Nil(t, err)
+	for _, filename := range filenames {
+		if strings.HasPrefix(filename, objectFilename("")+"/") {
+			objects++
+		}
+	}
+	assert.Equal(t, 2, objects)
+	files, err := snapshots.Open(taken[1].Id)
+	assert.Nil(t, err)
+	CloseClientFiles(files)
+
+	// the latest snapshot is always kept
+	snapshots.retention = SnapshotRetention{KeepDays: 1}
+	now = now.Add(72 * time.Hour)
+	assert.Nil(t, snapshots.Prune())
+	listed, err = snapshots.List()
+	assert.Nil(t, err)
+	assert.Equal(t, taken[2:], listed)
+}
+
+func TestSnapshots_Find(t *testing.T) {
+	at := func(hour int) time.Time {
+		return time.Date(2019, 1, 2, hour, 0, 0, 0, time.UTC)
+	}
+	taken := []Snapshot{{"1", at(10)}, {"2", at(12)}, {"3", at(14)}}
+
+	_, ok := FindSnapshot(taken, at(9))
+	assert.False(t, ok)
+	snapshot, ok := FindSnapshot(taken, at(12))
+	assert.True(t, ok)
+	assert.Equal(t, "2", snapshot.Id)
+	snapshot, ok = FindSnapshot(taken, at(13))
+	assert.True(t, ok)
+	assert.Equal(t, "2", snapshot.Id)
+	snapshot, ok = FindSnapshot(taken, at(23))
+	assert.True(t, ok)
+	assert.Equal(t, "3", snapshot.Id)
+}
@@ -0,0 +1,108 @@
+package carrybasket
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"github.com/pkg/errors"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+/// Digest recorded in SyncState for directories.
+const DirDigest = "dir"
+
+/// Last-synced state of a tree. Maps filename to the digest the file had
+/// when both sides last agreed on it (hex digest, or DirDigest for
+/// directories). It is used to tell which side has changed a file since
+/// the last sync.
+type SyncState map[string]string
+
+/// Filename of the sync state kept by the client.
+func ClientSyncStateFilename() string {
+	return filepath.Join(MetadataDir, "state")
+}
+
+/// Filename of the sync state kept by the server for the given client.
+func ServerSyncStateFilename(client string) string {
+	return filepath.Join(MetadataDir, "state-"+client)
+}
+
+func hashedFileDigest(hashedFile HashedFile) string {
+	if hashedFile.IsDir {
+		return DirDigest
+	}
+	return hex.EncodeToString(hashedFile.Digest)
+}
+
+func NewSyncStateFromHashedFiles(hashedFiles []HashedFile) SyncState {
+	state := make(SyncState, len(hashedFiles))
+	for _, hashedFile := range hashedFiles {
+		state[hashedFile.Filename] = hashedFileDigest(hashedFile)
+	}
+	return state
+}
+
+/// Filenames of the state in sorted order.
+func (ss SyncState) Filenames() []string {
+	filenames := make([]string, 0, len(ss))
+	for filename := range ss {
+		filenames = append(filenames, filename)
+	}
+	sort.Strings(filenames)
+	return filenames
+}
+
+/// Load sync state from the given file. Missing file means that
+/// nothing has been synced yet, so an empty state is returned.
+/// The format is similar to the one of sha256sum: "<digest> <filename>"
+/// on every line.
+func LoadSyncState(fs VirtualFilesystem, filename string) (SyncState, error) {
+	state := make(SyncState)
+	if !fs.IsPath(filename) {
+		return state, nil
+	}
+
+	r, err := fs.OpenRead(filename)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot open sync state")
+	}
+	defer r.Close()
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), " ", 2)
+		if len(fields) != 2 {
+			return nil, errors.Errorf("invalid sync state line: %v", scanner.Text())
+		}
+		state[fields[1]] = fields[0]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "cannot read sync state")
+	}
+
+	return state, nil
+}
+
+/// Save sync state into the given file. The state is written into
+/// a temporary file first so that a crash never leaves it half-written.
+func SaveSyncState(fs VirtualFilesystem, filename string, state SyncState) error {
+	tempFilename := tempFileFor(filename)
+	w, err := fs.OpenWrite(tempFilename)
+	if err != nil {
+		return errors.Wrap(err, "cannot open sync state")
+	}
+
+	for _, stateFilename := range state.Filenames() {
+		if _, err := fmt.Fprintf(w, "%v %v\n", state[stateFilename], stateFilename); err != nil {
+			_ = w.Close()
+			return errors.Wrap(err, "cannot write sync state")
+		}
+	}
+	if err := w.Close(); err != nil {
+		return errors.Wrap(err, "cannot write sync state")
+	}
+
+	return fs.Move(tempFilename, filename)
+}
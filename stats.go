@@ -0,0 +1,98 @@
+package carrybasket
+
+import (
+	"bytes"
+	"time"
+)
+
+/// Statistics of a single sync cycle, returned by SyncCycle. File counts
+/// and blocks describe the changes pushed to the server.
+type SyncStats struct {
+	FilesAdded     int
+	FilesUpdated   int
+	FilesRemoved   int
+	FilesUnchanged int /// sent as hashes only, server content stays the same
+
+	HashedBlocks  int    /// blocks that server already had
+	HashedBytes   uint64 /// bytes of the hashed blocks, never sent
+	ContentBlocks int    /// blocks sent as content
+	ContentBytes  uint64 /// bytes of the content blocks
+
+	PullTime  time.Duration /// getting server hashes (and changes in two-way sync)
+	ScanTime  time.Duration /// hashing and comparing client files
+	PushTime  time.Duration /// sending commands to the server
+	ApplyTime time.Duration /// waiting for the server to apply commands
+}
+
+/// Share of file bytes that did not have to be sent because server
+/// already had them, from 0 to 1. Zero when there is nothing to send.
+func (s SyncStats) DedupeRatio() float64 {
+	total := s.HashedBytes + s.ContentBytes
+	if total == 0 {
+		return 0
+	}
+	return float64(s.HashedBytes) / float64(total)
+}
+
+// Count commands that are about to be pushed. Server files are the
+// ones commands have been planned against.
+func (s *SyncStats) addCommands(commands []AdjustmentCommand, serverHashedFiles []HashedFile) {
+	serverFiles := make(map[string]HashedFile, len(serverHashedFiles))
+	for _, hashedFile := range serverHashedFiles {
+		serverFiles[hashedFile.Filename] = hashedFile
+	}
+
+	for _, abstractCommand := range commands {
+		switch command := abstractCommand.(type) {
+		case AdjustmentCommandRemoveFile:
+			s.FilesRemoved++
+
+		case AdjustmentCommandMkDir:
+			if _, ok := serverFiles[command.filename]; !ok {
+				s.FilesAdded++
+			}
+
+		case AdjustmentCommandApplyBlocksToFile:
+			serverFile, ok := serverFiles[command.filename]
+			switch {
+			case !ok || serverFile.IsDir:
+				s.FilesAdded++
+			case len(command.digest) > 0 && bytes.Equal(command.digest, serverFile.Digest):
+				s.FilesUnchanged++
+			default:
+				s.FilesUpdated++
+			}
+			s.addBlocks(command)
+		}
+	}
+}
+
+// Count blocks of the command, also when it is pushed once more.
+func (s *SyncStats) addBlocks(command AdjustmentCommandApplyBlocksToFile) {
+	for _, block := range command.blocks {
+		switch block.(type) {
+		case HashedBlock:
+			s.HashedBlocks++
+			s.HashedBytes += block.Size()
+		case ContentBlock:
+			s.ContentBlocks++
+			s.ContentBytes += block.Size()
+		}
+	}
+}
+
+func (s SyncStats) logFields() []LogField {
+	return []LogField{
+		Field("files_added", s.FilesAdded),
+		Field("files_updated", s.FilesUpdated),
+		Field("files_removed", s.FilesRemoved),
+		Field("files_unchanged", s.FilesUnchanged),
+		Field("hashed_bytes", s.HashedBytes),
+		Field("content_bytes", s.ContentBytes),
+		Field("dedupe_ratio", s.DedupeRatio()),
+		Field("pull_time", s.PullTime),
+		Field("scan_time", s.ScanTime),
+		Field("push_time", s.PushTime),
+		Field("apply_time", s.ApplyTime),
+	}
+}
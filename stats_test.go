@@ -0,0 +1,48 @@
+package carrybasket
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestSyncStats_AddCommands(t *testing.T) {
+	serverHashedFiles := []HashedFile{
+		{"dir", true, nil, nil, nil},
+		{"changed", false, nil, nil, []byte("old")},
+		{"same", false, nil, nil, []byte("same")},
+		{"removed", false, nil, nil, []byte("removed")},
+	}
+	commands := []AdjustmentCommand{
+		AdjustmentCommandMkDir{"dir"},
+		AdjustmentCommandMkDir{"newdir"},
+		AdjustmentCommandApplyBlocksToFile{"changed", []Block{
+			NewHashedBlock(0, 4, []byte("hash")),
+			NewContentBlock(4, 2, []byte("ab")),
+		}, []byte("new")},
+		AdjustmentCommandApplyBlocksToFile{"same", []Block{
+			NewHashedBlock(0, 4, []byte("hash")),
+		}, []byte("same")},
+		AdjustmentCommandApplyBlocksToFile{"new", []Block{
+			NewContentBlock(0, 2, []byte("cd")),
+		}, []byte("new")},
+		AdjustmentCommandRemoveFile{"removed"},
+	}
+
+	stats := SyncStats{}
+	stats.addCommands(commands, serverHashedFiles)
+	assert.Equal(t, 2, stats.FilesAdded)
+	assert.Equal(t, 1, stats.FilesUpdated)
+	assert.Equal(t, 1, stats.FilesRemoved)
+	assert.Equal(t, 1, stats.FilesUnchanged)
+	assert.Equal(t, 2, stats.HashedBlocks)
+	assert.Equal(t, uint64(8), stats.HashedBytes)
+	assert.Equal(t, 2, stats.ContentBlocks)
+	assert.Equal(t, uint64(4), stats.ContentBytes)
+	assert.InDelta(t, 8.0/12.0, stats.DedupeRatio(), 1e-9)
+}
+
+func TestSyncStats_DedupeRatio(t *testing.T) {
+	assert.Equal(t, 0.0, SyncStats{}.DedupeRatio())
+	assert.Equal(t, 0.0, SyncStats{ContentBytes: 10}.DedupeRatio())
+	assert.Equal(t, 1.0, SyncStats{HashedBytes: 10}.DedupeRatio())
+}
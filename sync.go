@@ -4,15 +4,37 @@ import (
 	"context"
 	"github.com/pkg/errors"
 	"io"
-	"log"
 	"net"
+	"os"
+	"sync"
+	"time"
 
 	pb "github.com/balta2ar/carrybasket/rpc"
+	"github.com/golang/protobuf/proto"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 )
 
+/// Returned by a sync cycle when some of its files have not been applied.
+/// The rest of the cycle is done, the failed files are retried on the
+/// next cycle.
+var ErrFilesNotApplied = errors.New("files have not been applied")
+
+/// Returned when server files have changed between the pull and the push
+/// of a cycle, e.g. by another client. SyncCycle then starts over, at
+/// most maxCycleRestarts times.
+var ErrServerChanged = errors.New("server files have changed since they were pulled")
+
+/// How many times a cycle starts over when server files change under it.
+/// Every restart means another cycle has pushed its changes meanwhile.
+const maxCycleRestarts = 10
+
 type SyncServiceClient interface {
-	SyncCycle() error
+	SyncCycle() (SyncStats, error)
+	SyncCycleContext(ctx context.Context) (SyncStats, error)
 }
 
 //
@@ -22,55 +44,161 @@ type SyncServiceClient interface {
 type syncServiceServer struct {
 	blockSize   int
 	targetDir   string
-	fs          VirtualFilesystem
 	address     string
 	hashFactory HashFactory
 
-	contentCache BlockCache
-	rpcServer    *grpc.Server
+	modules        map[string]*serverModule
+	deletionGuard  DeletionGuard                    /// see SetDeletionGuard
+	clientLimiters *clientBandwidthLimiters         /// see SetClientBandwidthLimit
+	metrics        *Metrics                         /// see SetMetrics
+	authToken      string                           /// see SetAuthToken
+	credentials    credentials.TransportCredentials /// see SetCredentials
+	logger         Logger
+	rpcServer      *grpc.Server
+	stopped        bool       /// Stop or Shutdown has been called
+	lock           sync.Mutex /// guards the two above
 }
 
+/// Create a server that serves the given filesystem as the default
+/// module. When fs is nil, only named modules added with AddModule
+/// are served and clients have to pick one of them. Nil logger logs
+/// info messages to stderr.
 func NewSyncServiceServer(
 	blockSize int,
 	targetDir string,
 	fs VirtualFilesystem,
 	address string,
 	hashFactory HashFactory,
+	logger Logger,
 ) *syncServiceServer {
-	return &syncServiceServer{
+	server := &syncServiceServer{
 		blockSize:   blockSize,
 		targetDir:   targetDir,
-		fs:          fs,
 		address:     address,
 		hashFactory: hashFactory,
+		logger:      defaultLogger(logger),
 
-		contentCache: NewBlockCache(),
+		modules:        make(map[string]*serverModule),
+		clientLimiters: newClientBandwidthLimiters(),
 	}
+	if fs != nil {
+		server.AddModule(DefaultModule, fs, ModuleAccess{})
+	}
+	return server
+}
+
+/// Serve fs as a named module. Modules must be added before Serve.
+/// Modules that serve the same fs share the content cache, versions,
+/// snapshots and the lock, so that a push into one of them never runs along with
+/// another call on the same files.
+func (s *syncServiceServer) AddModule(name string, fs VirtualFilesystem, access ModuleAccess) {
+	module := newServerModule(name, fs, access)
+	for _, other := range s.modules {
+		if other.fs == fs {
+			module.contentCache = other.contentCache
+			module.versions = other.versions
+			module.snapshots = other.snapshots
+			module.lock = other.lock
+			module.generation = other.generation
+			break
+		}
+	}
+	s.modules[name] = module
+}
+
+/// Refuse pushes that would remove too many files from a module,
+/// unless client has been forced to sync anyway.
+func (s *syncServiceServer) SetDeletionGuard(guard DeletionGuard) {
+	s.deletionGuard = guard
+}
+
+/// Limit the rate at which every client can push, e.g. so that one
+/// client does not take all the bandwidth. Can be changed at any time,
+/// also for connected clients.
+func (s *syncServiceServer) SetClientBandwidthLimit(schedule BandwidthSchedule) {
+	s.clientLimiters.SetSchedule(schedule)
+}
+
+/// Set how long previous versions of files are kept in the module.
+/// By default all versions are kept.
+func (s *syncServiceServer) SetVersionRetention(name string, retention VersionRetention) error {
+	module, ok := s.modules[name]
+	if !ok {
+		return errors.Errorf("unknown module %q", name)
+	}
+	module.versions.retention = retention
+	return nil
+}
+
+/// Set how long snapshots of the module are kept. By default all
+/// snapshots are kept.
+func (s *syncServiceServer) SetSnapshotRetention(name string, retention SnapshotRetention) error {
+	module, ok := s.modules[name]
+	if !ok {
+		return errors.Errorf("unknown module %q", name)
+	}
+	module.snapshots.retention = retention
+	return nil
+}
+
+/// Record metrics of the server. Must be set before Serve.
+func (s *syncServiceServer) SetMetrics(metrics *Metrics) {
+	s.metrics = metrics
+}
+
+/// Refuse calls that do not carry the token. Empty token allows all.
+func (s *syncServiceServer) SetAuthToken(token string) {
+	s.authToken = token
+}
+
+/// Serve over TLS with the credentials, e.g. from
+/// credentials.NewServerTLSFromFile. Must be set before Serve.
+func (s *syncServiceServer) SetCredentials(creds credentials.TransportCredentials) {
+	s.credentials = creds
 }
 
 func (s *syncServiceServer) PullHashedFiles(
 	empty *pb.ProtoEmpty,
 	stream pb.SyncService_PullHashedFilesServer,
 ) error {
+	logger := s.callLogger(stream.Context())
+	module, err := s.moduleFromContext(stream.Context(), false)
+	if err != nil {
+		logger.Warn("module error", Field("error", err))
+		return err
+	}
+
 	fastHasher := s.hashFactory.MakeFastHash()
 	strongHasher := s.hashFactory.MakeStrongHash()
 	generator := NewHashGenerator(s.blockSize, fastHasher, strongHasher)
 
-	listedServerFiles, err := ListServerFiles(s.fs, generator, s.contentCache)
+	unlock := module.lockFor(false)
+	listedServerFiles, err := ListServerFiles(module.fs, generator, module.contentCache)
+	generation := module.currentGeneration()
+	unlock()
 	if err != nil {
+		logger.Error("server list error", Field("error", err))
 		return err
 	}
+	// client sends it back with the push planned against these files
+	err = stream.SendHeader(metadata.Pairs(generationMetadataKey, generation))
+	if err != nil {
+		logger.Error("send header error", Field("error", err))
+		return err
+	}
+	s.metrics.setCacheBlocks(module.name, module.contentCache.Len())
 
-	log.Println("sending hashed files")
+	logger.Info("sending hashed files", Field("files", len(listedServerFiles)))
 
 	for _, serverFile := range listedServerFiles {
 		protoHashedFile := serverFile.asProtoHashedFile()
-		log.Printf("sending %v\n", serverFile.Filename)
+		logger.Debug("sending hashed file", Field("filename", serverFile.Filename))
 		err := stream.Send(&protoHashedFile)
 		if err != nil {
-			log.Printf("send error: %v\n", err)
+			logger.Error("send error", Field("error", err))
 			return err
 		}
+		s.metrics.pulled(proto.Size(&protoHashedFile))
 	}
 
 	return nil
@@ -79,69 +207,209 @@ func (s *syncServiceServer) PullHashedFiles(
 func (s *syncServiceServer) PushAdjustmentCommands(
 	stream pb.SyncService_PushAdjustmentCommandsServer,
 ) error {
+	logger := s.callLogger(stream.Context())
+	module, err := s.moduleFromContext(stream.Context(), true)
+	if err != nil {
+		logger.Warn("module error", Field("error", err))
+		return err
+	}
+
 	commands := make([]AdjustmentCommand, 0)
+	bytesReceived := 0
 
 	for {
 
 		protoCommand, err := stream.Recv()
 		if err == io.EOF {
-			log.Println("EOF, done")
-			err = stream.SendAndClose(&pb.ProtoEmpty{})
-			if err != nil {
-				log.Printf("send and close error: %v\n", err)
-				return err
-			}
 			break
 		}
 
 		if err != nil {
-			log.Printf("recv error: %v\n", err)
+			logger.Error("recv error", Field("error", err))
 			return err
 		}
-		log.Printf(
-			"received protoCommand for filename: %v\n",
-			protoCommand.Filename,
-		)
+		logger.Debug("received command", Field("filename", protoCommand.Filename))
+
+		bytesReceived += proto.Size(protoCommand)
+		s.metrics.pushed(proto.Size(protoCommand))
 
 		command := protoAdjustmentCommandAsAdjustmentCommand(protoCommand)
 		commands = append(commands, command)
 	}
+	logger.Info(
+		"received commands",
+		Field("commands", len(commands)), Field("bytes", bytesReceived),
+	)
+	if err := validateAdjustmentCommands(commands); err != nil {
+		logger.Warn("push refused", Field("error", err))
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
 
+	// commands are received before taking the lock, so that a slow
+	// client does not hold up other clients of the module
+	unlock := module.lockFor(true)
+	if err := module.checkGeneration(stream.Context()); err != nil {
+		unlock()
+		logger.Warn("push refused", Field("error", err))
+		return err
+	}
+	if !forceFromContext(stream.Context()) {
+		if err := s.checkDeletions(module, commands); err != nil {
+			unlock()
+			logger.Warn("push refused", Field("error", err))
+			return err
+		}
+	}
 	strongHasher := s.hashFactory.MakeStrongHash()
-	reconstructor := NewContentReconstructor(strongHasher, s.contentCache)
+	var contentCache BlockCache = module.contentCache
+	if s.metrics != nil {
+		contentCache = meteredBlockCache{contentCache, s.metrics}
+	}
+	reconstructor := NewContentReconstructor(strongHasher, contentCache)
 	applier := NewAdjustmentCommandApplier()
-	err := applier.Apply(commands, s.fs, reconstructor)
+	applier.SetFileVersions(module.versions)
+	// a call dropped on shutdown stops before the next command
+	results := applier.ApplyContext(stream.Context(), commands, module.fs, reconstructor)
+	if len(commands) > 0 {
+		module.changed()
+	}
+	generation := module.currentGeneration()
+	s.metrics.setCacheBlocks(module.name, module.contentCache.Len())
+	s.metrics.commandsFailed(results)
+	if err := module.versions.Prune(); err != nil {
+		logger.Warn("error pruning versions", Field("error", err))
+	}
+	if allApplied(results) {
+		takeSnapshot(module, commands, logger)
+	}
+	unlock()
+	for _, result := range results {
+		if result.Status != AdjustmentResultApplied {
+			logger.Warn(
+				"error applying command",
+				Field("filename", result.Filename), Field("error", result.Reason),
+			)
+		}
+	}
+
+	// client may pull right after its push, see TwoWaySyncCycle
+	stream.SetTrailer(metadata.Pairs(generationMetadataKey, generation))
+	err = stream.SendAndClose(adjustmentResultsAsProtoAdjustmentResults(results))
 	if err != nil {
-		log.Printf("error applying commands: %v\n", err)
+		logger.Error("send and close error", Field("error", err))
 		return err
 	}
 	return nil
 }
 
+func (s *syncServiceServer) checkDeletions(module *serverModule, commands []AdjustmentCommand) error {
+	total, err := countFiles(module.fs)
+	if err != nil {
+		return err
+	}
+	removed := countRemovals(commands, module.fs.IsDir)
+	if err := s.deletionGuard.Check(removed, total); err != nil {
+		return status.Error(codes.FailedPrecondition, err.Error())
+	}
+	return nil
+}
+
 func (s *syncServiceServer) Serve() error {
-	log.Println("server starting")
+	s.logger.Info("server starting")
 
 	listener, err := net.Listen("tcp", s.address)
 	if err != nil {
-		log.Printf("server cannot listen: %v\n", err)
+		s.logger.Error("server cannot listen", Field("error", err))
 		return err
 	}
-	log.Printf("sever listening on %v...\n", s.address)
+	s.logger.Info("server listening", Field("address", s.address))
+	// clients are limited as their data comes in, not a whole command
+	// at a time
+	listener = limitedListener{listener, s.clientLimiters}
+
+	options := []grpc.ServerOption{
+		grpc.UnaryInterceptor(s.unaryInterceptor),
+		grpc.StreamInterceptor(s.streamInterceptor),
+	}
+	if s.credentials != nil {
+		options = append(options, grpc.Creds(s.credentials))
+	}
+	s.removeTempFiles()
 
-	s.rpcServer = grpc.NewServer()
+	s.lock.Lock()
+	if s.stopped {
+		s.lock.Unlock()
+		listener.Close()
+		return nil
+	}
+	s.rpcServer = grpc.NewServer(options...)
 	pb.RegisterSyncServiceServer(s.rpcServer, s)
+	s.lock.Unlock()
 	err = s.rpcServer.Serve(listener)
 	if err != nil {
-		log.Printf("server error: %v\n", err)
+		s.logger.Error("server error", Field("error", err))
 		return err
 	}
 
-	log.Println("server done")
+	s.logger.Info("server done")
 	return nil
 }
 
+/// Stop accepting calls and wait until the running ones finish.
 func (s *syncServiceServer) Stop() {
-	s.rpcServer.GracefulStop()
+	if rpcServer := s.markStopped(); rpcServer != nil {
+		rpcServer.GracefulStop()
+	}
+}
+
+/// Stop accepting calls and wait until the running ones finish, at most
+/// for timeout. Then the calls are dropped. A push that is being applied
+/// stops once the command it applies is done, the files changed before
+/// stay changed, so the tree may be partly synced until the next cycle
+/// of the client. Temporary files are removed once pushes have stopped.
+func (s *syncServiceServer) Shutdown(timeout time.Duration) {
+	rpcServer := s.markStopped()
+	if rpcServer == nil {
+		return
+	}
+	s.logger.Info("server shutting down", Field("timeout", timeout))
+
+	done := make(chan struct{})
+	go func() {
+		rpcServer.GracefulStop()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		s.logger.Warn("calls did not finish in time, dropping them")
+		rpcServer.Stop()
+	}
+	s.removeTempFiles()
+}
+
+func (s *syncServiceServer) markStopped() *grpc.Server {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.stopped = true
+	return s.rpcServer
+}
+
+// Remove leftovers of pushes interrupted by a crash or a shutdown. A push
+// that is still being applied is waited for, its temporary files are
+// not removed from under it.
+func (s *syncServiceServer) removeTempFiles() {
+	for _, module := range s.modules {
+		unlock := module.lockFor(true)
+		err := RemoveTempFiles(module.fs)
+		unlock()
+		if err != nil {
+			s.logger.Warn(
+				"error removing temporary files",
+				Field("module", module.name), Field("error", err),
+			)
+		}
+	}
 }
 
 //
@@ -159,15 +427,46 @@ type syncServiceClient struct {
 
 	hashFactory       HashFactory
 	serverHashedFiles []HashedFile
+	serverGeneration  string   /// of the server files, see serverModule
+	fullContentFiles  []string /// server asked to resend these in full
+
+	module               string                           /// server module, see SetModule
+	twoWay               bool                             /// see SetTwoWay
+	deletionGuard        DeletionGuard                    /// see SetDeletionGuard
+	bandwidthLimiter     BandwidthLimiter                 /// see SetBandwidthLimiter
+	lock                 sync.Mutex                       /// guards bandwidthLimiter
+	progressReporter     ProgressReporter                 /// see SetProgressReporter
+	metrics              *Metrics                         /// see SetMetrics
+	ignoreRules          IgnoreRules                      /// see SetIgnoreRules
+	authToken            string                           /// see SetAuthToken
+	credentials          credentials.TransportCredentials /// see SetCredentials
+	baseLogger           Logger
+	logger               Logger           /// with the number of the current cycle
+	cycle                int              /// number of the current cycle
+	progress             *progressTracker /// progress of the current cycle
+	stats                SyncStats        /// of the current cycle
+	force                bool             /// see SetForce
+	hostname             string           /// identifies client in conflicts and server state
+	now                  func() time.Time /// clock used to name conflict copies
+	pullFullContentFiles []string         /// server should send these in full
 }
 
+/// Create a client that syncs fs with the server at address. Nil logger
+/// logs info messages to stderr.
 func NewSyncServiceClient(
 	blockSize int,
 	targetDir string,
 	fs VirtualFilesystem,
 	address string,
 	hashFactory HashFactory,
+	logger Logger,
 ) *syncServiceClient {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	logger = defaultLogger(logger)
+
 	return &syncServiceClient{
 		blockSize:   blockSize,
 		targetDir:   targetDir,
@@ -176,17 +475,128 @@ func NewSyncServiceClient(
 		hashFactory: hashFactory,
 
 		serverHashedFiles: make([]HashedFile, 0),
+
+		baseLogger: logger,
+		logger:     logger,
+		hostname:   hostname,
+		now:        time.Now,
+		progress:   newProgressTracker(nil, time.Now),
+	}
+}
+
+/// Select the server module to sync with. DefaultModule is used
+/// when the server serves a single directory.
+func (c *syncServiceClient) SetModule(module string) {
+	c.module = module
+}
+
+/// Refuse to remove too many files on either side. The server may have
+/// its own guard as well.
+func (c *syncServiceClient) SetDeletionGuard(guard DeletionGuard) {
+	c.deletionGuard = guard
+}
+
+/// Limit the rate of pushed data. Nil removes the limit. Can be changed
+/// at any time, also after Dial.
+func (c *syncServiceClient) SetBandwidthLimiter(limiter BandwidthLimiter) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.bandwidthLimiter = limiter
+}
+
+func (c *syncServiceClient) currentBandwidthLimiter() BandwidthLimiter {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.bandwidthLimiter
+}
+
+/// Report progress of every sync cycle. Nil stops reporting.
+func (c *syncServiceClient) SetProgressReporter(reporter ProgressReporter) {
+	c.progressReporter = reporter
+}
+
+/// Record metrics of the client.
+func (c *syncServiceClient) SetMetrics(metrics *Metrics) {
+	c.metrics = metrics
+}
+
+/// Neither sync nor remove files matching the rules, on both sides.
+func (c *syncServiceClient) SetIgnoreRules(rules IgnoreRules) {
+	if ifs, ok := c.fs.(*ignoringFilesystem); ok {
+		c.fs = ifs.VirtualFilesystem
+	}
+	c.ignoreRules = rules
+	c.fs = NewIgnoringFilesystem(c.fs, rules)
+}
+
+/// Send the token with every call, see the server SetAuthToken.
+func (c *syncServiceClient) SetAuthToken(token string) {
+	c.authToken = token
+}
+
+/// Connect over TLS with the credentials, e.g. from
+/// credentials.NewClientTLSFromFile. Must be set before Dial.
+func (c *syncServiceClient) SetCredentials(creds credentials.TransportCredentials) {
+	c.credentials = creds
+}
+
+// Start tracking progress and stats of a new cycle. Messages logged
+// during the cycle carry its number.
+func (c *syncServiceClient) startCycle() {
+	c.cycle++
+	c.logger = c.baseLogger.With(Field("cycle", c.cycle))
+	c.progress = newProgressTracker(c.progressReporter, c.now)
+	c.stats = SyncStats{}
+}
+
+/// Skip deletion guards of both the client and the server.
+func (c *syncServiceClient) SetForce(force bool) {
+	c.force = force
+}
+
+// Context of every call to the server, derived from ctx of the caller
+// so that its deadline and cancellation reach the call.
+func (c *syncServiceClient) callContext(ctx context.Context) context.Context {
+	ctx = withForce(withModule(ctx, c.module), c.force)
+	return withAuthToken(ctx, c.authToken)
+}
+
+func (c *syncServiceClient) checkDeletions(removed int, total int) error {
+	if c.force {
+		return nil
 	}
+	return c.deletionGuard.Check(removed, total)
+}
+
+/// In two-way mode SyncCycle runs TwoWaySyncCycle, otherwise client
+/// files are mirrored to the server.
+func (c *syncServiceClient) SetTwoWay(twoWay bool) {
+	c.twoWay = twoWay
 }
 
 func (c *syncServiceClient) Reset() {
 	c.serverHashedFiles = make([]HashedFile, 0)
+	c.serverGeneration = ""
 }
 
 func (c *syncServiceClient) Dial() error {
-	connection, err := grpc.Dial(c.address, grpc.WithInsecure())
+	security := grpc.WithInsecure()
+	if c.credentials != nil {
+		security = grpc.WithTransportCredentials(c.credentials)
+	}
+	// pushes are limited as they are written to the connection, not
+	// a whole command at a time
+	dialer := &net.Dialer{}
+	limitedDialer := func(ctx context.Context, address string) (net.Conn, error) {
+		conn, err := dialer.DialContext(ctx, "tcp", address)
+		if err != nil {
+			return nil, err
+		}
+		return newLimitedConn(conn, nil, c.currentBandwidthLimiter), nil
+	}
+	connection, err := grpc.Dial(c.address, security, grpc.WithContextDialer(limitedDialer))
 	if err != nil {
-		log.Printf("dial error: %v\n", err)
+		c.logger.Error("dial error", Field("error", err))
 		return err
 	}
 
@@ -201,15 +611,38 @@ func (c *syncServiceClient) Close() error {
 	return c.connection.Close()
 }
 
+/// Drop the connection and dial the server again, e.g. after the server
+/// has been restarted.
+func (c *syncServiceClient) Redial() error {
+	if c.connection != nil {
+		c.connection.Close()
+	}
+	c.logger.Info("redialing server", Field("address", c.address))
+	return c.Dial()
+}
+
 func (c *syncServiceClient) PullHashedFiles() error {
+	return c.PullHashedFilesContext(context.Background())
+}
+
+/// Pull like PullHashedFiles, the call is cancelled with ctx.
+func (c *syncServiceClient) PullHashedFilesContext(ctx context.Context) error {
 	c.Reset()
 
-	pullStream, err := c.client.PullHashedFiles(context.Background(), &pb.ProtoEmpty{})
+	pullStream, err := c.client.PullHashedFiles(c.callContext(ctx), &pb.ProtoEmpty{})
 
 	if err != nil {
-		log.Printf("error receiving pullStream: %v\n", err)
+		c.logger.Error("error receiving pullStream", Field("error", err))
+		return err
+	}
+	header, err := pullStream.Header()
+	if err != nil {
+		c.logger.Error("recv header error", Field("error", err))
 		return err
 	}
+	if values := header.Get(generationMetadataKey); len(values) > 0 {
+		c.serverGeneration = values[0]
+	}
 
 	for {
 		protoHashedFile, err := pullStream.Recv()
@@ -217,72 +650,326 @@ func (c *syncServiceClient) PullHashedFiles() error {
 			break
 		}
 		if err != nil {
-			log.Printf("recv error %v\n", err)
+			c.logger.Error("recv error", Field("error", err))
 			return err
 		}
-		log.Printf(
-			"received hashed file for filename: %v\n",
-			protoHashedFile.Filename,
-		)
+		c.logger.Debug("received hashed file", Field("filename", protoHashedFile.Filename))
 
+		c.metrics.pulled(proto.Size(protoHashedFile))
 		hashedFile := protoHashedFileAsHashedFile(protoHashedFile)
 		c.serverHashedFiles = append(c.serverHashedFiles, hashedFile)
 	}
+	c.serverHashedFiles = selectNotIgnoredHashedFiles(c.serverHashedFiles, c.ignoreRules)
 	return nil
 }
 
-func (c *syncServiceClient) PushAdjustmentCommands() error {
+/// Compare client files with the server hashed files received by the
+/// last PullHashedFiles call and return commands that would bring server
+/// in sync with the client. Nothing is sent to the server.
+func (c *syncServiceClient) PlanAdjustmentCommands() ([]AdjustmentCommand, error) {
+	return c.PlanAdjustmentCommandsContext(context.Background())
+}
+
+/// Plan like PlanAdjustmentCommands, scanning of client files stops
+/// when ctx is done.
+func (c *syncServiceClient) PlanAdjustmentCommandsContext(
+	ctx context.Context,
+) ([]AdjustmentCommand, error) {
 	listedClientFiles, err := ListClientFiles(c.fs)
-	log.Printf("client listed %d files\n", len(listedClientFiles))
+	if err != nil {
+		c.logger.Error("client list error", Field("error", err))
+		return nil, err
+	}
+	c.logger.Info("client listed files", Field("files", len(listedClientFiles)))
 
 	factory := NewProducerFactory(c.blockSize, c.hashFactory)
 	comparator := NewFilesComparator(factory)
-	log.Println("comparing files...")
-	commands := comparator.Compare(listedClientFiles, c.serverHashedFiles)
+	comparator.SetLogger(c.logger)
+	comparator.SetFullContentFiles(c.fullContentFiles)
+	c.logger.Info("comparing files")
+	c.progress.startPhase(ProgressPhaseScan)
+	c.progress.trackScan(listedClientFiles)
+	start := c.now()
+	commands, err := comparator.CompareContext(ctx, listedClientFiles, c.serverHashedFiles)
+	CloseClientFiles(listedClientFiles)
+	if err != nil {
+		c.logger.Warn("scan stopped", Field("error", err))
+		return nil, err
+	}
+	c.stats.ScanTime += c.now().Sub(start)
+	c.progress.scanned(commands)
+	return commands, nil
+}
 
-	pushStream, err := c.client.PushAdjustmentCommands(context.Background())
+func (c *syncServiceClient) PushAdjustmentCommands() error {
+	return c.PushAdjustmentCommandsContext(context.Background())
+}
+
+/// Push like PushAdjustmentCommands, scanning and the call are
+/// cancelled with ctx.
+func (c *syncServiceClient) PushAdjustmentCommandsContext(ctx context.Context) error {
+	commands, err := c.PlanAdjustmentCommandsContext(ctx)
 	if err != nil {
-		log.Printf("push error: %v\n", err)
 		return err
 	}
 
-	log.Println("pushing commands...")
-	for _, abstractCommand := range commands {
+	results, err := c.pushCommands(ctx, commands)
+	if err != nil {
+		return err
+	}
+	return notAppliedError(results)
+}
 
+func (c *syncServiceClient) pushCommands(
+	ctx context.Context,
+	commands []AdjustmentCommand,
+) ([]AdjustmentResult, error) {
+	serverState := NewSyncStateFromHashedFiles(c.serverHashedFiles)
+	removed := countRemovals(commands, func(filename string) bool {
+		return serverState[filename] == DirDigest
+	})
+	total := countStateFiles(serverState, serverState.Filenames())
+	if err := c.checkDeletions(removed, total); err != nil {
+		c.logger.Warn("push refused", Field("error", err))
+		return nil, err
+	}
+
+	c.stats.addCommands(commands, c.serverHashedFiles)
+	results, err := c.sendCommands(ctx, commands)
+	if err != nil {
+		return nil, err
+	}
+	return c.resendFullContent(ctx, results)
+}
+
+func (c *syncServiceClient) sendCommands(
+	ctx context.Context,
+	commands []AdjustmentCommand,
+) ([]AdjustmentResult, error) {
+	start := c.now()
+	callCtx := withGeneration(c.callContext(ctx), c.serverGeneration)
+	pushStream, err := c.client.PushAdjustmentCommands(callCtx)
+	if err != nil {
+		c.logger.Error("push error", Field("error", err))
+		return nil, err
+	}
+
+	protoCommands := make([]pb.ProtoAdjustmentCommand, 0, len(commands))
+	bytesTotal := uint64(0)
+	for _, abstractCommand := range commands {
 		protoCommand := adjustmentCommandAsProtoAdjustmentCommand(abstractCommand)
-		err = pushStream.Send(&protoCommand)
+		protoCommands = append(protoCommands, protoCommand)
+		bytesTotal += uint64(proto.Size(&protoCommand))
+	}
+	c.progress.startPhase(ProgressPhasePush)
+	c.progress.pushing(bytesTotal)
+
+	c.logger.Info(
+		"pushing commands",
+		Field("commands", len(protoCommands)), Field("bytes", bytesTotal),
+	)
+	for i := range protoCommands {
+		protoCommand := &protoCommands[i]
+		size := proto.Size(protoCommand)
+		err = pushStream.Send(protoCommand)
 		if err == io.EOF {
-			log.Printf("push EOF")
+			c.logger.Warn("push EOF")
 		} else if err != nil {
-			log.Printf("push stream send error: %v\n", err)
-			return err
+			c.logger.Error("push stream send error", Field("error", err))
+			return nil, err
 		}
+		c.progress.sent(size)
+		c.metrics.pushed(size)
 	}
+	c.stats.PushTime += c.now().Sub(start)
 
+	start = c.now()
 	reply, err := pushStream.CloseAndRecv()
 	if err != nil {
-		log.Printf("error closing: %v\n", err)
-		return err
+		c.logger.Error("error closing", Field("error", err))
+		return nil, serverChangedError(err)
+	}
+	// files are the ones of the pull changed by this push
+	if values := pushStream.Trailer().Get(generationMetadataKey); len(values) > 0 {
+		c.serverGeneration = values[0]
 	}
-	log.Printf("reply: %v\n", reply)
+	c.stats.ApplyTime += c.now().Sub(start)
 
-	return nil
+	results := protoAdjustmentResultsAsAdjustmentResults(reply)
+	c.handleAdjustmentResults(results)
+	return results, nil
 }
 
-func (c *syncServiceClient) SyncCycle() error {
-	log.Println("sync cycle: pulling...")
-	err := c.PullHashedFiles()
+// Error of a cycle with the results, nil when all files are applied.
+func notAppliedError(results []AdjustmentResult) error {
+	notApplied := 0
+	for _, result := range results {
+		if result.Status != AdjustmentResultApplied {
+			notApplied++
+		}
+	}
+	if notApplied == 0 {
+		return nil
+	}
+	return errors.Wrapf(ErrFilesNotApplied, "%d of %d files", notApplied, len(results))
+}
+
+// Push the files that server could not reconstruct once more, as pure
+// content, and return the results with the ones of the resent files
+// replaced. Files that fail again are left to the next cycle.
+func (c *syncServiceClient) resendFullContent(
+	ctx context.Context,
+	results []AdjustmentResult,
+) ([]AdjustmentResult, error) {
+	if len(c.fullContentFiles) == 0 {
+		return results, nil
+	}
+	c.logger.Info("resending full content", Field("files", len(c.fullContentFiles)))
+
+	listedClientFiles, err := ListClientFiles(c.fs)
 	if err != nil {
-		return errors.Wrap(err, "sync cycle: pull error: %v")
+		c.logger.Error("client list error", Field("error", err))
+		return nil, err
+	}
+	factory := NewProducerFactory(c.blockSize, c.hashFactory)
+	comparator := NewFilesComparator(factory)
+	comparator.SetLogger(c.logger)
+	comparator.SetFullContentFiles(c.fullContentFiles)
+	// without server files to compare with, files removed from the
+	// client meanwhile are not removed from the server
+	commands, err := comparator.CompareContext(
+		ctx,
+		selectVirtualFiles(listedClientFiles, c.fullContentFiles),
+		nil,
+	)
+	CloseClientFiles(listedClientFiles)
+	if err != nil {
+		c.logger.Warn("scan stopped", Field("error", err))
+		return nil, err
+	}
+	for _, abstractCommand := range commands {
+		if command, ok := abstractCommand.(AdjustmentCommandApplyBlocksToFile); ok {
+			c.stats.addBlocks(command)
+		}
 	}
-	log.Println("sync cycle: pull done")
 
-	log.Println("sync cycle: pushing...")
-	err = c.PushAdjustmentCommands()
+	resent, err := c.sendCommands(ctx, commands)
 	if err != nil {
-		return errors.Wrap(err, "sync cycle: push error: %v")
+		return nil, err
+	}
+	resentResults := make(map[string]AdjustmentResult, len(resent))
+	for _, result := range resent {
+		resentResults[result.Filename] = result
 	}
+	for i, result := range results {
+		if resentResult, ok := resentResults[result.Filename]; ok {
+			results[i] = resentResult
+		}
+	}
+	return results, nil
+}
 
-	log.Println("sync cycle: push done")
-	return nil
+// Failed files are not retried immediately. Every cycle sends all client
+// files anyway, so the failed ones are retried on the next cycle. Files
+// that server could not reconstruct are resent as pure content right
+// away, and once more on the next cycle when that fails too.
+func (c *syncServiceClient) handleAdjustmentResults(results []AdjustmentResult) {
+	c.fullContentFiles = make([]string, 0)
+	c.metrics.commandsFailed(results)
+
+	for _, result := range results {
+		switch result.Status {
+		case AdjustmentResultFailed:
+			c.logger.Warn(
+				"server failed to apply command, will retry",
+				Field("filename", result.Filename), Field("error", result.Reason),
+			)
+
+		case AdjustmentResultNeedsFullResend:
+			c.logger.Warn(
+				"server needs full content, will resend",
+				Field("filename", result.Filename), Field("error", result.Reason),
+			)
+			c.fullContentFiles = append(c.fullContentFiles, result.Filename)
+		}
+	}
+}
+
+/// Bring server in sync with the client and return what it took.
+func (c *syncServiceClient) SyncCycle() (SyncStats, error) {
+	return c.SyncCycleContext(context.Background())
+}
+
+/// Run a cycle like SyncCycle. The cycle stops with an error when ctx
+/// is cancelled or its deadline is exceeded, both during the calls to
+/// the server and during the scan of client files. When server files
+/// change between the pull and the push, e.g. by another client, server
+/// refuses the push and the cycle starts over with a new pull.
+func (c *syncServiceClient) SyncCycleContext(ctx context.Context) (SyncStats, error) {
+	start := c.now()
+	var stats SyncStats
+	var err error
+	for restarts := 0; ; restarts++ {
+		if c.twoWay {
+			stats, err = c.TwoWaySyncCycleContext(ctx)
+		} else {
+			stats, err = c.oneWaySyncCycle(ctx)
+		}
+		if errors.Cause(err) != ErrServerChanged || restarts == maxCycleRestarts {
+			break
+		}
+		c.logger.Info("server files have changed during the cycle, starting over")
+	}
+	c.metrics.cycleDone(c.now().Sub(start), err)
+	return stats, err
+}
+
+func (c *syncServiceClient) oneWaySyncCycle(ctx context.Context) (SyncStats, error) {
+	c.startCycle()
+	c.logger.Info("sync cycle: pulling")
+	start := c.now()
+	err := c.PullHashedFilesContext(ctx)
+	if err != nil {
+		return c.stats, errors.Wrap(err, "sync cycle: pull error")
+	}
+	c.stats.PullTime += c.now().Sub(start)
+	c.logger.Info("sync cycle: pushing")
+	err = c.PushAdjustmentCommandsContext(ctx)
+	if err != nil {
+		return c.stats, errors.Wrap(err, "sync cycle: push error")
+	}
+
+	c.logger.Info("sync cycle: done", c.stats.logFields()...)
+	c.progress.finish()
+	return c.stats, nil
+}
+
+/// Same as SyncCycle, but only returns planned commands instead of
+/// pushing them to the server. Server data is never modified. Only
+/// one-way cycles can be planned, in two-way mode an error is returned.
+func (c *syncServiceClient) DryRunCycle() ([]AdjustmentCommand, error) {
+	return c.DryRunCycleContext(context.Background())
+}
+
+/// Run a dry run cycle like DryRunCycle, cancelled with ctx.
+func (c *syncServiceClient) DryRunCycleContext(ctx context.Context) ([]AdjustmentCommand, error) {
+	// the one-way plan would show server files as removed, while
+	// a two-way cycle pulls them
+	if c.twoWay {
+		return nil, errors.New("dry run cycle: not supported in two-way mode")
+	}
+	c.startCycle()
+	c.logger.Info("dry run cycle: pulling")
+	err := c.PullHashedFilesContext(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "dry run cycle: pull error")
+	}
+	c.logger.Info("dry run cycle: planning")
+
+	commands, err := c.PlanAdjustmentCommandsContext(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "dry run cycle: plan error")
+	}
+	c.progress.finish()
+	return commands, nil
 }
@@ -0,0 +1,72 @@
+package carrybasket
+
+import (
+	"github.com/pkg/errors"
+
+	pb "github.com/balta2ar/carrybasket/rpc"
+)
+
+/// How many times restore asks for files that could not be reconstructed
+/// from the client blocks. Second and further attempts send pure content.
+const restoreAttempts = 2
+
+/// Turn the client directory into a copy of the server one, e.g. to
+/// rebuild a lost client. This is the reverse of SyncCycle: client sends
+/// hashes of its files, server finds out which parts client already has
+/// and sends back commands with the rest.
+func (c *syncServiceClient) RestoreCycle() error {
+	return c.restoreFrom("")
+}
+
+// Make the client directory a copy of the server snapshot, or of the
+// current server tree when snapshot is empty.
+func (c *syncServiceClient) restoreFrom(snapshot string) error {
+	c.startCycle()
+	var failed []AdjustmentResult
+
+	for attempt := 0; attempt < restoreAttempts; attempt++ {
+		c.logger.Info("restore cycle: hashing client files")
+		clientHashedFiles, contentCache, err := c.listHashedFiles()
+		if err != nil {
+			return errors.Wrap(err, "restore cycle: list error")
+		}
+
+		request := &pb.ProtoPullRequest{
+			All:                  true,
+			Snapshot:             snapshot,
+			HashedFiles:          []*pb.ProtoHashedFile{},
+			FullContentFilenames: c.pullFullContentFiles,
+		}
+		for _, hashedFile := range clientHashedFiles {
+			protoHashedFile := hashedFile.asProtoHashedFile()
+			request.HashedFiles = append(request.HashedFiles, &protoHashedFile)
+		}
+
+		c.logger.Info("restore cycle: pulling")
+		commands, err := c.PullAdjustmentCommands(request)
+		if err != nil {
+			return errors.Wrap(err, "restore cycle: pull error")
+		}
+		c.logger.Info("restore cycle: applying commands", Field("commands", len(commands)))
+
+		failed = failed[:0]
+		for _, result := range c.applyPulledCommands(commands, contentCache) {
+			if result.Status != AdjustmentResultApplied {
+				failed = append(failed, result)
+			}
+		}
+		if len(c.pullFullContentFiles) == 0 {
+			break
+		}
+	}
+
+	if len(failed) > 0 {
+		return errors.Errorf(
+			"restore cycle: %d files failed, first: %v: %v",
+			len(failed), failed[0].Filename, failed[0].Reason,
+		)
+	}
+
+	c.logger.Info("restore cycle: done")
+	return nil
+}
@@ -0,0 +1,139 @@
+package carrybasket
+
+import (
+	"context"
+	"github.com/pkg/errors"
+
+	pb "github.com/balta2ar/carrybasket/rpc"
+)
+
+//
+// Server
+//
+
+// Record the module tree after the commands have been applied. Failure
+// to take a snapshot does not fail the push, the files are already in place.
+func takeSnapshot(module *serverModule, commands []AdjustmentCommand, logger Logger) {
+	snapshot, taken, err := module.snapshots.TakeAfter(commands)
+	if err != nil {
+		logger.Error("error taking snapshot", Field("error", err))
+		return
+	}
+	if taken {
+		logger.Info("took snapshot", Field("snapshot", snapshot.Id))
+	}
+	if err := module.snapshots.Prune(); err != nil {
+		logger.Warn("error pruning snapshots", Field("error", err))
+	}
+}
+
+func (s *syncServiceServer) ListSnapshots(
+	ctx context.Context,
+	empty *pb.ProtoEmpty,
+) (*pb.ProtoSnapshots, error) {
+	logger := s.callLogger(ctx)
+	module, err := s.moduleFromContext(ctx, false)
+	if err != nil {
+		logger.Warn("module error", Field("error", err))
+		return nil, err
+	}
+	defer module.lockFor(false)()
+
+	snapshots, err := module.snapshots.List()
+	if err != nil {
+		logger.Error("error listing snapshots", Field("error", err))
+		return nil, err
+	}
+
+	return snapshotsAsProtoSnapshots(snapshots), nil
+}
+
+/// Roll the whole module tree back to the snapshot. Files changed since
+/// the snapshot are kept as versions, and the rolled back tree becomes
+/// the latest snapshot.
+func (s *syncServiceServer) RestoreSnapshot(
+	ctx context.Context,
+	request *pb.ProtoSnapshotRequest,
+) (*pb.ProtoEmpty, error) {
+	logger := s.callLogger(ctx)
+	module, err := s.moduleFromContext(ctx, true)
+	if err != nil {
+		logger.Warn("module error", Field("error", err))
+		return nil, err
+	}
+	defer module.lockFor(true)()
+
+	logger.Info("restoring snapshot", Field("snapshot", request.Id))
+	snapshotFiles, err := module.snapshots.Open(request.Id)
+	if err != nil {
+		logger.Error("error opening snapshot", Field("error", err))
+		return nil, err
+	}
+	defer CloseClientFiles(snapshotFiles)
+
+	generator := NewHashGenerator(
+		s.blockSize,
+		s.hashFactory.MakeFastHash(),
+		s.hashFactory.MakeStrongHash(),
+	)
+	serverHashedFiles, err := ListServerFiles(module.fs, generator, module.contentCache)
+	if err != nil {
+		logger.Error("server list error", Field("error", err))
+		return nil, err
+	}
+
+	comparator := NewFilesComparator(NewProducerFactory(s.blockSize, s.hashFactory))
+	comparator.SetLogger(logger)
+	commands := comparator.Compare(snapshotFiles, serverHashedFiles)
+
+	reconstructor := NewContentReconstructor(s.hashFactory.MakeStrongHash(), module.contentCache)
+	applier := NewAdjustmentCommandApplier()
+	applier.SetFileVersions(module.versions)
+	results := applier.ApplyContext(ctx, commands, module.fs, reconstructor)
+	module.changed()
+	for _, result := range results {
+		if result.Status != AdjustmentResultApplied {
+			logger.Warn(
+				"error restoring file",
+				Field("filename", result.Filename), Field("error", result.Reason),
+			)
+			return nil, errors.Errorf(
+				"cannot restore %v of snapshot %v: %v",
+				result.Filename, request.Id, result.Reason,
+			)
+		}
+	}
+	takeSnapshot(module, commands, logger)
+
+	return &pb.ProtoEmpty{}, nil
+}
+
+//
+// Client
+//
+
+/// List snapshots of the server tree, oldest first.
+func (c *syncServiceClient) ListSnapshots() ([]Snapshot, error) {
+	protoSnapshots, err := c.client.ListSnapshots(c.callContext(context.Background()), &pb.ProtoEmpty{})
+	if err != nil {
+		c.logger.Error("list snapshots error", Field("error", err))
+		return nil, err
+	}
+	return protoSnapshotsAsSnapshots(protoSnapshots), nil
+}
+
+/// Roll both the server and the client trees back to the snapshot.
+func (c *syncServiceClient) RestoreSnapshot(id string) error {
+	_, err := c.client.RestoreSnapshot(c.callContext(context.Background()), &pb.ProtoSnapshotRequest{Id: id})
+	if err != nil {
+		c.logger.Error("restore snapshot error", Field("error", err))
+		return err
+	}
+	return c.RestoreCycle()
+}
+
+/// Make the client directory a copy of the snapshot without changing
+/// the server, e.g. to look at an old state of the tree.
+func (c *syncServiceClient) ExportSnapshot(id string) error {
+	return c.restoreFrom(id)
+}
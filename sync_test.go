@@ -1,12 +1,24 @@
 package carrybasket
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
+	"io"
+	"io/ioutil"
+	"net"
 	"os"
+	"path/filepath"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 type filesystemSandbox struct {
@@ -43,28 +55,48 @@ func (fs *filesystemSandbox) Cleanup() error {
 	return os.RemoveAll(fs.rootDir)
 }
 
+// Client RPCs fail fast, so we need to make sure the server
+// is listening before the client starts talking to it.
+func waitForServer(address string) error {
+	var err error
+	for i := 0; i < 100; i++ {
+		var conn net.Conn
+		if conn, err = net.Dial("tcp", address); err == nil {
+			return conn.Close()
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return err
+}
+
 func runClientServerCycle(t *testing.T, client *syncServiceClient, server *syncServiceServer) {
 	var wg sync.WaitGroup
 	wg.Add(2)
 	go func() {
 		defer wg.Done()
 		if err := server.Serve(); err != nil {
-			t.Fatalf("server serve failed: %v\n", err)
+			t.Errorf("server serve failed: %v\n", err)
 		}
 	}()
 	go func() {
 		defer wg.Done()
+		if err := waitForServer(server.address); err != nil {
+			t.Errorf("server is not listening: %v\n", err)
+			return
+		}
+		defer server.Stop()
 		if err := client.Dial(); err != nil {
-			t.Fatalf("client dial error: %v\n", err)
+			t.Errorf("client dial error: %v\n", err)
+			return
 		}
 		defer client.Close()
 		if err := client.PullHashedFiles(); err != nil {
-			t.Fatalf("client pull error: %v\n", err)
+			t.Errorf("client pull error: %v\n", err)
+			return
 		}
 		if err := client.PushAdjustmentCommands(); err != nil {
-			t.Fatalf("client push error: %v\n", err)
+			t.Errorf("client push error: %v\n", err)
 		}
-		server.Stop()
 	}()
 
 	wg.Wait()
@@ -95,6 +127,9 @@ func (csr *clientServerRunner) StartServer() {
 }
 
 func (csr *clientServerRunner) DialClient() {
+	if err := waitForServer(csr.server.address); err != nil {
+		panic(fmt.Sprintf("server is not listening: %v\n", err))
+	}
 	if err := csr.client.Dial(); err != nil {
 		panic(fmt.Sprintf("client dial error: %v\n", err))
 	}
@@ -107,6 +142,12 @@ func (csr *clientServerRunner) Stop() {
 	csr.wg.Wait()
 }
 
+// Run a sync cycle when the test does not need its stats.
+func syncCycle(client *syncServiceClient) error {
+	_, err := client.SyncCycle()
+	return err
+}
+
 func assertSyncOnline(
 	t *testing.T,
 	blockSize int,
@@ -123,8 +164,8 @@ func assertSyncOnline(
 	createFiles(serverFs, serverFiles)
 
 	hashFactory := NewHashFactory(blockSize)
-	server := NewSyncServiceServer(blockSize, serverDir, serverFs, address, hashFactory)
-	client := NewSyncServiceClient(blockSize, clientDir, clientFs, address, hashFactory)
+	server := NewSyncServiceServer(blockSize, serverDir, serverFs, address, hashFactory, nil)
+	client := NewSyncServiceClient(blockSize, clientDir, clientFs, address, hashFactory, nil)
 
 	runClientServerCycle(t, client, server)
 	assertFilesystemsEqual(t, clientFs, serverFs)
@@ -190,15 +231,13 @@ func TestSync_ActualFilesystem(t *testing.T) {
 	)
 }
 
-func TestSync_ChangeHandler(t *testing.T) {
+func TestSync_FullResend(t *testing.T) {
 	blockSize := 4
 	clientFiles := []File{
-		{"a", true, ""},
-		{"a/1", false, "XXXXaaaa1234"},
+		{"a", false, "XXXXaaaa1234"},
 	}
 	serverFiles := []File{
-		{"a", true, ""},
-		{"a/1", false, "aaaa1234"},
+		{"a", false, "aaaa1234"},
 	}
 
 	serverFs := NewLoggingFilesystem()
@@ -208,112 +247,1472 @@ func TestSync_ChangeHandler(t *testing.T) {
 	createFiles(serverFs, serverFiles)
 
 	address := "localhost:20000"
-	serverDir := "server"
-	clientDir := "client"
+	hashFactory := NewHashFactory(blockSize)
+	server := NewSyncServiceServer(blockSize, "server", serverFs, address, hashFactory, nil)
+	client := NewSyncServiceClient(blockSize, "client", clientFs, address, hashFactory, nil)
+	runner := NewClientServerRunner(client, server)
+	runner.StartServer()
+	runner.DialClient()
+
+	// server loses its content cache between pull and push, the file
+	// is resent as pure content right away
+	assert.Nil(t, client.PullHashedFiles())
+	server.modules[DefaultModule].contentCache = NewBlockCache()
+	assert.Nil(t, client.PushAdjustmentCommands())
+	assert.Empty(t, client.fullContentFiles)
+	assertFilesystemsEqual(t, clientFs, serverFs)
+
+	runner.Stop()
+}
+
+// Returns wrong content for every hash, as if it has not been updated
+// after the files have changed.
+type staleBlockCache struct {
+	BlockCache
+}
+
+func (sbc staleBlockCache) Get(hash []byte) (Block, bool) {
+	block, ok := sbc.BlockCache.Get(hash)
+	if !ok {
+		return nil, false
+	}
+	content := bytes.Repeat([]byte("."), int(block.Size()))
+	return NewContentBlock(block.Offset(), block.Size(), content), true
+}
+
+func TestSync_StaleContentCache(t *testing.T) {
+	blockSize := 4
+	clientFiles := []File{
+		{"a", false, "XXXXaaaa1234"},
+	}
+	serverFiles := []File{
+		{"a", false, "aaaa1234"},
+	}
+
+	serverFs := NewLoggingFilesystem()
+	clientFs := NewLoggingFilesystem()
+
+	createFiles(clientFs, clientFiles)
+	createFiles(serverFs, serverFiles)
 
+	address := "localhost:20000"
 	hashFactory := NewHashFactory(blockSize)
-	server := NewSyncServiceServer(blockSize, serverDir, serverFs, address, hashFactory)
-	client := NewSyncServiceClient(blockSize, clientDir, clientFs, address, hashFactory)
+	server := NewSyncServiceServer(blockSize, "server", serverFs, address, hashFactory, nil)
+	client := NewSyncServiceClient(blockSize, "client", clientFs, address, hashFactory, nil)
 	runner := NewClientServerRunner(client, server)
 	runner.StartServer()
 	runner.DialClient()
 
-	client.SyncCycle()
+	// digest of the reconstructed file does not match, a single cycle
+	// resends it as pure content
+	module := server.modules[DefaultModule]
+	module.contentCache = staleBlockCache{module.contentCache}
+	stats, err := client.SyncCycle()
+	assert.Nil(t, err)
+	assert.Empty(t, client.fullContentFiles)
+	assert.Equal(t, 1, stats.FilesUpdated)
+	assert.Equal(t, uint64(4+12), stats.ContentBytes)
 	assertFilesystemsEqual(t, clientFs, serverFs)
 
-	changeHandler := NewChangeHandler(client)
-	events := make(chan ChangeEvent, 0)
-	syncCycleDone := make(chan struct{}, 0)
-	changeHandler.Watch(events, syncCycleDone)
+	runner.Stop()
+}
 
-	clientFs.Mkdir("b")
-	events <- ChangeEvent{}
-	<-syncCycleDone
+// Fails to write files once the given number of writes has succeeded.
+type failingWritesFilesystem struct {
+	VirtualFilesystem
+	writes int32
+}
+
+func (fwf *failingWritesFilesystem) OpenWrite(filename string) (io.WriteCloser, error) {
+	if atomic.AddInt32(&fwf.writes, -1) < 0 {
+		return nil, errors.New("cannot write")
+	}
+	return fwf.VirtualFilesystem.OpenWrite(filename)
+}
+
+func TestSync_StaleContentCacheResendFails(t *testing.T) {
+	blockSize := 4
+	clientFs := NewLoggingFilesystem()
+	serverFs := &failingWritesFilesystem{NewLoggingFilesystem(), 1}
+	createFiles(clientFs, []File{{"a", false, "XXXXaaaa1234"}})
+	createFiles(serverFs.VirtualFilesystem, []File{{"a", false, "aaaa1234"}})
+
+	address := "localhost:20000"
+	hashFactory := NewHashFactory(blockSize)
+	server := NewSyncServiceServer(blockSize, "server", serverFs, address, hashFactory, nil)
+	client := NewSyncServiceClient(blockSize, "client", clientFs, address, hashFactory, nil)
+	runner := NewClientServerRunner(client, server)
+	runner.StartServer()
+	runner.DialClient()
+
+	module := server.modules[DefaultModule]
+	module.contentCache = staleBlockCache{module.contentCache}
+	_, err := client.SyncCycle()
+	assert.Equal(t, ErrFilesNotApplied, errors.Cause(err))
+	assertFileContent(t, serverFs, "a", "aaaa1234")
+
+	runner.Stop()
+}
+
+func TestSync_DryRun(t *testing.T) {
+	blockSize := 4
+	clientFiles := []File{
+		{"a", false, "XXXXaaaa1234"},
+		{"b", true, ""},
+	}
+	serverFiles := []File{
+		{"a", false, "aaaa1234"},
+		{"c", false, "ccc"},
+	}
+
+	serverFs := NewLoggingFilesystem()
+	clientFs := NewLoggingFilesystem()
+
+	createFiles(clientFs, clientFiles)
+	createFiles(serverFs, serverFiles)
+	expectedServerFs := NewLoggingFilesystem()
+	createFiles(expectedServerFs, serverFiles)
+
+	address := "localhost:20000"
+	hashFactory := NewHashFactory(blockSize)
+	server := NewSyncServiceServer(blockSize, "server", serverFs, address, hashFactory, nil)
+	client := NewSyncServiceClient(blockSize, "client", clientFs, address, hashFactory, nil)
+	runner := NewClientServerRunner(client, server)
+	runner.StartServer()
+	runner.DialClient()
+
+	commands, err := client.DryRunCycle()
+	assert.Nil(t, err)
+	assert.Len(t, commands, 3)
+	assert.Equal(t, "apply a: 4 bytes literal, 8 bytes reused", fmt.Sprint(commands[0]))
+	assert.Equal(t, "mkdir b", fmt.Sprint(commands[1]))
+	assert.Equal(t, "remove c", fmt.Sprint(commands[2]))
+	assertFilesystemsEqual(t, expectedServerFs, serverFs)
+
+	// a two-way cycle would pull c instead of removing it
+	client.SetTwoWay(true)
+	_, err = client.DryRunCycle()
+	assert.NotNil(t, err)
+
+	runner.Stop()
+}
+
+func assertFileContent(t *testing.T, fs VirtualFilesystem, filename string, expected string) {
+	r, err := fs.OpenRead(filename)
+	assert.Nil(t, err)
+	if err != nil {
+		return
+	}
+	content, err := ioutil.ReadAll(r)
+	assert.Nil(t, err)
+	assert.Equal(t, expected, string(content))
+}
+
+func TestSync_TwoWay(t *testing.T) {
+	blockSize := 4
+	clientFiles := []File{
+		{"a", false, "aaaa1234"},
+		{"b", false, "bbbb"},
+		{"d", true, ""},
+		{"d/1", false, "d1"},
+	}
+	serverFiles := []File{
+		{"b", false, "bbbb"},
+		{"c", false, "cccc"},
+	}
+
+	serverFs := NewLoggingFilesystem()
+	clientFs := NewLoggingFilesystem()
+
+	createFiles(clientFs, clientFiles)
+	createFiles(serverFs, serverFiles)
+
+	address := "localhost:20000"
+	hashFactory := NewHashFactory(blockSize)
+	server := NewSyncServiceServer(blockSize, "server", serverFs, address, hashFactory, nil)
+	client := NewSyncServiceClient(blockSize, "client", clientFs, address, hashFactory, nil)
+	client.SetTwoWay(true)
+	client.hostname = "laptop"
+	client.now = func() time.Time { return time.Date(2019, 4, 20, 17, 0, 0, 0, time.UTC) }
+	runner := NewClientServerRunner(client, server)
+	runner.StartServer()
+	runner.DialClient()
+
+	// first sync merges both trees
+	assert.Nil(t, syncCycle(client))
 	assertFilesystemsEqual(t, clientFs, serverFs)
+	assert.Equal(t, []string{"a", "b", "c", "d", "d/1"}, listSyncedFiles(t, serverFs))
+	assert.True(t, serverFs.IsPath(ServerSyncStateFilename("laptop")))
 
-	clientFs.Delete("a")
-	events <- ChangeEvent{}
-	<-syncCycleDone
+	// changes flow in both directions
+	createFiles(clientFs, []File{{"a", false, "XXXXaaaa1234"}})
+	createFiles(serverFs, []File{{"c", false, "ccccYYYY"}})
+	assert.Nil(t, serverFs.Delete("d/1"))
+	assert.Nil(t, serverFs.Delete("d"))
+	assert.Nil(t, syncCycle(client))
 	assertFilesystemsEqual(t, clientFs, serverFs)
+	assert.Equal(t, []string{"a", "b", "c"}, listSyncedFiles(t, clientFs))
+	assertFileContent(t, serverFs, "a", "XXXXaaaa1234")
+	assertFileContent(t, clientFs, "c", "ccccYYYY")
 
-	w, err := clientFs.OpenWrite("c")
-	assert.Nil(t, err)
-	w.Write([]byte("ccc"))
-	events <- ChangeEvent{}
-	<-syncCycleDone
+	// concurrent edits are kept as a conflict copy
+	createFiles(clientFs, []File{{"b", false, "client"}})
+	createFiles(serverFs, []File{{"b", false, "server"}})
+	assert.Nil(t, syncCycle(client))
 	assertFilesystemsEqual(t, clientFs, serverFs)
+	conflictFilename := "b.conflict-laptop-20190420-170000"
+	assert.Equal(t, []string{"a", "b", conflictFilename, "c"}, listSyncedFiles(t, clientFs))
+	assertFileContent(t, clientFs, "b", "server")
+	assertFileContent(t, clientFs, conflictFilename, "client")
+
+	// nothing changes when both sides are in sync
+	assert.Nil(t, syncCycle(client))
+	assertFilesystemsEqual(t, clientFs, serverFs)
+	assert.Equal(t, []string{"a", "b", conflictFilename, "c"}, listSyncedFiles(t, serverFs))
 
 	runner.Stop()
 }
 
-func TestSync_ActualFilesystem_Watcher(t *testing.T) {
+func TestSync_Restore(t *testing.T) {
 	sandbox := NewFilesystemSandbox("sandbox")
 	defer sandbox.Cleanup()
 
 	blockSize := 4
 	clientFiles := []File{
-		{"a", true, ""},
-		{"a/1", false, "1"},
-		{"a/2", false, "2"},
-		{"a/3", false, "3"},
+		{"a", false, "aaaa"},
+		{"b", true, ""},
+		{"b/1", false, "stale"},
+		{"c", false, "cccc"},
 	}
 	serverFiles := []File{
-		{"z", false, "z"},
+		{"a", false, "aaaa1234"},
+		{"b", false, "bbbb"},
+		{"d", true, ""},
+		{"d/1", false, "1234aaaa"},
 	}
 
+	serverFs := NewActualFilesystem("server")
+	clientFs := NewActualFilesystem("client")
+
+	createFiles(clientFs, clientFiles)
+	createFiles(serverFs, serverFiles)
+
 	address := "localhost:20000"
-	serverDir := "server"
-	clientDir := "client"
+	hashFactory := NewHashFactory(blockSize)
+	server := NewSyncServiceServer(blockSize, "server", serverFs, address, hashFactory, nil)
+	client := NewSyncServiceClient(blockSize, "client", clientFs, address, hashFactory, nil)
+	runner := NewClientServerRunner(client, server)
+	runner.StartServer()
+	runner.DialClient()
 
-	serverFs := NewActualFilesystem(serverDir)
-	clientFs := NewActualFilesystem(clientDir)
+	assert.Nil(t, client.RestoreCycle())
+	assertFilesystemsEqual(t, serverFs, clientFs)
 
-	createFiles(serverFs, serverFiles)
-	createFiles(clientFs, clientFiles)
+	// restoring an up-to-date client changes nothing
+	assert.Nil(t, client.RestoreCycle())
+	assertFilesystemsEqual(t, serverFs, clientFs)
+
+	runner.Stop()
+}
+
+func TestSync_Modules(t *testing.T) {
+	blockSize := 4
+	aliceFs := NewLoggingFilesystem()
+	bobFs := NewLoggingFilesystem()
+	sharedFs := NewLoggingFilesystem()
+	aliceClientFs := NewLoggingFilesystem()
+	bobClientFs := NewLoggingFilesystem()
+
+	createFiles(aliceClientFs, []File{{"alice", false, "aaaa"}})
+	createFiles(bobClientFs, []File{{"bob", false, "bbbb"}})
+	createFiles(sharedFs, []File{{"shared", false, "ssss"}})
+
+	address := "localhost:20000"
+	hashFactory := NewHashFactory(blockSize)
+	server := NewSyncServiceServer(blockSize, "", nil, address, hashFactory, nil)
+	server.AddModule("alice", aliceFs, ModuleAccess{})
+	server.AddModule("bob", bobFs, ModuleAccess{HostsAllow: []string{"127.0.0.0/8"}})
+	server.AddModule("shared", sharedFs, ModuleAccess{ReadOnly: true})
 
+	alice := NewSyncServiceClient(blockSize, "alice", aliceClientFs, address, hashFactory, nil)
+	alice.SetModule("alice")
+	bob := NewSyncServiceClient(blockSize, "bob", bobClientFs, address, hashFactory, nil)
+	bob.SetModule("bob")
+
+	runner := NewClientServerRunner(alice, server)
+	runner.StartServer()
+	runner.DialClient()
+	assert.Nil(t, bob.Dial())
+
+	// clients do not remove each other's files
+	assert.Nil(t, syncCycle(alice))
+	assert.Nil(t, syncCycle(bob))
+	assertFilesystemsEqual(t, aliceClientFs, aliceFs)
+	assertFilesystemsEqual(t, bobClientFs, bobFs)
+
+	// read only module can be restored, but not modified
+	alice.SetModule("shared")
+	assert.NotNil(t, syncCycle(alice))
+	assert.Equal(t, []string{"shared"}, listSyncedFiles(t, sharedFs))
+	assert.Nil(t, alice.RestoreCycle())
+	assertFilesystemsEqual(t, sharedFs, aliceClientFs)
+
+	// module has to exist, and there is no default one
+	alice.SetModule("unknown")
+	assert.NotNil(t, syncCycle(alice))
+	alice.SetModule(DefaultModule)
+	assert.NotNil(t, syncCycle(alice))
+
+	assert.Nil(t, bob.Close())
+	runner.Stop()
+}
+
+func TestSync_InvalidFilenames(t *testing.T) {
+	root, err := ioutil.TempDir("", "carrybasket-modules")
+	assert.Nil(t, err)
+	defer os.RemoveAll(root)
+	for _, dir := range []string{"alice", "bob"} {
+		assert.Nil(t, os.Mkdir(filepath.Join(root, dir), os.ModeDir|0755))
+	}
+	bobFile := filepath.Join(root, "bob", "b")
+	assert.Nil(t, ioutil.WriteFile(bobFile, []byte("bbbb"), 0644))
+
+	blockSize := 4
+	address := "localhost:20000"
+	hashFactory := NewHashFactory(blockSize)
+	server := NewSyncServiceServer(blockSize, "", nil, address, hashFactory, nil)
+	server.AddModule("alice", NewActualFilesystem(filepath.Join(root, "alice")), ModuleAccess{})
+	server.AddModule("bob", NewActualFilesystem(filepath.Join(root, "bob")), ModuleAccess{})
+	alice := NewSyncServiceClient(blockSize, "alice", NewLoggingFilesystem(), address, hashFactory, nil)
+	alice.SetModule("alice")
+	runner := NewClientServerRunner(alice, server)
+	runner.StartServer()
+	runner.DialClient()
+
+	for _, commands := range [][]AdjustmentCommand{
+		{AdjustmentCommandRemoveFile{"../bob/b"}},
+		{AdjustmentCommandRemoveFile{bobFile}},
+		{AdjustmentCommandApplyBlocksToFile{"../bob/c", []Block{NewContentBlock(0, 4, []byte("cccc"))}, nil}},
+		{AdjustmentCommandMkDir{"a/../../bob/d"}},
+		{AdjustmentCommandRemoveFile{MetadataDir}},
+	} {
+		_, err := alice.pushCommands(context.Background(), commands)
+		assert.Equal(t, codes.InvalidArgument, status.Code(errors.Cause(err)), commands)
+	}
+	content, err := ioutil.ReadFile(bobFile)
+	assert.Nil(t, err)
+	assert.Equal(t, "bbbb", string(content))
+	filenames, err := ioutil.ReadDir(filepath.Join(root, "bob"))
+	assert.Nil(t, err)
+	assert.Len(t, filenames, 1)
+
+	runner.Stop()
+}
+
+func TestSync_ModuleHostsAllow(t *testing.T) {
+	blockSize := 4
+	serverFs := NewLoggingFilesystem()
+	clientFs := NewLoggingFilesystem()
+	createFiles(clientFs, []File{{"a", false, "aaaa"}})
+
+	address := "localhost:20000"
 	hashFactory := NewHashFactory(blockSize)
-	server := NewSyncServiceServer(blockSize, serverDir, serverFs, address, hashFactory)
-	client := NewSyncServiceClient(blockSize, clientDir, clientFs, address, hashFactory)
+	server := NewSyncServiceServer(blockSize, "", nil, address, hashFactory, nil)
+	server.AddModule("remote", serverFs, ModuleAccess{HostsAllow: []string{"10.0.0.0/8"}})
+	client := NewSyncServiceClient(blockSize, "client", clientFs, address, hashFactory, nil)
+	client.SetModule("remote")
+
 	runner := NewClientServerRunner(client, server)
 	runner.StartServer()
 	runner.DialClient()
 
-	client.SyncCycle()
-	assertFilesystemsEqual(t, clientFs, serverFs)
+	assert.NotNil(t, syncCycle(client))
+	assert.Empty(t, listSyncedFiles(t, serverFs))
 
-	changeHandler := NewChangeHandler(client)
-	fileWatcher := NewActualFileEventWatcher(clientDir)
-	events := make(chan ChangeEvent, 0)
-	syncCycleDone := make(chan struct{}, 0)
+	runner.Stop()
+}
 
-	go func() {
-		changeHandler.Watch(events, syncCycleDone)
-		fileWatcher.Watch(events, time.Millisecond*50)
-	}()
-	fileWatcher.Wait() // wait until file watcher has stared
+func TestSync_Versions(t *testing.T) {
+	blockSize := 4
+	serverFs := NewLoggingFilesystem()
+	clientFs := NewLoggingFilesystem()
+	createFiles(clientFs, []File{
+		{"a", false, "aaaa1"},
+		{"dir", true, ""},
+		{"dir/b", false, "bbbb1"},
+	})
 
-	clientFs.Mkdir("b")
-	w, err := clientFs.OpenWrite("b/1")
+	address := "localhost:20000"
+	hashFactory := NewHashFactory(blockSize)
+	server := NewSyncServiceServer(blockSize, "server", serverFs, address, hashFactory, nil)
+	assert.Nil(t, server.SetVersionRetention(DefaultModule, VersionRetention{KeepVersions: 2}))
+	client := NewSyncServiceClient(blockSize, "client", clientFs, address, hashFactory, nil)
+	runner := NewClientServerRunner(client, server)
+	runner.StartServer()
+	runner.DialClient()
+
+	// nothing is overwritten by the first sync
+	assert.Nil(t, syncCycle(client))
+	versions, err := client.ListVersions("")
 	assert.Nil(t, err)
-	w.Write([]byte("abc"))
-	w.(*os.File).Close()
-	<-syncCycleDone
+	assert.Empty(t, versions)
+
+	// overwrite a three times, remove dir
+	for _, content := range []string{"aaaa2", "aaaa3", "aaaa4"} {
+		assert.Nil(t, clientFs.Delete("a"))
+		createFiles(clientFs, []File{{"a", false, content}})
+		assert.Nil(t, syncCycle(client))
+	}
+	assert.Nil(t, clientFs.Delete("dir/b"))
+	assert.Nil(t, clientFs.Delete("dir"))
+	assert.Nil(t, syncCycle(client))
 	assertFilesystemsEqual(t, clientFs, serverFs)
 
-	w, err = clientFs.OpenWrite("a/1")
+	versions, err = client.ListVersions("a")
 	assert.Nil(t, err)
-	w.Write([]byte("xyz"))
-	w.(*os.File).Close()
-	<-syncCycleDone
-	assertFilesystemsEqual(t, clientFs, serverFs)
+	assert.Len(t, versions, 2)
+	assertFileContent(t, serverFs, versionFilename("a", versions[0].Version), "aaaa2")
+	versions, err = client.ListVersions("dir")
+	assert.Nil(t, err)
+	assert.Len(t, versions, 1)
+	assert.Equal(t, "dir/b", versions[0].Filename)
 
-	clientFs.Move("a/1", "b/100")
-	<-syncCycleDone
+	// restored file comes back on both sides and survives the next sync
+	assert.Nil(t, client.RestoreVersion("dir/b", versions[0].Version))
+	assertFileContent(t, clientFs, "dir/b", "bbbb1")
+	assert.Nil(t, syncCycle(client))
 	assertFilesystemsEqual(t, clientFs, serverFs)
+	assertFileContent(t, serverFs, "dir/b", "bbbb1")
 
-	clientFs.Delete("b/100")
-	<-syncCycleDone
+	assert.NotNil(t, client.RestoreVersion("dir/b", "20190102-150405.000000000"))
+
+	runner.Stop()
+}
+
+func TestSync_Snapshots(t *testing.T) {
+	blockSize := 4
+	serverFs := NewLoggingFilesystem()
+	clientFs := NewLoggingFilesystem()
+	exportFs := NewLoggingFilesystem()
+	createFiles(clientFs, []File{
+		{"a", false, "aaaa1"},
+		{"dir", true, ""},
+		{"dir/b", false, "bbbb1"},
+	})
+	createFiles(exportFs, []File{{"junk", false, "junk"}})
+
+	address := "localhost:20000"
+	hashFactory := NewHashFactory(blockSize)
+	server := NewSyncServiceServer(blockSize, "server", serverFs, address, hashFactory, nil)
+	client := NewSyncServiceClient(blockSize, "client", clientFs, address, hashFactory, nil)
+	exporter := NewSyncServiceClient(blockSize, "exporter", exportFs, address, hashFactory, nil)
+	runner := NewClientServerRunner(client, server)
+	runner.StartServer()
+	runner.DialClient()
+	assert.Nil(t, exporter.Dial())
+
+	assert.Nil(t, syncCycle(client))
+	firstFs := NewLoggingFilesystem()
+	createFiles(firstFs, []File{
+		{"a", false, "aaaa1"},
+		{"dir", true, ""},
+		{"dir/b", false, "bbbb1"},
+	})
+
+	// unchanged tree does not produce new snapshots
+	assert.Nil(t, syncCycle(client))
+	snapshots, err := client.ListSnapshots()
+	assert.Nil(t, err)
+	assert.Len(t, snapshots, 1)
+
+	assert.Nil(t, clientFs.Delete("a"))
+	createFiles(clientFs, []File{{"a", false, "aaaa2"}, {"c", false, "cccc"}})
+	assert.Nil(t, clientFs.Delete("dir/b"))
+	assert.Nil(t, clientFs.Delete("dir"))
+	assert.Nil(t, syncCycle(client))
+	snapshots, err = client.ListSnapshots()
+	assert.Nil(t, err)
+	assert.Len(t, snapshots, 2)
+
+	// export leaves server as is
+	assert.Nil(t, exporter.ExportSnapshot(snapshots[0].Id))
+	assertFilesystemsEqual(t, firstFs, exportFs)
 	assertFilesystemsEqual(t, clientFs, serverFs)
 
+	// restore rolls back both sides
+	assert.Nil(t, client.RestoreSnapshot(snapshots[0].Id))
+	assertFilesystemsEqual(t, firstFs, serverFs)
+	assertFilesystemsEqual(t, firstFs, clientFs)
+	snapshots, err = client.ListSnapshots()
+	assert.Nil(t, err)
+	assert.Len(t, snapshots, 3)
+	versions, err := client.ListVersions("c")
+	assert.Nil(t, err)
+	assert.Len(t, versions, 1)
+
+	assert.NotNil(t, client.RestoreSnapshot("20190102-150405.000000000"))
+	assert.NotNil(t, exporter.ExportSnapshot("../../state"))
+
+	assert.Nil(t, exporter.Close())
+	runner.Stop()
+}
+
+func TestSync_DeletionGuard(t *testing.T) {
+	blockSize := 4
+	serverFs := NewLoggingFilesystem()
+	clientFs := NewLoggingFilesystem()
+	createFiles(clientFs, []File{
+		{"a", false, "aaaa"},
+		{"b", false, "bbbb"},
+		{"c", false, "cccc"},
+		{"d", false, "dddd"},
+	})
+
+	address := "localhost:20000"
+	hashFactory := NewHashFactory(blockSize)
+	server := NewSyncServiceServer(blockSize, "server", serverFs, address, hashFactory, nil)
+	server.SetDeletionGuard(DeletionGuard{MaxFiles: 2})
+	client := NewSyncServiceClient(blockSize, "client", clientFs, address, hashFactory, nil)
+	runner := NewClientServerRunner(client, server)
+	runner.StartServer()
+	runner.DialClient()
+	assert.Nil(t, syncCycle(client))
+
+	// client directory went empty
+	for _, filename := range []string{"a", "b", "c"} {
+		assert.Nil(t, clientFs.Delete(filename))
+	}
+
+	// refused by the client
+	client.SetDeletionGuard(DeletionGuard{MaxPercent: 50})
+	_, err := client.SyncCycle()
+	assert.Equal(t, ErrTooManyDeletions, errors.Cause(err))
+	assert.Len(t, listSyncedFiles(t, serverFs), 4)
+
+	// refused by the server
+	client.SetDeletionGuard(DeletionGuard{})
+	_, err = client.SyncCycle()
+	assert.NotNil(t, err)
+	assert.Equal(t, codes.FailedPrecondition, status.Code(errors.Cause(err)))
+	assert.Len(t, listSyncedFiles(t, serverFs), 4)
+
+	// forced on both sides
+	client.SetDeletionGuard(DeletionGuard{MaxPercent: 50})
+	client.SetForce(true)
+	assert.Nil(t, syncCycle(client))
+	assertFilesystemsEqual(t, clientFs, serverFs)
+
+	runner.Stop()
+}
+
+func TestSync_DeletionGuardOneFile(t *testing.T) {
+	blockSize := 4
+	serverFs := NewLoggingFilesystem()
+	clientFs := NewLoggingFilesystem()
+	createFiles(clientFs, []File{
+		{"dir", true, ""},
+		{"dir/a", false, "aaaa"},
+		{"dir/b", false, "bbbb"},
+		{"dir/c", false, "cccc"},
+	})
+
+	address := "localhost:20000"
+	hashFactory := NewHashFactory(blockSize)
+	guard := DeletionGuard{MaxPercent: 50, MinFiles: 10}
+	server := NewSyncServiceServer(blockSize, "server", serverFs, address, hashFactory, nil)
+	server.SetDeletionGuard(guard)
+	client := NewSyncServiceClient(blockSize, "client", clientFs, address, hashFactory, nil)
+	client.SetDeletionGuard(guard)
+	runner := NewClientServerRunner(client, server)
+	runner.StartServer()
+	runner.DialClient()
+	assert.Nil(t, syncCycle(client))
+
+	// most files of a small tree can be removed
+	assert.Nil(t, clientFs.Delete("dir/a"))
+	assert.Nil(t, clientFs.Delete("dir/b"))
+	assert.Nil(t, syncCycle(client))
+	assertFilesystemsEqual(t, clientFs, serverFs)
+
+	// but not all of them, by either side
+	assert.Nil(t, clientFs.Delete("dir/c"))
+	_, err := client.SyncCycle()
+	assert.Equal(t, ErrTooManyDeletions, errors.Cause(err))
+	client.SetDeletionGuard(DeletionGuard{})
+	_, err = client.SyncCycle()
+	assert.Equal(t, codes.FailedPrecondition, status.Code(errors.Cause(err)))
+	assert.Equal(t, []string{"dir", "dir/c"}, listSyncedFiles(t, serverFs))
+
+	client.SetDeletionGuard(guard)
+	client.SetForce(true)
+	assert.Nil(t, syncCycle(client))
+	assertFilesystemsEqual(t, clientFs, serverFs)
+
+	runner.Stop()
+}
+
+func TestSync_DeletionGuardTwoWay(t *testing.T) {
+	blockSize := 4
+	serverFs := NewLoggingFilesystem()
+	clientFs := NewLoggingFilesystem()
+	createFiles(clientFs, []File{{"a", false, "aaaa"}, {"b", false, "bbbb"}})
+
+	address := "localhost:20000"
+	hashFactory := NewHashFactory(blockSize)
+	server := NewSyncServiceServer(blockSize, "server", serverFs, address, hashFactory, nil)
+	client := NewSyncServiceClient(blockSize, "client", clientFs, address, hashFactory, nil)
+	client.SetTwoWay(true)
+	client.SetDeletionGuard(DeletionGuard{MaxFiles: 1})
+	runner := NewClientServerRunner(client, server)
+	runner.StartServer()
+	runner.DialClient()
+	assert.Nil(t, syncCycle(client))
+
+	// server side went empty, client must not follow
+	assert.Nil(t, serverFs.Delete("a"))
+	assert.Nil(t, serverFs.Delete("b"))
+	_, err := client.SyncCycle()
+	assert.Equal(t, ErrTooManyDeletions, errors.Cause(err))
+	assert.Equal(t, []string{"a", "b"}, listSyncedFiles(t, clientFs))
+
+	client.SetForce(true)
+	assert.Nil(t, syncCycle(client))
+	assert.Empty(t, listSyncedFiles(t, clientFs))
+
+	runner.Stop()
+}
+
+type countingBandwidthLimiter struct {
+	BandwidthLimiter
+	sent int64 /// atomic, the connection writes from its own goroutine
+}
+
+func (cbl *countingBandwidthLimiter) Wait(ctx context.Context, n int) error {
+	atomic.AddInt64(&cbl.sent, int64(n))
+	return nil
+}
+
+func (cbl *countingBandwidthLimiter) Limit() int {
+	return 0
+}
+
+func TestSync_BandwidthLimit(t *testing.T) {
+	blockSize := 4
+	serverFs := NewLoggingFilesystem()
+	clientFs := NewLoggingFilesystem()
+	content := strings.Repeat("abcdefgh", 1024)
+	createFiles(clientFs, []File{{"a", false, content}})
+
+	address := "localhost:20000"
+	hashFactory := NewHashFactory(blockSize)
+	server := NewSyncServiceServer(blockSize, "server", serverFs, address, hashFactory, nil)
+	client := NewSyncServiceClient(blockSize, "client", clientFs, address, hashFactory, nil)
+	runner := NewClientServerRunner(client, server)
+	runner.StartServer()
+	runner.DialClient()
+
+	// client accounts for everything it pushes
+	limiter := &countingBandwidthLimiter{}
+	client.SetBandwidthLimiter(limiter)
+	assert.Nil(t, syncCycle(client))
+	sent := atomic.LoadInt64(&limiter.sent)
+	assert.True(t, sent > int64(len(content)), sent)
+	assertFilesystemsEqual(t, clientFs, serverFs)
+
+	// the file goes out in a single command, twice the size of the
+	// bucket, and still at the limited rate
+	client.SetBandwidthLimiter(NewBandwidthLimiter(16 * 1024))
+	assert.Nil(t, serverFs.Delete("a"))
+	start := time.Now()
+	assert.Nil(t, syncCycle(client))
+	assert.True(t, time.Since(start) > 400*time.Millisecond)
+	assertFilesystemsEqual(t, clientFs, serverFs)
+
+	// server slows the client down
+	schedule, err := ParseBandwidthSchedule("32k")
+	assert.Nil(t, err)
+	server.SetClientBandwidthLimit(schedule)
+	client.SetBandwidthLimiter(nil)
+	assert.Nil(t, serverFs.Delete("a"))
+	start = time.Now()
+	assert.Nil(t, syncCycle(client))
+	assert.True(t, time.Since(start) > 200*time.Millisecond)
+	assertFilesystemsEqual(t, clientFs, serverFs)
+
+	runner.Stop()
+}
+
+func TestSync_Progress(t *testing.T) {
+	blockSize := 4
+	serverFs := NewLoggingFilesystem()
+	clientFs := NewLoggingFilesystem()
+	createFiles(clientFs, []File{
+		{"a", false, "abcdefgh"},
+		{"dir", true, ""},
+		{"dir/b", false, "12345678"},
+	})
+
+	address := "localhost:20000"
+	hashFactory := NewHashFactory(blockSize)
+	server := NewSyncServiceServer(blockSize, "server", serverFs, address, hashFactory, nil)
+	client := NewSyncServiceClient(blockSize, "client", clientFs, address, hashFactory, nil)
+	runner := NewClientServerRunner(client, server)
+	runner.StartServer()
+	runner.DialClient()
+
+	reporter := &recordingProgressReporter{}
+	client.SetProgressReporter(reporter)
+	assert.Nil(t, syncCycle(client))
+	assertFilesystemsEqual(t, clientFs, serverFs)
+
+	assert.Equal(t, []string{ProgressPhaseScan, ProgressPhasePush, ProgressPhaseDone}, reporter.phases())
+	done := reporter.last()
+	assert.Equal(t, 2, done.FilesTotal)
+	assert.Equal(t, 2, done.FilesScanned)
+	assert.Equal(t, uint64(16), done.BytesScanned)
+	assert.Equal(t, uint64(16), done.BytesLiteral)
+	assert.Equal(t, uint64(0), done.BytesMatched)
+	assert.True(t, done.BytesTotal > 0)
+	assert.Equal(t, done.BytesTotal, done.BytesSent)
+
+	// second cycle starts from scratch, unchanged content is matched
+	assert.Nil(t, clientFs.Delete("a"))
+	createFiles(clientFs, []File{{"a", false, "abcdXXXX"}})
+	reporter.reports = nil
+	assert.Nil(t, syncCycle(client))
+	done = reporter.last()
+	assert.Equal(t, 2, done.FilesScanned)
+	assert.Equal(t, uint64(4), done.BytesLiteral)
+	assert.Equal(t, uint64(12), done.BytesMatched)
+	assert.Equal(t, done.BytesTotal, done.BytesSent)
+
+	runner.Stop()
+}
+
+func TestSync_Stats(t *testing.T) {
+	blockSize := 4
+	serverFs := NewLoggingFilesystem()
+	clientFs := NewLoggingFilesystem()
+	createFiles(clientFs, []File{
+		{"a", false, "abcdefgh"},
+		{"b", false, "12345678"},
+		{"c", false, "xyz"},
+	})
+
+	address := "localhost:20000"
+	hashFactory := NewHashFactory(blockSize)
+	server := NewSyncServiceServer(blockSize, "server", serverFs, address, hashFactory, nil)
+	client := NewSyncServiceClient(blockSize, "client", clientFs, address, hashFactory, nil)
+	runner := NewClientServerRunner(client, server)
+	runner.StartServer()
+	runner.DialClient()
+
+	stats, err := client.SyncCycle()
+	assert.Nil(t, err)
+	assert.Equal(t, 3, stats.FilesAdded)
+	assert.Equal(t, 0, stats.HashedBlocks)
+	assert.Equal(t, 3, stats.ContentBlocks)
+	assert.Equal(t, uint64(19), stats.ContentBytes)
+	assert.Equal(t, 0.0, stats.DedupeRatio())
+	assert.True(t, stats.PullTime > 0)
+	assert.True(t, stats.ScanTime > 0)
+	assert.True(t, stats.PushTime > 0)
+	assert.True(t, stats.ApplyTime > 0)
+
+	assert.Nil(t, clientFs.Delete("a"))
+	assert.Nil(t, clientFs.Delete("c"))
+	createFiles(clientFs, []File{
+		{"a", false, "abcdXXXX"},
+		{"d", false, "1234"},
+	})
+	stats, err = client.SyncCycle()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, stats.FilesAdded)
+	assert.Equal(t, 1, stats.FilesUpdated)
+	assert.Equal(t, 1, stats.FilesRemoved)
+	assert.Equal(t, 1, stats.FilesUnchanged)
+	assert.Equal(t, 4, stats.HashedBlocks)
+	assert.Equal(t, uint64(16), stats.HashedBytes)
+	assert.Equal(t, 1, stats.ContentBlocks)
+	assert.Equal(t, uint64(4), stats.ContentBytes)
+	assert.InDelta(t, 0.8, stats.DedupeRatio(), 1e-9)
+	assertFilesystemsEqual(t, clientFs, serverFs)
+
+	runner.Stop()
+}
+
+func TestSync_Metrics(t *testing.T) {
+	blockSize := 4
+	serverFs := NewLoggingFilesystem()
+	clientFs := NewLoggingFilesystem()
+	createFiles(clientFs, []File{{"a", false, "abcdefgh"}})
+
+	address := "localhost:20000"
+	hashFactory := NewHashFactory(blockSize)
+	server := NewSyncServiceServer(blockSize, "server", serverFs, address, hashFactory, nil)
+	client := NewSyncServiceClient(blockSize, "client", clientFs, address, hashFactory, nil)
+	serverMetrics, clientMetrics := NewMetrics(), NewMetrics()
+	server.SetMetrics(serverMetrics)
+	client.SetMetrics(clientMetrics)
+	runner := NewClientServerRunner(client, server)
+	runner.StartServer()
+	runner.DialClient()
+
+	assert.Nil(t, syncCycle(client))
+	assert.Nil(t, clientFs.Delete("a"))
+	createFiles(clientFs, []File{{"a", false, "abcdXXXX"}})
+	assert.Nil(t, syncCycle(client))
+	assertFilesystemsEqual(t, clientFs, serverFs)
+
+	text := scrapeMetrics(t, clientMetrics)
+	assert.Contains(t, text, `carrybasket_sync_cycles_total{result="ok"} 2`)
+	assert.Contains(t, text, "carrybasket_pulled_bytes_total")
+	assert.NotContains(t, text, "carrybasket_pushed_bytes_total 0")
+
+	text = scrapeMetrics(t, serverMetrics)
+	method := "/carrybasket.SyncService/PushAdjustmentCommands"
+	assert.Contains(t, text, `carrybasket_requests_total{code="OK",method="`+method+`"} 2`)
+	assert.Contains(t, text, `carrybasket_active_streams{method="`+method+`"} 0`)
+	assert.Contains(t, text, `carrybasket_block_cache_blocks{module=""} 4`)
+	assert.Contains(t, text, `carrybasket_block_cache_lookups_total{result="hit"} 1`)
+	assert.NotContains(t, text, "carrybasket_pushed_bytes_total 0")
+
+	runner.Stop()
+}
+
+// Run with -race to check the server for data races.
+func TestSync_ConcurrentClients(t *testing.T) {
+	blockSize := 4
+	serverFs := NewLoggingFilesystem()
+	otherServerFs := NewLoggingFilesystem()
+
+	address := "localhost:20000"
+	hashFactory := NewHashFactory(blockSize)
+	server := NewSyncServiceServer(blockSize, "", serverFs, address, hashFactory, nil)
+	server.AddModule("other", otherServerFs, ModuleAccess{})
+
+	var clients []*syncServiceClient
+	newClient := func(fs VirtualFilesystem, module string) *syncServiceClient {
+		client := NewSyncServiceClient(blockSize, "client", fs, address, hashFactory, nil)
+		client.SetModule(module)
+		clients = append(clients, client)
+		return client
+	}
+	var writers, otherWriters, readers []*syncServiceClient
+	for i := 0; i < 4; i++ {
+		writerFs := NewLoggingFilesystem()
+		createFiles(writerFs, []File{
+			{"a", false, "aaaa1234"},
+			{"dir", true, ""},
+			{"dir/b", false, fmt.Sprintf("bbbb%vbbbb", i)},
+		})
+		writers = append(writers, newClient(writerFs, DefaultModule))
+
+		otherWriterFs := NewLoggingFilesystem()
+		createFiles(otherWriterFs, []File{{"other", false, fmt.Sprintf("other%v", i)}})
+		otherWriters = append(otherWriters, newClient(otherWriterFs, "other"))
+
+		readers = append(readers, newClient(NewLoggingFilesystem(), DefaultModule))
+	}
+
+	runner := NewClientServerRunner(clients[0], server)
+	runner.StartServer()
+	runner.DialClient()
+	for _, client := range clients[1:] {
+		assert.Nil(t, client.Dial())
+	}
+
+	var wg sync.WaitGroup
+	run := func(client *syncServiceClient, cycle func() error) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 3; i++ {
+				if err := cycle(); err != nil {
+					t.Errorf("cycle error: %v", err)
+					return
+				}
+			}
+		}()
+	}
+	for i := range writers {
+		writer, otherWriter := writers[i], otherWriters[i]
+		run(writer, func() error { return syncCycle(writer) })
+		run(otherWriter, func() error { return syncCycle(otherWriter) })
+		run(readers[i], readers[i].RestoreCycle)
+	}
+	wg.Wait()
+
+	// writers overwrite each other's changes, but never apply a push
+	// planned against files another writer has changed meanwhile
+	assert.Nil(t, syncCycle(writers[0]))
+	assertFilesystemsEqual(t, writers[0].fs, serverFs)
+	assert.Equal(t, []string{"other"}, listSyncedFiles(t, otherServerFs))
+	for _, reader := range readers {
+		assert.Nil(t, reader.RestoreCycle())
+		assertFilesystemsEqual(t, serverFs, reader.fs)
+	}
+
+	for _, client := range clients[1:] {
+		assert.Nil(t, client.Close())
+	}
+	runner.Stop()
+}
+
+func TestSync_ServerChanged(t *testing.T) {
+	blockSize := 4
+	serverFs := NewLoggingFilesystem()
+	clientFs := NewLoggingFilesystem()
+	otherClientFs := NewLoggingFilesystem()
+	createFiles(serverFs, []File{{"a", false, "aaaa1234"}})
+	createFiles(clientFs, []File{{"a", false, "XXXXaaaa1234"}})
+	createFiles(otherClientFs, []File{{"a", false, "1234aaaa"}})
+
+	address := "localhost:20000"
+	hashFactory := NewHashFactory(blockSize)
+	server := NewSyncServiceServer(blockSize, "server", serverFs, address, hashFactory, nil)
+	client := NewSyncServiceClient(blockSize, "client", clientFs, address, hashFactory, nil)
+	otherClient := NewSyncServiceClient(blockSize, "client", otherClientFs, address, hashFactory, nil)
+	runner := NewClientServerRunner(client, server)
+	runner.StartServer()
+	runner.DialClient()
+	assert.Nil(t, otherClient.Dial())
+
+	// another client pushes between the pull and the push
+	assert.Nil(t, client.PullHashedFiles())
+	assert.Nil(t, syncCycle(otherClient))
+	err := client.PushAdjustmentCommands()
+	assert.Equal(t, ErrServerChanged, errors.Cause(err))
+	assertFilesystemsEqual(t, otherClientFs, serverFs)
+
+	// a whole cycle starts over and pushes against the new files
+	assert.Nil(t, syncCycle(client))
+	assertFilesystemsEqual(t, clientFs, serverFs)
+
+	assert.Nil(t, otherClient.Close())
+	runner.Stop()
+}
+
+func TestSync_ChangeHandler(t *testing.T) {
+	blockSize := 4
+	clientFiles := []File{
+		{"a", true, ""},
+		{"a/1", false, "XXXXaaaa1234"},
+	}
+	serverFiles := []File{
+		{"a", true, ""},
+		{"a/1", false, "aaaa1234"},
+	}
+
+	serverFs := NewLoggingFilesystem()
+	clientFs := NewLoggingFilesystem()
+
+	createFiles(clientFs, clientFiles)
+	createFiles(serverFs, serverFiles)
+
+	address := "localhost:20000"
+	serverDir := "server"
+	clientDir := "client"
+
+	hashFactory := NewHashFactory(blockSize)
+	server := NewSyncServiceServer(blockSize, serverDir, serverFs, address, hashFactory, nil)
+	client := NewSyncServiceClient(blockSize, clientDir, clientFs, address, hashFactory, nil)
+	runner := NewClientServerRunner(client, server)
+	runner.StartServer()
+	runner.DialClient()
+
+	client.SyncCycle()
+	assertFilesystemsEqual(t, clientFs, serverFs)
+
+	changeHandler := NewChangeHandler(client, nil)
+	events := make(chan ChangeEvent, 0)
+	syncCycleDone := make(chan struct{}, 0)
+	changeHandler.Watch(events, syncCycleDone)
+
+	clientFs.Mkdir("b")
+	events <- ChangeEvent{}
+	<-syncCycleDone
+	assertFilesystemsEqual(t, clientFs, serverFs)
+
+	clientFs.Delete("a")
+	events <- ChangeEvent{}
+	<-syncCycleDone
+	assertFilesystemsEqual(t, clientFs, serverFs)
+
+	w, err := clientFs.OpenWrite("c")
+	assert.Nil(t, err)
+	w.Write([]byte("ccc"))
+	events <- ChangeEvent{}
+	<-syncCycleDone
+	assertFilesystemsEqual(t, clientFs, serverFs)
+
+	runner.Stop()
+}
+
+// Fails a number of cycles, as if the server were down.
+type failingSyncClient struct {
+	failures int
+	cycles   int
+	redials  int
+}
+
+func (f *failingSyncClient) SyncCycle() (SyncStats, error) {
+	return f.SyncCycleContext(context.Background())
+}
+
+func (f *failingSyncClient) SyncCycleContext(ctx context.Context) (SyncStats, error) {
+	f.cycles++
+	if f.failures > 0 {
+		f.failures--
+		return SyncStats{}, errors.New("server is down")
+	}
+	return SyncStats{}, nil
+}
+
+func (f *failingSyncClient) Redial() error {
+	f.redials++
+	return nil
+}
+
+func TestChangeHandler_Retry(t *testing.T) {
+	client := &failingSyncClient{failures: 2}
+	changeHandler := NewChangeHandler(client, NewNopLogger())
+	changeHandler.SetBackoff(Backoff{Initial: 50 * time.Millisecond, Max: time.Second, Multiplier: 2})
+	events := make(chan ChangeEvent, 0)
+	syncCycleDone := make(chan struct{}, 0)
+	changeHandler.Watch(events, syncCycleDone)
+
+	// events while waiting for the retry do not run cycles of their own
+	events <- ChangeEvent{}
+	events <- ChangeEvent{}
+	events <- ChangeEvent{}
+	<-syncCycleDone
+	assert.Equal(t, 3, client.cycles)
+	assert.Equal(t, 2, client.redials)
+
+	events <- ChangeEvent{}
+	<-syncCycleDone
+	assert.Equal(t, 4, client.cycles)
+	assert.Equal(t, 2, client.redials)
+}
+
+func TestSync_ChangeHandlerReconnect(t *testing.T) {
+	blockSize := 4
+	serverFs := NewLoggingFilesystem()
+	clientFs := NewLoggingFilesystem()
+
+	address := "localhost:20000"
+	hashFactory := NewHashFactory(blockSize)
+	server := NewSyncServiceServer(blockSize, "server", serverFs, address, hashFactory, nil)
+	client := NewSyncServiceClient(blockSize, "client", clientFs, address, hashFactory, nil)
+	runner := NewClientServerRunner(client, server)
+	runner.StartServer()
+	runner.DialClient()
+	assert.Nil(t, syncCycle(client))
+	server.Stop()
+
+	changeHandler := NewChangeHandler(client, NewNopLogger())
+	changeHandler.SetBackoff(Backoff{Initial: 10 * time.Millisecond, Max: 50 * time.Millisecond, Multiplier: 2})
+	events := make(chan ChangeEvent, 0)
+	syncCycleDone := make(chan struct{}, 0)
+	changeHandler.Watch(events, syncCycleDone)
+
+	createFiles(clientFs, []File{{"a", false, "aaaa"}})
+	events <- ChangeEvent{}
+
+	// pending changes are synced once the server is back
+	restarted := NewSyncServiceServer(blockSize, "server", serverFs, address, hashFactory, nil)
+	restartedRunner := NewClientServerRunner(client, restarted)
+	restartedRunner.StartServer()
+	<-syncCycleDone
+	assertFilesystemsEqual(t, clientFs, serverFs)
+
+	restartedRunner.Stop()
+}
+
+// Takes its time to finish a cycle, unless the cycle is cancelled.
+type slowSyncClient struct {
+	duration  time.Duration
+	started   chan struct{} /// receives every cycle when it starts
+	cycles    int32
+	cancelled int32
+}
+
+func newSlowSyncClient(duration time.Duration) *slowSyncClient {
+	return &slowSyncClient{duration: duration, started: make(chan struct{})}
+}
+
+func (s *slowSyncClient) SyncCycle() (SyncStats, error) {
+	return s.SyncCycleContext(context.Background())
+}
+
+func (s *slowSyncClient) SyncCycleContext(ctx context.Context) (SyncStats, error) {
+	atomic.AddInt32(&s.cycles, 1)
+	s.started <- struct{}{}
+	select {
+	case <-time.After(s.duration):
+		return SyncStats{}, nil
+	case <-ctx.Done():
+		atomic.AddInt32(&s.cancelled, 1)
+		return SyncStats{}, ctx.Err()
+	}
+}
+
+func TestChangeHandler_Stop(t *testing.T) {
+	for _, timeout := range []time.Duration{time.Second, 10 * time.Millisecond} {
+		client := newSlowSyncClient(100 * time.Millisecond)
+		changeHandler := NewChangeHandler(client, NewNopLogger())
+		events := make(chan ChangeEvent, 0)
+		syncCycleDone := make(chan struct{}, 0)
+		changeHandler.Watch(events, syncCycleDone)
+
+		// cycle is running, nobody reads syncCycleDone
+		events <- ChangeEvent{}
+		<-client.started
+		assert.Equal(t, timeout == time.Second, changeHandler.Stop(timeout), timeout)
+		// a cycle that has not finished in time is cancelled
+		<-changeHandler.stopped
+	}
+}
+
+func TestChangeHandler_CycleTimeout(t *testing.T) {
+	client := newSlowSyncClient(time.Hour)
+	changeHandler := NewChangeHandler(client, NewNopLogger())
+	changeHandler.SetBackoff(Backoff{Initial: 10 * time.Millisecond, Max: time.Hour, Multiplier: 2})
+	changeHandler.SetCycleTimeout(10 * time.Millisecond)
+	events := make(chan ChangeEvent, 0)
+	syncCycleDone := make(chan struct{}, 0)
+	changeHandler.Watch(events, syncCycleDone)
+
+	// the hung cycle is given up and retried
+	events <- ChangeEvent{}
+	<-client.started
+	<-client.started
+	assert.True(t, atomic.LoadInt32(&client.cancelled) >= 1)
+	assert.True(t, changeHandler.Stop(time.Second))
+}
+
+func TestChangeHandler_CoalesceDuringCycle(t *testing.T) {
+	client := newSlowSyncClient(50 * time.Millisecond)
+	changeHandler := NewChangeHandler(client, NewNopLogger())
+	events := make(chan ChangeEvent, 0)
+	syncCycleDone := make(chan struct{}, 0)
+	changeHandler.Watch(events, syncCycleDone)
+
+	events <- ChangeEvent{}
+	<-client.started
+	// the watcher is not blocked by the running cycle
+	for i := 0; i < 100; i++ {
+		events <- ChangeEvent{}
+	}
+	<-syncCycleDone
+	<-client.started
+	<-syncCycleDone
+	assert.True(t, changeHandler.Stop(time.Second))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&client.cycles))
+}
+
+func TestChangeHandler_RescanInterval(t *testing.T) {
+	client := &failingSyncClient{}
+	metrics := NewMetrics()
+	changeHandler := NewChangeHandler(client, NewNopLogger())
+	changeHandler.SetMetrics(metrics)
+	changeHandler.SetRescanInterval(20 * time.Millisecond)
+	events := make(chan ChangeEvent, 0)
+	syncCycleDone := make(chan struct{}, 0)
+	changeHandler.Watch(events, syncCycleDone)
+
+	// no events at all
+	<-syncCycleDone
+	<-syncCycleDone
+	assert.True(t, changeHandler.Stop(time.Second))
+	assert.True(t, client.cycles >= 2)
+	assert.Contains(t, scrapeMetrics(t, metrics), `carrybasket_rescan_cycles_total{result="ok"}`)
+}
+
+func TestChangeHandler_Debounce(t *testing.T) {
+	client := &failingSyncClient{}
+	changeHandler := NewChangeHandler(client, NewNopLogger())
+	changeHandler.SetDebounce(Debounce{Quiet: 50 * time.Millisecond, MaxDelay: time.Hour})
+	events := make(chan ChangeEvent, 0)
+	syncCycleDone := make(chan struct{}, 0)
+	changeHandler.Watch(events, syncCycleDone)
+
+	for i := 0; i < 100; i++ {
+		events <- ChangeEvent{}
+	}
+	<-syncCycleDone
+	assert.True(t, changeHandler.Stop(time.Second))
+	assert.Equal(t, 1, client.cycles)
+}
+
+func TestChangeHandler_DebounceMaxDelay(t *testing.T) {
+	client := &failingSyncClient{}
+	changeHandler := NewChangeHandler(client, NewNopLogger())
+	changeHandler.SetDebounce(Debounce{Quiet: 20 * time.Millisecond, MaxDelay: 100 * time.Millisecond})
+	events := make(chan ChangeEvent, 0)
+	syncCycleDone := make(chan struct{}, 0)
+	changeHandler.Watch(events, syncCycleDone)
+
+	// changes never settle, the cycle runs anyway
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case events <- ChangeEvent{}:
+				time.Sleep(5 * time.Millisecond)
+			case <-done:
+				return
+			}
+		}
+	}()
+	select {
+	case <-syncCycleDone:
+	case <-time.After(time.Second):
+		t.Error("no cycle after max delay")
+	}
+	close(done)
+	changeHandler.Stop(time.Second)
+}
+
+func TestSync_SyncCycleContextCancelled(t *testing.T) {
+	blockSize := 4
+	serverFs := NewLoggingFilesystem()
+	clientFs := NewLoggingFilesystem()
+	createFiles(clientFs, []File{{"a", false, "aaaa"}})
+
+	address := "localhost:20000"
+	hashFactory := NewHashFactory(blockSize)
+	server := NewSyncServiceServer(blockSize, "server", serverFs, address, hashFactory, nil)
+	client := NewSyncServiceClient(blockSize, "client", clientFs, address, hashFactory, nil)
+	runner := NewClientServerRunner(client, server)
+	runner.StartServer()
+	runner.DialClient()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := client.SyncCycleContext(ctx)
+	assert.Equal(t, codes.Canceled, status.Code(errors.Cause(err)))
+	files, err := serverFs.ListAll()
+	assert.Nil(t, err)
+	assert.Empty(t, files)
+
+	// the client is still usable with another context
+	assert.Nil(t, syncCycle(client))
+	assertFilesystemsEqual(t, clientFs, serverFs)
+
+	runner.Stop()
+}
+
+func TestSync_ChangeHandlerRescan(t *testing.T) {
+	blockSize := 4
+	serverFs := NewLoggingFilesystem()
+	clientFs := NewLoggingFilesystem()
+
+	address := "localhost:20000"
+	hashFactory := NewHashFactory(blockSize)
+	server := NewSyncServiceServer(blockSize, "server", serverFs, address, hashFactory, nil)
+	client := NewSyncServiceClient(blockSize, "client", clientFs, address, hashFactory, nil)
+	runner := NewClientServerRunner(client, server)
+	runner.StartServer()
+	runner.DialClient()
+
+	metrics := NewMetrics()
+	changeHandler := NewChangeHandler(client, NewNopLogger())
+	changeHandler.SetMetrics(metrics)
+	events := make(chan ChangeEvent, 0)
+	syncCycleDone := make(chan struct{}, 0)
+	changeHandler.Watch(events, syncCycleDone)
+
+	// changes made while the client was down produce no events
+	createFiles(clientFs, []File{{"a", false, "aaaa"}, {"b", false, "bbbb"}})
+	changeHandler.Rescan()
+	<-syncCycleDone
+	assertFilesystemsEqual(t, clientFs, serverFs)
+	text := scrapeMetrics(t, metrics)
+	assert.Contains(t, text, `carrybasket_rescan_cycles_total{result="ok"} 1`)
+	assert.Contains(t, text, `carrybasket_rescan_missed_files_total 2`)
+
+	changeHandler.Stop(time.Second)
+	runner.Stop()
+}
+
+func TestSync_Shutdown(t *testing.T) {
+	blockSize := 4
+	serverFs := NewLoggingFilesystem()
+	clientFs := NewLoggingFilesystem()
+	createFiles(serverFs, []File{{"a" + TempFileSuffix, false, "aa"}})
+	createFiles(clientFs, []File{{"a", false, "aaaa"}})
+
+	address := "localhost:20000"
+	hashFactory := NewHashFactory(blockSize)
+	server := NewSyncServiceServer(blockSize, "server", serverFs, address, hashFactory, nil)
+	client := NewSyncServiceClient(blockSize, "client", clientFs, address, hashFactory, nil)
+	runner := NewClientServerRunner(client, server)
+	runner.StartServer()
+	runner.DialClient()
+
+	// leftovers of an interrupted push are removed on start
+	assert.Nil(t, syncCycle(client))
+	assertFilesystemsEqual(t, clientFs, serverFs)
+
+	// temporary files of a push that is still being applied are kept
+	// until it stops
+	unlock := server.modules[DefaultModule].lockFor(true)
+	createFiles(serverFs, []File{{"b" + TempFileSuffix, false, "bb"}})
+	done := make(chan struct{})
+	go func() {
+		server.Shutdown(0)
+		close(done)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	assert.True(t, serverFs.IsPath("b"+TempFileSuffix))
+	unlock()
+	<-done
+	assert.False(t, serverFs.IsPath("b"+TempFileSuffix))
+	assert.NotNil(t, syncCycle(client))
+
+	runner.Stop()
+}
+
+func TestSync_ActualFilesystem_Watcher(t *testing.T) {
+	testSyncActualFilesystemWatcher(t, FileWatcherAuto)
+}
+
+func TestSync_ActualFilesystem_PollingWatcher(t *testing.T) {
+	testSyncActualFilesystemWatcher(t, FileWatcherPolling)
+}
+
+func testSyncActualFilesystemWatcher(t *testing.T, fileWatcherKind string) {
+	sandbox := NewFilesystemSandbox("sandbox")
+	defer sandbox.Cleanup()
+
+	blockSize := 4
+	clientFiles := []File{
+		{"a", true, ""},
+		{"a/1", false, "1"},
+		{"a/2", false, "2"},
+		{"a/3", false, "3"},
+	}
+	serverFiles := []File{
+		{"z", false, "z"},
+	}
+
+	address := "localhost:20000"
+	serverDir := "server"
+	clientDir := "client"
+
+	serverFs := NewActualFilesystem(serverDir)
+	clientFs := NewActualFilesystem(clientDir)
+
+	createFiles(serverFs, serverFiles)
+	createFiles(clientFs, clientFiles)
+
+	hashFactory := NewHashFactory(blockSize)
+	server := NewSyncServiceServer(blockSize, serverDir, serverFs, address, hashFactory, nil)
+	client := NewSyncServiceClient(blockSize, clientDir, clientFs, address, hashFactory, nil)
+	runner := NewClientServerRunner(client, server)
+	runner.StartServer()
+	runner.DialClient()
+
+	client.SyncCycle()
+	assertFilesystemsEqual(t, clientFs, serverFs)
+
+	changeHandler := NewChangeHandler(client, nil)
+	// every step is synced by a single cycle
+	changeHandler.SetDebounce(Debounce{Quiet: 200 * time.Millisecond})
+	fileWatcher, err := NewFileEventWatcherFor(fileWatcherKind, clientDir, nil)
+	assert.Nil(t, err)
+	events := make(chan ChangeEvent, 0)
+	syncCycleDone := make(chan struct{}, 0)
+
+	go func() {
+		changeHandler.Watch(events, syncCycleDone)
+		fileWatcher.Watch(events, time.Millisecond*50)
+	}()
+	fileWatcher.Wait() // wait until file watcher has stared
+
+	clientFs.Mkdir("b")
+	w, err := clientFs.OpenWrite("b/1")
+	assert.Nil(t, err)
+	w.Write([]byte("abc"))
+	w.(*os.File).Close()
+	<-syncCycleDone
+	assertFilesystemsEqual(t, clientFs, serverFs)
+
+	w, err = clientFs.OpenWrite("a/1")
+	assert.Nil(t, err)
+	w.Write([]byte("xyz"))
+	w.(*os.File).Close()
+	<-syncCycleDone
+	assertFilesystemsEqual(t, clientFs, serverFs)
+
+	clientFs.Move("a/1", "b/100")
+	<-syncCycleDone
+	assertFilesystemsEqual(t, clientFs, serverFs)
+
+	clientFs.Delete("b/100")
+	<-syncCycleDone
+	assertFilesystemsEqual(t, clientFs, serverFs)
+
+	runner.Stop()
+}
+
+func TestSync_AuthToken(t *testing.T) {
+	blockSize := 4
+	serverFs := NewLoggingFilesystem()
+	clientFs := NewLoggingFilesystem()
+	createFiles(clientFs, []File{{"a", false, "aaaa"}})
+
+	address := "localhost:20000"
+	hashFactory := NewHashFactory(blockSize)
+	server := NewSyncServiceServer(blockSize, "server", serverFs, address, hashFactory, nil)
+	server.SetAuthToken("secret")
+	client := NewSyncServiceClient(blockSize, "client", clientFs, address, hashFactory, nil)
+	runner := NewClientServerRunner(client, server)
+	runner.StartServer()
+	runner.DialClient()
+
+	err := syncCycle(client)
+	assert.Equal(t, codes.Unauthenticated, status.Code(errors.Cause(err)))
+	assert.Empty(t, listSyncedFiles(t, serverFs))
+
+	client.SetAuthToken("secret")
+	assert.Nil(t, syncCycle(client))
+	assertFilesystemsEqual(t, clientFs, serverFs)
+
+	runner.Stop()
+}
+
+func TestSync_IgnoreRules(t *testing.T) {
+	blockSize := 4
+	serverFs := NewLoggingFilesystem()
+	clientFs := NewLoggingFilesystem()
+	createFiles(clientFs, []File{
+		{"a", false, "aaaa"},
+		{"b.tmp", false, "bbbb"},
+	})
+	createFiles(serverFs, []File{{"c.tmp", false, "cccc"}})
+
+	address := "localhost:20000"
+	hashFactory := NewHashFactory(blockSize)
+	server := NewSyncServiceServer(blockSize, "server", serverFs, address, hashFactory, nil)
+	client := NewSyncServiceClient(blockSize, "client", clientFs, address, hashFactory, nil)
+	rules, err := NewIgnoreRules([]string{"*.tmp"})
+	assert.Nil(t, err)
+	client.SetIgnoreRules(rules)
+	runner := NewClientServerRunner(client, server)
+	runner.StartServer()
+	runner.DialClient()
+
+	// ignored files are neither pushed nor removed from the server
+	assert.Nil(t, syncCycle(client))
+	assert.Equal(t, []string{"a", "c.tmp"}, listSyncedFiles(t, serverFs))
+
+	// nor pulled in two-way mode
+	client.SetTwoWay(true)
+	assert.Nil(t, syncCycle(client))
+	assert.Equal(t, []string{"a", "b.tmp"}, listSyncedFiles(t, clientFs))
+
 	runner.Stop()
 }
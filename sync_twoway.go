@@ -0,0 +1,502 @@
+package carrybasket
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"io"
+	"strings"
+
+	pb "github.com/balta2ar/carrybasket/rpc"
+	"github.com/golang/protobuf/proto"
+)
+
+//
+// Server
+//
+
+/// Send commands that bring the requested client files in line with the
+/// server files. The request carries hashes of the client files, so only
+/// the parts missing on the client are sent back as content. When all
+/// files are requested, the commands turn client into a copy of server,
+/// including removal of files that server does not have. Files can be
+/// taken from a snapshot instead of the current server tree.
+func (s *syncServiceServer) PullAdjustmentCommands(
+	request *pb.ProtoPullRequest,
+	stream pb.SyncService_PullAdjustmentCommandsServer,
+) error {
+	logger := s.callLogger(stream.Context())
+	module, err := s.moduleFromContext(stream.Context(), false)
+	if err != nil {
+		logger.Warn("module error", Field("error", err))
+		return err
+	}
+	defer module.lockFor(false)()
+	if err := module.checkGeneration(stream.Context()); err != nil {
+		logger.Warn("pull refused", Field("error", err))
+		return err
+	}
+
+	clientHashedFiles := make([]HashedFile, 0, len(request.HashedFiles))
+	for _, protoHashedFile := range request.HashedFiles {
+		clientHashedFiles = append(
+			clientHashedFiles,
+			protoHashedFileAsHashedFile(protoHashedFile),
+		)
+	}
+
+	var listedServerFiles []VirtualFile
+	if request.Snapshot != "" {
+		listedServerFiles, err = module.snapshots.Open(request.Snapshot)
+	} else {
+		listedServerFiles, err = ListClientFiles(module.fs)
+	}
+	if err != nil {
+		logger.Error("server list error", Field("error", err))
+		return err
+	}
+	defer CloseClientFiles(listedServerFiles)
+
+	factory := NewProducerFactory(s.blockSize, s.hashFactory)
+	comparator := NewFilesComparator(factory)
+	comparator.SetLogger(logger)
+	comparator.SetFullContentFiles(request.FullContentFilenames)
+	selectedServerFiles := listedServerFiles
+	if !request.All {
+		selectedServerFiles = selectVirtualFiles(listedServerFiles, request.Filenames)
+	}
+	commands, err := comparator.CompareContext(stream.Context(), selectedServerFiles, clientHashedFiles)
+	if err != nil {
+		logger.Warn("scan stopped", Field("error", err))
+		return err
+	}
+
+	logger.Info("sending commands", Field("commands", len(commands)))
+
+	for _, abstractCommand := range commands {
+		protoCommand := adjustmentCommandAsProtoAdjustmentCommand(abstractCommand)
+		logger.Debug("sending command", Field("filename", protoCommand.Filename))
+		if err := stream.Send(&protoCommand); err != nil {
+			logger.Error("send error", Field("error", err))
+			return err
+		}
+		s.metrics.pulled(proto.Size(&protoCommand))
+	}
+
+	return nil
+}
+
+func (s *syncServiceServer) PullSyncState(
+	ctx context.Context,
+	request *pb.ProtoSyncStateRequest,
+) (*pb.ProtoSyncState, error) {
+	logger := s.callLogger(ctx)
+	module, err := s.moduleFromContext(ctx, false)
+	if err != nil {
+		logger.Warn("module error", Field("error", err))
+		return nil, err
+	}
+	defer module.lockFor(false)()
+	if err := validateClientName(request.Client); err != nil {
+		return nil, err
+	}
+
+	state, err := LoadSyncState(module.fs, ServerSyncStateFilename(request.Client))
+	if err != nil {
+		logger.Error("error loading sync state", Field("error", err))
+		return nil, err
+	}
+
+	return syncStateAsProtoSyncState(request.Client, state), nil
+}
+
+func (s *syncServiceServer) PushSyncState(
+	ctx context.Context,
+	protoState *pb.ProtoSyncState,
+) (*pb.ProtoEmpty, error) {
+	logger := s.callLogger(ctx)
+	module, err := s.moduleFromContext(ctx, true)
+	if err != nil {
+		logger.Warn("module error", Field("error", err))
+		return nil, err
+	}
+	defer module.lockFor(true)()
+	if err := validateClientName(protoState.Client); err != nil {
+		return nil, err
+	}
+
+	state := protoSyncStateAsSyncState(protoState)
+	err = SaveSyncState(module.fs, ServerSyncStateFilename(protoState.Client), state)
+	if err != nil {
+		logger.Error("error saving sync state", Field("error", err))
+		return nil, err
+	}
+
+	return &pb.ProtoEmpty{}, nil
+}
+
+// Client name becomes a part of the state filename.
+func validateClientName(client string) error {
+	if client == "" || strings.ContainsAny(client, `/\`) || client[0] == '.' {
+		return errors.Errorf("invalid client name: %q", client)
+	}
+	return nil
+}
+
+//
+// Client
+//
+
+/// Sync changes in both directions. Changes made on the client are pushed
+/// to the server, changes made on the server are pulled to the client.
+/// When a file has been changed on both sides, the client version is
+/// renamed into a sibling conflict copy (see ConflictFilename) and
+/// pushed as a new file, while the server version takes its place.
+func (c *syncServiceClient) TwoWaySyncCycle() (SyncStats, error) {
+	return c.TwoWaySyncCycleContext(context.Background())
+}
+
+/// Run a two-way cycle like TwoWaySyncCycle, cancelled with ctx.
+func (c *syncServiceClient) TwoWaySyncCycleContext(ctx context.Context) (SyncStats, error) {
+	c.startCycle()
+	c.logger.Info("two-way sync cycle: pulling")
+	start := c.now()
+	if err := c.PullHashedFilesContext(ctx); err != nil {
+		return c.stats, errors.Wrap(err, "two-way sync cycle: pull error")
+	}
+	serverBase, err := c.pullSyncState(ctx)
+	if err != nil {
+		return c.stats, errors.Wrap(err, "two-way sync cycle: pull state error")
+	}
+	clientBase, err := LoadSyncState(c.fs, ClientSyncStateFilename())
+	if err != nil {
+		return c.stats, errors.Wrap(err, "two-way sync cycle: load state error")
+	}
+	c.stats.PullTime += c.now().Sub(start)
+	c.logger.Info("two-way sync cycle: planning")
+
+	clientHashedFiles, contentCache, err := c.listHashedFiles()
+	if err != nil {
+		return c.stats, errors.Wrap(err, "two-way sync cycle: list error")
+	}
+	serverState := NewSyncStateFromHashedFiles(c.serverHashedFiles)
+	clientState := NewSyncStateFromHashedFiles(clientHashedFiles)
+	plan := PlanTwoWaySync(clientState, serverState, clientBase, serverBase)
+
+	if len(plan.Conflicts) > 0 {
+		if err := c.keepConflictCopies(plan.Conflicts); err != nil {
+			return c.stats, errors.Wrap(err, "two-way sync cycle: conflict error")
+		}
+		clientHashedFiles, contentCache, err = c.listHashedFiles()
+		if err != nil {
+			return c.stats, errors.Wrap(err, "two-way sync cycle: list error")
+		}
+		clientState = NewSyncStateFromHashedFiles(clientHashedFiles)
+		plan = PlanTwoWaySync(clientState, serverState, clientBase, serverBase)
+	}
+
+	c.logger.Info(
+		"two-way sync cycle: planned",
+		Field("push", len(plan.Push)), Field("push_remove", len(plan.PushRemove)),
+		Field("pull", len(plan.Pull)), Field("pull_remove", len(plan.PullRemove)),
+	)
+	if err := c.checkDeletions(
+		countStateFiles(serverState, plan.PushRemove),
+		countStateFiles(serverState, serverState.Filenames()),
+	); err != nil {
+		return c.stats, errors.Wrap(err, "two-way sync cycle: server")
+	}
+	if err := c.checkDeletions(
+		countStateFiles(clientState, plan.PullRemove),
+		countStateFiles(clientState, clientState.Filenames()),
+	); err != nil {
+		return c.stats, errors.Wrap(err, "two-way sync cycle: client")
+	}
+
+	failed := make(map[string]struct{})
+	pushResults, err := c.pushPlanned(ctx, plan)
+	if err != nil {
+		return c.stats, errors.Wrap(err, "two-way sync cycle: push error")
+	}
+	start = c.now()
+	// server files must be the ones planned against, changed only by
+	// the push above
+	pullCtx := withGeneration(ctx, c.serverGeneration)
+	pullResults, err := c.pullPlanned(pullCtx, plan, clientHashedFiles, contentCache)
+	if err != nil {
+		return c.stats, errors.Wrap(err, "two-way sync cycle: pull commands error")
+	}
+	c.stats.PullTime += c.now().Sub(start)
+	for _, result := range append(pushResults, pullResults...) {
+		if result.Status != AdjustmentResultApplied {
+			failed[result.Filename] = struct{}{}
+		}
+	}
+
+	err = SaveSyncState(
+		c.fs,
+		ClientSyncStateFilename(),
+		AgreedSyncState(clientState, serverState, plan, clientBase, failed),
+	)
+	if err != nil {
+		return c.stats, errors.Wrap(err, "two-way sync cycle: save state error")
+	}
+	err = c.pushSyncState(
+		ctx,
+		AgreedSyncState(clientState, serverState, plan, serverBase, failed),
+	)
+	if err != nil {
+		return c.stats, errors.Wrap(err, "two-way sync cycle: push state error")
+	}
+	if err := notAppliedError(append(pushResults, pullResults...)); err != nil {
+		return c.stats, errors.Wrap(err, "two-way sync cycle")
+	}
+
+	c.logger.Info("two-way sync cycle: done", c.stats.logFields()...)
+	c.progress.finish()
+	return c.stats, nil
+}
+
+func (c *syncServiceClient) PullSyncState() (SyncState, error) {
+	return c.pullSyncState(context.Background())
+}
+
+func (c *syncServiceClient) pullSyncState(ctx context.Context) (SyncState, error) {
+	protoState, err := c.client.PullSyncState(
+		c.callContext(ctx),
+		&pb.ProtoSyncStateRequest{Client: c.hostname},
+	)
+	if err != nil {
+		c.logger.Error("pull sync state error", Field("error", err))
+		return nil, err
+	}
+	return protoSyncStateAsSyncState(protoState), nil
+}
+
+func (c *syncServiceClient) PushSyncState(state SyncState) error {
+	return c.pushSyncState(context.Background(), state)
+}
+
+func (c *syncServiceClient) pushSyncState(ctx context.Context, state SyncState) error {
+	_, err := c.client.PushSyncState(
+		c.callContext(ctx),
+		syncStateAsProtoSyncState(c.hostname, state),
+	)
+	if err != nil {
+		c.logger.Error("push sync state error", Field("error", err))
+		return err
+	}
+	return nil
+}
+
+// Hash client files the same way server does. Besides the hashes that are
+// sent to the server, this gives the content needed to reconstruct pulled
+// files.
+func (c *syncServiceClient) listHashedFiles() ([]HashedFile, BlockCache, error) {
+	generator := NewHashGenerator(
+		c.blockSize,
+		c.hashFactory.MakeFastHash(),
+		c.hashFactory.MakeStrongHash(),
+	)
+	contentCache := NewBlockCache()
+	hashedFiles, err := ListServerFiles(c.fs, generator, contentCache)
+	if err != nil {
+		return nil, nil, err
+	}
+	return hashedFiles, contentCache, nil
+}
+
+func (c *syncServiceClient) keepConflictCopies(conflicts []string) error {
+	for _, filename := range conflicts {
+		conflictFilename := ConflictFilename(filename, c.hostname, c.now())
+		c.logger.Warn(
+			"conflict: file has been changed on both sides, keeping client version as a copy",
+			Field("filename", filename), Field("copy", conflictFilename),
+		)
+		if err := c.fs.Move(filename, conflictFilename); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *syncServiceClient) pushPlanned(
+	ctx context.Context,
+	plan TwoWayPlan,
+) ([]AdjustmentResult, error) {
+	commands := make([]AdjustmentCommand, 0, len(plan.PushRemove)+len(plan.Push))
+	for _, filename := range plan.PushRemove {
+		commands = append(commands, AdjustmentCommandRemoveFile{filename})
+	}
+
+	if len(plan.Push) > 0 {
+		listedClientFiles, err := ListClientFiles(c.fs)
+		if err != nil {
+			return nil, err
+		}
+
+		factory := NewProducerFactory(c.blockSize, c.hashFactory)
+		comparator := NewFilesComparator(factory)
+		comparator.SetLogger(c.logger)
+		comparator.SetFullContentFiles(c.fullContentFiles)
+		selectedClientFiles := selectVirtualFiles(listedClientFiles, plan.Push)
+		c.progress.startPhase(ProgressPhaseScan)
+		c.progress.trackScan(selectedClientFiles)
+		start := c.now()
+		scannedCommands, err := comparator.CompareContext(
+			ctx,
+			selectedClientFiles,
+			selectHashedFiles(c.serverHashedFiles, plan.Push),
+		)
+		CloseClientFiles(listedClientFiles)
+		if err != nil {
+			c.logger.Warn("scan stopped", Field("error", err))
+			return nil, err
+		}
+		c.stats.ScanTime += c.now().Sub(start)
+		c.progress.scanned(scannedCommands)
+		commands = append(commands, scannedCommands...)
+	}
+
+	if len(commands) == 0 {
+		return nil, nil
+	}
+	return c.pushCommands(ctx, commands)
+}
+
+func (c *syncServiceClient) pullPlanned(
+	ctx context.Context,
+	plan TwoWayPlan,
+	clientHashedFiles []HashedFile,
+	contentCache BlockCache,
+) ([]AdjustmentResult, error) {
+	commands := make([]AdjustmentCommand, 0, len(plan.Pull)+len(plan.PullRemove))
+
+	if len(plan.Pull) > 0 {
+		request := &pb.ProtoPullRequest{
+			Filenames:            plan.Pull,
+			HashedFiles:          []*pb.ProtoHashedFile{},
+			FullContentFilenames: c.pullFullContentFiles,
+		}
+		for _, hashedFile := range selectHashedFiles(clientHashedFiles, plan.Pull) {
+			protoHashedFile := hashedFile.asProtoHashedFile()
+			request.HashedFiles = append(request.HashedFiles, &protoHashedFile)
+		}
+
+		pulledCommands, err := c.pullAdjustmentCommands(ctx, request)
+		if err != nil {
+			return nil, err
+		}
+		commands = append(commands, pulledCommands...)
+	}
+
+	for _, filename := range plan.PullRemove {
+		commands = append(commands, AdjustmentCommandRemoveFile{filename})
+	}
+
+	return c.applyPulledCommands(commands, contentCache), nil
+}
+
+// Apply commands received from the server to the client files. Files that
+// could not be reconstructed are requested in full on the next pull.
+func (c *syncServiceClient) applyPulledCommands(
+	commands []AdjustmentCommand,
+	contentCache BlockCache,
+) []AdjustmentResult {
+	reconstructor := NewContentReconstructor(c.hashFactory.MakeStrongHash(), contentCache)
+	applier := NewAdjustmentCommandApplier()
+	results := applier.Apply(commands, c.fs, reconstructor)
+
+	c.pullFullContentFiles = make([]string, 0)
+	for _, result := range results {
+		switch result.Status {
+		case AdjustmentResultFailed:
+			c.logger.Warn(
+				"failed to apply pulled command, will retry",
+				Field("filename", result.Filename), Field("error", result.Reason),
+			)
+
+		case AdjustmentResultNeedsFullResend:
+			c.logger.Warn(
+				"need full content of pulled file, will request",
+				Field("filename", result.Filename), Field("error", result.Reason),
+			)
+			c.pullFullContentFiles = append(c.pullFullContentFiles, result.Filename)
+		}
+	}
+
+	return results
+}
+
+func (c *syncServiceClient) PullAdjustmentCommands(
+	request *pb.ProtoPullRequest,
+) ([]AdjustmentCommand, error) {
+	return c.pullAdjustmentCommands(context.Background(), request)
+}
+
+func (c *syncServiceClient) pullAdjustmentCommands(
+	ctx context.Context,
+	request *pb.ProtoPullRequest,
+) ([]AdjustmentCommand, error) {
+	pullStream, err := c.client.PullAdjustmentCommands(c.callContext(ctx), request)
+	if err != nil {
+		c.logger.Error("error receiving pullStream", Field("error", err))
+		return nil, err
+	}
+
+	commands := make([]AdjustmentCommand, 0)
+	for {
+		protoCommand, err := pullStream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			c.logger.Error("recv error", Field("error", err))
+			return nil, serverChangedError(err)
+		}
+		c.logger.Debug("received command", Field("filename", protoCommand.Filename))
+		c.metrics.pulled(proto.Size(protoCommand))
+
+		command := protoAdjustmentCommandAsAdjustmentCommand(protoCommand)
+		if ignoresAdjustmentCommand(c.ignoreRules, command) {
+			continue
+		}
+		commands = append(commands, command)
+	}
+	// the server is not trusted to stay inside the tree either
+	if err := validateAdjustmentCommands(commands); err != nil {
+		c.logger.Error("pull refused", Field("error", err))
+		return nil, err
+	}
+
+	return commands, nil
+}
+
+func selectVirtualFiles(files []VirtualFile, filenames []string) []VirtualFile {
+	selected := make(map[string]struct{}, len(filenames))
+	for _, filename := range filenames {
+		selected[filename] = struct{}{}
+	}
+
+	result := make([]VirtualFile, 0, len(filenames))
+	for _, file := range files {
+		if _, ok := selected[file.Filename]; ok {
+			result = append(result, file)
+		}
+	}
+	return result
+}
+
+func selectHashedFiles(files []HashedFile, filenames []string) []HashedFile {
+	selected := make(map[string]struct{}, len(filenames))
+	for _, filename := range filenames {
+		selected[filename] = struct{}{}
+	}
+
+	result := make([]HashedFile, 0, len(filenames))
+	for _, file := range files {
+		if _, ok := selected[file.Filename]; ok {
+			result = append(result, file)
+		}
+	}
+	return result
+}
@@ -0,0 +1,119 @@
+package carrybasket
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"path/filepath"
+
+	pb "github.com/balta2ar/carrybasket/rpc"
+)
+
+//
+// Server
+//
+
+func (s *syncServiceServer) ListVersions(
+	ctx context.Context,
+	request *pb.ProtoListVersionsRequest,
+) (*pb.ProtoFileVersions, error) {
+	logger := s.callLogger(ctx)
+	module, err := s.moduleFromContext(ctx, false)
+	if err != nil {
+		logger.Warn("module error", Field("error", err))
+		return nil, err
+	}
+	defer module.lockFor(false)()
+
+	versions, err := module.versions.List(request.Filename)
+	if err != nil {
+		logger.Error("error listing versions", Field("error", err))
+		return nil, err
+	}
+
+	return fileVersionsAsProtoFileVersions(versions), nil
+}
+
+func (s *syncServiceServer) RestoreVersion(
+	ctx context.Context,
+	request *pb.ProtoRestoreVersionRequest,
+) (*pb.ProtoEmpty, error) {
+	logger := s.callLogger(ctx)
+	module, err := s.moduleFromContext(ctx, true)
+	if err != nil {
+		logger.Warn("module error", Field("error", err))
+		return nil, err
+	}
+	defer module.lockFor(true)()
+
+	logger.Info(
+		"restoring version",
+		Field("filename", request.Filename), Field("version", request.Version),
+	)
+	if err := module.versions.Restore(request.Filename, request.Version); err != nil {
+		logger.Error("error restoring version", Field("error", err))
+		return nil, err
+	}
+	module.changed()
+	restored := AdjustmentCommandApplyBlocksToFile{filename: request.Filename}
+	takeSnapshot(module, []AdjustmentCommand{restored}, logger)
+
+	return &pb.ProtoEmpty{}, nil
+}
+
+//
+// Client
+//
+
+/// List previous versions of the file kept by the server. Empty filename
+/// lists versions of all files.
+func (c *syncServiceClient) ListVersions(filename string) ([]FileVersion, error) {
+	protoVersions, err := c.client.ListVersions(
+		c.callContext(context.Background()),
+		&pb.ProtoListVersionsRequest{Filename: filename},
+	)
+	if err != nil {
+		c.logger.Error("list versions error", Field("error", err))
+		return nil, err
+	}
+	return protoFileVersionsAsFileVersions(protoVersions), nil
+}
+
+/// Make the server put the version back in place of the file, and then
+/// pull the restored file, so that the next sync does not overwrite it.
+func (c *syncServiceClient) RestoreVersion(filename string, version string) error {
+	ctx := context.Background()
+	_, err := c.client.RestoreVersion(
+		c.callContext(ctx),
+		&pb.ProtoRestoreVersionRequest{Filename: filename, Version: version},
+	)
+	if err != nil {
+		c.logger.Error("restore version error", Field("error", err))
+		return err
+	}
+
+	clientHashedFiles, contentCache, err := c.listHashedFiles()
+	if err != nil {
+		return errors.Wrap(err, "restore version: list error")
+	}
+
+	// parent directories may be gone on the client as well
+	var pulled []string
+	for dir := filepath.Dir(filename); dir != "."; dir = filepath.Dir(dir) {
+		pulled = append([]string{dir}, pulled...)
+	}
+	pulled = append(pulled, filename)
+
+	results, err := c.pullPlanned(ctx, TwoWayPlan{Pull: pulled}, clientHashedFiles, contentCache)
+	if err != nil {
+		return errors.Wrap(err, "restore version: pull error")
+	}
+	for _, result := range results {
+		if result.Status != AdjustmentResultApplied {
+			return errors.Errorf(
+				"restore version: cannot pull %v: %v",
+				result.Filename, result.Reason,
+			)
+		}
+	}
+	return nil
+}
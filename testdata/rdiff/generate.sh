@@ -0,0 +1,8 @@
+#!/bin/sh
+# Rebuild the rdiff fixtures with librsync's rdiff, rdiff_test.go
+# expects the files it writes byte for byte.
+set -e
+cd "$(dirname "$0")"
+rdiff signature -b 2048 -S 8 -H md4 -R rollsum basis basis.md4.sig
+rdiff signature -b 2048 -S 32 -H blake2 -R rabinkarp basis basis.blake2.sig
+rdiff delta basis.blake2.sig new new.delta
@@ -23,12 +23,23 @@ func createFiles(fs VirtualFilesystem, files []File) {
 	}
 }
 
-func assertFilesystemsEqual(t *testing.T, leftFs VirtualFilesystem, rightFs VirtualFilesystem) {
-	leftFiles, err := leftFs.ListAll()
+// List all files except carrybasket metadata
+func listSyncedFiles(t *testing.T, fs VirtualFilesystem) []string {
+	filenames, err := fs.ListAll()
 	assert.Nil(t, err)
 
-	rightFiles, err := rightFs.ListAll()
-	assert.Nil(t, err)
+	syncedFilenames := make([]string, 0, len(filenames))
+	for _, filename := range filenames {
+		if !isMetadataPath(filename) {
+			syncedFilenames = append(syncedFilenames, filename)
+		}
+	}
+	return syncedFilenames
+}
+
+func assertFilesystemsEqual(t *testing.T, leftFs VirtualFilesystem, rightFs VirtualFilesystem) {
+	leftFiles := listSyncedFiles(t, leftFs)
+	rightFiles := listSyncedFiles(t, rightFs)
 
 	assert.Equal(t, len(leftFiles), len(rightFiles))
 	assert.Equal(t, leftFiles, rightFiles)
@@ -50,3 +61,9 @@ func assertFilesystemsEqual(t *testing.T, leftFs VirtualFilesystem, rightFs Virt
 		}
 	}
 }
+
+func assertAllApplied(t *testing.T, results []AdjustmentResult) {
+	for _, result := range results {
+		assert.Equal(t, AdjustmentResultApplied, result.Status, result.Reason)
+	}
+}
@@ -0,0 +1,151 @@
+package carrybasket
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+/// Plan of a two-way sync cycle. Every file that differs between client
+/// and server ends up in exactly one of the lists.
+type TwoWayPlan struct {
+	Push       []string /// client files to create or update on the server
+	PushRemove []string /// files to remove from the server
+	Pull       []string /// server files to create or update on the client
+	PullRemove []string /// files to remove from the client
+	Conflicts  []string /// files changed on both sides in different ways
+}
+
+/// Decide which way every differing file should go. Current states of
+/// the client and the server are compared with the states both sides
+/// have recorded after the last successful sync. A file that has only
+/// changed on one side is copied to the other side. When a file has
+/// changed on both sides, a modification wins over a removal, and two
+/// different modifications are a conflict.
+func PlanTwoWaySync(
+	clientState SyncState,
+	serverState SyncState,
+	clientBase SyncState,
+	serverBase SyncState,
+) TwoWayPlan {
+	var plan TwoWayPlan
+
+	filenames := make(map[string]struct{}, len(clientState)+len(serverState))
+	for filename := range clientState {
+		filenames[filename] = struct{}{}
+	}
+	for filename := range serverState {
+		filenames[filename] = struct{}{}
+	}
+	sortedFilenames := make([]string, 0, len(filenames))
+	for filename := range filenames {
+		sortedFilenames = append(sortedFilenames, filename)
+	}
+	sort.Strings(sortedFilenames)
+
+	for _, filename := range sortedFilenames {
+		clientDigest := clientState[filename]
+		serverDigest := serverState[filename]
+		if clientDigest == serverDigest {
+			continue
+		}
+
+		clientChanged := clientDigest != clientBase[filename]
+		serverChanged := serverDigest != serverBase[filename]
+
+		switch {
+		case clientChanged && !serverChanged && clientDigest == "":
+			plan.PushRemove = append(plan.PushRemove, filename)
+		case clientChanged && !serverChanged:
+			plan.Push = append(plan.Push, filename)
+		case !clientChanged && serverChanged && serverDigest == "":
+			plan.PullRemove = append(plan.PullRemove, filename)
+		case !clientChanged && serverChanged:
+			plan.Pull = append(plan.Pull, filename)
+
+		// both sides have changed, or both have not changed but
+		// still differ (e.g. client has lost its state)
+		case clientDigest == "":
+			plan.Pull = append(plan.Pull, filename)
+		case serverDigest == "":
+			plan.Push = append(plan.Push, filename)
+		default:
+			plan.Conflicts = append(plan.Conflicts, filename)
+		}
+	}
+
+	// A directory must not be removed from one side while some of its
+	// files are being copied from that side, otherwise the copies
+	// would be lost. Bring the directory back instead.
+	plan.PushRemove, plan.Pull = keepParentDirs(plan.PushRemove, plan.Pull)
+	plan.PullRemove, plan.Push = keepParentDirs(plan.PullRemove, plan.Push)
+
+	return plan
+}
+
+// Move directories that have some of the copied files inside from
+// removed to copied.
+func keepParentDirs(removed []string, copied []string) ([]string, []string) {
+	var keptRemoved []string
+	for _, dir := range removed {
+		isParent := false
+		for _, filename := range copied {
+			if strings.HasPrefix(filename, dir+"/") {
+				isParent = true
+				break
+			}
+		}
+		if isParent {
+			copied = append(copied, dir)
+		} else {
+			keptRemoved = append(keptRemoved, dir)
+		}
+	}
+	sort.Strings(copied)
+	return keptRemoved, copied
+}
+
+/// State both sides agree on after the plan has been carried out.
+/// Files that failed to sync and unresolved conflicts keep their previous
+/// base state so that they are planned the same way on the next cycle.
+func AgreedSyncState(
+	clientState SyncState,
+	serverState SyncState,
+	plan TwoWayPlan,
+	base SyncState,
+	failed map[string]struct{},
+) SyncState {
+	agreed := make(SyncState, len(clientState))
+	for filename, digest := range clientState {
+		agreed[filename] = digest
+	}
+	for _, filename := range plan.Pull {
+		agreed[filename] = serverState[filename]
+	}
+	for _, filename := range plan.PullRemove {
+		delete(agreed, filename)
+	}
+
+	keepBase := func(filename string) {
+		if digest, ok := base[filename]; ok {
+			agreed[filename] = digest
+		} else {
+			delete(agreed, filename)
+		}
+	}
+	for _, filename := range plan.Conflicts {
+		keepBase(filename)
+	}
+	for filename := range failed {
+		keepBase(filename)
+	}
+
+	return agreed
+}
+
+/// Name of the sibling copy that keeps the conflicting version
+/// of a file made on the given host.
+func ConflictFilename(filename string, host string, t time.Time) string {
+	return fmt.Sprintf("%v.conflict-%v-%v", filename, host, t.Format("20060102-150405"))
+}
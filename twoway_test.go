@@ -0,0 +1,104 @@
+package carrybasket
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestPlanTwoWaySync_Smoke(t *testing.T) {
+	plan := PlanTwoWaySync(SyncState{}, SyncState{}, SyncState{}, SyncState{})
+	assert.Equal(t, TwoWayPlan{}, plan)
+}
+
+func TestPlanTwoWaySync_FirstSync(t *testing.T) {
+	clientState := SyncState{"a": "1", "b": "2", "d": DirDigest}
+	serverState := SyncState{"b": "2", "c": "3", "d": "4"}
+	plan := PlanTwoWaySync(clientState, serverState, SyncState{}, SyncState{})
+	assert.Equal(t, []string{"a"}, plan.Push)
+	assert.Empty(t, plan.PushRemove)
+	assert.Equal(t, []string{"c"}, plan.Pull)
+	assert.Empty(t, plan.PullRemove)
+	assert.Equal(t, []string{"d"}, plan.Conflicts)
+}
+
+func TestPlanTwoWaySync_ChangesOnBothSides(t *testing.T) {
+	base := SyncState{"a": "1", "b": "2", "c": "3", "d": "4", "e": "5", "f": "6"}
+	clientState := SyncState{"a": "10", "b": "2", "d": "4", "e": "50", "f": "60", "g": "7"}
+	serverState := SyncState{"a": "1", "b": "20", "c": "3", "e": "500", "f": "6"}
+	plan := PlanTwoWaySync(clientState, serverState, base, base)
+	assert.Equal(t, []string{"a", "f", "g"}, plan.Push)
+	assert.Equal(t, []string{"c"}, plan.PushRemove)
+	assert.Equal(t, []string{"b"}, plan.Pull)
+	assert.Equal(t, []string{"d"}, plan.PullRemove)
+	assert.Equal(t, []string{"e"}, plan.Conflicts)
+}
+
+func TestPlanTwoWaySync_ModificationWinsOverRemoval(t *testing.T) {
+	base := SyncState{"a": "1", "b": "2"}
+	clientState := SyncState{"a": "10"}
+	serverState := SyncState{"b": "20"}
+	plan := PlanTwoWaySync(clientState, serverState, base, base)
+	assert.Equal(t, []string{"a"}, plan.Push)
+	assert.Equal(t, []string{"b"}, plan.Pull)
+	assert.Empty(t, plan.PushRemove)
+	assert.Empty(t, plan.PullRemove)
+	assert.Empty(t, plan.Conflicts)
+}
+
+func TestPlanTwoWaySync_LostClientState(t *testing.T) {
+	base := SyncState{"a": "1", "b": "2"}
+	clientState := SyncState{}
+	serverState := SyncState{"a": "1", "b": "2"}
+	plan := PlanTwoWaySync(clientState, serverState, SyncState{}, base)
+	assert.Equal(t, []string{"a", "b"}, plan.Pull)
+	assert.Empty(t, plan.PushRemove)
+}
+
+func TestPlanTwoWaySync_KeepParentDir(t *testing.T) {
+	base := SyncState{"a": DirDigest, "a/1": "1"}
+	clientState := SyncState{}
+	serverState := SyncState{"a": DirDigest, "a/1": "10"}
+	plan := PlanTwoWaySync(clientState, serverState, base, base)
+	assert.Equal(t, []string{"a", "a/1"}, plan.Pull)
+	assert.Empty(t, plan.PushRemove)
+}
+
+func TestAgreedSyncState(t *testing.T) {
+	base := SyncState{"a": "1", "b": "2", "c": "3", "d": "4"}
+	clientState := SyncState{"a": "10", "b": "2", "d": "4", "e": "5"}
+	serverState := SyncState{"a": "1", "b": "20", "c": "3"}
+	plan := PlanTwoWaySync(clientState, serverState, base, base)
+
+	agreed := AgreedSyncState(clientState, serverState, plan, base, map[string]struct{}{})
+	assert.Equal(t, SyncState{"a": "10", "b": "20", "e": "5"}, agreed)
+
+	failed := map[string]struct{}{"a": {}, "d": {}, "e": {}}
+	agreed = AgreedSyncState(clientState, serverState, plan, base, failed)
+	assert.Equal(t, SyncState{"a": "1", "b": "20", "d": "4"}, agreed)
+}
+
+func TestSyncState_SaveLoad(t *testing.T) {
+	fs := NewLoggingFilesystem()
+	filename := ClientSyncStateFilename()
+
+	state, err := LoadSyncState(fs, filename)
+	assert.Nil(t, err)
+	assert.Empty(t, state)
+
+	expected := SyncState{"a": DirDigest, "a/file with spaces": "0123abcd"}
+	assert.Nil(t, SaveSyncState(fs, filename, expected))
+	state, err = LoadSyncState(fs, filename)
+	assert.Nil(t, err)
+	assert.Equal(t, expected, state)
+
+	clientFiles, err := ListClientFiles(fs)
+	assert.Nil(t, err)
+	assert.Empty(t, clientFiles)
+}
+
+func TestConflictFilename(t *testing.T) {
+	now := time.Date(2019, 4, 20, 17, 5, 9, 0, time.UTC)
+	assert.Equal(t, "a/b.txt.conflict-laptop-20190420-170509",
+		ConflictFilename("a/b.txt", "laptop", now))
+}
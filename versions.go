@@ -0,0 +1,257 @@
+package carrybasket
+
+import (
+	"github.com/pkg/errors"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+/// Format of the version identifiers. Versions are named after the time
+/// when they were replaced or removed.
+const VersionTimeFormat = "20060102-150405.000000000"
+
+/// How long previous versions of files are kept. Zero means no limit.
+type VersionRetention struct {
+	KeepVersions int /// number of the most recent versions kept per file
+	KeepDays     int /// versions older than this are removed
+}
+
+/// Previous version of a file.
+type FileVersion struct {
+	Filename string    /// file the version belongs to
+	Version  string    /// identifies the version among versions of the file
+	Time     time.Time /// when the version was replaced or removed
+}
+
+/// Keeps previous versions of files before they are overwritten
+/// or removed, so that they can be restored later.
+type FileVersions interface {
+	Keep(filename string) error
+	List(filename string) ([]FileVersion, error)
+	Restore(filename string, version string) error
+	Prune() error
+}
+
+/// Versions are kept inside MetadataDir, under the same relative path
+/// as the file itself with "~<version>" appended:
+///
+///     .carrybasket/versions/dir/file.txt~20190102-150405.000000000
+///
+type fileVersions struct {
+	fs        VirtualFilesystem
+	retention VersionRetention
+	now       func() time.Time
+}
+
+func NewFileVersions(fs VirtualFilesystem, retention VersionRetention) *fileVersions {
+	return &fileVersions{
+		fs:        fs,
+		retention: retention,
+		now:       time.Now,
+	}
+}
+
+func versionsDir() string {
+	return filepath.Join(MetadataDir, "versions")
+}
+
+func versionFilename(filename string, version string) string {
+	return filepath.Join(versionsDir(), filename) + "~" + version
+}
+
+// Split version filename into the original filename and the version.
+func parseVersionFilename(versionFilename string) (FileVersion, bool) {
+	prefix := versionsDir() + "/"
+	if !strings.HasPrefix(versionFilename, prefix) {
+		return FileVersion{}, false
+	}
+	versionFilename = versionFilename[len(prefix):]
+
+	i := strings.LastIndex(versionFilename, "~")
+	if i <= 0 {
+		return FileVersion{}, false
+	}
+	t, err := time.Parse(VersionTimeFormat, versionFilename[i+1:])
+	if err != nil {
+		return FileVersion{}, false
+	}
+	return FileVersion{versionFilename[:i], versionFilename[i+1:], t}, true
+}
+
+// Create all missing parent directories of the file.
+func mkdirParents(fs VirtualFilesystem, filename string) error {
+	dir := filepath.Dir(filename)
+	if dir == "." || fs.IsPath(dir) {
+		return nil
+	}
+	if err := mkdirParents(fs, dir); err != nil {
+		return err
+	}
+	return fs.Mkdir(dir)
+}
+
+/// Move the file into the versions area. Keeping a directory keeps all
+/// the files inside of it. Missing files are ignored.
+func (fv *fileVersions) Keep(filename string) error {
+	if !fv.fs.IsPath(filename) {
+		return nil
+	}
+	if !fv.fs.IsDir(filename) {
+		return fv.keepFile(filename)
+	}
+
+	filenames, err := fv.fs.ListAll()
+	if err != nil {
+		return errors.Wrap(err, "cannot list filesystem")
+	}
+	for _, child := range filenames {
+		if strings.HasPrefix(child, filename+"/") && !fv.fs.IsDir(child) {
+			if err := fv.keepFile(child); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (fv *fileVersions) keepFile(filename string) error {
+	t := fv.now().UTC()
+	target := versionFilename(filename, t.Format(VersionTimeFormat))
+	for fv.fs.IsPath(target) {
+		t = t.Add(time.Nanosecond)
+		target = versionFilename(filename, t.Format(VersionTimeFormat))
+	}
+
+	if err := mkdirParents(fv.fs, target); err != nil {
+		return errors.Wrapf(err, "cannot keep version of %v", filename)
+	}
+	return errors.Wrapf(fv.fs.Move(filename, target), "cannot keep version of %v", filename)
+}
+
+// All kept versions sorted by filename, oldest versions first.
+func (fv *fileVersions) listAll() ([]FileVersion, error) {
+	filenames, err := fv.fs.ListAll()
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot list filesystem")
+	}
+
+	versions := make([]FileVersion, 0)
+	for _, filename := range filenames {
+		if version, ok := parseVersionFilename(filename); ok && !fv.fs.IsDir(filename) {
+			versions = append(versions, version)
+		}
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		if versions[i].Filename != versions[j].Filename {
+			return versions[i].Filename < versions[j].Filename
+		}
+		return versions[i].Time.Before(versions[j].Time)
+	})
+	return versions, nil
+}
+
+/// List versions of the file, or of all files inside of it if it is
+/// a directory. Empty filename lists versions of all files.
+func (fv *fileVersions) List(filename string) ([]FileVersion, error) {
+	versions, err := fv.listAll()
+	if err != nil || filename == "" {
+		return versions, err
+	}
+
+	selected := make([]FileVersion, 0)
+	for _, version := range versions {
+		if version.Filename == filename || strings.HasPrefix(version.Filename, filename+"/") {
+			selected = append(selected, version)
+		}
+	}
+	return selected, nil
+}
+
+/// Put a copy of the version in place of the file. Current content of
+/// the file, if any, is kept as another version.
+func (fv *fileVersions) Restore(filename string, version string) error {
+	if err := validateFilename(filename); err != nil {
+		return err
+	}
+	if _, err := time.Parse(VersionTimeFormat, version); err != nil {
+		return errors.Errorf("invalid version: %q", version)
+	}
+	source := versionFilename(filename, version)
+	if !fv.fs.IsPath(source) {
+		return errors.Errorf("no version %v of %v", version, filename)
+	}
+	if fv.fs.IsDir(filename) {
+		return errors.Errorf("cannot restore %v: it is a directory", filename)
+	}
+
+	if err := mkdirParents(fv.fs, filename); err != nil {
+		return err
+	}
+	tempFilename := tempFileFor(filename)
+	if err := copyFile(fv.fs, source, tempFilename); err != nil {
+		_ = fv.fs.Delete(tempFilename)
+		return errors.Wrapf(err, "cannot restore %v", filename)
+	}
+	if err := fv.Keep(filename); err != nil {
+		_ = fv.fs.Delete(tempFilename)
+		return err
+	}
+	return fv.fs.Move(tempFilename, filename)
+}
+
+func copyFile(fs VirtualFilesystem, source string, dest string) error {
+	r, err := fs.OpenRead(source)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	w, err := fs.OpenWrite(dest)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, r)
+	if closeErr := w.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+/// Remove versions that are not covered by the retention rules.
+func (fv *fileVersions) Prune() error {
+	if fv.retention.KeepVersions <= 0 && fv.retention.KeepDays <= 0 {
+		return nil
+	}
+
+	versions, err := fv.listAll()
+	if err != nil {
+		return err
+	}
+	maxAge := time.Duration(fv.retention.KeepDays) * 24 * time.Hour
+	now := fv.now()
+
+	// versions of a file go one after another, oldest first
+	for start := 0; start < len(versions); {
+		end := start
+		for end < len(versions) && versions[end].Filename == versions[start].Filename {
+			end++
+		}
+
+		for i := start; i < end; i++ {
+			version := versions[i]
+			tooMany := fv.retention.KeepVersions > 0 && end-i > fv.retention.KeepVersions
+			tooOld := fv.retention.KeepDays > 0 && now.Sub(version.Time) > maxAge
+			if tooMany || tooOld {
+				filename := versionFilename(version.Filename, version.Version)
+				if err := fv.fs.Delete(filename); err != nil {
+					return errors.Wrapf(err, "cannot remove version %v", filename)
+				}
+			}
+		}
+		start = end
+	}
+	return nil
+}
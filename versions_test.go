@@ -0,0 +1,156 @@
+package carrybasket
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func newTestFileVersions(fs VirtualFilesystem, retention VersionRetention, now *time.Time) *fileVersions {
+	versions := NewFileVersions(fs, retention)
+	versions.now = func() time.Time { return *now }
+	return versions
+}
+
+func TestFileVersions_Smoke(t *testing.T) {
+	fs := NewLoggingFilesystem()
+	now := time.Date(2019, 1, 2, 15, 4, 5, 0, time.UTC)
+	versions := newTestFileVersions(fs, VersionRetention{}, &now)
+
+	assert.Nil(t, versions.Keep("missing"))
+	listed, err := versions.List("")
+	assert.Nil(t, err)
+	assert.Empty(t, listed)
+}
+
+func TestFileVersions_KeepAndList(t *testing.T) {
+	fs := NewLoggingFilesystem()
+	now := time.Date(2019, 1, 2, 15, 4, 5, 0, time.UTC)
+	versions := newTestFileVersions(fs, VersionRetention{}, &now)
+	createFiles(fs, []File{
+		{"a", false, "a1"},
+		{"dir", true, ""},
+		{"dir/b", false, "b1"},
+		{"dir/c~d", false, "c1"},
+	})
+
+	assert.Nil(t, versions.Keep("a"))
+	assert.False(t, fs.IsPath("a"))
+	createFiles(fs, []File{{"a", false, "a2"}})
+	assert.Nil(t, versions.Keep("a")) // same time, next nanosecond
+	assert.Nil(t, versions.Keep("dir"))
+	assert.True(t, fs.IsDir("dir"))
+	assert.Equal(t, []string{"dir"}, listSyncedFiles(t, fs))
+
+	first := time.Date(2019, 1, 2, 15, 4, 5, 0, time.UTC)
+	second := first.Add(time.Nanosecond)
+	listed, err := versions.List("")
+	assert.Nil(t, err)
+	assert.Equal(t, []FileVersion{
+		{"a", "20190102-150405.000000000", first},
+		{"a", "20190102-150405.000000001", second},
+		{"dir/b", "20190102-150405.000000000", first},
+		{"dir/c~d", "20190102-150405.000000000", first},
+	}, listed)
+
+	listed, err = versions.List("dir")
+	assert.Nil(t, err)
+	assert.Len(t, listed, 2)
+	listed, err = versions.List("dir/b")
+	assert.Nil(t, err)
+	assert.Len(t, listed, 1)
+	assertFileContent(t, fs, versionFilename("a", listed[0].Version), "a1")
+}
+
+func TestFileVersions_Restore(t *testing.T) {
+	fs := NewLoggingFilesystem()
+	now := time.Date(2019, 1, 2, 15, 4, 5, 0, time.UTC)
+	versions := newTestFileVersions(fs, VersionRetention{}, &now)
+	createFiles(fs, []File{
+		{"dir", true, ""},
+		{"dir/b", false, "b1"},
+	})
+	assert.Nil(t, versions.Keep("dir"))
+	assert.Nil(t, fs.Delete("dir"))
+
+	// parent directory is brought back too
+	assert.Nil(t, versions.Restore("dir/b", "20190102-150405.000000000"))
+	assert.True(t, fs.IsDir("dir"))
+	assertFileContent(t, fs, "dir/b", "b1")
+
+	// restored version stays, current content becomes a version
+	createFiles(fs, []File{{"dir/b", false, "b2"}})
+	now = now.Add(time.Hour)
+	assert.Nil(t, versions.Restore("dir/b", "20190102-150405.000000000"))
+	assertFileContent(t, fs, "dir/b", "b1")
+	listed, err := versions.List("dir/b")
+	assert.Nil(t, err)
+	assert.Len(t, listed, 2)
+	assertFileContent(t, fs, versionFilename("dir/b", "20190102-160405.000000000"), "b2")
+
+	assert.NotNil(t, versions.Restore("dir/b", "20190102-150405.000000002"))
+	assert.NotNil(t, versions.Restore("dir/b", "../../etc"))
+	assert.NotNil(t, versions.Restore("../b", "20190102-150405.000000000"))
+	assert.NotNil(t, versions.Restore(".carrybasket/state", "20190102-150405.000000000"))
+	assert.NotNil(t, versions.Restore("dir", "20190102-150405.000000000"))
+}
+
+func TestFileVersions_Prune(t *testing.T) {
+	fs := NewLoggingFilesystem()
+	now := time.Date(2019, 1, 2, 15, 4, 5, 0, time.UTC)
+	versions := newTestFileVersions(fs, VersionRetention{}, &now)
+
+	for i := 0; i < 4; i++ {
+		createFiles(fs, []File{{"a", false, "a"}, {"b", false, "b"}})
+		assert.Nil(t, versions.Keep("a"))
+		if i%2 == 0 {
+			assert.Nil(t, versions.Keep("b"))
+		}
+		now = now.Add(24 * time.Hour)
+	}
+
+	// no limits by default
+	assert.Nil(t, versions.Prune())
+	listed, err := versions.List("")
+	assert.Nil(t, err)
+	assert.Len(t, listed, 6)
+
+	versions.retention = VersionRetention{KeepVersions: 3}
+	assert.Nil(t, versions.Prune())
+	listed, err = versions.List("")
+	assert.Nil(t, err)
+	assert.Len(t, listed, 5)
+	assert.Equal(t, "20190103-150405.000000000", listed[0].Version)
+
+	versions.retention = VersionRetention{KeepVersions: 3, KeepDays: 2}
+	assert.Nil(t, versions.Prune())
+	listed, err = versions.List("")
+	assert.Nil(t, err)
+	assert.Equal(t, []FileVersion{
+		{"a", "20190104-150405.000000000", time.Date(2019, 1, 4, 15, 4, 5, 0, time.UTC)},
+		{"a", "20190105-150405.000000000", time.Date(2019, 1, 5, 15, 4, 5, 0, time.UTC)},
+		{"b", "20190104-150405.000000000", time.Date(2019, 1, 4, 15, 4, 5, 0, time.UTC)},
+	}, listed)
+}
+
+func TestFileVersions_ActualFilesystem(t *testing.T) {
+	sandbox := NewFilesystemSandbox("/tmp/carrybasket_versions")
+	defer sandbox.Cleanup()
+
+	fs := NewActualFilesystem("/tmp/carrybasket_versions")
+	now := time.Date(2019, 1, 2, 15, 4, 5, 0, time.UTC)
+	versions := newTestFileVersions(fs, VersionRetention{}, &now)
+	createFiles(fs, []File{
+		{"dir", true, ""},
+		{"dir/sub", true, ""},
+		{"dir/sub/b", false, "b1"},
+	})
+
+	assert.Nil(t, versions.Keep("dir"))
+	assert.Nil(t, fs.Delete("dir"))
+	assert.Empty(t, listSyncedFiles(t, fs))
+
+	assert.Nil(t, versions.Restore("dir/sub/b", "20190102-150405.000000000"))
+	assert.Equal(t, []string{"dir", "dir/sub", "dir/sub/b"}, listSyncedFiles(t, fs))
+	assertFileContent(t, fs, "dir/sub/b", "b1")
+}